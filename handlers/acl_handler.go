@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type AclHandler struct {
+	AuthorizationService services.AuthorizationService
+}
+
+type grantAccessRequest struct {
+	UserID            string `json:"user_id"`
+	GroupID           string `json:"group_id"`
+	FileID            string `json:"file_id"`
+	DirectoryID       string `json:"directory_id"`
+	Read              bool   `json:"read"`
+	Write             bool   `json:"write"`
+	Delete            bool   `json:"delete"`
+	CreateDirectories bool   `json:"create_directories"`
+}
+
+// AclEntriesHandler routes /acl and /acl/{id}. Entries are listed with
+// GET /acl?file_id= or ?directory_id=, granted with POST /acl and revoked
+// with DELETE /acl/{id}; each needs the right to change that item's access.
+// An entry grants access to user_id or to every member of group_id.
+func (ah *AclHandler) AclEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/acl"), "/")
+	if strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not_found", "ACL entry not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		ah.listAccess(w, r, user)
+	case r.Method == http.MethodPost && id == "":
+		ah.grantAccess(w, r, user)
+	case r.Method == http.MethodDelete && id != "":
+		ah.revokeAccess(w, user, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (ah *AclHandler) listAccess(w http.ResponseWriter, r *http.Request, user types.User) {
+	fileID := r.URL.Query().Get("file_id")
+	directoryID := r.URL.Query().Get("directory_id")
+	if (fileID == "") == (directoryID == "") {
+		writeError(w, http.StatusBadRequest, "bad_request", "Exactly one of file_id or directory_id is required")
+		return
+	}
+	if err := ah.AuthorizationService.AuthorizeAclChange(user, fileID, directoryID); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	entries, err := ah.AuthorizationService.ListAccess(fileID, directoryID)
+	if err != nil {
+		writeAclError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    entries,
+		Success: true,
+	})
+}
+
+func (ah *AclHandler) grantAccess(w http.ResponseWriter, r *http.Request, user types.User) {
+	var req grantAccessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	if (req.FileID == "") == (req.DirectoryID == "") {
+		writeError(w, http.StatusBadRequest, "bad_request", "Exactly one of file_id or directory_id is required")
+		return
+	}
+	if err := ah.AuthorizationService.AuthorizeAclChange(user, req.FileID, req.DirectoryID); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	entry, err := ah.AuthorizationService.GrantAccess(types.AclEntry{
+		UserID:      req.UserID,
+		GroupID:     req.GroupID,
+		FileID:      req.FileID,
+		DirectoryID: req.DirectoryID,
+		Privileges: types.Privileges{
+			Read:              req.Read,
+			Write:             req.Write,
+			Delete:            req.Delete,
+			CreateDirectories: req.CreateDirectories,
+		},
+	})
+	if err != nil {
+		writeAclError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    entry,
+		Message: "Access granted",
+		Success: true,
+	})
+}
+
+func (ah *AclHandler) revokeAccess(w http.ResponseWriter, user types.User, id string) {
+	entry, err := ah.AuthorizationService.GetAclEntry(id)
+	if err != nil {
+		writeAclError(w, err)
+		return
+	}
+	if err := ah.AuthorizationService.AuthorizeAclChange(user, entry.FileID, entry.DirectoryID); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+	if err := ah.AuthorizationService.RevokeAccess(id); err != nil {
+		writeAclError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAclError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrAclEntryNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "ACL entry not found")
+	case errors.Is(err, services.ErrUserNotFound), errors.Is(err, services.ErrGroupNotFound), errors.Is(err, services.ErrInvalidAclEntry):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	case errors.Is(err, services.ErrFileNotFound), errors.Is(err, services.ErrDirectoryNotFound):
+		writeAuthorizationError(w, err)
+	default:
+		http.Error(w, "Error updating access", http.StatusInternalServerError)
+	}
+}
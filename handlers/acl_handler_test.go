@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockAuthorizationService struct {
+	mock.Mock
+}
+
+func (m *MockAuthorizationService) AuthorizeFile(user types.User, f types.File, action services.Action) error {
+	args := m.Called(user, f, action)
+	return args.Error(0)
+}
+
+func (m *MockAuthorizationService) AuthorizeDirectory(user types.User, directoryID string, action services.Action) error {
+	args := m.Called(user, directoryID, action)
+	return args.Error(0)
+}
+
+func (m *MockAuthorizationService) AuthorizeAclChange(user types.User, fileID, directoryID string) error {
+	args := m.Called(user, fileID, directoryID)
+	return args.Error(0)
+}
+
+func (m *MockAuthorizationService) AuthorizeAdmin(user types.User) error {
+	args := m.Called(user)
+	return args.Error(0)
+}
+
+func (m *MockAuthorizationService) AuthorizeSpaceChange(user types.User, directoryID string) error {
+	args := m.Called(user, directoryID)
+	return args.Error(0)
+}
+
+func (m *MockAuthorizationService) GrantAccess(entry types.AclEntry) (types.AclEntry, error) {
+	args := m.Called(entry)
+	return args.Get(0).(types.AclEntry), args.Error(1)
+}
+
+func (m *MockAuthorizationService) GetAclEntry(id string) (types.AclEntry, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.AclEntry), args.Error(1)
+}
+
+func (m *MockAuthorizationService) ListAccess(fileID, directoryID string) ([]types.AclEntry, error) {
+	args := m.Called(fileID, directoryID)
+	return args.Get(0).([]types.AclEntry), args.Error(1)
+}
+
+func (m *MockAuthorizationService) RevokeAccess(id string) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+// assertApiError checks the response body is an ApiError carrying code
+func assertApiError(t *testing.T, rr *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	var apiErr types.ApiError
+	if err := json.NewDecoder(rr.Body).Decode(&apiErr); err != nil {
+		t.Fatalf("response body is not an ApiError: %v", err)
+	}
+	if apiErr.Code != code || apiErr.Key == "" {
+		t.Errorf("ApiError = %+v, want code %d", apiErr, code)
+	}
+}
+
+func TestAclEntriesHandler(t *testing.T) {
+	entry := types.AclEntry{ID: "e1", UserID: "2", DirectoryID: "d1", Privileges: types.Privileges{Read: true}}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		setup          func(m *MockAuthorizationService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/acl?directory_id=d1",
+			setup: func(m *MockAuthorizationService) {
+				m.On("AuthorizeAclChange", mock.Anything, "", "d1").Return(nil)
+				m.On("ListAccess", "", "d1").Return([]types.AclEntry{entry}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "ListNeedsOneTarget",
+			method:         http.MethodGet,
+			path:           "/acl?directory_id=d1&file_id=f1",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "ListForbidden",
+			method: http.MethodGet,
+			path:   "/acl?file_id=f1",
+			setup: func(m *MockAuthorizationService) {
+				m.On("AuthorizeAclChange", mock.Anything, "f1", "").Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Grant",
+			method: http.MethodPost,
+			path:   "/acl",
+			body:   `{"user_id":"2","directory_id":"d1","read":true}`,
+			setup: func(m *MockAuthorizationService) {
+				m.On("AuthorizeAclChange", mock.Anything, "", "d1").Return(nil)
+				m.On("GrantAccess", types.AclEntry{UserID: "2", DirectoryID: "d1", Privileges: types.Privileges{Read: true}}).Return(entry, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "GrantUnknownUser",
+			method: http.MethodPost,
+			path:   "/acl",
+			body:   `{"user_id":"9","file_id":"f1","read":true}`,
+			setup: func(m *MockAuthorizationService) {
+				m.On("AuthorizeAclChange", mock.Anything, "f1", "").Return(nil)
+				m.On("GrantAccess", mock.Anything).Return(types.AclEntry{}, services.ErrUserNotFound)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "GrantGroup",
+			method: http.MethodPost,
+			path:   "/acl",
+			body:   `{"group_id":"g1","directory_id":"d1","read":true}`,
+			setup: func(m *MockAuthorizationService) {
+				m.On("AuthorizeAclChange", mock.Anything, "", "d1").Return(nil)
+				m.On("GrantAccess", types.AclEntry{GroupID: "g1", DirectoryID: "d1", Privileges: types.Privileges{Read: true}}).Return(entry, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "GrantUnknownGroup",
+			method: http.MethodPost,
+			path:   "/acl",
+			body:   `{"group_id":"g9","file_id":"f1","read":true}`,
+			setup: func(m *MockAuthorizationService) {
+				m.On("AuthorizeAclChange", mock.Anything, "f1", "").Return(nil)
+				m.On("GrantAccess", mock.Anything).Return(types.AclEntry{}, services.ErrGroupNotFound)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "GrantMissingDirectory",
+			method: http.MethodPost,
+			path:   "/acl",
+			body:   `{"user_id":"2","directory_id":"nope"}`,
+			setup: func(m *MockAuthorizationService) {
+				m.On("AuthorizeAclChange", mock.Anything, "", "nope").Return(services.ErrDirectoryNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "Revoke",
+			method: http.MethodDelete,
+			path:   "/acl/e1",
+			setup: func(m *MockAuthorizationService) {
+				m.On("GetAclEntry", "e1").Return(entry, nil)
+				m.On("AuthorizeAclChange", mock.Anything, "", "d1").Return(nil)
+				m.On("RevokeAccess", "e1").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "RevokeForbidden",
+			method: http.MethodDelete,
+			path:   "/acl/e1",
+			setup: func(m *MockAuthorizationService) {
+				m.On("GetAclEntry", "e1").Return(entry, nil)
+				m.On("AuthorizeAclChange", mock.Anything, "", "d1").Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "RevokeMissing",
+			method: http.MethodDelete,
+			path:   "/acl/nope",
+			setup: func(m *MockAuthorizationService) {
+				m.On("GetAclEntry", "nope").Return(types.AclEntry{}, services.ErrAclEntryNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockAuthorizationService)
+			if tc.setup != nil {
+				tc.setup(mockService)
+			}
+			ah := &AclHandler{AuthorizationService: mockService}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Owner}))
+			rr := httptest.NewRecorder()
+			ah.AclEntriesHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus >= http.StatusBadRequest {
+				assertApiError(t, rr, tc.expectedStatus)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ApiKeyHandler struct {
+	ApiKeyService        services.ApiKeyService
+	AuthorizationService services.AuthorizationService
+}
+
+// privilegeFlags is how privileges are written in request bodies
+type privilegeFlags struct {
+	Read              bool `json:"read"`
+	Write             bool `json:"write"`
+	Delete            bool `json:"delete"`
+	CreateDirectories bool `json:"create_directories"`
+	AddUsers          bool `json:"add_users"`
+}
+
+func (f privilegeFlags) privileges() types.Privileges {
+	return types.Privileges{
+		Read:              f.Read,
+		Write:             f.Write,
+		Delete:            f.Delete,
+		CreateDirectories: f.CreateDirectories,
+		AddUsers:          f.AddUsers,
+	}
+}
+
+type createApiKeyRequest struct {
+	Name        string         `json:"name"`
+	Scope       privilegeFlags `json:"scope"`
+	DirectoryID string         `json:"directory_id"`
+	ExpiresAt   *time.Time     `json:"expires_at"`
+}
+
+// CreatedApiKey is the only time the key itself is shown
+type CreatedApiKey struct {
+	types.ApiKey
+	Key string
+}
+
+// ApiKeysHandler routes the signed in user's API keys:
+//
+//	GET    /api-keys         lists them
+//	POST   /api-keys         creates one, returning the key once
+//	DELETE /api-keys/{id}    revokes one
+//
+// Keys can't be managed with a key, so a leaked one can't mint others.
+func (kh *ApiKeyHandler) ApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if user.Scope != nil {
+		writeError(w, http.StatusForbidden, "forbidden", "API keys can't be managed with an API key")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api-keys"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		kh.listKeys(w, user)
+	case r.Method == http.MethodPost && id == "":
+		kh.createKey(w, r, user)
+	case r.Method == http.MethodDelete && id != "" && !strings.Contains(id, "/"):
+		kh.revokeKey(w, user, id)
+	case strings.Contains(id, "/"):
+		writeError(w, http.StatusNotFound, "not_found", "API key not found")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (kh *ApiKeyHandler) listKeys(w http.ResponseWriter, user types.User) {
+	keys, err := kh.ApiKeyService.ListKeys(user.ID)
+	if err != nil {
+		http.Error(w, "Error listing API keys", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    keys,
+		Success: true,
+	})
+}
+
+func (kh *ApiKeyHandler) createKey(w http.ResponseWriter, r *http.Request, user types.User) {
+	var req createApiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	if req.DirectoryID != "" {
+		if err := kh.AuthorizationService.AuthorizeDirectory(user, req.DirectoryID, services.ActionRead); err != nil {
+			writeAuthorizationError(w, err)
+			return
+		}
+	}
+
+	k := types.ApiKey{
+		UserID:      user.ID,
+		Name:        req.Name,
+		DirectoryID: req.DirectoryID,
+		Scope:       req.Scope.privileges(),
+	}
+	if req.ExpiresAt != nil {
+		k.ExpiresAt = *req.ExpiresAt
+	}
+	k, key, err := kh.ApiKeyService.CreateKey(k)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidApiKeySpec):
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		case errors.Is(err, services.ErrDirectoryNotFound):
+			writeError(w, http.StatusNotFound, "not_found", "Directory not found")
+		default:
+			http.Error(w, "Error creating the API key", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    CreatedApiKey{ApiKey: k, Key: key},
+		Message: "API key created, it won't be shown again",
+		Success: true,
+	})
+}
+
+func (kh *ApiKeyHandler) revokeKey(w http.ResponseWriter, user types.User, id string) {
+	if err := kh.ApiKeyService.RevokeKey(user.ID, id); err != nil {
+		if errors.Is(err, services.ErrApiKeyNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", "API key not found")
+			return
+		}
+		http.Error(w, "Error revoking the API key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockApiKeyService struct {
+	mock.Mock
+}
+
+func (m *MockApiKeyService) CreateKey(k types.ApiKey) (types.ApiKey, string, error) {
+	args := m.Called(k)
+	return args.Get(0).(types.ApiKey), args.String(1), args.Error(2)
+}
+
+func (m *MockApiKeyService) ListKeys(userID string) ([]types.ApiKey, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]types.ApiKey), args.Error(1)
+}
+
+func (m *MockApiKeyService) RevokeKey(userID, id string) error {
+	args := m.Called(userID, id)
+	return args.Error(0)
+}
+
+func (m *MockApiKeyService) Authenticate(key string) (types.User, error) {
+	args := m.Called(key)
+	return args.Get(0).(types.User), args.Error(1)
+}
+
+func TestApiKeysHandler(t *testing.T) {
+	key := types.ApiKey{ID: "k1", UserID: "1", Name: "ci", Prefix: "smd_abc", Scope: types.Privileges{Read: true}}
+	readOnly := types.Privileges{Read: true}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		scope          *types.Privileges
+		setup          func(m *MockApiKeyService, a *MockAuthorizationService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/api-keys",
+			setup: func(m *MockApiKeyService, a *MockAuthorizationService) {
+				m.On("ListKeys", "1").Return([]types.ApiKey{key}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Create",
+			method: http.MethodPost,
+			path:   "/api-keys",
+			body:   `{"name":"ci","scope":{"read":true}}`,
+			setup: func(m *MockApiKeyService, a *MockAuthorizationService) {
+				m.On("CreateKey", types.ApiKey{UserID: "1", Name: "ci", Scope: types.Privileges{Read: true}}).Return(key, "smd_abc_secret", nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateConfined",
+			method: http.MethodPost,
+			path:   "/api-keys",
+			body:   `{"name":"ci","scope":{"write":true},"directory_id":"d1"}`,
+			setup: func(m *MockApiKeyService, a *MockAuthorizationService) {
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionRead).Return(nil)
+				m.On("CreateKey", mock.MatchedBy(func(k types.ApiKey) bool { return k.DirectoryID == "d1" && k.Scope.Write })).Return(key, "smd_abc_secret", nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateConfinedForbidden",
+			method: http.MethodPost,
+			path:   "/api-keys",
+			body:   `{"name":"ci","scope":{"read":true},"directory_id":"d2"}`,
+			setup: func(m *MockApiKeyService, a *MockAuthorizationService) {
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionRead).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "CreateInvalid",
+			method: http.MethodPost,
+			path:   "/api-keys",
+			body:   `{"name":"ci"}`,
+			setup: func(m *MockApiKeyService, a *MockAuthorizationService) {
+				m.On("CreateKey", mock.Anything).Return(types.ApiKey{}, "", services.ErrInvalidApiKeySpec)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "CreateWithKey",
+			method:         http.MethodPost,
+			path:           "/api-keys",
+			body:           `{"name":"ci","scope":{"read":true}}`,
+			scope:          &readOnly,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Revoke",
+			method: http.MethodDelete,
+			path:   "/api-keys/k1",
+			setup: func(m *MockApiKeyService, a *MockAuthorizationService) {
+				m.On("RevokeKey", "1", "k1").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "RevokeUnknown",
+			method: http.MethodDelete,
+			path:   "/api-keys/k9",
+			setup: func(m *MockApiKeyService, a *MockAuthorizationService) {
+				m.On("RevokeKey", "1", "k9").Return(services.ErrApiKeyNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "RevokeWithoutID",
+			method:         http.MethodDelete,
+			path:           "/api-keys",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockApiKeyService)
+			mockAuthz := new(MockAuthorizationService)
+			if tc.setup != nil {
+				tc.setup(mockService, mockAuthz)
+			}
+			kh := &ApiKeyHandler{ApiKeyService: mockService, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Regular, Scope: tc.scope}))
+			rr := httptest.NewRecorder()
+			kh.ApiKeysHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			if strings.Contains(rr.Body.String(), "KeyHash") {
+				t.Errorf("response includes the key hash: %s", rr.Body.String())
+			}
+			mockService.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRequireAuthApiKey(t *testing.T) {
+	sessions := new(MockAuthService)
+	sessions.On("Authenticate", "session").Return(types.User{ID: "1"}, nil)
+	sessions.On("Authenticate", mock.Anything).Return(types.User{}, services.ErrInvalidSession)
+	keys := new(MockApiKeyService)
+	keys.On("Authenticate", "smd_abc_secret").Return(types.User{ID: "1", Scope: &types.Privileges{Read: true}}, nil)
+	authUtil := &utils.AuthUtil{Authenticator: sessions, ApiKeys: keys}
+
+	var gotUser types.User
+	next := authUtil.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, _ = utils.UserFromContext(r.Context())
+	})
+
+	for _, tc := range []struct {
+		name           string
+		header         string
+		cookie         string
+		expectedStatus int
+		scoped         bool
+	}{
+		{name: "ApiKey", header: "Bearer smd_abc_secret", expectedStatus: http.StatusOK, scoped: true},
+		{name: "Session", header: "Bearer session", expectedStatus: http.StatusOK},
+		// Keys belong in the header; as a cookie they are just an unknown session
+		{name: "ApiKeyCookie", cookie: "smd_abc_secret", expectedStatus: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotUser = types.User{}
+			req := httptest.NewRequest(http.MethodGet, "/files/f1", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: utils.SessionCookieName, Value: tc.cookie})
+			}
+			rr := httptest.NewRecorder()
+			next(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.expectedStatus == http.StatusOK && (gotUser.ID != "1" || (gotUser.Scope != nil) != tc.scoped) {
+				t.Errorf("handler ran as %+v", gotUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AuthHandler struct {
+	AuthService services.AuthService
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (ah *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	var req loginRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+			return
+		}
+	} else {
+		req.Username = r.FormValue("username")
+		req.Password = r.FormValue("password")
+	}
+	if req.Username == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Username and password are required")
+		return
+	}
+
+	session, challenge, err := ah.AuthService.Login(req.Username, req.Password)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidCredentials) {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid username or password")
+			return
+		}
+		if errors.Is(err, services.ErrAccountDisabled) {
+			writeError(w, http.StatusForbidden, "account_disabled", err.Error())
+			return
+		}
+		if writeAccountLocked(w, err) {
+			return
+		}
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	writeLogin(w, r, session, challenge)
+}
+
+// writeLogin answers a login with the challenge to complete, if there is one,
+// or with the new session
+func writeLogin(w http.ResponseWriter, r *http.Request, session types.Session, challenge types.LoginChallenge) {
+	if challenge.Token != "" {
+		message := "Authentication code required"
+		if challenge.EnrollmentRequired {
+			message = "Two-factor authentication has to be set up"
+		}
+		writeJSON(w, http.StatusAccepted, types.ApiResponse{
+			Data:    challenge,
+			Message: message,
+			Success: true,
+		})
+		return
+	}
+
+	setSessionCookie(w, r, session)
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    session.Token,
+		Message: "Logged in",
+		Success: true,
+	})
+}
+
+// writeAccountLocked answers 429 if err is a lockout, reporting whether it was
+func writeAccountLocked(w http.ResponseWriter, err error) bool {
+	var locked *services.AccountLockedError
+	if !errors.As(err, &locked) {
+		return false
+	}
+	utils.WriteTooManyRequests(w, time.Until(locked.Until), "account_locked", locked.Error())
+	return true
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, session types.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     utils.SessionCookieName,
+		Value:    session.Token.Token,
+		Path:     "/",
+		Expires:  session.Token.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type secondFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// SecondFactorLogin is the session a login challenge was exchanged for. When
+// answering it enrolled the user, it carries their new recovery codes.
+type SecondFactorLogin struct {
+	types.AuthToken
+	RecoveryCodes []string
+}
+
+// SecondFactorHandler serves POST /login/2fa, finishing a login that
+// LoginHandler answered with a challenge:
+//
+//	{"challenge": "...", "code": "123456"}
+//
+// The code comes from the user's authenticator app, or is one of their
+// recovery codes. For a challenge that required enrollment it is the first
+// code from the secret POST /login/2fa/enroll returned.
+func (ah *AuthHandler) SecondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	var req secondFactorRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+			return
+		}
+	} else {
+		req.Challenge = r.FormValue("challenge")
+		req.Code = r.FormValue("code")
+	}
+	if req.Challenge == "" || req.Code == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Challenge and code are required")
+		return
+	}
+
+	session, recoveryCodes, err := ah.AuthService.CompleteLogin(req.Challenge, req.Code)
+	if err != nil {
+		if writeAccountLocked(w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, services.ErrInvalidChallenge):
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid or expired login challenge")
+		case errors.Is(err, services.ErrInvalidTwoFactorCode):
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid authentication code")
+		case errors.Is(err, services.ErrNoTwoFactorEnrollment):
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		case errors.Is(err, services.ErrAccountDisabled):
+			writeError(w, http.StatusForbidden, "account_disabled", err.Error())
+		default:
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	setSessionCookie(w, r, session)
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    SecondFactorLogin{AuthToken: session.Token, RecoveryCodes: recoveryCodes},
+		Message: "Logged in",
+		Success: true,
+	})
+}
+
+// EnrollForLoginHandler serves POST /login/2fa/enroll, giving a user whose
+// role requires two-factor authentication the secret to set it up with
+// before answering their challenge:
+//
+//	{"challenge": "..."}
+func (ah *AuthHandler) EnrollForLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	var req secondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	enrollment, err := ah.AuthService.EnrollForLogin(req.Challenge)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidChallenge):
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid or expired login challenge")
+		case errors.Is(err, services.ErrTwoFactorEnabled):
+			writeError(w, http.StatusConflict, "conflict", err.Error())
+		case errors.Is(err, services.ErrAccountDisabled):
+			writeError(w, http.StatusForbidden, "account_disabled", err.Error())
+		default:
+			http.Error(w, "Error starting enrollment", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    enrollment,
+		Message: "Add the secret to an authenticator app and answer the challenge with its first code",
+		Success: true,
+	})
+}
+
+func (ah *AuthHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	token, err := utils.TokenFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if err := ah.AuthService.Logout(token); err != nil {
+		http.Error(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     utils.SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Message: "Logged out",
+		Success: true,
+	})
+}
+
+// sessionInfo describes a session without giving away its token
+type sessionInfo struct {
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	ID         string
+	Current    bool // Whether this is the session the request was made with
+}
+
+// SessionsHandler routes the signed in user's sessions:
+//
+//	GET    /sessions         lists them
+//	DELETE /sessions/{id}    ends one, e.g. on a lost device
+//	DELETE /sessions         ends all of them, this one included
+func (ah *AuthHandler) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	if user.Scope != nil {
+		writeError(w, http.StatusForbidden, "forbidden", "Sessions can't be managed with an API key")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		ah.listSessions(w, r, user)
+	case r.Method == http.MethodDelete && id == "":
+		ah.logoutEverywhere(w, user)
+	case r.Method == http.MethodDelete && !strings.Contains(id, "/"):
+		ah.revokeSession(w, user, id)
+	case id != "":
+		writeError(w, http.StatusNotFound, "not_found", "Session not found")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (ah *AuthHandler) listSessions(w http.ResponseWriter, r *http.Request, user types.User) {
+	sessions, err := ah.AuthService.ListSessions(user.ID)
+	if err != nil {
+		http.Error(w, "Error listing sessions", http.StatusInternalServerError)
+		return
+	}
+	// Sessions are stored by the hash of their token, so the current one is
+	// picked out by ID
+	currentID := ""
+	if token, err := utils.TokenFromRequest(r); err == nil {
+		if current, err := ah.AuthService.GetSession(token); err == nil {
+			currentID = current.ID
+		}
+	}
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, sessionInfo{
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.Token.ExpiresAt,
+			ID:         s.ID,
+			Current:    s.ID == currentID,
+		})
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    infos,
+		Success: true,
+	})
+}
+
+func (ah *AuthHandler) revokeSession(w http.ResponseWriter, user types.User, id string) {
+	if err := ah.AuthService.RevokeSession(user.ID, id); err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", "Session not found")
+			return
+		}
+		http.Error(w, "Error ending the session", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *AuthHandler) logoutEverywhere(w http.ResponseWriter, user types.User) {
+	n, err := ah.AuthService.LogoutEverywhere(user.ID)
+	if err != nil {
+		http.Error(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     utils.SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    n,
+		Message: "Logged out everywhere",
+		Success: true,
+	})
+}
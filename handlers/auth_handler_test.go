@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockAuthService struct {
+	mock.Mock
+}
+
+func (m *MockAuthService) Login(username, password string) (types.Session, types.LoginChallenge, error) {
+	args := m.Called(username, password)
+	return args.Get(0).(types.Session), args.Get(1).(types.LoginChallenge), args.Error(2)
+}
+
+func (m *MockAuthService) CompleteLogin(challenge, code string) (types.Session, []string, error) {
+	args := m.Called(challenge, code)
+	return args.Get(0).(types.Session), args.Get(1).([]string), args.Error(2)
+}
+
+func (m *MockAuthService) LoginVerified(user types.User) (types.Session, types.LoginChallenge, error) {
+	args := m.Called(user)
+	return args.Get(0).(types.Session), args.Get(1).(types.LoginChallenge), args.Error(2)
+}
+
+func (m *MockAuthService) EnrollForLogin(challenge string) (types.TotpEnrollment, error) {
+	args := m.Called(challenge)
+	return args.Get(0).(types.TotpEnrollment), args.Error(1)
+}
+
+func (m *MockAuthService) Logout(token string) error {
+	args := m.Called(token)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) Authenticate(token string) (types.User, error) {
+	args := m.Called(token)
+	return args.Get(0).(types.User), args.Error(1)
+}
+
+func (m *MockAuthService) GetSession(token string) (types.Session, error) {
+	args := m.Called(token)
+	return args.Get(0).(types.Session), args.Error(1)
+}
+
+func (m *MockAuthService) ListSessions(userID string) ([]types.Session, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]types.Session), args.Error(1)
+}
+
+func (m *MockAuthService) RevokeSession(userID, sessionID string) error {
+	args := m.Called(userID, sessionID)
+	return args.Error(0)
+}
+
+func (m *MockAuthService) LogoutEverywhere(userID string) (int, error) {
+	args := m.Called(userID)
+	return args.Int(0), args.Error(1)
+}
+
+func TestLoginHandler(t *testing.T) {
+	session := types.Session{
+		ID:     "s1",
+		UserID: "1",
+		Token:  types.AuthToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour)},
+	}
+
+	testCases := []struct {
+		name           string
+		method         string
+		contentType    string
+		body           string
+		challenge      types.LoginChallenge
+		loginErr       error
+		expectedStatus int
+		expectCookie   bool
+	}{
+		{
+			name:           "JSONSuccess",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"username":"alice","password":"secret"}`,
+			expectedStatus: http.StatusOK,
+			expectCookie:   true,
+		},
+		{
+			name:           "FormSuccess",
+			method:         http.MethodPost,
+			contentType:    "application/x-www-form-urlencoded",
+			body:           "username=alice&password=secret",
+			expectedStatus: http.StatusOK,
+			expectCookie:   true,
+		},
+		{
+			name:           "SecondFactor",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"username":"alice","password":"secret"}`,
+			challenge:      types.LoginChallenge{Token: "challenge", ExpiresAt: time.Now().Add(time.Minute)},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "WrongPassword",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"username":"alice","password":"secret"}`,
+			loginErr:       services.ErrInvalidCredentials,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Locked",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"username":"alice","password":"secret"}`,
+			loginErr:       &services.AccountLockedError{Until: time.Now().Add(90 * time.Second)},
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:           "Disabled",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"username":"alice","password":"secret"}`,
+			loginErr:       services.ErrAccountDisabled,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "ServiceError",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"username":"alice","password":"secret"}`,
+			loginErr:       errors.New("boom"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "MissingPassword",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           `{"username":"alice"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "WrongMethod",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockAuthService)
+			loginSession := session
+			if tc.challenge.Token != "" {
+				loginSession = types.Session{}
+			}
+			mockService.On("Login", "alice", "secret").Return(loginSession, tc.challenge, tc.loginErr)
+			ah := AuthHandler{AuthService: mockService}
+
+			req := httptest.NewRequest(tc.method, "/login", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			rr := httptest.NewRecorder()
+			ah.LoginHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			var cookie *http.Cookie
+			for _, c := range rr.Result().Cookies() {
+				if c.Name == utils.SessionCookieName {
+					cookie = c
+				}
+			}
+			if tc.expectCookie && (cookie == nil || cookie.Value != "token") {
+				t.Errorf("expected session cookie with token, got %v", cookie)
+			}
+			if !tc.expectCookie && cookie != nil {
+				t.Errorf("expected no session cookie, got %v", cookie)
+			}
+			if tc.expectedStatus == http.StatusTooManyRequests {
+				assertApiError(t, rr, http.StatusTooManyRequests)
+				if retry := rr.Header().Get("Retry-After"); retry != "90" && retry != "89" {
+					t.Errorf("got Retry-After %q, want 90", retry)
+				}
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestSecondFactorHandler(t *testing.T) {
+	session := types.Session{
+		ID:     "s1",
+		UserID: "1",
+		Token:  types.AuthToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour)},
+	}
+
+	testCases := []struct {
+		name           string
+		body           string
+		setup          func(m *MockAuthService)
+		expectedStatus int
+		expectCookie   bool
+		expectCodes    bool
+	}{
+		{
+			name: "Success",
+			body: `{"challenge":"challenge","code":"123456"}`,
+			setup: func(m *MockAuthService) {
+				m.On("CompleteLogin", "challenge", "123456").Return(session, []string(nil), nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectCookie:   true,
+		},
+		{
+			name: "Enrolled",
+			body: `{"challenge":"challenge","code":"123456"}`,
+			setup: func(m *MockAuthService) {
+				m.On("CompleteLogin", "challenge", "123456").Return(session, []string{"abcde-01234"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectCookie:   true,
+			expectCodes:    true,
+		},
+		{
+			name: "WrongCode",
+			body: `{"challenge":"challenge","code":"654321"}`,
+			setup: func(m *MockAuthService) {
+				m.On("CompleteLogin", "challenge", "654321").Return(types.Session{}, []string(nil), services.ErrInvalidTwoFactorCode)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "ExpiredChallenge",
+			body: `{"challenge":"old","code":"123456"}`,
+			setup: func(m *MockAuthService) {
+				m.On("CompleteLogin", "old", "123456").Return(types.Session{}, []string(nil), services.ErrInvalidChallenge)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "NotEnrolled",
+			body: `{"challenge":"challenge","code":"123456"}`,
+			setup: func(m *MockAuthService) {
+				m.On("CompleteLogin", "challenge", "123456").Return(types.Session{}, []string(nil), services.ErrNoTwoFactorEnrollment)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "MissingCode",
+			body:           `{"challenge":"challenge"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockAuthService)
+			if tc.setup != nil {
+				tc.setup(mockService)
+			}
+			ah := AuthHandler{AuthService: mockService}
+
+			req := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			ah.SecondFactorHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			var cookie *http.Cookie
+			for _, c := range rr.Result().Cookies() {
+				if c.Name == utils.SessionCookieName {
+					cookie = c
+				}
+			}
+			if tc.expectCookie != (cookie != nil && cookie.Value == "token") {
+				t.Errorf("expected session cookie %v, got %v", tc.expectCookie, cookie)
+			}
+			if tc.expectCodes != strings.Contains(rr.Body.String(), "abcde-01234") {
+				t.Errorf("expected recovery codes %v in %s", tc.expectCodes, rr.Body.String())
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestEnrollForLoginHandler(t *testing.T) {
+	mockService := new(MockAuthService)
+	mockService.On("EnrollForLogin", "challenge").Return(types.TotpEnrollment{Secret: "SECRET", URI: "otpauth://totp/Smd:alice?secret=SECRET"}, nil)
+	mockService.On("EnrollForLogin", "enrolled").Return(types.TotpEnrollment{}, services.ErrTwoFactorEnabled)
+	ah := AuthHandler{AuthService: mockService}
+
+	for challenge, expectedStatus := range map[string]int{"challenge": http.StatusOK, "enrolled": http.StatusConflict} {
+		req := httptest.NewRequest(http.MethodPost, "/login/2fa/enroll", strings.NewReader(`{"challenge":"`+challenge+`"}`))
+		rr := httptest.NewRecorder()
+		ah.EnrollForLoginHandler(rr, req)
+
+		if rr.Code != expectedStatus {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", challenge, rr.Code, expectedStatus)
+		}
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	mockService := new(MockAuthService)
+	mockService.On("Logout", "token").Return(nil)
+	ah := AuthHandler{AuthService: mockService}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rr := httptest.NewRecorder()
+	ah.LogoutHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	mockService.AssertCalled(t, "Logout", "token")
+
+	req = httptest.NewRequest(http.MethodPost, "/logout", nil)
+	rr = httptest.NewRecorder()
+	ah.LogoutHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	mockService := new(MockAuthService)
+	mockService.On("Authenticate", "good").Return(types.User{ID: "1", Username: "alice"}, nil)
+	mockService.On("Authenticate", "bad").Return(types.User{}, services.ErrInvalidSession)
+	authUtil := &utils.AuthUtil{Authenticator: mockService}
+
+	var gotUser types.User
+	next := authUtil.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, _ = utils.UserFromContext(r.Context())
+	})
+
+	testCases := []struct {
+		name           string
+		header         string
+		cookie         string
+		expectedStatus int
+	}{
+		{name: "Bearer", header: "Bearer good", expectedStatus: http.StatusOK},
+		{name: "Cookie", cookie: "good", expectedStatus: http.StatusOK},
+		{name: "BadToken", header: "Bearer bad", expectedStatus: http.StatusUnauthorized},
+		{name: "WrongScheme", header: "Basic good", expectedStatus: http.StatusUnauthorized},
+		{name: "NoToken", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotUser = types.User{}
+			req := httptest.NewRequest(http.MethodGet, "/upload", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: utils.SessionCookieName, Value: tc.cookie})
+			}
+			rr := httptest.NewRecorder()
+			next(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.expectedStatus == http.StatusOK && gotUser.ID != "1" {
+				t.Errorf("expected user 1 on context, got %+v", gotUser)
+			}
+		})
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	sessions := []types.Session{
+		{ID: "s1", UserID: "1", Token: types.AuthToken{Token: "current", ExpiresAt: time.Now().Add(time.Hour)}},
+		{ID: "s2", UserID: "1", Token: types.AuthToken{Token: "phone", ExpiresAt: time.Now().Add(time.Hour)}},
+	}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		setup          func(m *MockAuthService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/sessions",
+			setup: func(m *MockAuthService) {
+				m.On("ListSessions", "1").Return(sessions, nil)
+				m.On("GetSession", "current").Return(sessions[0], nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Revoke",
+			method: http.MethodDelete,
+			path:   "/sessions/s2",
+			setup: func(m *MockAuthService) {
+				m.On("RevokeSession", "1", "s2").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "RevokeUnknown",
+			method: http.MethodDelete,
+			path:   "/sessions/s9",
+			setup: func(m *MockAuthService) {
+				m.On("RevokeSession", "1", "s9").Return(services.ErrSessionNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "LogoutEverywhere",
+			method: http.MethodDelete,
+			path:   "/sessions",
+			setup: func(m *MockAuthService) {
+				m.On("LogoutEverywhere", "1").Return(2, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "WrongMethod",
+			method:         http.MethodPost,
+			path:           "/sessions",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockAuthService)
+			if tc.setup != nil {
+				tc.setup(mockService)
+			}
+			ah := AuthHandler{AuthService: mockService}
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("Authorization", "Bearer current")
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1"}))
+			rr := httptest.NewRecorder()
+			ah.SessionsHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if strings.Contains(rr.Body.String(), "phone") {
+				t.Errorf("response leaks a session token: %s", rr.Body.String())
+			}
+			if tc.name == "List" && !strings.Contains(rr.Body.String(), `"Current":true`) {
+				t.Errorf("current session not marked: %s", rr.Body.String())
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type DirectoryHandler struct {
+	DirectoryService     services.DirectoryService
+	AuthorizationService services.AuthorizationService
+	TrashService         services.TrashService
+}
+
+type createDirectoryRequest struct {
+	Name     string `json:"name"`
+	ParentID string `json:"parent_id"`
+}
+
+// updateDirectoryRequest uses pointers so a missing field leaves the value
+// alone while an empty parent_id moves the directory to the root
+type updateDirectoryRequest struct {
+	Name                 *string `json:"name"`
+	ParentID             *string `json:"parent_id"`
+	MaxVersions          *int    `json:"max_versions"`
+	VersionRetentionDays *int    `json:"version_retention_days"`
+}
+
+// DirectoriesHandler routes /directories and /directories/{id}
+func (dh *DirectoryHandler) DirectoriesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/directories"), "/")
+	if strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not_found", "Directory not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		dh.createDirectory(w, r, user)
+	case r.Method == http.MethodGet:
+		dh.listDirectory(w, r, user, id)
+	case r.Method == http.MethodPatch && id != "":
+		dh.updateDirectory(w, r, user, id)
+	case r.Method == http.MethodDelete && id != "":
+		dh.deleteDirectory(w, user, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (dh *DirectoryHandler) createDirectory(w http.ResponseWriter, r *http.Request, user types.User) {
+	var req createDirectoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	if _, ok := dh.authorizedDirectory(w, user, req.ParentID, services.ActionCreateDirectories); !ok {
+		return
+	}
+
+	dir, err := dh.DirectoryService.CreateDirectory(user.ID, req.Name, req.ParentID)
+	if err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    dir,
+		Message: "Directory created",
+		Success: true,
+	})
+}
+
+func (dh *DirectoryHandler) listDirectory(w http.ResponseWriter, r *http.Request, user types.User, id string) {
+	if _, ok := dh.authorizedDirectory(w, user, id, services.ActionRead); !ok {
+		return
+	}
+	limit, offset, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	listing, err := dh.DirectoryService.ListChildren(user.ID, id, limit, offset)
+	if err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    listing,
+		Success: true,
+	})
+}
+
+func (dh *DirectoryHandler) updateDirectory(w http.ResponseWriter, r *http.Request, user types.User, id string) {
+	dir, ok := dh.changeableDirectory(w, user, id, services.ActionWrite)
+	if !ok {
+		return
+	}
+	var req updateDirectoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	name, parentID := dir.Name, dir.ParentDirectoryID
+	if req.Name != nil {
+		name = *req.Name
+	}
+	if req.ParentID != nil {
+		parentID = *req.ParentID
+		if parentID != dir.ParentDirectoryID {
+			if _, ok := dh.authorizedDirectory(w, user, parentID, services.ActionCreateDirectories); !ok {
+				return
+			}
+		}
+	}
+
+	maxVersions, retentionDays := dir.MaxVersions, dir.VersionRetentionDays
+	if req.MaxVersions != nil {
+		maxVersions = *req.MaxVersions
+	}
+	if req.VersionRetentionDays != nil {
+		retentionDays = *req.VersionRetentionDays
+	}
+	if maxVersions < 0 || retentionDays < 0 {
+		writeDirectoryError(w, services.ErrInvalidRetention)
+		return
+	}
+	retentionChanged := maxVersions != dir.MaxVersions || retentionDays != dir.VersionRetentionDays
+	// Tightening retention deletes old versions straight away, so even the
+	// owner needs a role that can delete
+	if retentionChanged {
+		if err := dh.AuthorizationService.AuthorizeDirectory(user, id, services.ActionDelete); err != nil {
+			writeAuthorizationError(w, err)
+			return
+		}
+	}
+
+	dir, err := dh.DirectoryService.MoveDirectory(id, name, parentID)
+	if err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+	if retentionChanged {
+		dir, err = dh.DirectoryService.SetRetention(id, maxVersions, retentionDays)
+		if err != nil {
+			writeDirectoryError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    dir,
+		Message: "Directory updated",
+		Success: true,
+	})
+}
+
+func (dh *DirectoryHandler) deleteDirectory(w http.ResponseWriter, user types.User, id string) {
+	if _, ok := dh.changeableDirectory(w, user, id, services.ActionDelete); !ok {
+		return
+	}
+	if _, err := dh.TrashService.TrashDirectory(user, id); err != nil {
+		writeDirectoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizedDirectory looks up a directory, or the user's root when id is
+// empty, and checks the user may perform action on it, writing the error
+// response and returning false otherwise
+func (dh *DirectoryHandler) authorizedDirectory(w http.ResponseWriter, user types.User, id string, action services.Action) (types.Directory, bool) {
+	var dir types.Directory
+	if id != "" {
+		var err error
+		dir, err = dh.DirectoryService.GetDirectory(id)
+		if err != nil {
+			writeDirectoryError(w, err)
+			return types.Directory{}, false
+		}
+	}
+	if err := dh.AuthorizationService.AuthorizeDirectory(user, id, action); err != nil {
+		writeAuthorizationError(w, err)
+		return types.Directory{}, false
+	}
+	return dir, true
+}
+
+// changeableDirectory is authorizedDirectory for changing the directory
+// itself rather than what is in it, which a team space's members may not do
+// to its root
+func (dh *DirectoryHandler) changeableDirectory(w http.ResponseWriter, user types.User, id string, action services.Action) (types.Directory, bool) {
+	dir, ok := dh.authorizedDirectory(w, user, id, action)
+	if !ok {
+		return types.Directory{}, false
+	}
+	if err := dh.AuthorizationService.AuthorizeSpaceChange(user, id); err != nil {
+		writeAuthorizationError(w, err)
+		return types.Directory{}, false
+	}
+	return dir, true
+}
+
+func writeDirectoryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrDirectoryNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Directory not found")
+	case errors.Is(err, services.ErrDirectoryExists):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, services.ErrDirectoryCycle), errors.Is(err, services.ErrInvalidName), errors.Is(err, services.ErrInvalidRetention), errors.Is(err, services.ErrSpaceMove):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	case errors.Is(err, services.ErrQuotaExceeded):
+		writeQuotaExceeded(w)
+	default:
+		http.Error(w, "Error handling the directory", http.StatusInternalServerError)
+	}
+}
+
+// pagination reads the limit and offset query parameters
+func pagination(r *http.Request) (limit, offset int, err error) {
+	limit, offset = 100, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockDirectoryService struct {
+	mock.Mock
+}
+
+func (m *MockDirectoryService) CreateDirectory(ownerID, name, parentID string) (types.Directory, error) {
+	args := m.Called(ownerID, name, parentID)
+	return args.Get(0).(types.Directory), args.Error(1)
+}
+
+func (m *MockDirectoryService) GetDirectory(id string) (types.Directory, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.Directory), args.Error(1)
+}
+
+func (m *MockDirectoryService) ListChildren(ownerID, directoryID string, limit, offset int) (types.DirectoryListing, error) {
+	args := m.Called(ownerID, directoryID, limit, offset)
+	return args.Get(0).(types.DirectoryListing), args.Error(1)
+}
+
+func (m *MockDirectoryService) MoveDirectory(id, newName, newParentID string) (types.Directory, error) {
+	args := m.Called(id, newName, newParentID)
+	return args.Get(0).(types.Directory), args.Error(1)
+}
+
+func (m *MockDirectoryService) DeleteDirectory(id string) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockDirectoryService) SetRetention(id string, maxVersions, retentionDays int) (types.Directory, error) {
+	args := m.Called(id, maxVersions, retentionDays)
+	return args.Get(0).(types.Directory), args.Error(1)
+}
+
+func TestDirectoriesHandler(t *testing.T) {
+	own := types.Directory{ID: "d1", Name: "docs", OwnerID: "1"}
+	other := types.Directory{ID: "d2", Name: "theirs", OwnerID: "2"}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		setup          func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService)
+		expectedStatus int
+	}{
+		{
+			name:   "CreateAtRoot",
+			method: http.MethodPost,
+			path:   "/directories",
+			body:   `{"name":"docs"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				a.On("AuthorizeDirectory", mock.Anything, "", services.ActionCreateDirectories).Return(nil)
+				m.On("CreateDirectory", "1", "docs", "").Return(own, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateDuplicate",
+			method: http.MethodPost,
+			path:   "/directories",
+			body:   `{"name":"docs"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				a.On("AuthorizeDirectory", mock.Anything, "", services.ActionCreateDirectories).Return(nil)
+				m.On("CreateDirectory", "1", "docs", "").Return(types.Directory{}, services.ErrDirectoryExists)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "CreateInSharedDirectory",
+			method: http.MethodPost,
+			path:   "/directories",
+			body:   `{"name":"x","parent_id":"d2"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d2").Return(other, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionCreateDirectories).Return(nil)
+				m.On("CreateDirectory", "1", "x", "d2").Return(types.Directory{ID: "d3", Name: "x", OwnerID: "1", ParentDirectoryID: "d2"}, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateForbidden",
+			method: http.MethodPost,
+			path:   "/directories",
+			body:   `{"name":"x","parent_id":"d2"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d2").Return(other, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionCreateDirectories).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "ListRoot",
+			method: http.MethodGet,
+			path:   "/directories?limit=10&offset=5",
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				a.On("AuthorizeDirectory", mock.Anything, "", services.ActionRead).Return(nil)
+				m.On("ListChildren", "1", "", 10, 5).Return(types.DirectoryListing{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "ListBadLimit",
+			method: http.MethodGet,
+			path:   "/directories?limit=-1",
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				a.On("AuthorizeDirectory", mock.Anything, "", services.ActionRead).Return(nil)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "ListMissing",
+			method: http.MethodGet,
+			path:   "/directories/nope",
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "nope").Return(types.Directory{}, services.ErrDirectoryNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "ListForbidden",
+			method: http.MethodGet,
+			path:   "/directories/d2",
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d2").Return(other, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionRead).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Rename",
+			method: http.MethodPatch,
+			path:   "/directories/d1",
+			body:   `{"name":"papers"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+				m.On("MoveDirectory", "d1", "papers", "").Return(types.Directory{ID: "d1", Name: "papers", OwnerID: "1"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "MoveIntoItself",
+			method: http.MethodPatch,
+			path:   "/directories/d1",
+			body:   `{"parent_id":"d1"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionCreateDirectories).Return(nil)
+				m.On("MoveDirectory", "d1", "docs", "d1").Return(types.Directory{}, services.ErrDirectoryCycle)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "MoveOverQuota",
+			method: http.MethodPatch,
+			path:   "/directories/d1",
+			body:   `{"parent_id":"d2"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+				m.On("GetDirectory", "d2").Return(types.Directory{ID: "d2", Name: "full", OwnerID: "1"}, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionCreateDirectories).Return(nil)
+				m.On("MoveDirectory", "d1", "docs", "d2").Return(types.Directory{}, services.ErrQuotaExceeded)
+			},
+			expectedStatus: http.StatusInsufficientStorage,
+		},
+		{
+			name:   "MoveIntoForbidden",
+			method: http.MethodPatch,
+			path:   "/directories/d1",
+			body:   `{"parent_id":"d2"}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				m.On("GetDirectory", "d2").Return(other, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionCreateDirectories).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "SetRetention",
+			method: http.MethodPatch,
+			path:   "/directories/d1",
+			body:   `{"max_versions":5,"version_retention_days":30}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionDelete).Return(nil)
+				m.On("MoveDirectory", "d1", "docs", "").Return(own, nil)
+				m.On("SetRetention", "d1", 5, 30).Return(types.Directory{ID: "d1", Name: "docs", OwnerID: "1", MaxVersions: 5, VersionRetentionDays: 30}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "SetRetentionWithoutDelete",
+			method: http.MethodPatch,
+			path:   "/directories/d2",
+			body:   `{"max_versions":1}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d2").Return(other, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d2").Return(nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionDelete).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "OwnerSetRetentionWithoutDelete",
+			method: http.MethodPatch,
+			path:   "/directories/d1",
+			body:   `{"max_versions":1}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionDelete).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "SetNegativeRetention",
+			method: http.MethodPatch,
+			path:   "/directories/d1",
+			body:   `{"max_versions":-1}`,
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Delete",
+			method: http.MethodDelete,
+			path:   "/directories/d1",
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d1").Return(own, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionDelete).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "d1").Return(nil)
+				ts.On("TrashDirectory", mock.Anything, "d1").Return(types.TrashItem{ID: "t1", ItemType: types.TrashDirectory, ItemID: "d1"}, nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "DeleteForbidden",
+			method: http.MethodDelete,
+			path:   "/directories/d2",
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "d2").Return(other, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "d2", services.ActionDelete).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "DeleteTeamSpace",
+			method: http.MethodDelete,
+			path:   "/directories/s1",
+			setup: func(m *MockDirectoryService, a *MockAuthorizationService, ts *MockTrashService) {
+				m.On("GetDirectory", "s1").Return(types.Directory{ID: "s1", Name: "Shared", OwnerID: "g1"}, nil)
+				a.On("AuthorizeDirectory", mock.Anything, "s1", services.ActionDelete).Return(nil)
+				a.On("AuthorizeSpaceChange", mock.Anything, "s1").Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "DeleteRoot",
+			method:         http.MethodDelete,
+			path:           "/directories",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockDirectoryService)
+			mockAuthz := new(MockAuthorizationService)
+			mockTrash := new(MockTrashService)
+			if tc.setup != nil {
+				tc.setup(mockService, mockAuthz, mockTrash)
+			}
+			dh := &DirectoryHandler{DirectoryService: mockService, AuthorizationService: mockAuthz, TrashService: mockTrash}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Owner}))
+			rr := httptest.NewRecorder()
+			dh.DirectoriesHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus >= http.StatusBadRequest {
+				assertApiError(t, rr, tc.expectedStatus)
+			}
+			mockService.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+			mockTrash.AssertExpectations(t)
+		})
+	}
+}
@@ -3,66 +3,348 @@ package handlers
 import (
 	"Smd/services"
 	"Smd/types"
+	"Smd/utils"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type FileHandler struct {
-	FileService services.FileService
-	StorePath   string // Configurable store path
-	MaxFileSize int64  // Configurable max file MaxFileSize
+	FileService          services.FileService
+	AuthorizationService services.AuthorizationService
+	TrashService         services.TrashService
+	MaxFileSize          int64 // Configurable max file MaxFileSize
 }
 
+// DefaultMaxFileSize applies when FileHandler.MaxFileSize is not configured
+const DefaultMaxFileSize = 10 << 20
+
+// maxFormOverhead bounds the non-file form fields and multipart framing
+const maxFormOverhead = 1 << 20
+
 func (fh *FileHandler) UploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
 		return
 	}
 
-	file, header, err := fh.FileService.ParseAndValidateFile(r, w)
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	maxFileSize := fh.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxFileSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+maxFormOverhead)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		if err.Error() == "file too large" {
-			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		writeError(w, http.StatusBadRequest, "bad_request", "request body empty")
+		return
+	}
+
+	// A presigned URL fixes where the file goes and what it is called
+	signed, isSigned := utils.SignedRequestFromContext(r.Context())
+
+	// Stream the first uploadFile part straight into the store instead of
+	// buffering the whole form. Fields meant to apply to the file must come
+	// before it in the body.
+	directoryID := signed.DirectoryID
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeError(w, http.StatusBadRequest, "bad_request", "no file in request body")
 			return
-		} else {
-			http.Error(w, err.Error(), http.StatusBadRequest)
 		}
+		if err != nil {
+			if isTooLarge(err) {
+				writeError(w, http.StatusRequestEntityTooLarge, "too_large", "File too large")
+				return
+			}
+			writeError(w, http.StatusBadRequest, "bad_request", "error parsing form")
+			return
+		}
+		if part.FormName() == "directory_id" {
+			value, err := io.ReadAll(io.LimitReader(part, 256))
+			part.Close()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "bad_request", "error parsing form")
+				return
+			}
+			if isSigned && string(value) != signed.DirectoryID {
+				writeError(w, http.StatusBadRequest, "bad_request", "directory_id does not match the signed URL")
+				return
+			}
+			directoryID = string(value)
+			continue
+		}
+		if part.FormName() != "uploadFile" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		if err := fh.AuthorizationService.AuthorizeDirectory(user, directoryID, services.ActionWrite); err != nil {
+			part.Close()
+			writeAuthorizationError(w, err)
+			return
+		}
+		f := types.File{
+			Name:        filepath.Base(part.FileName()),
+			ContentType: part.Header.Get("Content-Type"),
+			OwnerID:     user.ID,
+			DirectoryID: directoryID,
+		}
+		var content io.Reader = part
+		if isSigned {
+			f.Name = signed.Name
+			content = services.CheckSignedContent(part, signed)
+		}
+		_, err = fh.FileService.StoreStream(content, maxFileSize, f)
+		part.Close()
+		if err != nil {
+			if errors.Is(err, services.ErrSignedContentMismatch) {
+				writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+				return
+			}
+			if errors.Is(err, services.ErrFileTooLarge) || isTooLarge(err) {
+				writeError(w, http.StatusRequestEntityTooLarge, "too_large", "File too large")
+				return
+			}
+			if errors.Is(err, services.ErrQuotaExceeded) {
+				writeQuotaExceeded(w)
+				return
+			}
+			http.Error(w, "Error saving and uploading the file", http.StatusInternalServerError)
+			return
+		}
+		break
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("File uploaded successfully"))
+}
+
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// FilesHandler routes /files/{id} by method, and /files/{id}/versions/...
+// to VersionsHandler
+func (fh *FileHandler) FilesHandler(w http.ResponseWriter, r *http.Request) {
+	if _, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/files/"), "/"); rest != "" {
+		fh.VersionsHandler(w, r)
 		return
 	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		fh.GetFileHandler(w, r)
+	case http.MethodDelete:
+		fh.DeleteFileHandler(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
 
-	hashedFilename, err := fh.FileService.HashFile(file)
+// GetFileHandler serves GET /files/{id}. Range, If-Range, If-None-Match and
+// If-Modified-Since are handled by http.ServeContent against the ETag and
+// upload date set here.
+func (fh *FileHandler) GetFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	file, ok := fh.authorizedFile(w, strings.TrimPrefix(r.URL.Path, "/files/"), user, services.ActionRead)
+	if !ok {
+		return
+	}
+
+	content, err := fh.FileService.OpenFile(file)
 	if err != nil {
-		http.Error(w, "Error hashing the file", http.StatusInternalServerError)
+		http.Error(w, "Error getting the file", http.StatusInternalServerError)
 		return
 	}
+	defer content.Close()
+	serveFile(w, r, file.Name, file.ContentType, file.Hash, file.UploadDate, content)
+}
 
-	f := types.File{
-		Name:        header.Filename,
-		Size:        header.Size,
-		ContentType: header.Header.Get("Content-Type"),
-		Location:    hashedFilename,
-		OwnerID:     "1", // todo implement auth
+// serveFile sends content as a download, answering range and conditional
+// requests against hash as the ETag and modTime
+func serveFile(w http.ResponseWriter, r *http.Request, name, contentType, hash string, modTime time.Time, content io.ReadSeeker) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if hash != "" {
+		w.Header().Set("ETag", `"`+hash+`"`)
+	}
+	http.ServeContent(w, r, name, modTime, content)
+}
 
-	if err := fh.FileService.SaveAndUploadFile(file, hashedFilename, r.FormValue("subdirectory"), f); err != nil {
-		http.Error(w, "Error saving and uploading the file", http.StatusInternalServerError)
+// DeleteFileHandler serves DELETE /files/{id}, moving the file to the trash
+func (fh *FileHandler) DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("File uploaded successfully"))
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	file, ok := fh.authorizedFile(w, strings.TrimPrefix(r.URL.Path, "/files/"), user, services.ActionDelete)
+	if !ok {
+		return
+	}
+	if _, err := fh.TrashService.TrashFile(user, file.ID); err != nil {
+		if errors.Is(err, services.ErrFileNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", "File not found")
+			return
+		}
+		http.Error(w, "Error deleting the file", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (fh *FileHandler) GetFileHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+// VersionsHandler serves the history of a file:
+//
+//	GET  /files/{id}/versions                   lists versions, newest first
+//	GET  /files/{id}/versions/{n}               downloads version n
+//	POST /files/{id}/versions/{n}/restore       makes a copy of version n current
+func (fh *FileHandler) VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/files/"), "/")
+	if len(parts) < 2 || len(parts) > 4 || parts[1] != "versions" || (len(parts) == 4 && parts[3] != "restore") {
+		writeError(w, http.StatusNotFound, "not_found", "Not found")
 		return
 	}
-	file, err := fh.FileService.GetFile(r.FormValue("filename"))
+	version := 0
+	if len(parts) > 2 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n < 1 {
+			writeError(w, http.StatusNotFound, "not_found", "Version not found")
+			return
+		}
+		version = n
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		fh.listVersions(w, user, parts[0])
+	case len(parts) == 3 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		fh.getVersion(w, r, user, parts[0], version)
+	case len(parts) == 4 && r.Method == http.MethodPost:
+		fh.restoreVersion(w, user, parts[0], version)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (fh *FileHandler) listVersions(w http.ResponseWriter, user types.User, id string) {
+	if _, ok := fh.authorizedFile(w, id, user, services.ActionRead); !ok {
+		return
+	}
+	versions, err := fh.FileService.ListVersions(id)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    versions,
+		Success: true,
+	})
+}
+
+func (fh *FileHandler) getVersion(w http.ResponseWriter, r *http.Request, user types.User, id string, version int) {
+	file, ok := fh.authorizedFile(w, id, user, services.ActionRead)
+	if !ok {
+		return
+	}
+	v, err := fh.FileService.GetVersion(id, version)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+	content, err := fh.FileService.OpenVersion(v)
 	if err != nil {
 		http.Error(w, "Error getting the file", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", file.ContentType)
-	http.ServeFile(w, r, file.Location)
+	defer content.Close()
+	serveFile(w, r, file.Name, v.ContentType, v.Hash, v.CreatedAt, content)
+}
+
+func (fh *FileHandler) restoreVersion(w http.ResponseWriter, user types.User, id string, version int) {
+	if _, ok := fh.authorizedFile(w, id, user, services.ActionWrite); !ok {
+		return
+	}
+	file, err := fh.FileService.RestoreVersion(id, version, user.ID)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    file,
+		Message: "Version restored",
+		Success: true,
+	})
+}
+
+func writeVersionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrFileNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "File not found")
+	case errors.Is(err, services.ErrVersionNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Version not found")
+	default:
+		http.Error(w, "Error handling the file versions", http.StatusInternalServerError)
+	}
+}
+
+// authorizedFile looks up the file with id and checks the user may perform
+// action on it, writing the error response otherwise
+func (fh *FileHandler) authorizedFile(w http.ResponseWriter, id string, user types.User, action services.Action) (types.File, bool) {
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not_found", "File not found")
+		return types.File{}, false
+	}
+	file, err := fh.FileService.GetFileByID(id)
+	if err != nil {
+		if errors.Is(err, services.ErrFileNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", "File not found")
+			return types.File{}, false
+		}
+		http.Error(w, "Error getting the file", http.StatusInternalServerError)
+		return types.File{}, false
+	}
+	if err := fh.AuthorizationService.AuthorizeFile(user, file, action); err != nil {
+		writeAuthorizationError(w, err)
+		return types.File{}, false
+	}
+	return file, true
 }
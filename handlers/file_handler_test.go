@@ -1,15 +1,18 @@
 package handlers
 
 import (
+	"Smd/services"
 	"Smd/types"
+	"Smd/utils"
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -18,33 +21,74 @@ type MockFileService struct {
 	mock.Mock
 }
 
-func (m *MockFileService) ParseAndValidateFile(r *http.Request, w http.ResponseWriter) (multipart.File, *multipart.FileHeader, error) {
-	args := m.Called(r, w)
-	return args.Get(0).(multipart.File), args.Get(1).(*multipart.FileHeader), args.Error(2)
+func (m *MockFileService) UploadFile(f types.File) error {
+	args := m.Called(f)
+	return args.Error(0)
 }
 
-func (m *MockFileService) HashFile(file multipart.File) (string, error) {
-	args := m.Called(file)
-	return args.String(0), args.Error(1)
+func (m *MockFileService) SaveFile(file multipart.File, hashedFilename string) (types.File, error) {
+	args := m.Called(file, hashedFilename)
+	return args.Get(0).(types.File), args.Error(1)
 }
 
-func (m *MockFileService) SaveAndUploadFile(file multipart.File, hashedFilename string, subdirectory string, f types.File) error {
-	args := m.Called(file, hashedFilename, subdirectory, f)
-	return args.Error(0)
+func (m *MockFileService) GetFile(id string) (types.File, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.File), args.Error(1)
 }
 
-func (m *MockFileService) UploadFile(f types.File) error {
+func (m *MockFileService) GetFileByID(id string) (types.File, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.File), args.Error(1)
+}
+
+func (m *MockFileService) OpenFile(f types.File) (io.ReadSeekCloser, error) {
 	args := m.Called(f)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(io.ReadSeekCloser), args.Error(1)
+}
+
+func (m *MockFileService) DeleteFile(id string) error {
+	args := m.Called(id)
 	return args.Error(0)
 }
 
-func (m *MockFileService) SaveFile(file multipart.File, hashedFilename, subdirectory string) (string, error) {
-	args := m.Called(file, hashedFilename, subdirectory)
-	return args.String(0), args.Error(1)
+func (m *MockFileService) ListVersions(fileID string) ([]types.FileVersion, error) {
+	args := m.Called(fileID)
+	return args.Get(0).([]types.FileVersion), args.Error(1)
 }
 
-func (m *MockFileService) GetFile(id string) (types.File, error) {
-	args := m.Called(id)
+func (m *MockFileService) GetVersion(fileID string, version int) (types.FileVersion, error) {
+	args := m.Called(fileID, version)
+	return args.Get(0).(types.FileVersion), args.Error(1)
+}
+
+func (m *MockFileService) OpenVersion(v types.FileVersion) (io.ReadSeekCloser, error) {
+	args := m.Called(v)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(io.ReadSeekCloser), args.Error(1)
+}
+
+func (m *MockFileService) RestoreVersion(fileID string, version int, uploaderID string) (types.File, error) {
+	args := m.Called(fileID, version, uploaderID)
+	return args.Get(0).(types.File), args.Error(1)
+}
+
+func (m *MockFileService) PruneVersions(fileID string) error {
+	args := m.Called(fileID)
+	return args.Error(0)
+}
+
+func (m *MockFileService) PruneAllVersions() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockFileService) StoreStream(r io.Reader, maxSize int64, f types.File) (types.File, error) {
+	args := m.Called(r, maxSize, f)
 	return args.Get(0).(types.File), args.Error(1)
 }
 
@@ -89,45 +133,72 @@ func (fc *FakeMultiPart) Seek(offset int64, whence int) (int64, error) {
 func TestUploadFileHandler(t *testing.T) {
 	testCases := []struct {
 		name           string
+		fieldName      string
 		fileData       []byte
+		storeErr       error
+		authErr        error
 		expectedStatus int
 	}{
 		{
 			name:           "FileTooLarge",
+			fieldName:      "uploadFile",
 			fileData:       make([]byte, 10*1024*1024+10), // 10 MB + 10 byte
+			storeErr:       services.ErrFileTooLarge,
 			expectedStatus: http.StatusRequestEntityTooLarge,
 		},
 		{
 			name:           "Success",
+			fieldName:      "uploadFile",
 			fileData:       []byte("test data"), // Less than 10MB
 			expectedStatus: http.StatusOK,
 		},
+		{
+			name:           "NoFile",
+			fieldName:      "somethingElse",
+			fileData:       []byte("test data"),
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "StoreError",
+			fieldName:      "uploadFile",
+			fileData:       []byte("test data"),
+			storeErr:       errors.New("disk full"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "Forbidden",
+			fieldName:      "uploadFile",
+			fileData:       []byte("test data"),
+			authErr:        services.ErrForbidden,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "QuotaExceeded",
+			fieldName:      "uploadFile",
+			fileData:       []byte("test data"),
+			storeErr:       services.ErrQuotaExceeded,
+			expectedStatus: http.StatusInsufficientStorage,
+		},
 		// Add more test cases here
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			mockService := new(MockFileService)
+			mockAuthz := new(MockAuthorizationService)
 			fh := FileHandler{
-				FileService: mockService,
-				StorePath:   "/tmp",
-				MaxFileSize: 10 * 1024 * 1024, // 10 MB
+				FileService:          mockService,
+				AuthorizationService: mockAuthz,
+				MaxFileSize:          10 * 1024 * 1024, // 10 MB
 			}
-			if int64(len(tc.fileData)) > fh.MaxFileSize {
-				mockService.On("ParseAndValidateFile", mock.Anything, mock.Anything).Return(&FakeMultiPart{bytes.NewBuffer(tc.fileData)}, &multipart.FileHeader{}, errors.New("file too large"))
-			} else {
-				mockService.On("ParseAndValidateFile", mock.Anything, mock.Anything).Return(&FakeMultiPart{bytes.NewBuffer(tc.fileData)}, &multipart.FileHeader{}, nil)
-			}
-			mockService.On("HashFile", mock.Anything).Return("test", nil)
-			mockService.On("SaveAndUploadFile", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
-			mockService.On("UploadFile", mock.Anything).Return(nil)
-			mockService.On("SaveFile", mock.Anything, mock.Anything, mock.Anything).Return("", nil)
+			mockService.On("StoreStream", mock.Anything, fh.MaxFileSize, mock.Anything).Return(types.File{}, tc.storeErr)
+			mockAuthz.On("AuthorizeDirectory", mock.Anything, "", services.ActionWrite).Return(tc.authErr)
 			// Create a buffer to hold the form data
 			var b bytes.Buffer
 			w := multipart.NewWriter(&b)
 
 			// Create a file field in the form
-			fw, err := w.CreateFormFile("file", "test.txt")
+			fw, err := w.CreateFormFile(tc.fieldName, "test.txt")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -152,6 +223,7 @@ func TestUploadFileHandler(t *testing.T) {
 
 			// Set the content type to multipart/form-data and include the boundary
 			req.Header.Set("Content-Type", w.FormDataContentType())
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1"}))
 
 			// Create a ResponseRecorder to record the response
 			rr := httptest.NewRecorder()
@@ -160,11 +232,396 @@ func TestUploadFileHandler(t *testing.T) {
 			fh.UploadFileHandler(rr, req)
 
 			// Check the status code
-			fmt.Println(rr.Code)
 			if status := rr.Code; status != tc.expectedStatus {
 				t.Errorf("handler returned wrong status code: got %v want %v",
 					status, tc.expectedStatus)
 			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+				mockService.AssertNotCalled(t, "StoreStream", mock.Anything, mock.Anything, mock.Anything)
+			}
+			if tc.expectedStatus == http.StatusInsufficientStorage {
+				assertApiError(t, rr, http.StatusInsufficientStorage)
+			}
+			if tc.expectedStatus == http.StatusOK {
+				mockService.AssertCalled(t, "StoreStream", mock.Anything, fh.MaxFileSize, mock.MatchedBy(func(f types.File) bool {
+					return f.OwnerID == "1" && f.Name == "test.txt"
+				}))
+			}
+		})
+	}
+}
+
+func TestUploadFileHandlerUnauthenticated(t *testing.T) {
+	mockService := new(MockFileService)
+	fh := FileHandler{FileService: mockService}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	rr := httptest.NewRecorder()
+	fh.UploadFileHandler(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	mockService.AssertNotCalled(t, "StoreStream", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUploadFileHandlerSigned(t *testing.T) {
+	signed := types.SignedRequest{Method: http.MethodPost, UserID: "1", DirectoryID: "d1", Name: "out.tar", ContentLength: 9}
+
+	testCases := []struct {
+		name           string
+		directoryID    string
+		storeErr       error
+		expectedStatus int
+	}{
+		{name: "Success", expectedStatus: http.StatusOK},
+		{name: "MatchingDirectory", directoryID: "d1", expectedStatus: http.StatusOK},
+		{name: "OtherDirectory", directoryID: "d2", expectedStatus: http.StatusBadRequest},
+		{name: "ContentMismatch", storeErr: services.ErrSignedContentMismatch, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockFileService)
+			mockAuthz := new(MockAuthorizationService)
+			fh := FileHandler{FileService: mockService, AuthorizationService: mockAuthz, MaxFileSize: 1024}
+			mockService.On("StoreStream", mock.Anything, fh.MaxFileSize, mock.Anything).Return(types.File{}, tc.storeErr)
+			mockAuthz.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+
+			var b bytes.Buffer
+			w := multipart.NewWriter(&b)
+			if tc.directoryID != "" {
+				w.WriteField("directory_id", tc.directoryID)
+			}
+			fw, _ := w.CreateFormFile("uploadFile", "whatever.bin")
+			fw.Write([]byte("test data"))
+			w.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/upload", &b)
+			req.Header.Set("Content-Type", w.FormDataContentType())
+			req = req.WithContext(utils.WithSignedRequest(utils.WithUser(req.Context(), types.User{ID: "1"}), signed))
+			rr := httptest.NewRecorder()
+			fh.UploadFileHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusOK {
+				mockService.AssertCalled(t, "StoreStream", mock.Anything, fh.MaxFileSize, mock.MatchedBy(func(f types.File) bool {
+					return f.Name == "out.tar" && f.DirectoryID == "d1" && f.OwnerID == "1"
+				}))
+			}
+		})
+	}
+}
+
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+func TestGetFileHandler(t *testing.T) {
+	uploaded := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := types.File{
+		ID:          "f1",
+		Name:        "report final.pdf",
+		ContentType: "application/pdf",
+		OwnerID:     "1",
+		Hash:        "abc123",
+		UploadDate:  uploaded,
+		Size:        10,
+	}
+
+	testCases := []struct {
+		name           string
+		path           string
+		headers        map[string]string
+		getErr         error
+		authErr        error
+		expectedStatus int
+		expectedBody   string
+		expectHeaders  map[string]string
+	}{
+		{
+			name:           "Success",
+			path:           "/files/f1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "0123456789",
+			expectHeaders: map[string]string{
+				"ETag":                `"abc123"`,
+				"Content-Type":        "application/pdf",
+				"Content-Disposition": `attachment; filename="report final.pdf"`,
+				"Last-Modified":       uploaded.Format(http.TimeFormat),
+				"Accept-Ranges":       "bytes",
+			},
+		},
+		{
+			name:           "Range",
+			path:           "/files/f1",
+			headers:        map[string]string{"Range": "bytes=2-4"},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "234",
+			expectHeaders:  map[string]string{"Content-Range": "bytes 2-4/10"},
+		},
+		{
+			name:           "IfRangeMatches",
+			path:           "/files/f1",
+			headers:        map[string]string{"Range": "bytes=0-0", "If-Range": `"abc123"`},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "0",
+		},
+		{
+			name:           "IfRangeStale",
+			path:           "/files/f1",
+			headers:        map[string]string{"Range": "bytes=0-0", "If-Range": `"old"`},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "0123456789",
+		},
+		{
+			name:           "IfNoneMatch",
+			path:           "/files/f1",
+			headers:        map[string]string{"If-None-Match": `"abc123"`},
+			expectedStatus: http.StatusNotModified,
+		},
+		{
+			name:           "IfModifiedSince",
+			path:           "/files/f1",
+			headers:        map[string]string{"If-Modified-Since": uploaded.Add(time.Hour).Format(http.TimeFormat)},
+			expectedStatus: http.StatusNotModified,
+		},
+		{
+			name:           "NotFound",
+			path:           "/files/f1",
+			getErr:         services.ErrFileNotFound,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "NoID",
+			path:           "/files/",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Forbidden",
+			path:           "/files/f1",
+			authErr:        services.ErrForbidden,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "LookupError",
+			path:           "/files/f1",
+			getErr:         errors.New("database is locked"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockFileService)
+			mockService.On("GetFileByID", "f1").Return(file, tc.getErr)
+			mockService.On("OpenFile", file).Return(nopReadSeekCloser{strings.NewReader("0123456789")}, nil)
+			mockAuthz := new(MockAuthorizationService)
+			mockAuthz.On("AuthorizeFile", mock.Anything, file, services.ActionRead).Return(tc.authErr)
+			fh := FileHandler{FileService: mockService, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1"}))
+			rr := httptest.NewRecorder()
+			fh.GetFileHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.authErr != nil {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			if tc.expectedBody != "" && rr.Body.String() != tc.expectedBody {
+				t.Errorf("handler returned body %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+			for k, v := range tc.expectHeaders {
+				if got := rr.Header().Get(k); got != v {
+					t.Errorf("header %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteFileHandler(t *testing.T) {
+	file := types.File{ID: "f1", Name: "a.txt", OwnerID: "2"}
+
+	testCases := []struct {
+		name           string
+		path           string
+		getErr         error
+		authErr        error
+		deleteErr      error
+		expectedStatus int
+	}{
+		{
+			name:           "Success",
+			path:           "/files/f1",
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "NotFound",
+			path:           "/files/f1",
+			getErr:         services.ErrFileNotFound,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Forbidden",
+			path:           "/files/f1",
+			authErr:        services.ErrForbidden,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "DeleteError",
+			path:           "/files/f1",
+			deleteErr:      errors.New("disk gone"),
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockFileService)
+			mockService.On("GetFileByID", "f1").Return(file, tc.getErr)
+			mockAuthz := new(MockAuthorizationService)
+			mockAuthz.On("AuthorizeFile", mock.Anything, file, services.ActionDelete).Return(tc.authErr)
+			mockTrash := new(MockTrashService)
+			mockTrash.On("TrashFile", mock.Anything, "f1").Return(types.TrashItem{}, tc.deleteErr)
+			fh := FileHandler{FileService: mockService, AuthorizationService: mockAuthz, TrashService: mockTrash}
+
+			req := httptest.NewRequest(http.MethodDelete, tc.path, nil)
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Owner}))
+			rr := httptest.NewRecorder()
+			fh.FilesHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.authErr != nil {
+				assertApiError(t, rr, http.StatusForbidden)
+				mockTrash.AssertNotCalled(t, "TrashFile", mock.Anything, "f1")
+			}
+		})
+	}
+}
+
+func TestVersionsHandler(t *testing.T) {
+	file := types.File{ID: "f1", Name: "a.txt", OwnerID: "2", Version: 2}
+	v1 := types.FileVersion{FileID: "f1", Version: 1, Hash: "old", ContentType: "text/plain", UploaderID: "2", Size: 3}
+	restored := file
+	restored.Version = 3
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		authErr        error
+		expectedStatus int
+		expectedBody   string
+		expectedAction services.Action
+		unrouted       bool // rejected before the file is looked up
+	}{
+		{
+			name:           "List",
+			method:         http.MethodGet,
+			path:           "/files/f1/versions",
+			expectedStatus: http.StatusOK,
+			expectedAction: services.ActionRead,
+		},
+		{
+			name:           "Download",
+			method:         http.MethodGet,
+			path:           "/files/f1/versions/1",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "old",
+			expectedAction: services.ActionRead,
+		},
+		{
+			name:           "UnknownVersion",
+			method:         http.MethodGet,
+			path:           "/files/f1/versions/7",
+			expectedStatus: http.StatusNotFound,
+			expectedAction: services.ActionRead,
+		},
+		{
+			name:           "InvalidVersion",
+			method:         http.MethodGet,
+			path:           "/files/f1/versions/latest",
+			expectedStatus: http.StatusNotFound,
+			unrouted:       true,
+		},
+		{
+			name:           "Restore",
+			method:         http.MethodPost,
+			path:           "/files/f1/versions/1/restore",
+			expectedStatus: http.StatusOK,
+			expectedAction: services.ActionWrite,
+		},
+		{
+			name:           "RestoreForbidden",
+			method:         http.MethodPost,
+			path:           "/files/f1/versions/1/restore",
+			authErr:        services.ErrForbidden,
+			expectedStatus: http.StatusForbidden,
+			expectedAction: services.ActionWrite,
+		},
+		{
+			name:           "RestoreWithGet",
+			method:         http.MethodGet,
+			path:           "/files/f1/versions/1/restore",
+			expectedStatus: http.StatusMethodNotAllowed,
+			unrouted:       true,
+		},
+		{
+			name:           "UnknownPath",
+			method:         http.MethodGet,
+			path:           "/files/f1/history",
+			expectedStatus: http.StatusNotFound,
+			unrouted:       true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockFileService)
+			mockService.On("GetFileByID", "f1").Return(file, nil)
+			mockService.On("ListVersions", "f1").Return([]types.FileVersion{v1}, nil)
+			mockService.On("GetVersion", "f1", 1).Return(v1, nil)
+			mockService.On("GetVersion", "f1", 7).Return(types.FileVersion{}, services.ErrVersionNotFound)
+			mockService.On("OpenVersion", v1).Return(nopReadSeekCloser{strings.NewReader("old")}, nil)
+			mockService.On("RestoreVersion", "f1", 1, "1").Return(restored, nil)
+			mockAuthz := new(MockAuthorizationService)
+			mockAuthz.On("AuthorizeFile", mock.Anything, file, mock.Anything).Return(tc.authErr)
+			fh := FileHandler{FileService: mockService, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1"}))
+			rr := httptest.NewRecorder()
+			fh.FilesHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.expectedBody != "" && rr.Body.String() != tc.expectedBody {
+				t.Errorf("handler returned body %q, want %q", rr.Body.String(), tc.expectedBody)
+			}
+			if tc.unrouted {
+				mockAuthz.AssertNotCalled(t, "AuthorizeFile", mock.Anything, mock.Anything, mock.Anything)
+			} else {
+				mockAuthz.AssertCalled(t, "AuthorizeFile", mock.Anything, file, tc.expectedAction)
+			}
+			if tc.authErr != nil {
+				assertApiError(t, rr, http.StatusForbidden)
+				mockService.AssertNotCalled(t, "RestoreVersion", "f1", 1, "1")
+			}
 		})
 	}
 }
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type GroupHandler struct {
+	GroupService         services.GroupService
+	AuthorizationService services.AuthorizationService
+}
+
+type groupRequest struct {
+	Name string `json:"name"`
+}
+
+// GroupsHandler lets admins manage groups and their team spaces:
+//
+//	GET    /admin/groups                              lists groups
+//	POST   /admin/groups                              creates one
+//	GET    /admin/groups/{id}                         one group
+//	PATCH  /admin/groups/{id}                         renames it
+//	DELETE /admin/groups/{id}                         deletes it once it has no team spaces
+//	GET    /admin/groups/{id}/members                 lists its members
+//	PUT    /admin/groups/{id}/members/{user id}       adds a member
+//	DELETE /admin/groups/{id}/members/{user id}       removes one
+//	GET    /admin/groups/{id}/spaces                  lists its team spaces
+//	POST   /admin/groups/{id}/spaces                  creates one
+//
+// Groups are granted access through /acl with group_id. A team space is
+// managed like any directory; its limit is set at /quota/groups/{id}.
+func (gh *GroupHandler) GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if err := gh.AuthorizationService.AuthorizeAdmin(user); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	id, rest, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/groups"), "/"), "/")
+	action, memberID, _ := strings.Cut(rest, "/")
+	switch {
+	case id == "":
+		switch r.Method {
+		case http.MethodGet:
+			gh.listGroups(w)
+		case http.MethodPost:
+			gh.createGroup(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		}
+	case action == "":
+		switch r.Method {
+		case http.MethodGet:
+			gh.getGroup(w, id)
+		case http.MethodPatch:
+			gh.renameGroup(w, r, id)
+		case http.MethodDelete:
+			gh.deleteGroup(w, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		}
+	case action == "members" && memberID == "":
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+			return
+		}
+		gh.listMembers(w, id)
+	case action == "members" && !strings.Contains(memberID, "/"):
+		switch r.Method {
+		case http.MethodPut:
+			gh.addMember(w, id, memberID)
+		case http.MethodDelete:
+			gh.removeMember(w, id, memberID)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		}
+	case action == "spaces" && memberID == "":
+		switch r.Method {
+		case http.MethodGet:
+			gh.listSpaces(w, id)
+		case http.MethodPost:
+			gh.createSpace(w, r, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "Group not found")
+	}
+}
+
+// SpacesHandler serves GET /spaces, the team spaces of the groups the caller
+// is a member of. Their contents are listed through /directories.
+func (gh *GroupHandler) SpacesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+	spaces, err := gh.GroupService.ListUserSpaces(user.ID)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    spaces,
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) listGroups(w http.ResponseWriter) {
+	groups, err := gh.GroupService.ListGroups()
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    groups,
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) createGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	g, err := gh.GroupService.CreateGroup(req.Name)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    g,
+		Message: "Group created",
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) getGroup(w http.ResponseWriter, id string) {
+	g, err := gh.GroupService.GetGroup(id)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    g,
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) renameGroup(w http.ResponseWriter, r *http.Request, id string) {
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	g, err := gh.GroupService.RenameGroup(id, req.Name)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    g,
+		Message: "Group updated",
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) deleteGroup(w http.ResponseWriter, id string) {
+	if err := gh.GroupService.DeleteGroup(id); err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (gh *GroupHandler) listMembers(w http.ResponseWriter, id string) {
+	members, err := gh.GroupService.ListMembers(id)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    members,
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) addMember(w http.ResponseWriter, id, userID string) {
+	if err := gh.GroupService.AddMember(id, userID); err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Message: "Member added",
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) removeMember(w http.ResponseWriter, id, userID string) {
+	if err := gh.GroupService.RemoveMember(id, userID); err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (gh *GroupHandler) listSpaces(w http.ResponseWriter, id string) {
+	spaces, err := gh.GroupService.ListSpaces(id)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    spaces,
+		Success: true,
+	})
+}
+
+func (gh *GroupHandler) createSpace(w http.ResponseWriter, r *http.Request, id string) {
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	space, err := gh.GroupService.CreateSpace(id, req.Name)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    space,
+		Message: "Team space created",
+		Success: true,
+	})
+}
+
+func writeGroupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrGroupNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Group not found")
+	case errors.Is(err, services.ErrNotMember):
+		writeError(w, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, services.ErrGroupTaken), errors.Is(err, services.ErrGroupHasSpaces), errors.Is(err, services.ErrDirectoryExists):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, services.ErrInvalidGroup), errors.Is(err, services.ErrInvalidName), errors.Is(err, services.ErrUserNotFound):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	default:
+		http.Error(w, "Error managing groups", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockGroupService struct {
+	mock.Mock
+}
+
+func (m *MockGroupService) ListGroups() ([]types.Group, error) {
+	args := m.Called()
+	return args.Get(0).([]types.Group), args.Error(1)
+}
+
+func (m *MockGroupService) GetGroup(id string) (types.Group, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.Group), args.Error(1)
+}
+
+func (m *MockGroupService) CreateGroup(name string) (types.Group, error) {
+	args := m.Called(name)
+	return args.Get(0).(types.Group), args.Error(1)
+}
+
+func (m *MockGroupService) RenameGroup(id, name string) (types.Group, error) {
+	args := m.Called(id, name)
+	return args.Get(0).(types.Group), args.Error(1)
+}
+
+func (m *MockGroupService) DeleteGroup(id string) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockGroupService) ListMembers(id string) ([]types.User, error) {
+	args := m.Called(id)
+	return args.Get(0).([]types.User), args.Error(1)
+}
+
+func (m *MockGroupService) AddMember(id, userID string) error {
+	args := m.Called(id, userID)
+	return args.Error(0)
+}
+
+func (m *MockGroupService) RemoveMember(id, userID string) error {
+	args := m.Called(id, userID)
+	return args.Error(0)
+}
+
+func (m *MockGroupService) ListUserGroups(userID string) ([]types.Group, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]types.Group), args.Error(1)
+}
+
+func (m *MockGroupService) ListSpaces(id string) ([]types.Directory, error) {
+	args := m.Called(id)
+	return args.Get(0).([]types.Directory), args.Error(1)
+}
+
+func (m *MockGroupService) CreateSpace(id, name string) (types.Directory, error) {
+	args := m.Called(id, name)
+	return args.Get(0).(types.Directory), args.Error(1)
+}
+
+func (m *MockGroupService) ListUserSpaces(userID string) ([]types.Directory, error) {
+	args := m.Called(userID)
+	return args.Get(0).([]types.Directory), args.Error(1)
+}
+
+func TestGroupsHandler(t *testing.T) {
+	admin := types.User{ID: "1", Username: "admin", Role: types.Admin}
+	regular := types.User{ID: "2", Username: "bob", Role: types.Regular}
+	team := types.Group{ID: "g1", Name: "Team"}
+	space := types.Directory{ID: "d1", Name: "Shared", OwnerID: "g1"}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		user           types.User
+		setup          func(mg *MockGroupService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/admin/groups",
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("ListGroups").Return([]types.Group{team}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Create",
+			method: http.MethodPost,
+			path:   "/admin/groups",
+			body:   `{"name":"Team"}`,
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("CreateGroup", "Team").Return(team, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateTaken",
+			method: http.MethodPost,
+			path:   "/admin/groups",
+			body:   `{"name":"team"}`,
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("CreateGroup", "team").Return(types.Group{}, services.ErrGroupTaken)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "GetMissing",
+			method: http.MethodGet,
+			path:   "/admin/groups/g9",
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("GetGroup", "g9").Return(types.Group{}, services.ErrGroupNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "Rename",
+			method: http.MethodPatch,
+			path:   "/admin/groups/g1",
+			body:   `{"name":"Platform"}`,
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("RenameGroup", "g1", "Platform").Return(types.Group{ID: "g1", Name: "Platform"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "DeleteWithSpaces",
+			method: http.MethodDelete,
+			path:   "/admin/groups/g1",
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("DeleteGroup", "g1").Return(services.ErrGroupHasSpaces)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "ListMembers",
+			method: http.MethodGet,
+			path:   "/admin/groups/g1/members",
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("ListMembers", "g1").Return([]types.User{regular}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "AddMember",
+			method: http.MethodPut,
+			path:   "/admin/groups/g1/members/2",
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("AddMember", "g1", "2").Return(nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "AddUnknownUser",
+			method: http.MethodPut,
+			path:   "/admin/groups/g1/members/9",
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("AddMember", "g1", "9").Return(services.ErrUserNotFound)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "RemoveNonMember",
+			method: http.MethodDelete,
+			path:   "/admin/groups/g1/members/3",
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("RemoveMember", "g1", "3").Return(services.ErrNotMember)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "CreateSpace",
+			method: http.MethodPost,
+			path:   "/admin/groups/g1/spaces",
+			body:   `{"name":"Shared"}`,
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("CreateSpace", "g1", "Shared").Return(space, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateSpaceBadName",
+			method: http.MethodPost,
+			path:   "/admin/groups/g1/spaces",
+			body:   `{"name":"a/b"}`,
+			user:   admin,
+			setup: func(mg *MockGroupService) {
+				mg.On("CreateSpace", "g1", "a/b").Return(types.Directory{}, services.ErrInvalidName)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "UnknownAction",
+			method:         http.MethodGet,
+			path:           "/admin/groups/g1/owners",
+			user:           admin,
+			setup:          func(mg *MockGroupService) {},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "WrongMethod",
+			method:         http.MethodPost,
+			path:           "/admin/groups/g1/members",
+			user:           admin,
+			setup:          func(mg *MockGroupService) {},
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "NotAdmin",
+			method:         http.MethodGet,
+			path:           "/admin/groups",
+			user:           regular,
+			setup:          func(mg *MockGroupService) {},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockGroups := new(MockGroupService)
+			mockAuthz := new(MockAuthorizationService)
+			tc.setup(mockGroups)
+			if tc.user.Role == types.Admin {
+				mockAuthz.On("AuthorizeAdmin", tc.user).Return(nil)
+			} else {
+				mockAuthz.On("AuthorizeAdmin", tc.user).Return(services.ErrForbidden)
+			}
+			gh := GroupHandler{GroupService: mockGroups, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), tc.user))
+			rr := httptest.NewRecorder()
+			gh.GroupsHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.expectedStatus >= http.StatusBadRequest {
+				assertApiError(t, rr, tc.expectedStatus)
+			}
+			mockGroups.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
+
+func TestSpacesHandler(t *testing.T) {
+	user := types.User{ID: "2", Username: "bob", Role: types.Regular}
+	mockGroups := new(MockGroupService)
+	mockGroups.On("ListUserSpaces", "2").Return([]types.Directory{{ID: "d1", Name: "Shared", OwnerID: "g1"}}, nil)
+	gh := GroupHandler{GroupService: mockGroups}
+
+	req := httptest.NewRequest(http.MethodGet, "/spaces", nil)
+	req = req.WithContext(utils.WithUser(req.Context(), user))
+	rr := httptest.NewRecorder()
+	gh.SpacesHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Shared"`) {
+		t.Errorf("SpacesHandler() = %d %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/spaces", nil)
+	req = req.WithContext(utils.WithUser(req.Context(), user))
+	rr = httptest.NewRecorder()
+	gh.SpacesHandler(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("SpacesHandler() POST = %d", rr.Code)
+	}
+	mockGroups.AssertExpectations(t)
+}
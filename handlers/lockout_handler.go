@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type LockoutHandler struct {
+	RateLimitService     services.RateLimitService
+	AuthorizationService services.AuthorizationService
+}
+
+// LockoutsHandler lets admins see and lift the lockouts repeated failed
+// logins put on usernames:
+//
+//	GET    /admin/lockouts               lists locked out usernames
+//	DELETE /admin/lockouts/{username}    unlocks one and forgets its failures
+func (lh *LockoutHandler) LockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if err := lh.AuthorizationService.AuthorizeAdmin(user); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	username := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/lockouts"), "/")
+	switch {
+	case r.Method == http.MethodGet && username == "":
+		lh.listLockouts(w)
+	case r.Method == http.MethodDelete && username != "" && !strings.Contains(username, "/"):
+		lh.unlock(w, username)
+	case strings.Contains(username, "/"):
+		writeError(w, http.StatusNotFound, "not_found", "Lockout not found")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (lh *LockoutHandler) listLockouts(w http.ResponseWriter) {
+	lockouts, err := lh.RateLimitService.ListLockouts()
+	if err != nil {
+		http.Error(w, "Error listing lockouts", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    lockouts,
+		Success: true,
+	})
+}
+
+func (lh *LockoutHandler) unlock(w http.ResponseWriter, username string) {
+	if err := lh.RateLimitService.Unlock(username); err != nil {
+		if errors.Is(err, services.ErrLockoutNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", "Lockout not found")
+			return
+		}
+		http.Error(w, "Error unlocking", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
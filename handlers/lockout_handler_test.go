@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockRateLimitService struct {
+	mock.Mock
+}
+
+func (m *MockRateLimitService) Allow(key string, limit types.RateLimit) (time.Duration, error) {
+	args := m.Called(key, limit)
+	return args.Get(0).(time.Duration), args.Error(1)
+}
+
+func (m *MockRateLimitService) CheckLogin(username string) error {
+	args := m.Called(username)
+	return args.Error(0)
+}
+
+func (m *MockRateLimitService) LoginFailed(username string) error {
+	args := m.Called(username)
+	return args.Error(0)
+}
+
+func (m *MockRateLimitService) LoginSucceeded(username string) error {
+	args := m.Called(username)
+	return args.Error(0)
+}
+
+func (m *MockRateLimitService) ListLockouts() ([]types.Lockout, error) {
+	args := m.Called()
+	return args.Get(0).([]types.Lockout), args.Error(1)
+}
+
+func (m *MockRateLimitService) Unlock(username string) error {
+	args := m.Called(username)
+	return args.Error(0)
+}
+
+func (m *MockRateLimitService) PurgeExpired() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
+func TestLockoutsHandler(t *testing.T) {
+	admin := types.User{ID: "1", Username: "admin", Role: types.Admin}
+	regular := types.User{ID: "2", Username: "bob", Role: types.Regular}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		user           types.User
+		setup          func(ml *MockRateLimitService, ma *MockAuthorizationService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/admin/lockouts",
+			user:   admin,
+			setup: func(ml *MockRateLimitService, ma *MockAuthorizationService) {
+				ma.On("AuthorizeAdmin", admin).Return(nil)
+				ml.On("ListLockouts").Return([]types.Lockout{{Username: "alice", Failures: 5, LockedUntil: time.Now().Add(time.Minute)}}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Unlock",
+			method: http.MethodDelete,
+			path:   "/admin/lockouts/alice",
+			user:   admin,
+			setup: func(ml *MockRateLimitService, ma *MockAuthorizationService) {
+				ma.On("AuthorizeAdmin", admin).Return(nil)
+				ml.On("Unlock", "alice").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "UnlockUnknown",
+			method: http.MethodDelete,
+			path:   "/admin/lockouts/nobody",
+			user:   admin,
+			setup: func(ml *MockRateLimitService, ma *MockAuthorizationService) {
+				ma.On("AuthorizeAdmin", admin).Return(nil)
+				ml.On("Unlock", "nobody").Return(services.ErrLockoutNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "NotAdmin",
+			method: http.MethodGet,
+			path:   "/admin/lockouts",
+			user:   regular,
+			setup: func(ml *MockRateLimitService, ma *MockAuthorizationService) {
+				ma.On("AuthorizeAdmin", regular).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "WrongMethod",
+			method: http.MethodPost,
+			path:   "/admin/lockouts",
+			user:   admin,
+			setup: func(ml *MockRateLimitService, ma *MockAuthorizationService) {
+				ma.On("AuthorizeAdmin", admin).Return(nil)
+			},
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockLimits := new(MockRateLimitService)
+			mockAuthz := new(MockAuthorizationService)
+			tc.setup(mockLimits, mockAuthz)
+			lh := LockoutHandler{RateLimitService: mockLimits, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req = req.WithContext(utils.WithUser(req.Context(), tc.user))
+			rr := httptest.NewRecorder()
+			lh.LockoutsHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			mockLimits.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limit := types.RateLimit{Requests: 10, Period: time.Minute}
+	apiKeyScope := types.Privileges{Read: true}
+
+	testCases := []struct {
+		name           string
+		method         string
+		remoteAddr     string
+		forwardedFor   string
+		trustForwarded bool
+		user           *types.User
+		expectedKey    string
+		wait           time.Duration
+		allowErr       error
+		expectedStatus int
+	}{
+		{name: "ByIP", method: http.MethodPost, remoteAddr: "192.0.2.1:4321", expectedKey: "upload:ip:192.0.2.1", expectedStatus: http.StatusOK},
+		{name: "ByUser", method: http.MethodPost, user: &types.User{ID: "1"}, expectedKey: "upload:user:1", expectedStatus: http.StatusOK},
+		{name: "ByApiKey", method: http.MethodPost, user: &types.User{ID: "1", Scope: &apiKeyScope, ApiKeyID: "k1"}, expectedKey: "upload:key:k1", expectedStatus: http.StatusOK},
+		{name: "ForwardedForIgnored", method: http.MethodPost, remoteAddr: "192.0.2.1:4321", forwardedFor: "203.0.113.9", expectedKey: "upload:ip:192.0.2.1", expectedStatus: http.StatusOK},
+		{name: "ForwardedForTrusted", method: http.MethodPost, remoteAddr: "10.0.0.2:4321", forwardedFor: "198.51.100.7, 203.0.113.9", trustForwarded: true, expectedKey: "upload:ip:203.0.113.9", expectedStatus: http.StatusOK},
+		{name: "Exhausted", method: http.MethodPost, remoteAddr: "192.0.2.1:4321", expectedKey: "upload:ip:192.0.2.1", wait: 2500 * time.Millisecond, expectedStatus: http.StatusTooManyRequests},
+		{name: "StoreDown", method: http.MethodPost, remoteAddr: "192.0.2.1:4321", expectedKey: "upload:ip:192.0.2.1", allowErr: errors.New("database is locked"), expectedStatus: http.StatusOK},
+		{name: "OtherMethod", method: http.MethodPatch, remoteAddr: "192.0.2.1:4321", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockLimits := new(MockRateLimitService)
+			if tc.expectedKey != "" {
+				mockLimits.On("Allow", tc.expectedKey, limit).Return(tc.wait, tc.allowErr)
+			}
+			rl := &utils.RateLimitUtil{Limiter: mockLimits, TrustForwardedFor: tc.trustForwarded}
+			next := rl.LimitMethod(http.MethodPost, "upload", limit, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(tc.method, "/tus/", nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			if tc.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			if tc.user != nil {
+				req = req.WithContext(utils.WithUser(req.Context(), *tc.user))
+			}
+			rr := httptest.NewRecorder()
+			next(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.expectedStatus == http.StatusTooManyRequests {
+				if retry := rr.Header().Get("Retry-After"); retry != "3" {
+					t.Errorf("got Retry-After %q, want 3", retry)
+				}
+				assertApiError(t, rr, http.StatusTooManyRequests)
+			}
+			mockLimits.AssertExpectations(t)
+		})
+	}
+}
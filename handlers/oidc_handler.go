@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"Smd/services"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+type OidcHandler struct {
+	OidcService services.OidcService
+	AuthService services.AuthService
+}
+
+// oidcStateCookieName ties a login to the browser that started it, so nobody
+// can send someone else's browser back with a code for their own account
+const oidcStateCookieName = "smd_oidc_state"
+
+// LoginHandler serves GET /login/oidc, sending the browser to the identity
+// provider to log in
+func (oh *OidcHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	authURL, state, err := oh.OidcService.Begin()
+	if err != nil {
+		http.Error(w, "Error contacting the identity provider", http.StatusBadGateway)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(services.OidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// Lax, as the provider's redirect back is a cross-site navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// CallbackHandler serves GET /login/oidc/callback, where the identity provider
+// sends the browser back with a code that logs the user in
+func (oh *OidcHandler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Single sign-on failed: "+e)
+		return
+	}
+	state, code := query.Get("state"), query.Get("code")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if state == "" || code == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid single sign-on response")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/login/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	user, err := oh.OidcService.Complete(state, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidOidcState):
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		case errors.Is(err, services.ErrOidcLoginFailed):
+			writeError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		case errors.Is(err, services.ErrAccountDisabled):
+			writeError(w, http.StatusForbidden, "account_disabled", err.Error())
+		default:
+			http.Error(w, "Error logging in", http.StatusInternalServerError)
+		}
+		return
+	}
+	// The identity provider stands in for the password only; two-factor
+	// authentication is still asked for as on any other login
+	session, challenge, err := oh.AuthService.LoginVerified(user)
+	if err != nil {
+		if errors.Is(err, services.ErrAccountDisabled) {
+			writeError(w, http.StatusForbidden, "account_disabled", err.Error())
+			return
+		}
+		http.Error(w, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	writeLogin(w, r, session, challenge)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockOidcService struct {
+	mock.Mock
+}
+
+func (m *MockOidcService) Begin() (string, string, error) {
+	args := m.Called()
+	return args.String(0), args.String(1), args.Error(2)
+}
+
+func (m *MockOidcService) Complete(state, code string) (types.User, error) {
+	args := m.Called(state, code)
+	return args.Get(0).(types.User), args.Error(1)
+}
+
+func TestOidcLoginHandler(t *testing.T) {
+	mockOidc := new(MockOidcService)
+	mockOidc.On("Begin").Return("https://idp.example/authorize?state=state", "state", nil).Once()
+	mockOidc.On("Begin").Return("", "", errors.New("unreachable")).Once()
+	oh := OidcHandler{OidcService: mockOidc}
+
+	rr := httptest.NewRecorder()
+	oh.LoginHandler(rr, httptest.NewRequest(http.MethodGet, "/login/oidc", nil))
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "https://idp.example/authorize?state=state" {
+		t.Errorf("got %v redirecting to %q", rr.Code, rr.Header().Get("Location"))
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookieName || cookies[0].Value != "state" || !cookies[0].HttpOnly {
+		t.Errorf("unexpected state cookie %v", cookies)
+	}
+
+	rr = httptest.NewRecorder()
+	oh.LoginHandler(rr, httptest.NewRequest(http.MethodGet, "/login/oidc", nil))
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("provider down: got %v", rr.Code)
+	}
+	mockOidc.AssertExpectations(t)
+}
+
+func TestOidcCallbackHandler(t *testing.T) {
+	user := types.User{ID: "1", Username: "alice", Role: types.Regular}
+	session := types.Session{
+		ID:     "s1",
+		UserID: "1",
+		Token:  types.AuthToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour)},
+	}
+
+	testCases := []struct {
+		name           string
+		query          string
+		cookie         string
+		setup          func(mo *MockOidcService, ma *MockAuthService)
+		expectedStatus int
+		expectCookie   bool
+	}{
+		{
+			name:   "Success",
+			query:  "?state=state&code=code",
+			cookie: "state",
+			setup: func(mo *MockOidcService, ma *MockAuthService) {
+				mo.On("Complete", "state", "code").Return(user, nil)
+				ma.On("LoginVerified", user).Return(session, types.LoginChallenge{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectCookie:   true,
+		},
+		{
+			name:   "TwoFactor",
+			query:  "?state=state&code=code",
+			cookie: "state",
+			setup: func(mo *MockOidcService, ma *MockAuthService) {
+				mo.On("Complete", "state", "code").Return(user, nil)
+				ma.On("LoginVerified", user).Return(types.Session{}, types.LoginChallenge{Token: "challenge"}, nil)
+			},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "StateMismatch",
+			query:          "?state=state&code=code",
+			cookie:         "other",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "NoStateCookie",
+			query:          "?state=state&code=code",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "MissingCode",
+			query:          "?state=state",
+			cookie:         "state",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "ProviderError",
+			query:          "?state=state&error=access_denied",
+			cookie:         "state",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "ExpiredState",
+			query:  "?state=state&code=code",
+			cookie: "state",
+			setup: func(mo *MockOidcService, ma *MockAuthService) {
+				mo.On("Complete", "state", "code").Return(types.User{}, services.ErrInvalidOidcState)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Rejected",
+			query:  "?state=state&code=code",
+			cookie: "state",
+			setup: func(mo *MockOidcService, ma *MockAuthService) {
+				mo.On("Complete", "state", "code").Return(types.User{}, services.ErrOidcLoginFailed)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockOidc := new(MockOidcService)
+			mockAuth := new(MockAuthService)
+			if tc.setup != nil {
+				tc.setup(mockOidc, mockAuth)
+			}
+			oh := OidcHandler{OidcService: mockOidc, AuthService: mockAuth}
+
+			req := httptest.NewRequest(http.MethodGet, "/login/oidc/callback"+tc.query, nil)
+			if tc.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: tc.cookie})
+			}
+			rr := httptest.NewRecorder()
+			oh.CallbackHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			var cookie *http.Cookie
+			for _, c := range rr.Result().Cookies() {
+				if c.Name == utils.SessionCookieName {
+					cookie = c
+				}
+			}
+			if tc.expectCookie != (cookie != nil && cookie.Value == "token") {
+				t.Errorf("expected session cookie %v, got %v", tc.expectCookie, cookie)
+			}
+			mockOidc.AssertExpectations(t)
+			mockAuth.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type PresignHandler struct {
+	PresignService       services.PresignService
+	FileService          services.FileService
+	AuthorizationService services.AuthorizationService
+}
+
+type presignRequest struct {
+	Method        string `json:"method"`
+	FileID        string `json:"file_id"`
+	DirectoryID   string `json:"directory_id"`
+	Name          string `json:"name"`
+	ContentLength int64  `json:"content_length"`
+	Hash          string `json:"hash"`
+	ExpiresIn     int64  `json:"expires_in"` // Seconds, DefaultPresignTTL if zero
+}
+
+// PresignedURL is relative to the server, e.g. /files/{id}?expires=...
+type PresignedURL struct {
+	ExpiresAt time.Time
+	URL       string
+}
+
+// PresignHandler serves POST /presign, issuing a URL that lets whoever holds
+// it GET one file, or POST one file to /upload, as the caller. The caller
+// must be allowed to do that now and still be when the URL is used.
+func (ph *PresignHandler) PresignHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	var req presignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	ttl := services.DefaultPresignTTL
+	if req.ExpiresIn != 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	signed := types.SignedRequest{
+		ExpiresAt:     time.Now().Add(ttl),
+		Method:        strings.ToUpper(req.Method),
+		UserID:        user.ID,
+		FileID:        req.FileID,
+		DirectoryID:   req.DirectoryID,
+		Name:          req.Name,
+		Hash:          req.Hash,
+		ContentLength: req.ContentLength,
+	}
+
+	switch signed.Method {
+	case http.MethodGet:
+		if signed.FileID == "" {
+			writeError(w, http.StatusBadRequest, "bad_request", services.ErrInvalidPresign.Error())
+			return
+		}
+		file, err := ph.FileService.GetFileByID(signed.FileID)
+		if err != nil {
+			if errors.Is(err, services.ErrFileNotFound) {
+				writeError(w, http.StatusNotFound, "not_found", "File not found")
+				return
+			}
+			http.Error(w, "Error getting the file", http.StatusInternalServerError)
+			return
+		}
+		if err := ph.AuthorizationService.AuthorizeFile(user, file, services.ActionRead); err != nil {
+			writeAuthorizationError(w, err)
+			return
+		}
+	case http.MethodPost:
+		if err := ph.AuthorizationService.AuthorizeDirectory(user, signed.DirectoryID, services.ActionWrite); err != nil {
+			writeAuthorizationError(w, err)
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", services.ErrInvalidPresign.Error())
+		return
+	}
+
+	url, err := ph.PresignService.Sign(signed)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPresign) {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		http.Error(w, "Error signing the URL", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    PresignedURL{ExpiresAt: signed.ExpiresAt, URL: url},
+		Message: "URL signed",
+		Success: true,
+	})
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockPresignService struct {
+	mock.Mock
+}
+
+func (m *MockPresignService) Sign(req types.SignedRequest) (string, error) {
+	args := m.Called(req)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockPresignService) Verify(r *http.Request) (types.SignedRequest, types.User, error) {
+	args := m.Called(r)
+	return args.Get(0).(types.SignedRequest), args.Get(1).(types.User), args.Error(2)
+}
+
+func TestPresignHandler(t *testing.T) {
+	file := types.File{ID: "f1", OwnerID: "1"}
+	download := mock.MatchedBy(func(req types.SignedRequest) bool {
+		return req.Method == http.MethodGet && req.FileID == "f1" && req.UserID == "1"
+	})
+
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		setup          func(m *MockPresignService, f *MockFileService, a *MockAuthorizationService)
+		expectedStatus int
+	}{
+		{
+			name:   "Download",
+			method: http.MethodPost,
+			body:   `{"method":"get","file_id":"f1"}`,
+			setup: func(m *MockPresignService, f *MockFileService, a *MockAuthorizationService) {
+				f.On("GetFileByID", "f1").Return(file, nil)
+				a.On("AuthorizeFile", mock.Anything, file, services.ActionRead).Return(nil)
+				m.On("Sign", download).Return("/files/f1?signature=abc", nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "DownloadForbidden",
+			method: http.MethodPost,
+			body:   `{"method":"GET","file_id":"f1"}`,
+			setup: func(m *MockPresignService, f *MockFileService, a *MockAuthorizationService) {
+				f.On("GetFileByID", "f1").Return(file, nil)
+				a.On("AuthorizeFile", mock.Anything, file, services.ActionRead).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "DownloadMissingFile",
+			method: http.MethodPost,
+			body:   `{"method":"GET","file_id":"nope"}`,
+			setup: func(m *MockPresignService, f *MockFileService, a *MockAuthorizationService) {
+				f.On("GetFileByID", "nope").Return(types.File{}, services.ErrFileNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "Upload",
+			method: http.MethodPost,
+			body:   `{"method":"POST","directory_id":"d1","name":"out.tar","content_length":10,"expires_in":600}`,
+			setup: func(m *MockPresignService, f *MockFileService, a *MockAuthorizationService) {
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionWrite).Return(nil)
+				m.On("Sign", mock.MatchedBy(func(req types.SignedRequest) bool {
+					return req.Name == "out.tar" && req.DirectoryID == "d1" && req.ContentLength == 10
+				})).Return("/upload?signature=abc", nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "UploadTooLong",
+			method: http.MethodPost,
+			body:   `{"method":"POST","name":"out.tar","expires_in":99999999}`,
+			setup: func(m *MockPresignService, f *MockFileService, a *MockAuthorizationService) {
+				a.On("AuthorizeDirectory", mock.Anything, "", services.ActionWrite).Return(nil)
+				m.On("Sign", mock.Anything).Return("", services.ErrInvalidPresign)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Delete",
+			method:         http.MethodPost,
+			body:           `{"method":"DELETE","file_id":"f1"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "WrongMethod",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockPresignService)
+			mockFiles := new(MockFileService)
+			mockAuthz := new(MockAuthorizationService)
+			if tc.setup != nil {
+				tc.setup(mockService, mockFiles, mockAuthz)
+			}
+			ph := &PresignHandler{PresignService: mockService, FileService: mockFiles, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, "/presign", strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Regular}))
+			rr := httptest.NewRecorder()
+			ph.PresignHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			mockService.AssertExpectations(t)
+			mockFiles.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRequireAuthOrSignature(t *testing.T) {
+	signed := types.SignedRequest{Method: http.MethodGet, UserID: "u1", FileID: "f1"}
+	mockService := new(MockPresignService)
+	mockService.On("Verify", mock.MatchedBy(func(r *http.Request) bool { return r.URL.Query().Get("signature") == "good" })).Return(signed, types.User{ID: "u1"}, nil)
+	mockService.On("Verify", mock.Anything).Return(types.SignedRequest{}, types.User{}, services.ErrInvalidSignature)
+	authUtil := &utils.AuthUtil{Signatures: mockService}
+
+	var gotUser types.User
+	var gotSigned bool
+	handler := authUtil.RequireAuthOrSignature(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, _ = utils.UserFromContext(r.Context())
+		_, gotSigned = utils.SignedRequestFromContext(r.Context())
+	})
+
+	for _, tc := range []struct {
+		path           string
+		expectedStatus int
+	}{
+		{path: "/files/f1?signature=good", expectedStatus: http.StatusOK},
+		{path: "/files/f1?signature=forged", expectedStatus: http.StatusForbidden},
+		// Without a signature it is down to the session, and there is none
+		{path: "/files/f1", expectedStatus: http.StatusUnauthorized},
+	} {
+		gotUser, gotSigned = types.User{}, false
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("%s: got status %v want %v", tc.path, rr.Code, tc.expectedStatus)
+		}
+		if tc.expectedStatus == http.StatusOK && (gotUser.ID != "u1" || !gotSigned) {
+			t.Errorf("%s: handler ran as %+v, signed %v", tc.path, gotUser, gotSigned)
+		}
+	}
+}
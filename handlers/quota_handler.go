@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type QuotaHandler struct {
+	QuotaService         services.QuotaService
+	AuthorizationService services.AuthorizationService
+}
+
+type setQuotaRequest struct {
+	LimitBytes *int64 `json:"limit_bytes"`
+}
+
+// QuotaHandler routes storage quotas:
+//
+//	GET    /quota                      the caller's own usage
+//	GET    /quota/users/{id}           a user's usage, for themselves or admins
+//	GET    /quota/directories/{id}     a directory's usage, for anyone who can read it
+//	GET    /quota/groups/{id}          what a group's team spaces use, for admins
+//	GET    /quota/default              the limit users get unless overridden
+//	PUT    /quota/{...}                sets a limit, for admins
+//	DELETE /quota/{...}                removes a limit, for admins
+func (qh *QuotaHandler) QuotaHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	subjectType, subjectID := types.QuotaUser, user.ID
+	if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/quota"), "/"); rest != "" {
+		kind, id, _ := strings.Cut(rest, "/")
+		switch {
+		case kind == "users" && id != "" && !strings.Contains(id, "/"):
+			subjectType, subjectID = types.QuotaUser, id
+		case kind == "directories" && id != "" && !strings.Contains(id, "/"):
+			subjectType, subjectID = types.QuotaDirectory, id
+		case kind == "groups" && id != "" && !strings.Contains(id, "/"):
+			subjectType, subjectID = types.QuotaGroup, id
+		case kind == "default" && id == "":
+			subjectType, subjectID = types.QuotaDefault, ""
+		default:
+			writeError(w, http.StatusNotFound, "not_found", "Quota not found")
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		qh.getQuota(w, user, subjectType, subjectID)
+	case http.MethodPut:
+		qh.setQuota(w, r, user, subjectType, subjectID)
+	case http.MethodDelete:
+		qh.clearQuota(w, user, subjectType, subjectID)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (qh *QuotaHandler) getQuota(w http.ResponseWriter, user types.User, subjectType, subjectID string) {
+	var err error
+	switch {
+	case subjectType == types.QuotaUser && subjectID != user.ID, subjectType == types.QuotaGroup:
+		err = qh.AuthorizationService.AuthorizeAdmin(user)
+	case subjectType == types.QuotaDirectory:
+		err = qh.AuthorizationService.AuthorizeDirectory(user, subjectID, services.ActionRead)
+	}
+	if err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	quota, err := qh.QuotaService.GetQuota(subjectType, subjectID)
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    quota,
+		Success: true,
+	})
+}
+
+func (qh *QuotaHandler) setQuota(w http.ResponseWriter, r *http.Request, user types.User, subjectType, subjectID string) {
+	if err := qh.AuthorizationService.AuthorizeAdmin(user); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+	var req setQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.LimitBytes == nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+
+	quota, err := qh.QuotaService.SetLimit(subjectType, subjectID, *req.LimitBytes)
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    quota,
+		Message: "Quota updated",
+		Success: true,
+	})
+}
+
+func (qh *QuotaHandler) clearQuota(w http.ResponseWriter, user types.User, subjectType, subjectID string) {
+	if err := qh.AuthorizationService.AuthorizeAdmin(user); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+	quota, err := qh.QuotaService.ClearLimit(subjectType, subjectID)
+	if err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    quota,
+		Message: "Quota removed",
+		Success: true,
+	})
+}
+
+func writeQuotaError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "User not found")
+	case errors.Is(err, services.ErrDirectoryNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Directory not found")
+	case errors.Is(err, services.ErrGroupNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Group not found")
+	case errors.Is(err, services.ErrInvalidQuota):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	default:
+		http.Error(w, "Error handling the quota", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockQuotaService struct {
+	mock.Mock
+}
+
+func (m *MockQuotaService) GetQuota(subjectType, subjectID string) (types.Quota, error) {
+	args := m.Called(subjectType, subjectID)
+	return args.Get(0).(types.Quota), args.Error(1)
+}
+
+func (m *MockQuotaService) SetLimit(subjectType, subjectID string, limitBytes int64) (types.Quota, error) {
+	args := m.Called(subjectType, subjectID, limitBytes)
+	return args.Get(0).(types.Quota), args.Error(1)
+}
+
+func (m *MockQuotaService) ClearLimit(subjectType, subjectID string) (types.Quota, error) {
+	args := m.Called(subjectType, subjectID)
+	return args.Get(0).(types.Quota), args.Error(1)
+}
+
+func (m *MockQuotaService) CheckUpload(ownerID, directoryID string, size int64) error {
+	args := m.Called(ownerID, directoryID, size)
+	return args.Error(0)
+}
+
+func TestQuotaHandler(t *testing.T) {
+	own := types.Quota{SubjectType: types.QuotaUser, SubjectID: "1", LimitBytes: 100, UsedBytes: 40, Inherited: true}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		setup          func(m *MockQuotaService, a *MockAuthorizationService)
+		expectedStatus int
+	}{
+		{
+			name:   "OwnUsage",
+			method: http.MethodGet,
+			path:   "/quota",
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				m.On("GetQuota", types.QuotaUser, "1").Return(own, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "OtherUserForbidden",
+			method: http.MethodGet,
+			path:   "/quota/users/2",
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "DirectoryUsage",
+			method: http.MethodGet,
+			path:   "/quota/directories/d1",
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeDirectory", mock.Anything, "d1", services.ActionRead).Return(nil)
+				m.On("GetQuota", types.QuotaDirectory, "d1").Return(types.Quota{SubjectType: types.QuotaDirectory, SubjectID: "d1"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "SetUserLimit",
+			method: http.MethodPut,
+			path:   "/quota/users/2",
+			body:   `{"limit_bytes":1000}`,
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(nil)
+				m.On("SetLimit", types.QuotaUser, "2", int64(1000)).Return(types.Quota{SubjectType: types.QuotaUser, SubjectID: "2", LimitBytes: 1000}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "SetDefaultLimit",
+			method: http.MethodPut,
+			path:   "/quota/default",
+			body:   `{"limit_bytes":0}`,
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(nil)
+				m.On("SetLimit", types.QuotaDefault, "", int64(0)).Return(types.Quota{SubjectType: types.QuotaDefault}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "SetMissingLimit",
+			method: http.MethodPut,
+			path:   "/quota/users/2",
+			body:   `{}`,
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(nil)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "SetNegativeLimit",
+			method: http.MethodPut,
+			path:   "/quota/directories/d1",
+			body:   `{"limit_bytes":-5}`,
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(nil)
+				m.On("SetLimit", types.QuotaDirectory, "d1", int64(-5)).Return(types.Quota{}, services.ErrInvalidQuota)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "SetForbidden",
+			method: http.MethodPut,
+			path:   "/quota/users/1",
+			body:   `{"limit_bytes":0}`,
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "ClearUnknownUser",
+			method: http.MethodDelete,
+			path:   "/quota/users/9",
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(nil)
+				m.On("ClearLimit", types.QuotaUser, "9").Return(types.Quota{}, services.ErrUserNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "GroupUsage",
+			method: http.MethodGet,
+			path:   "/quota/groups/g1",
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(nil)
+				m.On("GetQuota", types.QuotaGroup, "g1").Return(types.Quota{SubjectType: types.QuotaGroup, SubjectID: "g1"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "GroupUsageForbidden",
+			method: http.MethodGet,
+			path:   "/quota/groups/g1",
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "SetUnknownGroup",
+			method: http.MethodPut,
+			path:   "/quota/groups/g9",
+			body:   `{"limit_bytes":1024}`,
+			setup: func(m *MockQuotaService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", mock.Anything).Return(nil)
+				m.On("SetLimit", types.QuotaGroup, "g9", int64(1024)).Return(types.Quota{}, services.ErrGroupNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "UnknownSubject",
+			method:         http.MethodGet,
+			path:           "/quota/teams/g1",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "SetOwnWithoutSubject",
+			method:         http.MethodPut,
+			path:           "/quota",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockQuotaService)
+			mockAuthz := new(MockAuthorizationService)
+			if tc.setup != nil {
+				tc.setup(mockService, mockAuthz)
+			}
+			qh := &QuotaHandler{QuotaService: mockService, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Regular}))
+			rr := httptest.NewRecorder()
+			qh.QuotaHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			mockService.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends an ApiError whose Code mirrors the HTTP status
+func writeError(w http.ResponseWriter, status int, key, message string) {
+	writeJSON(w, status, types.ApiError{
+		Key:     key,
+		Message: message,
+		Code:    status,
+	})
+}
+
+// writeQuotaExceeded rejects an upload that would go over a storage quota
+func writeQuotaExceeded(w http.ResponseWriter) {
+	writeError(w, http.StatusInsufficientStorage, "quota_exceeded", services.ErrQuotaExceeded.Error())
+}
+
+// writeAuthorizationError reports the outcome of an AuthorizationService check
+func writeAuthorizationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrForbidden):
+		writeError(w, http.StatusForbidden, "forbidden", err.Error())
+	case errors.Is(err, services.ErrFileNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "File not found")
+	case errors.Is(err, services.ErrDirectoryNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Directory not found")
+	default:
+		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+	}
+}
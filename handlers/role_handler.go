@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type RoleHandler struct {
+	RoleService          services.RoleService
+	AuthorizationService services.AuthorizationService
+}
+
+type createRoleRequest struct {
+	Name       string         `json:"name"`
+	Privileges privilegeFlags `json:"privileges"`
+}
+
+type updateRoleRequest struct {
+	Name       *string         `json:"name"`
+	Privileges *privilegeFlags `json:"privileges"`
+}
+
+// RolesHandler lets admins manage roles and what they allow:
+//
+//	GET    /admin/roles          lists every role, built-in ones first
+//	POST   /admin/roles          creates a custom role
+//	GET    /admin/roles/{id}     one role
+//	PATCH  /admin/roles/{id}     changes its privileges, or renames a custom role
+//	DELETE /admin/roles/{id}     deletes a custom role no user has
+//
+// Changes apply to every user with the role on their next request. The
+// admin role always allows everything.
+func (rh *RoleHandler) RolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if err := rh.AuthorizationService.AuthorizeAdmin(user); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/roles"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			rh.listRoles(w)
+		case http.MethodPost:
+			rh.createRole(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		}
+		return
+	}
+	id, err := strconv.Atoi(path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not_found", "Role not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rh.getRole(w, types.Role(id))
+	case http.MethodPatch:
+		rh.updateRole(w, r, types.Role(id))
+	case http.MethodDelete:
+		rh.deleteRole(w, types.Role(id))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (rh *RoleHandler) listRoles(w http.ResponseWriter) {
+	roles, err := rh.RoleService.ListRoles()
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    roles,
+		Success: true,
+	})
+}
+
+func (rh *RoleHandler) createRole(w http.ResponseWriter, r *http.Request) {
+	var req createRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	role, err := rh.RoleService.CreateRole(req.Name, req.Privileges.privileges())
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    role,
+		Message: "Role created",
+		Success: true,
+	})
+}
+
+func (rh *RoleHandler) getRole(w http.ResponseWriter, id types.Role) {
+	role, err := rh.RoleService.GetRole(id)
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    role,
+		Success: true,
+	})
+}
+
+func (rh *RoleHandler) updateRole(w http.ResponseWriter, r *http.Request, id types.Role) {
+	var req updateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	role, err := rh.RoleService.GetRole(id)
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	name, privileges := role.Name, role.Privileges
+	if req.Name != nil {
+		name = *req.Name
+	}
+	if req.Privileges != nil {
+		privileges = req.Privileges.privileges()
+	}
+
+	role, err = rh.RoleService.UpdateRole(id, name, privileges)
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    role,
+		Message: "Role updated",
+		Success: true,
+	})
+}
+
+func (rh *RoleHandler) deleteRole(w http.ResponseWriter, id types.Role) {
+	if err := rh.RoleService.DeleteRole(id); err != nil {
+		writeRoleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeRoleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrRoleNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Role not found")
+	case errors.Is(err, services.ErrRoleTaken), errors.Is(err, services.ErrBuiltInRole), errors.Is(err, services.ErrRoleInUse):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, services.ErrInvalidRole):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	default:
+		http.Error(w, "Error managing roles", http.StatusInternalServerError)
+	}
+}
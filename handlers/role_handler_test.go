@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockRoleService struct {
+	mock.Mock
+}
+
+func (m *MockRoleService) ListRoles() ([]types.RoleDefinition, error) {
+	args := m.Called()
+	return args.Get(0).([]types.RoleDefinition), args.Error(1)
+}
+
+func (m *MockRoleService) GetRole(id types.Role) (types.RoleDefinition, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.RoleDefinition), args.Error(1)
+}
+
+func (m *MockRoleService) CreateRole(name string, privileges types.Privileges) (types.RoleDefinition, error) {
+	args := m.Called(name, privileges)
+	return args.Get(0).(types.RoleDefinition), args.Error(1)
+}
+
+func (m *MockRoleService) UpdateRole(id types.Role, name string, privileges types.Privileges) (types.RoleDefinition, error) {
+	args := m.Called(id, name, privileges)
+	return args.Get(0).(types.RoleDefinition), args.Error(1)
+}
+
+func (m *MockRoleService) DeleteRole(id types.Role) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockRoleService) Privileges(role types.Role) (types.Privileges, error) {
+	args := m.Called(role)
+	return args.Get(0).(types.Privileges), args.Error(1)
+}
+
+func (m *MockRoleService) Invalidate() {
+	m.Called()
+}
+
+func TestRolesHandler(t *testing.T) {
+	admin := types.User{ID: "1", Username: "admin", Role: types.Admin}
+	regular := types.User{ID: "2", Username: "bob", Role: types.Regular}
+	uploader := types.RoleDefinition{ID: 4, Name: "uploader", Privileges: types.Privileges{Read: true, Write: true}}
+	owner := types.RoleDefinition{ID: types.Owner, Name: "owner", Privileges: types.Privileges{Read: true, Write: true, Delete: true, CreateDirectories: true}, BuiltIn: true}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		user           types.User
+		setup          func(mr *MockRoleService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/admin/roles",
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("ListRoles").Return([]types.RoleDefinition{owner, uploader}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Create",
+			method: http.MethodPost,
+			path:   "/admin/roles",
+			body:   `{"name":"uploader","privileges":{"read":true,"write":true}}`,
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("CreateRole", "uploader", uploader.Privileges).Return(uploader, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateTaken",
+			method: http.MethodPost,
+			path:   "/admin/roles",
+			body:   `{"name":"Owner"}`,
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("CreateRole", "Owner", types.Privileges{}).Return(types.RoleDefinition{}, services.ErrRoleTaken)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "CreateBadBody",
+			method:         http.MethodPost,
+			path:           "/admin/roles",
+			body:           `{"name":`,
+			user:           admin,
+			setup:          func(mr *MockRoleService) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Get",
+			method: http.MethodGet,
+			path:   "/admin/roles/4",
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("GetRole", types.Role(4)).Return(uploader, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "GetNotANumber",
+			method:         http.MethodGet,
+			path:           "/admin/roles/uploader",
+			user:           admin,
+			setup:          func(mr *MockRoleService) {},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "EditPrivileges",
+			method: http.MethodPatch,
+			path:   "/admin/roles/1",
+			body:   `{"privileges":{"read":true,"write":true}}`,
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("GetRole", types.Owner).Return(owner, nil)
+				mr.On("UpdateRole", types.Owner, "owner", types.Privileges{Read: true, Write: true}).Return(owner, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "RenameBuiltIn",
+			method: http.MethodPatch,
+			path:   "/admin/roles/1",
+			body:   `{"name":"manager"}`,
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("GetRole", types.Owner).Return(owner, nil)
+				mr.On("UpdateRole", types.Owner, "manager", owner.Privileges).Return(types.RoleDefinition{}, services.ErrBuiltInRole)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "EditMissing",
+			method: http.MethodPatch,
+			path:   "/admin/roles/9",
+			body:   `{"name":"ghost"}`,
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("GetRole", types.Role(9)).Return(types.RoleDefinition{}, services.ErrRoleNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "Delete",
+			method: http.MethodDelete,
+			path:   "/admin/roles/4",
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("DeleteRole", types.Role(4)).Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "DeleteInUse",
+			method: http.MethodDelete,
+			path:   "/admin/roles/4",
+			user:   admin,
+			setup: func(mr *MockRoleService) {
+				mr.On("DeleteRole", types.Role(4)).Return(services.ErrRoleInUse)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "WrongMethod",
+			method:         http.MethodPut,
+			path:           "/admin/roles/4",
+			user:           admin,
+			setup:          func(mr *MockRoleService) {},
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "NotAdmin",
+			method:         http.MethodGet,
+			path:           "/admin/roles",
+			user:           regular,
+			setup:          func(mr *MockRoleService) {},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockRoles := new(MockRoleService)
+			mockAuthz := new(MockAuthorizationService)
+			tc.setup(mockRoles)
+			if tc.user.Role == types.Admin {
+				mockAuthz.On("AuthorizeAdmin", tc.user).Return(nil)
+			} else {
+				mockAuthz.On("AuthorizeAdmin", tc.user).Return(services.ErrForbidden)
+			}
+			rh := RoleHandler{RoleService: mockRoles, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), tc.user))
+			rr := httptest.NewRecorder()
+			rh.RolesHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			mockRoles.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
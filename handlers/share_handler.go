@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ShareHandler struct {
+	ShareService         services.ShareService
+	FileService          services.FileService
+	AuthorizationService services.AuthorizationService
+	MaxFileSize          int64
+}
+
+type createShareRequest struct {
+	FileID       string     `json:"file_id"`
+	DirectoryID  string     `json:"directory_id"`
+	Mode         string     `json:"mode"`
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads"`
+}
+
+// SharesHandler routes /shares and /shares/{id} for signed in users. Links
+// are listed with GET /shares, created with POST /shares by anyone who may
+// change the access to the item and revoked with DELETE /shares/{id}.
+func (sh *ShareHandler) SharesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/shares"), "/")
+	if strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not_found", "Share link not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		sh.listLinks(w, user)
+	case r.Method == http.MethodPost && id == "":
+		sh.createLink(w, r, user)
+	case r.Method == http.MethodDelete && id != "":
+		sh.revokeLink(w, user, id)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (sh *ShareHandler) listLinks(w http.ResponseWriter, user types.User) {
+	links, err := sh.ShareService.ListLinks(user.ID)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    links,
+		Success: true,
+	})
+}
+
+func (sh *ShareHandler) createLink(w http.ResponseWriter, r *http.Request, user types.User) {
+	var req createShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	if (req.FileID == "") == (req.DirectoryID == "") {
+		writeError(w, http.StatusBadRequest, "bad_request", services.ErrInvalidShareLink.Error())
+		return
+	}
+	if err := sh.AuthorizationService.AuthorizeAclChange(user, req.FileID, req.DirectoryID); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	link := types.ShareLink{
+		OwnerID:      user.ID,
+		FileID:       req.FileID,
+		DirectoryID:  req.DirectoryID,
+		Mode:         req.Mode,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if req.ExpiresAt != nil {
+		link.ExpiresAt = *req.ExpiresAt
+	}
+	link, err := sh.ShareService.CreateLink(link, req.Password)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    link,
+		Message: "Share link created",
+		Success: true,
+	})
+}
+
+func (sh *ShareHandler) revokeLink(w http.ResponseWriter, user types.User, id string) {
+	link, err := sh.ShareService.GetLink(id)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	if link.OwnerID != user.ID {
+		if err := sh.AuthorizationService.AuthorizeAdmin(user); err != nil {
+			writeAuthorizationError(w, err)
+			return
+		}
+	}
+	if err := sh.ShareService.RevokeLink(id); err != nil {
+		writeShareError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PublicShareHandler serves share links to anyone holding the token:
+//
+//	GET  /s/{token}                  the shared file, or a listing of the shared
+//	                                 directory (?directory_id= for one below it)
+//	GET  /s/{token}/files/{id}       a file below the shared directory
+//	GET  /s/{token}/zip              the shared directory as a zip
+//	POST /s/{token}                  adds an uploadFile to an upload link's directory
+//
+// A link's password is read from the X-Share-Password header or from basic
+// auth, so browsers can prompt for it.
+func (sh *ShareHandler) PublicShareHandler(w http.ResponseWriter, r *http.Request) {
+	// Keep the token out of the Referer of anything the download links to
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	token, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	if token == "" {
+		writeError(w, http.StatusNotFound, "not_found", "Share link not found")
+		return
+	}
+	link, err := sh.ShareService.OpenLink(token, sharePassword(r))
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case rest == "" && read && link.FileID != "":
+		sh.serveShared(w, r, link, "")
+	case rest == "" && read:
+		sh.listShared(w, r, link)
+	case rest == "" && r.Method == http.MethodPost:
+		sh.uploadShared(w, r, link)
+	case rest == "zip" && r.Method == http.MethodGet:
+		sh.zipShared(w, link)
+	case strings.HasPrefix(rest, "files/") && read:
+		sh.serveShared(w, r, link, strings.TrimPrefix(rest, "files/"))
+	case rest == "" || rest == "zip" || strings.HasPrefix(rest, "files/"):
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "Not found")
+	}
+}
+
+func sharePassword(r *http.Request) string {
+	if password := r.Header.Get("X-Share-Password"); password != "" {
+		return password
+	}
+	_, password, _ := r.BasicAuth()
+	return password
+}
+
+func (sh *ShareHandler) serveShared(w http.ResponseWriter, r *http.Request, link types.ShareLink, fileID string) {
+	file, err := sh.ShareService.SharedFile(link, fileID)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	// Every GET counts, ranges included: any of them can fetch the whole file
+	if r.Method == http.MethodGet {
+		if err := sh.ShareService.CountUse(link); err != nil {
+			writeShareError(w, err)
+			return
+		}
+	}
+
+	content, err := sh.FileService.OpenFile(file)
+	if err != nil {
+		http.Error(w, "Error getting the file", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+	w.Header().Set("Cache-Control", "private, no-store")
+	serveFile(w, r, file.Name, file.ContentType, file.Hash, file.UploadDate, content)
+}
+
+func (sh *ShareHandler) listShared(w http.ResponseWriter, r *http.Request, link types.ShareLink) {
+	limit, offset, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	listing, err := sh.ShareService.ListShared(link, r.URL.Query().Get("directory_id"), limit, offset)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    listing,
+		Success: true,
+	})
+}
+
+func (sh *ShareHandler) zipShared(w http.ResponseWriter, link types.ShareLink) {
+	dir, err := sh.ShareService.SharedDirectory(link)
+	if err != nil {
+		writeShareError(w, err)
+		return
+	}
+	if err := sh.ShareService.CountUse(link); err != nil {
+		writeShareError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": dir.Name + ".zip"}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := sh.ShareService.WriteZip(link, w); err != nil {
+		// Too late for an error status, the client sees a truncated archive
+		fmt.Printf("error writing zip for share link %s: %v\n", link.ID, err)
+	}
+}
+
+func (sh *ShareHandler) uploadShared(w http.ResponseWriter, r *http.Request, link types.ShareLink) {
+	maxFileSize := sh.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxFileSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+maxFormOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "request body empty")
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeError(w, http.StatusBadRequest, "bad_request", "no file in request body")
+			return
+		}
+		if err != nil {
+			if isTooLarge(err) {
+				writeError(w, http.StatusRequestEntityTooLarge, "too_large", "File too large")
+				return
+			}
+			writeError(w, http.StatusBadRequest, "bad_request", "error parsing form")
+			return
+		}
+		if part.FormName() != "uploadFile" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		_, err = sh.ShareService.Upload(link, part, maxFileSize, filepath.Base(part.FileName()), part.Header.Get("Content-Type"))
+		part.Close()
+		if err != nil {
+			if errors.Is(err, services.ErrFileTooLarge) || isTooLarge(err) {
+				writeError(w, http.StatusRequestEntityTooLarge, "too_large", "File too large")
+				return
+			}
+			writeShareError(w, err)
+			return
+		}
+		break
+	}
+
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Message: "File uploaded",
+		Success: true,
+	})
+}
+
+func writeShareError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrShareLinkNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Share link not found")
+	case errors.Is(err, services.ErrShareLinkExpired), errors.Is(err, services.ErrShareLinkExhausted):
+		writeError(w, http.StatusGone, "gone", err.Error())
+	case errors.Is(err, services.ErrSharePassword):
+		w.Header().Set("WWW-Authenticate", `Basic realm="share"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+	case errors.Is(err, services.ErrShareMode):
+		writeError(w, http.StatusForbidden, "forbidden", err.Error())
+	case errors.Is(err, services.ErrInvalidShareLink), errors.Is(err, services.ErrInvalidName):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	case errors.Is(err, services.ErrShareNameTaken):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, services.ErrQuotaExceeded):
+		writeQuotaExceeded(w)
+	case errors.Is(err, services.ErrFileNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "File not found")
+	case errors.Is(err, services.ErrDirectoryNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Directory not found")
+	default:
+		http.Error(w, "Error handling the share link", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,424 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockShareService struct {
+	mock.Mock
+}
+
+func (m *MockShareService) CreateLink(l types.ShareLink, password string) (types.ShareLink, error) {
+	args := m.Called(l, password)
+	return args.Get(0).(types.ShareLink), args.Error(1)
+}
+
+func (m *MockShareService) GetLink(id string) (types.ShareLink, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.ShareLink), args.Error(1)
+}
+
+func (m *MockShareService) ListLinks(ownerID string) ([]types.ShareLink, error) {
+	args := m.Called(ownerID)
+	return args.Get(0).([]types.ShareLink), args.Error(1)
+}
+
+func (m *MockShareService) RevokeLink(id string) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockShareService) OpenLink(token, password string) (types.ShareLink, error) {
+	args := m.Called(token, password)
+	return args.Get(0).(types.ShareLink), args.Error(1)
+}
+
+func (m *MockShareService) CountUse(l types.ShareLink) error {
+	args := m.Called(l)
+	return args.Error(0)
+}
+
+func (m *MockShareService) SharedFile(l types.ShareLink, fileID string) (types.File, error) {
+	args := m.Called(l, fileID)
+	return args.Get(0).(types.File), args.Error(1)
+}
+
+func (m *MockShareService) SharedDirectory(l types.ShareLink) (types.Directory, error) {
+	args := m.Called(l)
+	return args.Get(0).(types.Directory), args.Error(1)
+}
+
+func (m *MockShareService) ListShared(l types.ShareLink, directoryID string, limit, offset int) (types.DirectoryListing, error) {
+	args := m.Called(l, directoryID, limit, offset)
+	return args.Get(0).(types.DirectoryListing), args.Error(1)
+}
+
+func (m *MockShareService) WriteZip(l types.ShareLink, w io.Writer) error {
+	args := m.Called(l, w)
+	return args.Error(0)
+}
+
+func (m *MockShareService) Upload(l types.ShareLink, r io.Reader, maxSize int64, name, contentType string) (types.File, error) {
+	args := m.Called(l, r, maxSize, name, contentType)
+	return args.Get(0).(types.File), args.Error(1)
+}
+
+func TestSharesHandler(t *testing.T) {
+	link := types.ShareLink{ID: "l1", Token: "tok", OwnerID: "1", FileID: "f1", Mode: types.ShareRead}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		setup          func(m *MockShareService, a *MockAuthorizationService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/shares",
+			setup: func(m *MockShareService, a *MockAuthorizationService) {
+				m.On("ListLinks", "1").Return([]types.ShareLink{link}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Create",
+			method: http.MethodPost,
+			path:   "/shares",
+			body:   `{"file_id":"f1","password":"pw","max_downloads":3}`,
+			setup: func(m *MockShareService, a *MockAuthorizationService) {
+				a.On("AuthorizeAclChange", mock.Anything, "f1", "").Return(nil)
+				m.On("CreateLink", types.ShareLink{OwnerID: "1", FileID: "f1", MaxDownloads: 3}, "pw").Return(link, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "CreateWithoutTarget",
+			method:         http.MethodPost,
+			path:           "/shares",
+			body:           `{"mode":"read"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "CreateForbidden",
+			method: http.MethodPost,
+			path:   "/shares",
+			body:   `{"directory_id":"d1","mode":"upload"}`,
+			setup: func(m *MockShareService, a *MockAuthorizationService) {
+				a.On("AuthorizeAclChange", mock.Anything, "", "d1").Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "CreateInvalid",
+			method: http.MethodPost,
+			path:   "/shares",
+			body:   `{"file_id":"f1","mode":"upload"}`,
+			setup: func(m *MockShareService, a *MockAuthorizationService) {
+				a.On("AuthorizeAclChange", mock.Anything, "f1", "").Return(nil)
+				m.On("CreateLink", mock.Anything, "").Return(types.ShareLink{}, services.ErrInvalidShareLink)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "RevokeOwn",
+			method: http.MethodDelete,
+			path:   "/shares/l1",
+			setup: func(m *MockShareService, a *MockAuthorizationService) {
+				m.On("GetLink", "l1").Return(link, nil)
+				m.On("RevokeLink", "l1").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "RevokeOthersForbidden",
+			method: http.MethodDelete,
+			path:   "/shares/l2",
+			setup: func(m *MockShareService, a *MockAuthorizationService) {
+				m.On("GetLink", "l2").Return(types.ShareLink{ID: "l2", OwnerID: "2"}, nil)
+				a.On("AuthorizeAdmin", mock.Anything).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "RevokeMissing",
+			method: http.MethodDelete,
+			path:   "/shares/nope",
+			setup: func(m *MockShareService, a *MockAuthorizationService) {
+				m.On("GetLink", "nope").Return(types.ShareLink{}, services.ErrShareLinkNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "RevokeWithoutID",
+			method:         http.MethodDelete,
+			path:           "/shares",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockShareService)
+			mockAuthz := new(MockAuthorizationService)
+			if tc.setup != nil {
+				tc.setup(mockService, mockAuthz)
+			}
+			sh := &ShareHandler{ShareService: mockService, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Regular}))
+			rr := httptest.NewRecorder()
+			sh.SharesHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			mockService.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPublicShareHandler(t *testing.T) {
+	fileLink := types.ShareLink{ID: "l1", Token: "ftok", OwnerID: "1", FileID: "f1", Mode: types.ShareRead}
+	dirLink := types.ShareLink{ID: "l2", Token: "dtok", OwnerID: "1", DirectoryID: "d1", Mode: types.ShareRead}
+	dropLink := types.ShareLink{ID: "l3", Token: "utok", OwnerID: "1", DirectoryID: "d1", Mode: types.ShareUpload}
+	file := types.File{ID: "f1", Name: "a.txt", ContentType: "text/plain", Hash: "abc"}
+
+	uploadBody := func() (string, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		part, _ := mw.CreateFormFile("uploadFile", "note.txt")
+		part.Write([]byte("hello"))
+		mw.Close()
+		return buf.String(), mw.FormDataContentType()
+	}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		header         map[string]string
+		upload         bool
+		setup          func(m *MockShareService, f *MockFileService)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:   "DownloadFile",
+			method: http.MethodGet,
+			path:   "/s/ftok",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "ftok", "").Return(fileLink, nil)
+				m.On("SharedFile", fileLink, "").Return(file, nil)
+				m.On("CountUse", fileLink).Return(nil)
+				f.On("OpenFile", file).Return(nopReadSeekCloser{strings.NewReader("0123456789")}, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "0123456789",
+		},
+		{
+			name:   "RangeIsCounted",
+			method: http.MethodGet,
+			path:   "/s/ftok",
+			header: map[string]string{"Range": "bytes=5-"},
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "ftok", "").Return(fileLink, nil)
+				m.On("SharedFile", fileLink, "").Return(file, nil)
+				m.On("CountUse", fileLink).Return(nil)
+				f.On("OpenFile", file).Return(nopReadSeekCloser{strings.NewReader("0123456789")}, nil)
+			},
+			expectedStatus: http.StatusPartialContent,
+			expectedBody:   "56789",
+		},
+		{
+			name:   "SuffixRangeIsCounted",
+			method: http.MethodGet,
+			path:   "/s/ftok",
+			header: map[string]string{"Range": "bytes=-999999999"},
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "ftok", "").Return(fileLink, nil)
+				m.On("SharedFile", fileLink, "").Return(file, nil)
+				m.On("CountUse", fileLink).Return(services.ErrShareLinkExhausted)
+			},
+			expectedStatus: http.StatusGone,
+		},
+		{
+			name:   "PasswordHeader",
+			method: http.MethodHead,
+			path:   "/s/ftok",
+			header: map[string]string{"X-Share-Password": "pw"},
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "ftok", "pw").Return(fileLink, nil)
+				m.On("SharedFile", fileLink, "").Return(file, nil)
+				f.On("OpenFile", file).Return(nopReadSeekCloser{strings.NewReader("0123456789")}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "WrongPassword",
+			method: http.MethodGet,
+			path:   "/s/ftok",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "ftok", "").Return(types.ShareLink{}, services.ErrSharePassword)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:   "Expired",
+			method: http.MethodGet,
+			path:   "/s/old",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "old", "").Return(types.ShareLink{}, services.ErrShareLinkExpired)
+			},
+			expectedStatus: http.StatusGone,
+		},
+		{
+			name:   "Exhausted",
+			method: http.MethodGet,
+			path:   "/s/ftok",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "ftok", "").Return(fileLink, nil)
+				m.On("SharedFile", fileLink, "").Return(file, nil)
+				m.On("CountUse", fileLink).Return(services.ErrShareLinkExhausted)
+			},
+			expectedStatus: http.StatusGone,
+		},
+		{
+			name:   "ListDirectory",
+			method: http.MethodGet,
+			path:   "/s/dtok?directory_id=d2",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "dtok", "").Return(dirLink, nil)
+				m.On("ListShared", dirLink, "d2", mock.Anything, 0).Return(types.DirectoryListing{}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "FileOutsideShare",
+			method: http.MethodGet,
+			path:   "/s/dtok/files/f9",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "dtok", "").Return(dirLink, nil)
+				m.On("SharedFile", dirLink, "f9").Return(types.File{}, services.ErrFileNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "Zip",
+			method: http.MethodGet,
+			path:   "/s/dtok/zip",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "dtok", "").Return(dirLink, nil)
+				m.On("SharedDirectory", dirLink).Return(types.Directory{ID: "d1", Name: "docs"}, nil)
+				m.On("CountUse", dirLink).Return(nil)
+				m.On("WriteZip", dirLink, mock.Anything).Return(nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "ListUploadLink",
+			method: http.MethodGet,
+			path:   "/s/utok",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "utok", "").Return(dropLink, nil)
+				m.On("ListShared", dropLink, "", mock.Anything, 0).Return(types.DirectoryListing{}, services.ErrShareMode)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Upload",
+			method: http.MethodPost,
+			path:   "/s/utok",
+			upload: true,
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "utok", "").Return(dropLink, nil)
+				m.On("Upload", dropLink, mock.Anything, int64(DefaultMaxFileSize), "note.txt", "application/octet-stream").Return(types.File{ID: "f2"}, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "UploadNameTaken",
+			method: http.MethodPost,
+			path:   "/s/utok",
+			upload: true,
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "utok", "").Return(dropLink, nil)
+				m.On("Upload", dropLink, mock.Anything, int64(DefaultMaxFileSize), "note.txt", mock.Anything).Return(types.File{}, services.ErrShareNameTaken)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "UnknownPath",
+			method: http.MethodGet,
+			path:   "/s/ftok/other",
+			setup: func(m *MockShareService, f *MockFileService) {
+				m.On("OpenLink", "ftok", "").Return(fileLink, nil)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "NoToken",
+			method:         http.MethodGet,
+			path:           "/s/",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockShareService)
+			mockFiles := new(MockFileService)
+			if tc.setup != nil {
+				tc.setup(mockService, mockFiles)
+			}
+			sh := &ShareHandler{ShareService: mockService, FileService: mockFiles}
+
+			var req *http.Request
+			if tc.upload {
+				body, contentType := uploadBody()
+				req = httptest.NewRequest(tc.method, tc.path, strings.NewReader(body))
+				req.Header.Set("Content-Type", contentType)
+			} else {
+				req = httptest.NewRequest(tc.method, tc.path, nil)
+			}
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			sh.PublicShareHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedBody != "" && rr.Body.String() != tc.expectedBody {
+				t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), tc.expectedBody)
+			}
+			if got := rr.Header().Get("Referrer-Policy"); got != "no-referrer" {
+				t.Errorf("Referrer-Policy = %q, want no-referrer", got)
+			}
+			if tc.expectedStatus == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+			mockService.AssertExpectations(t)
+			mockFiles.AssertExpectations(t)
+		})
+	}
+}
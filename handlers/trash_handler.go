@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type TrashHandler struct {
+	TrashService services.TrashService
+}
+
+// TrashHandler routes the trash:
+//
+//	GET    /trash                 lists items the user owns or deleted
+//	DELETE /trash                 empties it
+//	POST   /trash/{id}/restore    puts an item back where it was
+//	DELETE /trash/{id}            deletes an item for good
+func (th *TrashHandler) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/trash"), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		th.listTrash(w, user)
+	case r.Method == http.MethodDelete && id == "":
+		th.emptyTrash(w, user)
+	case r.Method == http.MethodPost && id != "" && action == "restore":
+		th.restoreItem(w, user, id)
+	case r.Method == http.MethodDelete && id != "" && action == "":
+		th.purgeItem(w, user, id)
+	case id != "" && action != "" && action != "restore":
+		writeError(w, http.StatusNotFound, "not_found", "Trash item not found")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (th *TrashHandler) listTrash(w http.ResponseWriter, user types.User) {
+	items, err := th.TrashService.ListTrash(user)
+	if err != nil {
+		writeTrashError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    items,
+		Success: true,
+	})
+}
+
+func (th *TrashHandler) emptyTrash(w http.ResponseWriter, user types.User) {
+	if _, err := th.TrashService.EmptyTrash(user); err != nil {
+		writeTrashError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (th *TrashHandler) restoreItem(w http.ResponseWriter, user types.User, id string) {
+	item, err := th.TrashService.Restore(user, id)
+	if err != nil {
+		writeTrashError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    item,
+		Message: "Item restored",
+		Success: true,
+	})
+}
+
+func (th *TrashHandler) purgeItem(w http.ResponseWriter, user types.User, id string) {
+	if err := th.TrashService.Purge(user, id); err != nil {
+		writeTrashError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTrashError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrTrashItemNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "Trash item not found")
+	case errors.Is(err, services.ErrRestoreConflict):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, services.ErrForbidden):
+		writeAuthorizationError(w, err)
+	case errors.Is(err, services.ErrQuotaExceeded):
+		writeQuotaExceeded(w)
+	default:
+		http.Error(w, "Error handling the trash", http.StatusInternalServerError)
+	}
+}
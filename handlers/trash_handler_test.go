@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockTrashService struct {
+	mock.Mock
+}
+
+func (m *MockTrashService) TrashFile(user types.User, fileID string) (types.TrashItem, error) {
+	args := m.Called(user, fileID)
+	return args.Get(0).(types.TrashItem), args.Error(1)
+}
+
+func (m *MockTrashService) TrashDirectory(user types.User, directoryID string) (types.TrashItem, error) {
+	args := m.Called(user, directoryID)
+	return args.Get(0).(types.TrashItem), args.Error(1)
+}
+
+func (m *MockTrashService) ListTrash(user types.User) ([]types.TrashItem, error) {
+	args := m.Called(user)
+	return args.Get(0).([]types.TrashItem), args.Error(1)
+}
+
+func (m *MockTrashService) GetTrashItem(user types.User, id string) (types.TrashItem, error) {
+	args := m.Called(user, id)
+	return args.Get(0).(types.TrashItem), args.Error(1)
+}
+
+func (m *MockTrashService) Restore(user types.User, id string) (types.TrashItem, error) {
+	args := m.Called(user, id)
+	return args.Get(0).(types.TrashItem), args.Error(1)
+}
+
+func (m *MockTrashService) Purge(user types.User, id string) error {
+	args := m.Called(user, id)
+	return args.Error(0)
+}
+
+func (m *MockTrashService) EmptyTrash(user types.User) (int, error) {
+	args := m.Called(user)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockTrashService) PurgeDeletedBefore(t time.Time) (int, error) {
+	args := m.Called(t)
+	return args.Int(0), args.Error(1)
+}
+
+func TestTrashHandler(t *testing.T) {
+	item := types.TrashItem{ID: "t1", OwnerID: "1", DeletedBy: "1", ItemType: types.TrashFile, ItemID: "f1", Name: "a.txt"}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		setup          func(m *MockTrashService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/trash",
+			setup: func(m *MockTrashService) {
+				m.On("ListTrash", mock.Anything).Return([]types.TrashItem{item}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Empty",
+			method: http.MethodDelete,
+			path:   "/trash",
+			setup: func(m *MockTrashService) {
+				m.On("EmptyTrash", mock.Anything).Return(1, nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "Restore",
+			method: http.MethodPost,
+			path:   "/trash/t1/restore",
+			setup: func(m *MockTrashService) {
+				m.On("Restore", mock.Anything, "t1").Return(item, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "RestoreConflict",
+			method: http.MethodPost,
+			path:   "/trash/t1/restore",
+			setup: func(m *MockTrashService) {
+				m.On("Restore", mock.Anything, "t1").Return(types.TrashItem{}, services.ErrRestoreConflict)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "RestoreForbidden",
+			method: http.MethodPost,
+			path:   "/trash/t2/restore",
+			setup: func(m *MockTrashService) {
+				m.On("Restore", mock.Anything, "t2").Return(types.TrashItem{}, services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Purge",
+			method: http.MethodDelete,
+			path:   "/trash/t1",
+			setup: func(m *MockTrashService) {
+				m.On("Purge", mock.Anything, "t1").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "PurgeWithoutDelete",
+			method: http.MethodDelete,
+			path:   "/trash/t1",
+			setup: func(m *MockTrashService) {
+				m.On("Purge", mock.Anything, "t1").Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "PurgeMissing",
+			method: http.MethodDelete,
+			path:   "/trash/nope",
+			setup: func(m *MockTrashService) {
+				m.On("Purge", mock.Anything, "nope").Return(services.ErrTrashItemNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "UnknownAction",
+			method:         http.MethodPost,
+			path:           "/trash/t1/shred",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "RestoreWrongMethod",
+			method:         http.MethodGet,
+			path:           "/trash/t1/restore",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockTrashService)
+			if tc.setup != nil {
+				tc.setup(mockService)
+			}
+			th := &TrashHandler{TrashService: mockService}
+
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1", Role: types.Owner}))
+			rr := httptest.NewRecorder()
+			th.TrashHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+// TusHandler implements the tus 1.0 resumable upload protocol with the
+// creation, termination and expiration extensions, mounted at BasePath
+type TusHandler struct {
+	UploadService        services.UploadService
+	AuthorizationService services.AuthorizationService
+	BasePath             string // e.g. "/tus/"
+	MaxFileSize          int64
+}
+
+func (th *TusHandler) TusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		th.options(w)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, http.StatusPreconditionFailed, "precondition_failed", "Unsupported tus version")
+		return
+	}
+
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, th.BasePath), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+			return
+		}
+		th.create(w, r, user)
+		return
+	}
+
+	upload, err := th.UploadService.GetUpload(id)
+	if err != nil {
+		if errors.Is(err, services.ErrUploadNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", "Upload not found")
+			return
+		}
+		http.Error(w, "Error getting the upload", http.StatusInternalServerError)
+		return
+	}
+	if upload.OwnerID != user.ID {
+		writeError(w, http.StatusForbidden, "forbidden", "upload belongs to another user")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		th.head(w, upload)
+	case http.MethodPatch:
+		th.patch(w, r, upload)
+	case http.MethodDelete:
+		th.terminate(w, upload)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (th *TusHandler) options(w http.ResponseWriter) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if th.MaxFileSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(th.MaxFileSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (th *TusHandler) create(w http.ResponseWriter, r *http.Request, user types.User) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Deferred upload length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid Upload-Length")
+		return
+	}
+	if th.MaxFileSize > 0 && length > th.MaxFileSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", "File too large")
+		return
+	}
+	// Finished uploads land in the user's root
+	if err := th.AuthorizationService.AuthorizeDirectory(user, "", services.ActionWrite); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+	metadata := r.Header.Get("Upload-Metadata")
+	if _, err := services.ParseUploadMetadata(metadata); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	upload, err := th.UploadService.CreateUpload(user.ID, length, metadata)
+	if errors.Is(err, services.ErrQuotaExceeded) {
+		writeQuotaExceeded(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error creating the upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join(th.BasePath, upload.ID))
+	w.Header().Set("Upload-Offset", "0")
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (th *TusHandler) head(w http.ResponseWriter, upload types.Upload) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// setUploadExpires tells the client when the upload is removed if no more
+// chunks arrive
+func setUploadExpires(w http.ResponseWriter, upload types.Upload) {
+	w.Header().Set("Upload-Expires", upload.UpdatedAt.Add(services.UploadTTL).UTC().Format(http.TimeFormat))
+}
+
+func (th *TusHandler) patch(w http.ResponseWriter, r *http.Request, upload types.Upload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid Upload-Offset")
+		return
+	}
+	if r.ContentLength > upload.Length-offset {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", "Chunk exceeds Upload-Length")
+		return
+	}
+
+	upload, _, err = th.UploadService.AppendChunk(upload.ID, offset, r.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUploadOffsetMismatch):
+			writeError(w, http.StatusConflict, "conflict", "Upload-Offset does not match")
+		case errors.Is(err, services.ErrUploadTooLarge):
+			writeError(w, http.StatusRequestEntityTooLarge, "too_large", "Chunk exceeds Upload-Length")
+		case errors.Is(err, services.ErrUploadNotFound):
+			writeError(w, http.StatusNotFound, "not_found", "Upload not found")
+		case errors.Is(err, services.ErrQuotaExceeded):
+			writeQuotaExceeded(w)
+		default:
+			http.Error(w, "Error saving the chunk", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Offset < upload.Length {
+		setUploadExpires(w, upload)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (th *TusHandler) terminate(w http.ResponseWriter, upload types.Upload) {
+	if err := th.UploadService.TerminateUpload(upload.ID); err != nil {
+		if errors.Is(err, services.ErrUploadNotFound) {
+			writeError(w, http.StatusNotFound, "not_found", "Upload not found")
+			return
+		}
+		http.Error(w, "Error terminating the upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockUploadService struct {
+	mock.Mock
+}
+
+func (m *MockUploadService) CreateUpload(ownerID string, length int64, metadata string) (types.Upload, error) {
+	args := m.Called(ownerID, length, metadata)
+	return args.Get(0).(types.Upload), args.Error(1)
+}
+
+func (m *MockUploadService) GetUpload(id string) (types.Upload, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.Upload), args.Error(1)
+}
+
+func (m *MockUploadService) AppendChunk(id string, offset int64, r io.Reader) (types.Upload, *types.File, error) {
+	args := m.Called(id, offset, r)
+	return args.Get(0).(types.Upload), args.Get(1).(*types.File), args.Error(2)
+}
+
+func (m *MockUploadService) TerminateUpload(id string) error {
+	args := m.Called(id)
+	return args.Error(0)
+}
+
+func (m *MockUploadService) PurgeAbandoned(t time.Time) (int, error) {
+	args := m.Called(t)
+	return args.Int(0), args.Error(1)
+}
+
+func TestTusUploadHandler(t *testing.T) {
+	upload := types.Upload{ID: "abc", OwnerID: "1", Length: 10, Offset: 4}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		headers        map[string]string
+		setup          func(m *MockUploadService)
+		authErr        error
+		expectedStatus int
+		expectHeaders  map[string]string
+	}{
+		{
+			name:           "Options",
+			method:         http.MethodOptions,
+			path:           "/tus/",
+			expectedStatus: http.StatusNoContent,
+			expectHeaders:  map[string]string{"Tus-Version": "1.0.0", "Tus-Extension": "creation,termination,expiration", "Tus-Max-Size": "100"},
+		},
+		{
+			name:           "MissingTusResumable",
+			method:         http.MethodPost,
+			path:           "/tus/",
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "Create",
+			method:  http.MethodPost,
+			path:    "/tus/",
+			headers: map[string]string{"Upload-Length": "10", "Upload-Metadata": "filename YS50eHQ="},
+			setup: func(m *MockUploadService) {
+				m.On("CreateUpload", "1", int64(10), "filename YS50eHQ=").Return(types.Upload{ID: "abc", Length: 10}, nil)
+			},
+			expectedStatus: http.StatusCreated,
+			expectHeaders:  map[string]string{"Location": "/tus/abc", "Tus-Resumable": "1.0.0"},
+		},
+		{
+			name:           "CreateTooLarge",
+			method:         http.MethodPost,
+			path:           "/tus/",
+			headers:        map[string]string{"Upload-Length": "101"},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "CreateOverQuota",
+			method:  http.MethodPost,
+			path:    "/tus/",
+			headers: map[string]string{"Upload-Length": "10"},
+			setup: func(m *MockUploadService) {
+				m.On("CreateUpload", "1", int64(10), "").Return(types.Upload{}, services.ErrQuotaExceeded)
+			},
+			expectedStatus: http.StatusInsufficientStorage,
+		},
+		{
+			name:           "CreateForbidden",
+			method:         http.MethodPost,
+			path:           "/tus/",
+			headers:        map[string]string{"Upload-Length": "10"},
+			authErr:        services.ErrForbidden,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "CreateMissingLength",
+			method:         http.MethodPost,
+			path:           "/tus/",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Head",
+			method: http.MethodHead,
+			path:   "/tus/abc",
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "abc").Return(upload, nil)
+			},
+			expectedStatus: http.StatusOK,
+			expectHeaders:  map[string]string{"Upload-Offset": "4", "Upload-Length": "10", "Cache-Control": "no-store"},
+		},
+		{
+			name:   "HeadNotFound",
+			method: http.MethodHead,
+			path:   "/tus/missing",
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "missing").Return(types.Upload{}, services.ErrUploadNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "HeadOtherOwner",
+			method: http.MethodHead,
+			path:   "/tus/abc",
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "abc").Return(types.Upload{ID: "abc", OwnerID: "2"}, nil)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:    "Patch",
+			method:  http.MethodPatch,
+			path:    "/tus/abc",
+			headers: map[string]string{"Upload-Offset": "4", "Content-Type": "application/offset+octet-stream"},
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "abc").Return(upload, nil)
+				m.On("AppendChunk", "abc", int64(4), mock.Anything).Return(types.Upload{ID: "abc", OwnerID: "1", Length: 10, Offset: 10}, &types.File{ID: "f1"}, nil)
+			},
+			expectedStatus: http.StatusNoContent,
+			expectHeaders:  map[string]string{"Upload-Offset": "10"},
+		},
+		{
+			name:    "PatchOffsetMismatch",
+			method:  http.MethodPatch,
+			path:    "/tus/abc",
+			headers: map[string]string{"Upload-Offset": "2", "Content-Type": "application/offset+octet-stream"},
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "abc").Return(upload, nil)
+				m.On("AppendChunk", "abc", int64(2), mock.Anything).Return(upload, (*types.File)(nil), services.ErrUploadOffsetMismatch)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:    "PatchTooLarge",
+			method:  http.MethodPatch,
+			path:    "/tus/abc",
+			headers: map[string]string{"Upload-Offset": "5", "Content-Type": "application/offset+octet-stream"},
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "abc").Return(upload, nil)
+			},
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "PatchWrongContentType",
+			method:  http.MethodPatch,
+			path:    "/tus/abc",
+			headers: map[string]string{"Upload-Offset": "4", "Content-Type": "text/plain"},
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "abc").Return(upload, nil)
+			},
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:   "Terminate",
+			method: http.MethodDelete,
+			path:   "/tus/abc",
+			setup: func(m *MockUploadService) {
+				m.On("GetUpload", "abc").Return(upload, nil)
+				m.On("TerminateUpload", "abc").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockUploadService)
+			if tc.setup != nil {
+				tc.setup(mockService)
+			}
+			mockAuthz := new(MockAuthorizationService)
+			mockAuthz.On("AuthorizeDirectory", mock.Anything, "", services.ActionWrite).Return(tc.authErr)
+			th := TusHandler{UploadService: mockService, AuthorizationService: mockAuthz, BasePath: "/tus/", MaxFileSize: 100}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("chunk!"))
+			if tc.name != "MissingTusResumable" {
+				req.Header.Set("Tus-Resumable", "1.0.0")
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			req = req.WithContext(utils.WithUser(req.Context(), types.User{ID: "1"}))
+			rr := httptest.NewRecorder()
+			th.TusUploadHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			for k, v := range tc.expectHeaders {
+				if got := rr.Header().Get(k); got != v {
+					t.Errorf("header %s = %q, want %q", k, got, v)
+				}
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type TwoFactorHandler struct {
+	TwoFactorService     services.TwoFactorService
+	AuthorizationService services.AuthorizationService
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type twoFactorPolicyRequest struct {
+	Roles []types.Role `json:"roles"`
+}
+
+// TwoFactorPolicy lists the roles that can't log in without two-factor
+// authentication
+type TwoFactorPolicy struct {
+	Roles []types.Role
+}
+
+// TwoFactorHandler routes the signed in user's two-factor authentication:
+//
+//	GET    /2fa                       whether it is on and how many recovery codes are left
+//	POST   /2fa/enroll                starts setting it up, returning the secret
+//	POST   /2fa/confirm               {code} turns it on, returning recovery codes
+//	POST   /2fa/recovery-codes        {code} replaces the recovery codes
+//	POST   /2fa/disable               {code} turns it off
+//	GET    /2fa/policy                the roles that must use it, for admins
+//	PUT    /2fa/policy                {roles} sets them, for admins
+//
+// None of it can be done with an API key. A new policy applies from each
+// user's next login.
+func (th *TwoFactorHandler) TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if user.Scope != nil {
+		writeError(w, http.StatusForbidden, "forbidden", "Two-factor authentication can't be managed with an API key")
+		return
+	}
+
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/2fa"), "/")
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		th.getStatus(w, user)
+	case r.Method == http.MethodPost && action == "enroll":
+		th.beginEnrollment(w, user)
+	case r.Method == http.MethodPost && (action == "confirm" || action == "recovery-codes" || action == "disable"):
+		th.useCode(w, r, user, action)
+	case (r.Method == http.MethodGet || r.Method == http.MethodPut) && action == "policy":
+		th.policy(w, r, user)
+	default:
+		switch action {
+		case "", "enroll", "confirm", "recovery-codes", "disable", "policy":
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+		default:
+			writeError(w, http.StatusNotFound, "not_found", "Not found")
+		}
+	}
+}
+
+func (th *TwoFactorHandler) getStatus(w http.ResponseWriter, user types.User) {
+	status, err := th.TwoFactorService.Status(user)
+	if err != nil {
+		http.Error(w, "Error getting two-factor status", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    status,
+		Success: true,
+	})
+}
+
+func (th *TwoFactorHandler) beginEnrollment(w http.ResponseWriter, user types.User) {
+	enrollment, err := th.TwoFactorService.BeginEnrollment(user)
+	if err != nil {
+		if errors.Is(err, services.ErrTwoFactorEnabled) {
+			writeError(w, http.StatusConflict, "conflict", err.Error())
+			return
+		}
+		http.Error(w, "Error starting enrollment", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    enrollment,
+		Message: "Add the secret to an authenticator app and confirm with its first code",
+		Success: true,
+	})
+}
+
+// useCode runs the actions that need a code from the user's authenticator app
+func (th *TwoFactorHandler) useCode(w http.ResponseWriter, r *http.Request, user types.User, action string) {
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+
+	var codes []string
+	var err error
+	var message string
+	switch action {
+	case "confirm":
+		codes, err = th.TwoFactorService.ConfirmEnrollment(user, req.Code)
+		message = "Two-factor authentication enabled, keep the recovery codes somewhere safe"
+	case "recovery-codes":
+		codes, err = th.TwoFactorService.RegenerateRecoveryCodes(user, req.Code)
+		message = "Recovery codes replaced, the old ones no longer work"
+	case "disable":
+		err = th.TwoFactorService.Disable(user, req.Code)
+		message = "Two-factor authentication disabled"
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidTwoFactorCode):
+			writeError(w, http.StatusUnauthorized, "invalid_code", err.Error())
+		case errors.Is(err, services.ErrTwoFactorRequired):
+			writeError(w, http.StatusForbidden, "forbidden", err.Error())
+		case errors.Is(err, services.ErrTwoFactorEnabled), errors.Is(err, services.ErrTwoFactorNotEnabled),
+			errors.Is(err, services.ErrNoTwoFactorEnrollment):
+			writeError(w, http.StatusConflict, "conflict", err.Error())
+		default:
+			http.Error(w, "Error updating two-factor authentication", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    codes,
+		Message: message,
+		Success: true,
+	})
+}
+
+func (th *TwoFactorHandler) policy(w http.ResponseWriter, r *http.Request, user types.User) {
+	if err := th.AuthorizationService.AuthorizeAdmin(user); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req twoFactorPolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+			return
+		}
+		if err := th.TwoFactorService.SetRequiredRoles(req.Roles); err != nil {
+			if errors.Is(err, services.ErrUnknownRole) {
+				writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+				return
+			}
+			http.Error(w, "Error saving the two-factor policy", http.StatusInternalServerError)
+			return
+		}
+	}
+	roles, err := th.TwoFactorService.RequiredRoles()
+	if err != nil {
+		http.Error(w, "Error getting the two-factor policy", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    TwoFactorPolicy{Roles: roles},
+		Success: true,
+	})
+}
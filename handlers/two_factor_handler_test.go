@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockTwoFactorService struct {
+	mock.Mock
+}
+
+func (m *MockTwoFactorService) Status(user types.User) (types.TwoFactorStatus, error) {
+	args := m.Called(user)
+	return args.Get(0).(types.TwoFactorStatus), args.Error(1)
+}
+
+func (m *MockTwoFactorService) BeginEnrollment(user types.User) (types.TotpEnrollment, error) {
+	args := m.Called(user)
+	return args.Get(0).(types.TotpEnrollment), args.Error(1)
+}
+
+func (m *MockTwoFactorService) ConfirmEnrollment(user types.User, code string) ([]string, error) {
+	args := m.Called(user, code)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockTwoFactorService) Verify(user types.User, code string) error {
+	args := m.Called(user, code)
+	return args.Error(0)
+}
+
+func (m *MockTwoFactorService) RegenerateRecoveryCodes(user types.User, code string) ([]string, error) {
+	args := m.Called(user, code)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockTwoFactorService) Disable(user types.User, code string) error {
+	args := m.Called(user, code)
+	return args.Error(0)
+}
+
+func (m *MockTwoFactorService) RequiredRoles() ([]types.Role, error) {
+	args := m.Called()
+	return args.Get(0).([]types.Role), args.Error(1)
+}
+
+func (m *MockTwoFactorService) SetRequiredRoles(roles []types.Role) error {
+	args := m.Called(roles)
+	return args.Error(0)
+}
+
+func TestTwoFactorHandler(t *testing.T) {
+	user := types.User{ID: "1", Username: "alice", Role: types.Regular}
+	admin := types.User{ID: "2", Username: "root", Role: types.Admin}
+	readOnly := types.Privileges{Read: true}
+	keyUser := user
+	keyUser.Scope = &readOnly
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		user           types.User
+		setup          func(m *MockTwoFactorService, a *MockAuthorizationService)
+		expectedStatus int
+	}{
+		{
+			name:   "Status",
+			method: http.MethodGet,
+			path:   "/2fa",
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("Status", user).Return(types.TwoFactorStatus{Enabled: true, RecoveryCodesLeft: 10}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Enroll",
+			method: http.MethodPost,
+			path:   "/2fa/enroll",
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("BeginEnrollment", user).Return(types.TotpEnrollment{Secret: "SECRET"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "EnrollAgain",
+			method: http.MethodPost,
+			path:   "/2fa/enroll",
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("BeginEnrollment", user).Return(types.TotpEnrollment{}, services.ErrTwoFactorEnabled)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "Confirm",
+			method: http.MethodPost,
+			path:   "/2fa/confirm",
+			body:   `{"code":"123456"}`,
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("ConfirmEnrollment", user, "123456").Return([]string{"abcde-01234"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "ConfirmWrongCode",
+			method: http.MethodPost,
+			path:   "/2fa/confirm",
+			body:   `{"code":"654321"}`,
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("ConfirmEnrollment", user, "654321").Return([]string(nil), services.ErrInvalidTwoFactorCode)
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "ConfirmWithoutCode",
+			method:         http.MethodPost,
+			path:           "/2fa/confirm",
+			body:           `{}`,
+			user:           user,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "RecoveryCodes",
+			method: http.MethodPost,
+			path:   "/2fa/recovery-codes",
+			body:   `{"code":"123456"}`,
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("RegenerateRecoveryCodes", user, "123456").Return([]string{"abcde-01234"}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Disable",
+			method: http.MethodPost,
+			path:   "/2fa/disable",
+			body:   `{"code":"123456"}`,
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("Disable", user, "123456").Return(nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "DisableRequired",
+			method: http.MethodPost,
+			path:   "/2fa/disable",
+			body:   `{"code":"123456"}`,
+			user:   admin,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				m.On("Disable", admin, "123456").Return(services.ErrTwoFactorRequired)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "WithApiKey",
+			method:         http.MethodGet,
+			path:           "/2fa",
+			user:           keyUser,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "GetPolicy",
+			method: http.MethodGet,
+			path:   "/2fa/policy",
+			user:   admin,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", admin).Return(nil)
+				m.On("RequiredRoles").Return([]types.Role{types.Admin}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "SetPolicy",
+			method: http.MethodPut,
+			path:   "/2fa/policy",
+			body:   `{"roles":[0,1]}`,
+			user:   admin,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", admin).Return(nil)
+				m.On("SetRequiredRoles", []types.Role{types.Admin, types.Owner}).Return(nil)
+				m.On("RequiredRoles").Return([]types.Role{types.Admin, types.Owner}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "SetPolicyUnknownRole",
+			method: http.MethodPut,
+			path:   "/2fa/policy",
+			body:   `{"roles":[42]}`,
+			user:   admin,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", admin).Return(nil)
+				m.On("SetRequiredRoles", []types.Role{42}).Return(services.ErrUnknownRole)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "SetPolicyNotAdmin",
+			method: http.MethodPut,
+			path:   "/2fa/policy",
+			body:   `{"roles":[]}`,
+			user:   user,
+			setup: func(m *MockTwoFactorService, a *MockAuthorizationService) {
+				a.On("AuthorizeAdmin", user).Return(services.ErrForbidden)
+			},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "WrongMethod",
+			method:         http.MethodGet,
+			path:           "/2fa/enroll",
+			user:           user,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "UnknownAction",
+			method:         http.MethodPost,
+			path:           "/2fa/sms",
+			user:           user,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockService := new(MockTwoFactorService)
+			mockAuthz := new(MockAuthorizationService)
+			if tc.setup != nil {
+				tc.setup(mockService, mockAuthz)
+			}
+			th := &TwoFactorHandler{TwoFactorService: mockService, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), tc.user))
+			rr := httptest.NewRecorder()
+			th.TwoFactorHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v, body %q", rr.Code, tc.expectedStatus, rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			mockService.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type UserHandler struct {
+	UserService          services.UserService
+	AuthorizationService services.AuthorizationService
+}
+
+type createUserRequest struct {
+	Username string     `json:"username"`
+	Password string     `json:"password"`
+	Email    string     `json:"email"`
+	Role     types.Role `json:"role"`
+}
+
+type updateUserRequest struct {
+	Username *string     `json:"username"`
+	Email    *string     `json:"email"`
+	Role     *types.Role `json:"role"`
+}
+
+type resetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// UsersHandler lets admins manage accounts:
+//
+//	GET    /admin/users                    pages through users, see below
+//	POST   /admin/users                    creates one
+//	GET    /admin/users/{id}               one user
+//	PATCH  /admin/users/{id}               changes their username, email or role
+//	PUT    /admin/users/{id}/password      sets a new password, ending their sessions
+//	POST   /admin/users/{id}/disable       stops them logging in, ending their sessions
+//	POST   /admin/users/{id}/enable        lets them log in again
+//	DELETE /admin/users/{id}               deletes them, see below
+//
+// Listings take limit and offset like directories do, and search to only
+// return users whose username or email contains it.
+//
+// Deleting a user needs files=trash or files=transfer&to={id} to say what
+// becomes of their files. Either way the files and directories they kept at
+// their root are gathered in a directory named after them, which goes to
+// the caller's trash or to the root of the other user.
+//
+// The last enabled admin can't be demoted, disabled or deleted.
+func (uh *UserHandler) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := utils.UserFromContext(r.Context())
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return
+	}
+	if err := uh.AuthorizationService.AuthorizeAdmin(user); err != nil {
+		writeAuthorizationError(w, err)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/users"), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		uh.listUsers(w, r)
+	case r.Method == http.MethodPost && id == "":
+		uh.createUser(w, r)
+	case r.Method == http.MethodGet && id != "" && action == "":
+		uh.getUser(w, id)
+	case r.Method == http.MethodPatch && id != "" && action == "":
+		uh.updateUser(w, r, id)
+	case r.Method == http.MethodPut && id != "" && action == "password":
+		uh.resetPassword(w, r, id)
+	case r.Method == http.MethodPost && id != "" && (action == "disable" || action == "enable"):
+		uh.setDisabled(w, id, action == "disable")
+	case r.Method == http.MethodDelete && id != "" && action == "":
+		uh.deleteUser(w, r, user, id)
+	case id != "" && action != "" && action != "password" && action != "disable" && action != "enable":
+		writeError(w, http.StatusNotFound, "not_found", "User not found")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Invalid request method")
+	}
+}
+
+func (uh *UserHandler) listUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	listing, err := uh.UserService.ListUsers(r.URL.Query().Get("search"), limit, offset)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    listing,
+		Success: true,
+	})
+}
+
+func (uh *UserHandler) createUser(w http.ResponseWriter, r *http.Request) {
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	created, err := uh.UserService.CreateUser(req.Username, req.Password, req.Email, req.Role)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, types.ApiResponse{
+		Data:    created,
+		Message: "User created",
+		Success: true,
+	})
+}
+
+func (uh *UserHandler) getUser(w http.ResponseWriter, id string) {
+	user, err := uh.UserService.GetUser(id)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    user,
+		Success: true,
+	})
+}
+
+func (uh *UserHandler) updateUser(w http.ResponseWriter, r *http.Request, id string) {
+	var req updateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	user, err := uh.UserService.GetUser(id)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	username, email, role := user.Username, user.Email, user.Role
+	if req.Username != nil {
+		username = *req.Username
+	}
+	if req.Email != nil {
+		email = *req.Email
+	}
+	if req.Role != nil {
+		role = *req.Role
+	}
+
+	user, err = uh.UserService.UpdateUser(id, username, email, role)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    user,
+		Message: "User updated",
+		Success: true,
+	})
+}
+
+func (uh *UserHandler) resetPassword(w http.ResponseWriter, r *http.Request, id string) {
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid request body")
+		return
+	}
+	if err := uh.UserService.ResetPassword(id, req.Password); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Message: "Password reset",
+		Success: true,
+	})
+}
+
+func (uh *UserHandler) setDisabled(w http.ResponseWriter, id string, disabled bool) {
+	user, err := uh.UserService.SetDisabled(id, disabled)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	message := "User enabled"
+	if disabled {
+		message = "User disabled"
+	}
+	writeJSON(w, http.StatusOK, types.ApiResponse{
+		Data:    user,
+		Message: message,
+		Success: true,
+	})
+}
+
+func (uh *UserHandler) deleteUser(w http.ResponseWriter, r *http.Request, admin types.User, id string) {
+	query := r.URL.Query()
+	if err := uh.UserService.DeleteUser(admin, id, query.Get("files"), query.Get("to")); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, "not_found", "User not found")
+	case errors.Is(err, services.ErrUsernameTaken), errors.Is(err, services.ErrLastAdmin), errors.Is(err, services.ErrDeleteSelf):
+		writeError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, services.ErrInvalidUser), errors.Is(err, services.ErrUnknownRole), errors.Is(err, services.ErrInvalidTransfer):
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+	default:
+		http.Error(w, "Error managing users", http.StatusInternalServerError)
+	}
+}
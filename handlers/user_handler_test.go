@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"Smd/utils"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+type MockUserService struct {
+	mock.Mock
+}
+
+func (m *MockUserService) ListUsers(search string, limit, offset int) (types.UserListing, error) {
+	args := m.Called(search, limit, offset)
+	return args.Get(0).(types.UserListing), args.Error(1)
+}
+
+func (m *MockUserService) GetUser(id string) (types.User, error) {
+	args := m.Called(id)
+	return args.Get(0).(types.User), args.Error(1)
+}
+
+func (m *MockUserService) CreateUser(username, password, email string, role types.Role) (types.User, error) {
+	args := m.Called(username, password, email, role)
+	return args.Get(0).(types.User), args.Error(1)
+}
+
+func (m *MockUserService) UpdateUser(id, username, email string, role types.Role) (types.User, error) {
+	args := m.Called(id, username, email, role)
+	return args.Get(0).(types.User), args.Error(1)
+}
+
+func (m *MockUserService) ResetPassword(id, password string) error {
+	args := m.Called(id, password)
+	return args.Error(0)
+}
+
+func (m *MockUserService) SetDisabled(id string, disabled bool) (types.User, error) {
+	args := m.Called(id, disabled)
+	return args.Get(0).(types.User), args.Error(1)
+}
+
+func (m *MockUserService) DeleteUser(admin types.User, id, files, transferTo string) error {
+	args := m.Called(admin, id, files, transferTo)
+	return args.Error(0)
+}
+
+func TestUsersHandler(t *testing.T) {
+	admin := types.User{ID: "1", Username: "admin", Role: types.Admin}
+	regular := types.User{ID: "2", Username: "bob", Role: types.Regular}
+	alice := types.User{ID: "3", Username: "alice", Password: "$argon2id$hash", Email: "alice@example.com", Role: types.Regular}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		user           types.User
+		setup          func(mu *MockUserService)
+		expectedStatus int
+	}{
+		{
+			name:   "List",
+			method: http.MethodGet,
+			path:   "/admin/users?search=ali&limit=10&offset=20",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("ListUsers", "ali", 10, 20).Return(types.UserListing{Users: []types.User{alice}, Total: 21, Limit: 10, Offset: 20}, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "ListBadLimit",
+			method:         http.MethodGet,
+			path:           "/admin/users?limit=0",
+			user:           admin,
+			setup:          func(mu *MockUserService) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Create",
+			method: http.MethodPost,
+			path:   "/admin/users",
+			body:   `{"username":"alice","password":"secret","email":"alice@example.com","role":2}`,
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("CreateUser", "alice", "secret", "alice@example.com", types.Regular).Return(alice, nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "CreateTaken",
+			method: http.MethodPost,
+			path:   "/admin/users",
+			body:   `{"username":"alice","password":"secret","role":2}`,
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("CreateUser", "alice", "secret", "", types.Regular).Return(types.User{}, services.ErrUsernameTaken)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "CreateUnknownRole",
+			method: http.MethodPost,
+			path:   "/admin/users",
+			body:   `{"username":"alice","password":"secret","role":9}`,
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("CreateUser", "alice", "secret", "", types.Role(9)).Return(types.User{}, services.ErrUnknownRole)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "Get",
+			method: http.MethodGet,
+			path:   "/admin/users/3",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("GetUser", "3").Return(alice, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "GetMissing",
+			method: http.MethodGet,
+			path:   "/admin/users/9",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("GetUser", "9").Return(types.User{}, services.ErrUserNotFound)
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:   "ChangeRole",
+			method: http.MethodPatch,
+			path:   "/admin/users/3",
+			body:   `{"role":0}`,
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("GetUser", "3").Return(alice, nil)
+				mu.On("UpdateUser", "3", "alice", "alice@example.com", types.Admin).Return(alice, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "DemoteLastAdmin",
+			method: http.MethodPatch,
+			path:   "/admin/users/1",
+			body:   `{"role":2}`,
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("GetUser", "1").Return(admin, nil)
+				mu.On("UpdateUser", "1", "admin", "", types.Regular).Return(types.User{}, services.ErrLastAdmin)
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:   "ResetPassword",
+			method: http.MethodPut,
+			path:   "/admin/users/3/password",
+			body:   `{"password":"new secret"}`,
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("ResetPassword", "3", "new secret").Return(nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Disable",
+			method: http.MethodPost,
+			path:   "/admin/users/3/disable",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("SetDisabled", "3", true).Return(alice, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "Enable",
+			method: http.MethodPost,
+			path:   "/admin/users/3/enable",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("SetDisabled", "3", false).Return(alice, nil)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "DeleteToTrash",
+			method: http.MethodDelete,
+			path:   "/admin/users/3?files=trash",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("DeleteUser", admin, "3", services.DeletedFilesTrash, "").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "DeleteTransfer",
+			method: http.MethodDelete,
+			path:   "/admin/users/3?files=transfer&to=2",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("DeleteUser", admin, "3", services.DeletedFilesTransfer, "2").Return(nil)
+			},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:   "DeleteWithoutPolicy",
+			method: http.MethodDelete,
+			path:   "/admin/users/3",
+			user:   admin,
+			setup: func(mu *MockUserService) {
+				mu.On("DeleteUser", admin, "3", "", "").Return(services.ErrInvalidTransfer)
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "UnknownAction",
+			method:         http.MethodPost,
+			path:           "/admin/users/3/promote",
+			user:           admin,
+			setup:          func(mu *MockUserService) {},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "WrongMethod",
+			method:         http.MethodPut,
+			path:           "/admin/users",
+			user:           admin,
+			setup:          func(mu *MockUserService) {},
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "NotAdmin",
+			method:         http.MethodGet,
+			path:           "/admin/users",
+			user:           regular,
+			setup:          func(mu *MockUserService) {},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockUsers := new(MockUserService)
+			mockAuthz := new(MockAuthorizationService)
+			tc.setup(mockUsers)
+			if tc.user.Role == types.Admin {
+				mockAuthz.On("AuthorizeAdmin", tc.user).Return(nil)
+			} else {
+				mockAuthz.On("AuthorizeAdmin", tc.user).Return(services.ErrForbidden)
+			}
+			uh := UserHandler{UserService: mockUsers, AuthorizationService: mockAuthz}
+
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(utils.WithUser(req.Context(), tc.user))
+			rr := httptest.NewRecorder()
+			uh.UsersHandler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+			if strings.Contains(rr.Body.String(), "argon2id") {
+				t.Errorf("response leaks the password hash: %s", rr.Body.String())
+			}
+			if tc.expectedStatus == http.StatusForbidden {
+				assertApiError(t, rr, http.StatusForbidden)
+			}
+			mockUsers.AssertExpectations(t)
+			mockAuthz.AssertExpectations(t)
+		})
+	}
+}
+
+func TestUsersHandlerListing(t *testing.T) {
+	admin := types.User{ID: "1", Username: "admin", Role: types.Admin}
+	mockUsers := new(MockUserService)
+	mockUsers.On("ListUsers", "", 100, 0).Return(types.UserListing{
+		Users: []types.User{{ID: "3", Username: "alice", Password: "$argon2id$hash", Disabled: true}},
+		Total: 1,
+		Limit: 100,
+	}, nil)
+	mockAuthz := new(MockAuthorizationService)
+	mockAuthz.On("AuthorizeAdmin", admin).Return(nil)
+	uh := UserHandler{UserService: mockUsers, AuthorizationService: mockAuthz}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	req = req.WithContext(utils.WithUser(req.Context(), admin))
+	rr := httptest.NewRecorder()
+	uh.UsersHandler(rr, req)
+
+	var resp struct {
+		Data map[string]interface{}
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := resp.Data["Users"].([]interface{})
+	if len(users) != 1 || resp.Data["Total"] != float64(1) {
+		t.Fatalf("got listing %v", resp.Data)
+	}
+	user := users[0].(map[string]interface{})
+	if _, ok := user["Password"]; ok || user["Disabled"] != true || user["Username"] != "alice" {
+		t.Errorf("got user %v", user)
+	}
+}
@@ -4,13 +4,31 @@ import (
 	handlers "Smd/handlers"
 	"Smd/services"
 	"Smd/types"
+	"Smd/utils"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(types.NewDatabase(), os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if err := runRotateKeysCommand(types.NewDatabase()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	port := os.Getenv("PORT")
 	maxFileSize := os.Getenv("MAX_FILE_SIZE")
 	if port == "" {
@@ -20,27 +38,230 @@ func main() {
 		maxFileSize = "100000000"
 	}
 
-	fileService := services.NewFileService()
+	maxFileSizeBytes, err := strconv.ParseInt(maxFileSize, 10, 64)
+	if err != nil {
+		panic(fmt.Errorf("invalid MAX_FILE_SIZE: %v", err))
+	}
+	trashRetentionDays := 30
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		trashRetentionDays, err = strconv.Atoi(v)
+		if err != nil || trashRetentionDays < 1 {
+			panic(fmt.Errorf("invalid TRASH_RETENTION_DAYS: %q", v))
+		}
+	}
+
+	// STORAGE_ROOT holds local blobs and, whatever the driver, the staging
+	// areas for uploads still in flight
+	storageRoot := os.Getenv("STORAGE_ROOT")
+	if storageRoot == "" {
+		storageRoot = services.DefaultStoreRoot()
+	}
+	fmt.Println("Creating " + storageRoot + " directory")
+	if err := os.MkdirAll(storageRoot, os.ModePerm); err != nil {
+		panic(err)
+	}
+	blobStore, err := newBlobStore(storageRoot)
+	if err != nil {
+		panic(fmt.Errorf("error configuring storage: %v", err))
+	}
+	keys, err := newKeyring()
+	if err != nil {
+		panic(fmt.Errorf("error loading master keys: %v", err))
+	}
+	if keys == nil {
+		fmt.Println("ALLOW_UNENCRYPTED_BLOBS is set, new blobs will be stored unencrypted")
+	}
+
+	fileService := services.NewFileServiceWithStore(blobStore, filepath.Join(storageRoot, ".tmp"), keys)
+	directoryService := services.NewDirectoryService(fileService)
+	roleService := services.NewRoleService()
+	authorizationService := services.NewAuthorizationService(roleService)
+	trashService := services.NewTrashService(fileService, roleService)
 	fileHandler := &handlers.FileHandler{
-		FileService: fileService,
+		FileService:          fileService,
+		AuthorizationService: authorizationService,
+		TrashService:         trashService,
+		MaxFileSize:          maxFileSizeBytes,
+	}
+	directoryHandler := &handlers.DirectoryHandler{
+		DirectoryService:     directoryService,
+		AuthorizationService: authorizationService,
+		TrashService:         trashService,
+	}
+	trashHandler := &handlers.TrashHandler{
+		TrashService: trashService,
+	}
+	shareHandler := &handlers.ShareHandler{
+		ShareService:         services.NewShareService(fileService, directoryService),
+		FileService:          fileService,
+		AuthorizationService: authorizationService,
+		MaxFileSize:          maxFileSizeBytes,
 	}
-	fmt.Println("Creating ~/StoreMeDaddy directory")
-	homeDir, err := os.UserHomeDir()
+	quotaHandler := &handlers.QuotaHandler{
+		QuotaService:         services.NewQuotaService(),
+		AuthorizationService: authorizationService,
+	}
+	aclHandler := &handlers.AclHandler{
+		AuthorizationService: authorizationService,
+	}
+	uploadService := services.NewUploadServiceWithStagingDir(fileService, filepath.Join(storageRoot, ".uploads"))
+	tusHandler := &handlers.TusHandler{
+		UploadService:        uploadService,
+		AuthorizationService: authorizationService,
+		BasePath:             "/tus/",
+		MaxFileSize:          maxFileSizeBytes,
+	}
+	presignSecret, err := newPresignSecret()
+	if err != nil {
+		panic(fmt.Errorf("error loading presign secret: %v", err))
+	}
+	presignService := services.NewPresignService(presignSecret)
+	presignHandler := &handlers.PresignHandler{
+		PresignService:       presignService,
+		FileService:          fileService,
+		AuthorizationService: authorizationService,
+	}
+	sessionStore, err := newSessionStore()
 	if err != nil {
 		panic(err)
 	}
-	dir := filepath.Join(homeDir, "StoreMeDaddy")
-	err = os.MkdirAll(dir, os.ModePerm)
+	ldapService, err := newLdapService()
+	if err != nil {
+		panic(fmt.Errorf("error configuring ldap: %v", err))
+	}
+	rateLimitStore, err := newRateLimitStore()
+	if err != nil {
+		panic(err)
+	}
+	rateLimitService := services.NewRateLimitService(rateLimitStore)
+	authService := services.NewAuthServiceWithLimits(sessionStore, ldapService, rateLimitService)
+	authHandler := &handlers.AuthHandler{
+		AuthService: authService,
+	}
+	twoFactorHandler := &handlers.TwoFactorHandler{
+		TwoFactorService:     services.NewTwoFactorService(),
+		AuthorizationService: authorizationService,
+	}
+	apiKeyService := services.NewApiKeyService()
+	apiKeyHandler := &handlers.ApiKeyHandler{
+		ApiKeyService:        apiKeyService,
+		AuthorizationService: authorizationService,
+	}
+	userHandler := &handlers.UserHandler{
+		UserService:          services.NewUserService(sessionStore, trashService),
+		AuthorizationService: authorizationService,
+	}
+	roleHandler := &handlers.RoleHandler{
+		RoleService:          roleService,
+		AuthorizationService: authorizationService,
+	}
+	groupHandler := &handlers.GroupHandler{
+		GroupService:         services.NewGroupService(),
+		AuthorizationService: authorizationService,
+	}
+	lockoutHandler := &handlers.LockoutHandler{
+		RateLimitService:     rateLimitService,
+		AuthorizationService: authorizationService,
+	}
+	rateLimits := &utils.RateLimitUtil{
+		Limiter:           rateLimitService,
+		TrustForwardedFor: os.Getenv("TRUST_FORWARDED_FOR") == "true",
+	}
+	loginLimit, err := rateLimitFromEnv("RATE_LIMIT_LOGIN", "10/m")
 	if err != nil {
 		panic(err)
 	}
+	uploadLimit, err := rateLimitFromEnv("RATE_LIMIT_UPLOAD", "60/m")
+	if err != nil {
+		panic(err)
+	}
+	downloadLimit, err := rateLimitFromEnv("RATE_LIMIT_DOWNLOAD", "600/m")
+	if err != nil {
+		panic(err)
+	}
+	authUtil := &utils.AuthUtil{
+		Authenticator: authService,
+		ApiKeys:       apiKeyService,
+		Signatures:    presignService,
+	}
 	fmt.Println("Starting server (modem noises)...")
+	fmt.Println("Registering handlers for /login, /logout and /sessions")
+	http.HandleFunc("/login", rateLimits.Limit("login", loginLimit, authHandler.LoginHandler))
+	http.HandleFunc("/login/2fa", rateLimits.Limit("login", loginLimit, authHandler.SecondFactorHandler))
+	http.HandleFunc("/login/2fa/enroll", rateLimits.Limit("login", loginLimit, authHandler.EnrollForLoginHandler))
+	http.HandleFunc("/logout", authHandler.LogoutHandler)
+	http.HandleFunc("/sessions", authUtil.RequireAuth(authHandler.SessionsHandler))
+	http.HandleFunc("/sessions/", authUtil.RequireAuth(authHandler.SessionsHandler))
+	oidcService, err := newOidcService()
+	if err != nil {
+		panic(fmt.Errorf("error configuring single sign-on: %v", err))
+	}
+	if oidcService != nil {
+		oidcHandler := &handlers.OidcHandler{
+			OidcService: oidcService,
+			AuthService: authService,
+		}
+		fmt.Println("Registering handlers for /login/oidc")
+		http.HandleFunc("/login/oidc", rateLimits.Limit("login", loginLimit, oidcHandler.LoginHandler))
+		http.HandleFunc("/login/oidc/callback", rateLimits.Limit("login", loginLimit, oidcHandler.CallbackHandler))
+	}
+	fmt.Println("Registering handlers for /admin/users")
+	http.HandleFunc("/admin/users", authUtil.RequireAuth(userHandler.UsersHandler))
+	http.HandleFunc("/admin/users/", authUtil.RequireAuth(userHandler.UsersHandler))
+	fmt.Println("Registering handlers for /admin/roles")
+	http.HandleFunc("/admin/roles", authUtil.RequireAuth(roleHandler.RolesHandler))
+	http.HandleFunc("/admin/roles/", authUtil.RequireAuth(roleHandler.RolesHandler))
+	fmt.Println("Registering handlers for /admin/groups and /spaces")
+	http.HandleFunc("/admin/groups", authUtil.RequireAuth(groupHandler.GroupsHandler))
+	http.HandleFunc("/admin/groups/", authUtil.RequireAuth(groupHandler.GroupsHandler))
+	http.HandleFunc("/spaces", authUtil.RequireAuth(groupHandler.SpacesHandler))
+	fmt.Println("Registering handlers for /admin/lockouts")
+	http.HandleFunc("/admin/lockouts", authUtil.RequireAuth(lockoutHandler.LockoutsHandler))
+	http.HandleFunc("/admin/lockouts/", authUtil.RequireAuth(lockoutHandler.LockoutsHandler))
+	fmt.Println("Registering handlers for /2fa")
+	http.HandleFunc("/2fa", authUtil.RequireAuth(twoFactorHandler.TwoFactorHandler))
+	http.HandleFunc("/2fa/", authUtil.RequireAuth(twoFactorHandler.TwoFactorHandler))
+	fmt.Println("Registering handlers for /api-keys")
+	http.HandleFunc("/api-keys", authUtil.RequireAuth(apiKeyHandler.ApiKeysHandler))
+	http.HandleFunc("/api-keys/", authUtil.RequireAuth(apiKeyHandler.ApiKeysHandler))
 	fmt.Println("Registering handler for /upload")
-	http.HandleFunc("/upload", fileHandler.UploadFileHandler)
+	http.HandleFunc("/upload", authUtil.RequireAuthOrSignature(rateLimits.Limit("upload", uploadLimit, fileHandler.UploadFileHandler)))
+	fmt.Println("Registering handler for /files/")
+	http.HandleFunc("/files/", authUtil.RequireAuthOrSignature(rateLimits.Limit("download", downloadLimit, fileHandler.FilesHandler)))
+	fmt.Println("Registering handler for /presign")
+	http.HandleFunc("/presign", authUtil.RequireAuth(presignHandler.PresignHandler))
+	fmt.Println("Registering handlers for /directories")
+	http.HandleFunc("/directories", authUtil.RequireAuth(directoryHandler.DirectoriesHandler))
+	http.HandleFunc("/directories/", authUtil.RequireAuth(directoryHandler.DirectoriesHandler))
+	fmt.Println("Registering handlers for /trash")
+	http.HandleFunc("/trash", authUtil.RequireAuth(trashHandler.TrashHandler))
+	http.HandleFunc("/trash/", authUtil.RequireAuth(trashHandler.TrashHandler))
+	fmt.Println("Registering handlers for /shares and /s/")
+	http.HandleFunc("/shares", authUtil.RequireAuth(shareHandler.SharesHandler))
+	http.HandleFunc("/shares/", authUtil.RequireAuth(shareHandler.SharesHandler))
+	http.HandleFunc("/s/", rateLimits.Limit("download", downloadLimit, shareHandler.PublicShareHandler))
+	fmt.Println("Registering handlers for /quota")
+	http.HandleFunc("/quota", authUtil.RequireAuth(quotaHandler.QuotaHandler))
+	http.HandleFunc("/quota/", authUtil.RequireAuth(quotaHandler.QuotaHandler))
+	fmt.Println("Registering handlers for /acl")
+	http.HandleFunc("/acl", authUtil.RequireAuth(aclHandler.AclEntriesHandler))
+	http.HandleFunc("/acl/", authUtil.RequireAuth(aclHandler.AclEntriesHandler))
+	fmt.Println("Registering handler for /tus/")
+	http.HandleFunc("/tus/", authUtil.RequireAuth(rateLimits.LimitMethod(http.MethodPost, "upload", uploadLimit, tusHandler.TusUploadHandler)))
 	fmt.Println("Handlers registered")
 	fmt.Println("Spinning up database")
 	db := types.NewDatabase()
-	types.Database.CreateDb(db)
+	if err := types.Database.CreateDb(db); err != nil {
+		panic(fmt.Errorf("error migrating database: %v", err))
+	}
+	if err := ensureAdminUser(db, os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD")); err != nil {
+		panic(err)
+	}
+	go pruneVersionsPeriodically(fileService, time.Hour)
+	go purgeTrashPeriodically(trashService, time.Duration(trashRetentionDays)*24*time.Hour, time.Hour)
+	go purgeSessionsPeriodically(sessionStore, 10*time.Minute)
+	go purgeRateLimitsPeriodically(rateLimitService, 10*time.Minute)
+	go purgeUploadsPeriodically(uploadService, time.Hour)
 	fmt.Println("Server started")
 	fmt.Println("Press Ctrl+C to exit")
 	fmt.Println("Listening on port " + port)
@@ -48,3 +269,103 @@ func main() {
 		fmt.Printf("error starting server: %v", err)
 	}
 }
+
+// ensureAdminUser creates the initial admin account so there is someone to log in as
+func ensureAdminUser(db types.Database, username, password string) error {
+	if username == "" || password == "" {
+		return nil
+	}
+	if err := db.Connect(); err != nil {
+		return err
+	}
+	defer db.Disconnect()
+	if _, err := db.GetUser(username); err == nil {
+		return nil
+	}
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return err
+	}
+	hash, err := types.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Creating admin user " + username)
+	return db.InsertUser(types.User{
+		ID:        id,
+		Username:  username,
+		Password:  hash,
+		Role:      types.Admin,
+		CreatedAt: time.Now(),
+	})
+}
+
+// pruneVersionsPeriodically enforces day based version retention, which
+// otherwise only runs when a file gets a new version
+func pruneVersionsPeriodically(fileService services.FileService, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := fileService.PruneAllVersions()
+		if err != nil {
+			fmt.Printf("error pruning file versions: %v\n", err)
+		}
+		if n > 0 {
+			fmt.Printf("Pruned %d file versions\n", n)
+		}
+	}
+}
+
+// purgeTrashPeriodically deletes trashed items once they are older than
+// retention, along with any blobs only they referenced
+func purgeTrashPeriodically(trashService services.TrashService, retention, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := trashService.PurgeDeletedBefore(time.Now().Add(-retention))
+		if err != nil {
+			fmt.Printf("error purging trash: %v\n", err)
+		}
+		if n > 0 {
+			fmt.Printf("Purged %d trash items\n", n)
+		}
+	}
+}
+
+// purgeSessionsPeriodically drops expired sessions, which are otherwise only
+// removed when someone tries to use them
+func purgeSessionsPeriodically(sessions services.SessionStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := sessions.PurgeExpired(time.Now())
+		if err != nil {
+			fmt.Printf("error purging sessions: %v\n", err)
+		}
+		if n > 0 {
+			fmt.Printf("Purged %d expired sessions\n", n)
+		}
+	}
+}
+
+// purgeRateLimitsPeriodically drops refilled buckets and forgotten failed
+// logins, which otherwise stay until the same caller comes back
+func purgeRateLimitsPeriodically(limits services.RateLimitService, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := limits.PurgeExpired()
+		if err != nil {
+			fmt.Printf("error purging rate limits: %v\n", err)
+		}
+		if n > 0 {
+			fmt.Printf("Purged %d rate limit entries\n", n)
+		}
+	}
+}
+
+// purgeUploadsPeriodically removes resumable uploads abandoned for longer than
+// UploadTTL, along with their staged chunks
+func purgeUploadsPeriodically(uploads services.UploadService, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := uploads.PurgeAbandoned(time.Now().Add(-services.UploadTTL))
+		if err != nil {
+			fmt.Printf("error purging uploads: %v\n", err)
+		}
+		if n > 0 {
+			fmt.Printf("Purged %d abandoned uploads\n", n)
+		}
+	}
+}
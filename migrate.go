@@ -0,0 +1,55 @@
+package main
+
+import (
+	"Smd/types"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// runMigrateCommand handles `Smd migrate [status|up|down [steps]]`
+func runMigrateCommand(db types.Database, args []string) error {
+	if err := db.Connect(); err != nil {
+		return err
+	}
+	defer db.Disconnect()
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "status":
+	case "up":
+		if err := db.Migrate(); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		if err := db.Rollback(steps); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected status, up or down [steps]", command)
+	}
+
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(os.Stdout, "%4d  %-60s %s\n", s.Version, s.Name, state)
+	}
+	return nil
+}
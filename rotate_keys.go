@@ -0,0 +1,32 @@
+package main
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"errors"
+	"fmt"
+)
+
+// runRotateKeysCommand handles `Smd rotate-keys`. After a new master key is
+// appended to the keyring, it rewraps every data key with it so the old key
+// can be removed. Blobs are not rewritten.
+func runRotateKeysCommand(db types.Database) error {
+	keys, err := newKeyring()
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return errors.New("set MASTER_KEY_FILE or MASTER_KEY to rotate keys")
+	}
+	if err := db.Connect(); err != nil {
+		return err
+	}
+	defer db.Disconnect()
+
+	n, err := services.RewrapDataKeys(db, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rewrapped %d data keys with master key %s\n", n, keys.ActiveKeyID())
+	return nil
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrApiKeyNotFound    = errors.New("api key not found")
+	ErrInvalidApiKey     = errors.New("invalid or expired api key")
+	ErrInvalidApiKeySpec = errors.New("an api key needs a name, at least one privilege and an expiry in the future")
+)
+
+// apiKeyTouchInterval limits how often last-used tracking writes to the database
+const apiKeyTouchInterval = time.Minute
+
+// ApiKeyService manages long-lived keys scripts authenticate with in place
+// of a session
+type ApiKeyService interface {
+	// CreateKey saves k for k.UserID and returns it along with the key itself,
+	// which is not stored and can't be shown again
+	CreateKey(k types.ApiKey) (types.ApiKey, string, error)
+	ListKeys(userID string) ([]types.ApiKey, error)
+	RevokeKey(userID, id string) error
+	// Authenticate returns the user key belongs to, with Scope and
+	// ScopeDirectoryID narrowing what they may do to what the key allows
+	Authenticate(key string) (types.User, error)
+}
+
+type apiKeyService struct {
+	db types.Database
+}
+
+func NewApiKeyService() ApiKeyService {
+	ks := &apiKeyService{
+		db: types.NewDatabase(),
+	}
+	err := ks.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ks
+}
+
+func (ks *apiKeyService) CreateKey(k types.ApiKey) (types.ApiKey, string, error) {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" || len(k.Name) > 100 || k.Scope == (types.Privileges{}) ||
+		(!k.ExpiresAt.IsZero() && !k.ExpiresAt.After(time.Now())) {
+		return types.ApiKey{}, "", ErrInvalidApiKeySpec
+	}
+	if _, err := ks.db.GetUserByID(k.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.ApiKey{}, "", ErrUserNotFound
+		}
+		return types.ApiKey{}, "", fmt.Errorf("error getting user: %v", err)
+	}
+	if k.DirectoryID != "" {
+		if _, err := ks.db.GetDirectoryByID(k.DirectoryID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return types.ApiKey{}, "", ErrDirectoryNotFound
+			}
+			return types.ApiKey{}, "", fmt.Errorf("error getting directory: %v", err)
+		}
+	}
+
+	var err error
+	k.ID, err = utils.GenerateToken(16)
+	if err != nil {
+		return types.ApiKey{}, "", err
+	}
+	prefix, err := utils.GenerateToken(6)
+	if err != nil {
+		return types.ApiKey{}, "", err
+	}
+	secret, err := utils.GenerateToken(32)
+	if err != nil {
+		return types.ApiKey{}, "", err
+	}
+	k.Prefix = types.ApiKeyPrefix + prefix
+	key := k.Prefix + "_" + secret
+	k.KeyHash = hashApiKey(key)
+	k.CreatedAt = time.Now()
+	k.LastUsedAt = time.Time{}
+	if err := ks.db.InsertApiKey(k); err != nil {
+		return types.ApiKey{}, "", fmt.Errorf("error saving api key: %v", err)
+	}
+	return k, key, nil
+}
+
+// hashApiKey needs no salt or stretching: keys are 256 random bits, not
+// something a person picked
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ks *apiKeyService) ListKeys(userID string) ([]types.ApiKey, error) {
+	keys, err := ks.db.ListApiKeys(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing api keys: %v", err)
+	}
+	if keys == nil {
+		keys = []types.ApiKey{}
+	}
+	return keys, nil
+}
+
+func (ks *apiKeyService) RevokeKey(userID, id string) error {
+	err := ks.db.DeleteApiKey(userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrApiKeyNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting api key: %v", err)
+	}
+	return nil
+}
+
+func (ks *apiKeyService) Authenticate(key string) (types.User, error) {
+	// Keys look like smd_<prefix>_<secret>
+	i := strings.LastIndexByte(key, '_')
+	if !strings.HasPrefix(key, types.ApiKeyPrefix) || i <= len(types.ApiKeyPrefix) {
+		return types.User{}, ErrInvalidApiKey
+	}
+	k, err := ks.db.GetApiKeyByPrefix(key[:i])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrInvalidApiKey
+		}
+		return types.User{}, fmt.Errorf("error looking up api key: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashApiKey(key)), []byte(k.KeyHash)) != 1 {
+		return types.User{}, ErrInvalidApiKey
+	}
+	now := time.Now()
+	if !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt) {
+		return types.User{}, ErrInvalidApiKey
+	}
+
+	user, err := ks.db.GetUserByID(k.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrInvalidApiKey
+		}
+		return types.User{}, fmt.Errorf("error looking up user: %v", err)
+	}
+	if user.Disabled {
+		return types.User{}, ErrInvalidApiKey
+	}
+	if now.Sub(k.LastUsedAt) >= apiKeyTouchInterval {
+		if err := ks.db.TouchApiKey(k.ID, now); err != nil {
+			fmt.Printf("error recording use of api key %s: %v\n", k.ID, err)
+		}
+	}
+	scope := k.Scope
+	user.Scope = &scope
+	user.ScopeDirectoryID = k.DirectoryID
+	user.ApiKeyID = k.ID
+	return user, nil
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiKeys(t *testing.T) {
+	db := newTestDatabase(t)
+	ks := &apiKeyService{db: db}
+	if err := db.InsertUser(types.User{ID: "u1", Username: "ci", Password: "pw", Role: types.Owner, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	readOnly := types.Privileges{Read: true}
+
+	for _, tt := range []struct {
+		name    string
+		key     types.ApiKey
+		wantErr error
+	}{
+		{name: "NoName", key: types.ApiKey{UserID: "u1", Scope: readOnly}, wantErr: ErrInvalidApiKeySpec},
+		{name: "NoScope", key: types.ApiKey{UserID: "u1", Name: "ci"}, wantErr: ErrInvalidApiKeySpec},
+		{name: "Expired", key: types.ApiKey{UserID: "u1", Name: "ci", Scope: readOnly, ExpiresAt: time.Now().Add(-time.Hour)}, wantErr: ErrInvalidApiKeySpec},
+		{name: "UnknownUser", key: types.ApiKey{UserID: "nobody", Name: "ci", Scope: readOnly}, wantErr: ErrUserNotFound},
+		{name: "UnknownDirectory", key: types.ApiKey{UserID: "u1", Name: "ci", Scope: readOnly, DirectoryID: "nope"}, wantErr: ErrDirectoryNotFound},
+	} {
+		if _, _, err := ks.CreateKey(tt.key); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: CreateKey() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	k, key, err := ks.CreateKey(types.ApiKey{UserID: "u1", Name: " deploy ", Scope: readOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Name != "deploy" || !strings.HasPrefix(key, k.Prefix+"_") || !strings.HasPrefix(k.Prefix, types.ApiKeyPrefix) {
+		t.Errorf("CreateKey() = %+v, %q", k, key)
+	}
+	if strings.Contains(k.KeyHash, key[len(k.Prefix)+1:]) {
+		t.Error("key stored in the clear")
+	}
+
+	user, err := ks.Authenticate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != "u1" || user.Scope == nil || *user.Scope != readOnly {
+		t.Errorf("Authenticate() = %+v, want u1 scoped to read", user)
+	}
+	keys, err := ks.ListKeys("u1")
+	if err != nil || len(keys) != 1 || keys[0].LastUsedAt.IsZero() {
+		t.Errorf("ListKeys() = %+v, %v, want the key with a last use", keys, err)
+	}
+
+	for name, bad := range map[string]string{
+		"WrongSecret": k.Prefix + "_" + strings.Repeat("0", 64),
+		"NoSecret":    k.Prefix,
+		"Session":     "not-a-key",
+		"UnknownKey":  types.ApiKeyPrefix + "000000000000_" + strings.Repeat("0", 64),
+	} {
+		if _, err := ks.Authenticate(bad); !errors.Is(err, ErrInvalidApiKey) {
+			t.Errorf("%s: Authenticate() error = %v, want ErrInvalidApiKey", name, err)
+		}
+	}
+
+	if err := ks.RevokeKey("someone else", k.ID); !errors.Is(err, ErrApiKeyNotFound) {
+		t.Errorf("RevokeKey() of another user's key error = %v, want ErrApiKeyNotFound", err)
+	}
+	if err := ks.RevokeKey("u1", k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Authenticate(key); !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("Authenticate() after RevokeKey() error = %v, want ErrInvalidApiKey", err)
+	}
+}
+
+func TestApiKeyExpiry(t *testing.T) {
+	db := newTestDatabase(t)
+	ks := &apiKeyService{db: db}
+	if err := db.InsertUser(types.User{ID: "u1", Username: "ci", Password: "pw", Role: types.Owner, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	k, key, err := ks.CreateKey(types.ApiKey{UserID: "u1", Name: "ci", Scope: types.Privileges{Read: true}, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteApiKey("u1", k.ID); err != nil {
+		t.Fatal(err)
+	}
+	k.ExpiresAt = time.Now().Add(-time.Second)
+	if err := db.InsertApiKey(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Authenticate(key); !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("Authenticate() of an expired key error = %v, want ErrInvalidApiKey", err)
+	}
+}
+
+func TestAuthorizeApiKeyScope(t *testing.T) {
+	db := newTestDatabase(t)
+	as := &authorizationService{db: db, roles: newTestRoleService(db)}
+	ds := &directoryService{db: db, fileService: newTestFileService(t, db)}
+	build, _ := ds.CreateDirectory("u1", "build", "")
+	out, _ := ds.CreateDirectory("u1", "out", build.ID)
+	other, _ := ds.CreateDirectory("u1", "other", "")
+	readOnly := types.Privileges{Read: true}
+	everything := types.Privileges{Read: true, Write: true, Delete: true, CreateDirectories: true, AddUsers: true}
+
+	owner := types.User{ID: "u1", Role: types.Owner}
+	scoped := owner
+	scoped.Scope = &readOnly
+	confined := owner
+	confined.Scope = &everything
+	confined.ScopeDirectoryID = build.ID
+	admin := types.User{ID: "u9", Role: types.Admin, Scope: &readOnly}
+
+	for _, tt := range []struct {
+		name        string
+		user        types.User
+		directoryID string
+		action      Action
+		wantErr     error
+	}{
+		{name: "ScopedRead", user: scoped, directoryID: out.ID, action: ActionRead},
+		{name: "ScopedWrite", user: scoped, directoryID: out.ID, action: ActionWrite, wantErr: ErrForbidden},
+		{name: "ConfinedBelow", user: confined, directoryID: out.ID, action: ActionWrite},
+		{name: "ConfinedElsewhere", user: confined, directoryID: other.ID, action: ActionRead, wantErr: ErrForbidden},
+		{name: "ConfinedRoot", user: confined, directoryID: "", action: ActionRead, wantErr: ErrForbidden},
+		// A key without AddUsers doesn't get the admin bypass
+		{name: "ScopedAdmin", user: admin, directoryID: other.ID, action: ActionRead, wantErr: ErrForbidden},
+	} {
+		if err := as.AuthorizeDirectory(tt.user, tt.directoryID, tt.action); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: AuthorizeDirectory() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if err := as.AuthorizeFile(confined, types.File{ID: "f1", OwnerID: "u1"}, ActionRead); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeFile() of a root file by a confined key error = %v, want ErrForbidden", err)
+	}
+	if err := as.AuthorizeAdmin(admin); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeAdmin() with a read only key error = %v, want ErrForbidden", err)
+	}
+	if err := as.AuthorizeAclChange(scoped, "", out.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeAclChange() with a read only key error = %v, want ErrForbidden", err)
+	}
+	if err := as.AuthorizeAclChange(confined, "", other.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeAclChange() outside a confined key's directory error = %v, want ErrForbidden", err)
+	}
+	if err := as.AuthorizeAclChange(confined, "", out.ID); err != nil {
+		t.Errorf("AuthorizeAclChange() inside a confined key's directory error = %v", err)
+	}
+	confinedAdmin := types.User{ID: "u9", Role: types.Admin, Scope: &everything, ScopeDirectoryID: build.ID}
+	if err := as.AuthorizeAdmin(confinedAdmin); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeAdmin() with a confined key error = %v, want ErrForbidden", err)
+	}
+}
@@ -0,0 +1,410 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidSession     = errors.New("invalid or expired session")
+	ErrInvalidChallenge   = errors.New("invalid or expired login challenge")
+	ErrAccountDisabled    = errors.New("account is disabled")
+)
+
+const (
+	// DefaultSessionTTL is how long an issued auth token stays valid
+	DefaultSessionTTL = 24 * time.Hour
+	// LoginChallengeTTL is how long a user has to enter their second factor
+	LoginChallengeTTL    = 5 * time.Minute
+	maxChallengeAttempts = 5
+)
+
+type AuthService interface {
+	// Login returns a new session, or for users who have or need two-factor
+	// authentication a challenge that CompleteLogin turns into one
+	Login(username, password string) (types.Session, types.LoginChallenge, error)
+	// CompleteLogin answers a challenge with an authentication or recovery
+	// code. If the challenge required enrollment, code confirms it and the
+	// new recovery codes are returned with the session.
+	CompleteLogin(challenge, code string) (types.Session, []string, error)
+	// LoginVerified logs in a user whose identity was checked some other way,
+	// such as by an identity provider. Like Login it returns a challenge
+	// instead of a session if they have or need two-factor authentication.
+	LoginVerified(user types.User) (types.Session, types.LoginChallenge, error)
+	// EnrollForLogin starts two-factor enrollment for the user a challenge is
+	// for, using up one of its attempts
+	EnrollForLogin(challenge string) (types.TotpEnrollment, error)
+	Logout(token string) error
+	// Authenticate returns the user token belongs to, pushing the session's
+	// expiry back so it lasts as long as it keeps being used
+	Authenticate(token string) (types.User, error)
+	// GetSession returns the live session token belongs to, without
+	// renewing it
+	GetSession(token string) (types.Session, error)
+	ListSessions(userID string) ([]types.Session, error)
+	RevokeSession(userID, sessionID string) error
+	// LogoutEverywhere ends all of the user's sessions, returning how many
+	LogoutEverywhere(userID string) (int, error)
+}
+
+type authService struct {
+	db         types.Database
+	sessions   SessionStore
+	twoFactor  TwoFactorService
+	directory  LdapService
+	limits     RateLimitService // Locks usernames out after failed logins when set
+	sessionTTL time.Duration
+}
+
+// NewAuthService keeps sessions in the database
+func NewAuthService() AuthService {
+	return NewAuthServiceWithSessions(NewDatabaseSessionStore())
+}
+
+func NewAuthServiceWithSessions(sessions SessionStore) AuthService {
+	return NewAuthServiceWithDirectory(sessions, nil)
+}
+
+// NewAuthServiceWithDirectory checks passwords against directory, when it
+// isn't nil, before local users
+func NewAuthServiceWithDirectory(sessions SessionStore, directory LdapService) AuthService {
+	return NewAuthServiceWithLimits(sessions, directory, nil)
+}
+
+// NewAuthServiceWithLimits also locks usernames out with limits after too
+// many failed logins
+func NewAuthServiceWithLimits(sessions SessionStore, directory LdapService, limits RateLimitService) AuthService {
+	as := &authService{
+		db:         types.NewDatabase(),
+		sessions:   sessions,
+		directory:  directory,
+		limits:     limits,
+		sessionTTL: DefaultSessionTTL,
+	}
+	err := as.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+	as.twoFactor = &twoFactorService{db: as.db, now: time.Now}
+
+	return as
+}
+
+func (as *authService) Login(username, password string) (types.Session, types.LoginChallenge, error) {
+	if err := as.checkLockout(username); err != nil {
+		return types.Session{}, types.LoginChallenge{}, err
+	}
+	user, err := as.checkPassword(username, password)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			as.loginFailed(username)
+		}
+		return types.Session{}, types.LoginChallenge{}, err
+	}
+	// Disabled accounts are only reported by LoginVerified, once the password
+	// is right, so it doesn't give away who exists
+	session, challenge, err := as.LoginVerified(user)
+	if err != nil {
+		return types.Session{}, types.LoginChallenge{}, err
+	}
+	if challenge.Token == "" {
+		as.loginSucceeded(username)
+	}
+	return session, challenge, nil
+}
+
+func (as *authService) LoginVerified(user types.User) (types.Session, types.LoginChallenge, error) {
+	if user.Disabled {
+		return types.Session{}, types.LoginChallenge{}, ErrAccountDisabled
+	}
+
+	status, err := as.twoFactor.Status(user)
+	if err != nil {
+		return types.Session{}, types.LoginChallenge{}, err
+	}
+	if status.Enabled || status.Required {
+		challenge, err := as.newChallenge(user.ID)
+		if err != nil {
+			return types.Session{}, types.LoginChallenge{}, err
+		}
+		challenge.EnrollmentRequired = !status.Enabled
+		return types.Session{}, challenge, nil
+	}
+	session, err := as.startSession(user.ID)
+	if err != nil {
+		return types.Session{}, types.LoginChallenge{}, err
+	}
+	return session, types.LoginChallenge{}, nil
+}
+
+// checkLockout returns an *AccountLockedError if username is locked out.
+// Passwords aren't checked while it is, so they can't be guessed.
+func (as *authService) checkLockout(username string) error {
+	if as.limits == nil {
+		return nil
+	}
+	return as.limits.CheckLogin(username)
+}
+
+// loginFailed counts a failed password or code towards locking username out
+func (as *authService) loginFailed(username string) {
+	if as.limits == nil {
+		return
+	}
+	if err := as.limits.LoginFailed(username); err != nil {
+		fmt.Printf("error counting failed login for %s: %v\n", username, err)
+	}
+}
+
+// loginSucceeded clears username's failed logins once a session is issued;
+// a right password alone doesn't, or the second factor could be guessed
+// without end
+func (as *authService) loginSucceeded(username string) {
+	if as.limits == nil {
+		return
+	}
+	if err := as.limits.LoginSucceeded(username); err != nil {
+		fmt.Printf("error clearing failed logins for %s: %v\n", username, err)
+	}
+}
+
+// rehashPassword replaces a user's password hash with one made with the
+// current algorithm and parameters. Plaintext rows are hashed by migration
+// 23, so for them this is only a fallback.
+func (as *authService) rehashPassword(userID, password string) error {
+	hash, err := types.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return as.db.UpdateUserPassword(userID, hash)
+}
+
+// checkPassword returns the user username and password log in as, trying
+// the directory first
+func (as *authService) checkPassword(username, password string) (types.User, error) {
+	if as.directory != nil {
+		user, err := as.directory.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		}
+		// Local users can still log in when the directory turns them down or
+		// is unreachable; directory users' local passwords are unguessable
+		if !errors.Is(err, ErrInvalidCredentials) && !errors.Is(err, ErrNotDirectoryUser) {
+			fmt.Printf("error checking password against the directory: %v\n", err)
+		}
+	}
+
+	user, err := as.db.GetUser(username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Burn the same time as a real check so unknown usernames can't be timed
+			types.VerifyPassword(password, dummyPasswordHash())
+			return types.User{}, ErrInvalidCredentials
+		}
+		return types.User{}, fmt.Errorf("error looking up user: %v", err)
+	}
+	match, needsRehash, err := types.VerifyPassword(password, user.Password)
+	if err != nil {
+		return types.User{}, fmt.Errorf("error verifying password: %v", err)
+	}
+	if !match {
+		return types.User{}, ErrInvalidCredentials
+	}
+	if needsRehash {
+		if err := as.rehashPassword(user.ID, password); err != nil {
+			fmt.Printf("error upgrading password hash for user %s: %v\n", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+func (as *authService) startSession(userID string) (types.Session, error) {
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.Session{}, err
+	}
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		return types.Session{}, err
+	}
+	now := time.Now()
+	session := types.Session{
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ID:         id,
+		UserID:     userID,
+		Token: types.AuthToken{
+			Token:     token,
+			ExpiresAt: now.Add(as.sessionTTL),
+		},
+	}
+	if err := as.sessions.Create(session); err != nil {
+		return types.Session{}, err
+	}
+	return session, nil
+}
+
+func (as *authService) newChallenge(userID string) (types.LoginChallenge, error) {
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		return types.LoginChallenge{}, err
+	}
+	now := time.Now()
+	// Challenges are short lived, so clearing out old ones here keeps the
+	// table small without a job of its own
+	if _, err := as.db.DeleteExpiredLoginChallenges(now); err != nil {
+		fmt.Printf("error deleting expired login challenges: %v\n", err)
+	}
+	challenge := types.LoginChallenge{
+		ExpiresAt: now.Add(LoginChallengeTTL),
+		Token:     token,
+		UserID:    userID,
+	}
+	if err := as.db.InsertLoginChallenge(challenge); err != nil {
+		return types.LoginChallenge{}, fmt.Errorf("error saving login challenge: %v", err)
+	}
+	return challenge, nil
+}
+
+func (as *authService) CompleteLogin(challengeToken, code string) (types.Session, []string, error) {
+	user, err := as.challengeUser(challengeToken)
+	if err != nil {
+		return types.Session{}, nil, err
+	}
+	if err := as.checkLockout(user.Username); err != nil {
+		return types.Session{}, nil, err
+	}
+	status, err := as.twoFactor.Status(user)
+	if err != nil {
+		return types.Session{}, nil, err
+	}
+
+	var recoveryCodes []string
+	switch {
+	case status.Enabled:
+		err = as.twoFactor.Verify(user, code)
+	case status.Required:
+		recoveryCodes, err = as.twoFactor.ConfirmEnrollment(user, code)
+	}
+	// Otherwise two-factor authentication was turned off since the password
+	// was checked, and the challenge is just a session waiting to be issued
+	if err != nil {
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			as.loginFailed(user.Username)
+		}
+		return types.Session{}, nil, err
+	}
+
+	if err := as.db.DeleteLoginChallenge(challengeToken); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Session{}, nil, ErrInvalidChallenge
+		}
+		return types.Session{}, nil, fmt.Errorf("error deleting login challenge: %v", err)
+	}
+	session, err := as.startSession(user.ID)
+	if err != nil {
+		return types.Session{}, nil, err
+	}
+	as.loginSucceeded(user.Username)
+	return session, recoveryCodes, nil
+}
+
+func (as *authService) EnrollForLogin(challengeToken string) (types.TotpEnrollment, error) {
+	user, err := as.challengeUser(challengeToken)
+	if err != nil {
+		return types.TotpEnrollment{}, err
+	}
+	return as.twoFactor.BeginEnrollment(user)
+}
+
+// challengeUser counts an attempt at answering the challenge and returns the
+// user it is for. Attempts are counted before any code is checked, so guesses
+// made in parallel can't get past the limit.
+func (as *authService) challengeUser(challengeToken string) (types.User, error) {
+	err := as.db.UseLoginChallengeAttempt(challengeToken, maxChallengeAttempts, time.Now())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrInvalidChallenge
+		}
+		return types.User{}, fmt.Errorf("error checking login challenge: %v", err)
+	}
+	challenge, err := as.db.GetLoginChallenge(challengeToken)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrInvalidChallenge
+		}
+		return types.User{}, fmt.Errorf("error looking up login challenge: %v", err)
+	}
+	user, err := as.db.GetUserByID(challenge.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrInvalidChallenge
+		}
+		return types.User{}, fmt.Errorf("error looking up user: %v", err)
+	}
+	if user.Disabled {
+		return types.User{}, ErrAccountDisabled
+	}
+	return user, nil
+}
+
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := types.HashPassword("dummy password")
+	return hash
+})
+
+func (as *authService) Logout(token string) error {
+	return as.sessions.Delete(token)
+}
+
+func (as *authService) Authenticate(token string) (types.User, error) {
+	session, err := as.sessions.Get(token)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSession) {
+			as.sessions.Delete(token)
+		}
+		return types.User{}, err
+	}
+	user, err := as.db.GetUserByID(session.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrInvalidSession
+		}
+		return types.User{}, fmt.Errorf("error looking up user: %v", err)
+	}
+	if user.Disabled {
+		return types.User{}, ErrInvalidSession
+	}
+
+	// Only renew once a tenth of the TTL has been used up, so busy clients
+	// don't cost a write per request
+	now := time.Now()
+	if session.Token.ExpiresAt.Before(now.Add(as.sessionTTL - as.sessionTTL/10)) {
+		if err := as.sessions.Renew(token, now.Add(as.sessionTTL), now); err != nil {
+			fmt.Printf("error renewing session %s: %v\n", session.ID, err)
+		}
+	}
+	return user, nil
+}
+
+func (as *authService) GetSession(token string) (types.Session, error) {
+	return as.sessions.Get(token)
+}
+
+func (as *authService) ListSessions(userID string) ([]types.Session, error) {
+	return as.sessions.ListByUser(userID)
+}
+
+func (as *authService) RevokeSession(userID, sessionID string) error {
+	return as.sessions.DeleteByID(userID, sessionID)
+}
+
+func (as *authService) LogoutEverywhere(userID string) (int, error) {
+	return as.sessions.DeleteByUser(userID)
+}
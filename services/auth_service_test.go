@@ -0,0 +1,149 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a connected database with a fresh schema in a temp dir
+func newTestDatabase(t *testing.T) types.Database {
+	t.Helper()
+	db := types.NewDatabaseWithPath(filepath.Join(t.TempDir(), "Smd.db"))
+	if err := db.CreateDb(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Disconnect() })
+	return db
+}
+
+func TestLogin(t *testing.T) {
+	db := newTestDatabase(t)
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: &twoFactorService{db: db, now: time.Now}, sessionTTL: time.Hour}
+	if err := db.InsertUser(types.User{ID: "u1", Username: "alice", Password: "secret", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{
+			name:     "Success",
+			username: "alice",
+			password: "secret",
+		},
+		{
+			name:     "WrongPassword",
+			username: "alice",
+			password: "nope",
+			wantErr:  ErrInvalidCredentials,
+		},
+		{
+			name:     "UnknownUser",
+			username: "bob",
+			password: "secret",
+			wantErr:  ErrInvalidCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, _, err := as.Login(tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Login() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if session.UserID != "u1" || session.Token.Token == "" {
+				t.Errorf("Login() session = %+v", session)
+			}
+			user, err := as.Authenticate(session.Token.Token)
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if user.Username != "alice" {
+				t.Errorf("Authenticate() user = %+v", user)
+			}
+		})
+	}
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	db := newTestDatabase(t)
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: &twoFactorService{db: db, now: time.Now}, sessionTTL: time.Hour}
+	hash, err := types.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertUser(types.User{ID: "u1", Username: "alice", Password: hash, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Password != hash {
+		t.Fatalf("InsertUser() stored password %q, want the hash as given", stored.Password)
+	}
+
+	defaults := types.DefaultPasswordParams
+	t.Cleanup(func() { types.DefaultPasswordParams = defaults })
+	types.DefaultPasswordParams.Iterations++
+
+	if _, _, err := as.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := db.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded.Password == stored.Password {
+		t.Fatalf("Login() did not rehash password with stronger parameters")
+	}
+	match, needsRehash, err := types.VerifyPassword("secret", upgraded.Password)
+	if err != nil || !match || needsRehash {
+		t.Errorf("VerifyPassword(upgraded) = (%v, %v, %v), want (true, false, nil)", match, needsRehash, err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	db := newTestDatabase(t)
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: &twoFactorService{db: db, now: time.Now}, sessionTTL: time.Hour}
+	if err := db.InsertUser(types.User{ID: "u1", Username: "alice", Password: "secret", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	expired := types.Session{ID: "s1", UserID: "u1", Token: types.AuthToken{Token: "expired", ExpiresAt: time.Now().Add(-time.Minute)}}
+	if err := as.sessions.Create(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := as.Authenticate("expired"); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("Authenticate(expired) error = %v, want %v", err, ErrInvalidSession)
+	}
+	if _, err := db.GetSessionByToken(hashSessionToken("expired")); err == nil {
+		t.Errorf("expected expired session to be removed")
+	}
+	if _, err := as.Authenticate("unknown"); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("Authenticate(unknown) error = %v, want %v", err, ErrInvalidSession)
+	}
+
+	session, _, err := as.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := as.Logout(session.Token.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.Authenticate(session.Token.Token); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("Authenticate() after logout error = %v, want %v", err, ErrInvalidSession)
+	}
+}
@@ -0,0 +1,431 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrForbidden        = errors.New("you do not have permission to do that")
+	ErrAclEntryNotFound = errors.New("acl entry not found")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrInvalidAclEntry  = errors.New("an acl entry needs exactly one of a user or a group, and exactly one of a file or a directory")
+)
+
+// Action is an operation checked against a user's privileges
+type Action int
+
+const (
+	ActionRead Action = iota
+	ActionWrite
+	ActionDelete
+	ActionCreateDirectories
+)
+
+// maxDirectoryDepth stops the ancestor walk should the tree ever contain a loop
+const maxDirectoryDepth = 256
+
+// AuthorizationService decides what a user may do with a file or directory.
+// A user's role sets the actions they may ever perform; the action is then
+// allowed on things they own, on anything inside a directory they own, and
+// wherever an ACL entry on the item or one of its parent directories grants
+// it. Members of a group share what it owns, its team spaces, and what it is
+// granted. Roles that can add users bypass the checks entirely.
+type AuthorizationService interface {
+	// AuthorizeFile returns ErrForbidden unless user may perform action on f
+	AuthorizeFile(user types.User, f types.File, action Action) error
+	// AuthorizeDirectory checks action against a directory, or against the
+	// user's own root when directoryID is empty
+	AuthorizeDirectory(user types.User, directoryID string, action Action) error
+	// AuthorizeAclChange returns ErrForbidden unless user may change who has
+	// access to the file or directory, which takes the Write privilege
+	AuthorizeAclChange(user types.User, fileID, directoryID string) error
+	// AuthorizeAdmin returns ErrForbidden unless user's role can manage users
+	AuthorizeAdmin(user types.User) error
+	// AuthorizeSpaceChange returns ErrForbidden if directoryID is the root of
+	// a team space and user isn't an admin. Only admins create team spaces,
+	// so only they rename, move, delete or share them; members work inside.
+	AuthorizeSpaceChange(user types.User, directoryID string) error
+	GrantAccess(entry types.AclEntry) (types.AclEntry, error)
+	GetAclEntry(id string) (types.AclEntry, error)
+	ListAccess(fileID, directoryID string) ([]types.AclEntry, error)
+	RevokeAccess(id string) error
+}
+
+type authorizationService struct {
+	db    types.Database
+	roles RoleService
+}
+
+func NewAuthorizationService(roles RoleService) AuthorizationService {
+	as := &authorizationService{
+		db:    types.NewDatabase(),
+		roles: roles,
+	}
+	err := as.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return as
+}
+
+func (as *authorizationService) AuthorizeFile(user types.User, f types.File, action Action) error {
+	if err := as.checkScopeDirectory(user, f.DirectoryID); err != nil {
+		return err
+	}
+	role, err := rolePrivileges(as.roles, user)
+	if err != nil {
+		return err
+	}
+	if role.AddUsers {
+		return nil
+	}
+	if !allows(role, action) {
+		return ErrForbidden
+	}
+	if f.OwnerID == user.ID {
+		return nil
+	}
+	principals, err := as.principals(user)
+	if err != nil {
+		return err
+	}
+	if principals[f.OwnerID] {
+		return nil
+	}
+	entries, err := as.db.GetAclEntriesForFile(f.ID)
+	if err != nil {
+		return fmt.Errorf("error getting acl: %v", err)
+	}
+	if grants(entries, principals, action) {
+		return nil
+	}
+	if f.DirectoryID == "" {
+		// Someone else's root
+		return ErrForbidden
+	}
+	return as.authorizeTree(principals, f.DirectoryID, action)
+}
+
+func (as *authorizationService) AuthorizeDirectory(user types.User, directoryID string, action Action) error {
+	if err := as.checkScopeDirectory(user, directoryID); err != nil {
+		return err
+	}
+	role, err := rolePrivileges(as.roles, user)
+	if err != nil {
+		return err
+	}
+	if !role.AddUsers && !allows(role, action) {
+		return ErrForbidden
+	}
+	if directoryID == "" {
+		return nil
+	}
+	if role.AddUsers {
+		// Still report a missing directory as such
+		_, err := as.getDirectory(directoryID)
+		return err
+	}
+	principals, err := as.principals(user)
+	if err != nil {
+		return err
+	}
+	return as.authorizeTree(principals, directoryID, action)
+}
+
+// authorizeTree walks from directoryID up to the root looking for a
+// directory one of principals owns or an entry granting one of them action
+func (as *authorizationService) authorizeTree(principals map[string]bool, directoryID string, action Action) error {
+	for depth := 0; directoryID != "" && depth < maxDirectoryDepth; depth++ {
+		dir, err := as.getDirectory(directoryID)
+		if err != nil {
+			return err
+		}
+		if principals[dir.OwnerID] {
+			return nil
+		}
+		entries, err := as.db.GetAclEntriesForDirectory(dir.ID)
+		if err != nil {
+			return fmt.Errorf("error getting acl: %v", err)
+		}
+		if grants(entries, principals, action) {
+			return nil
+		}
+		directoryID = dir.ParentDirectoryID
+	}
+	return ErrForbidden
+}
+
+func (as *authorizationService) AuthorizeAdmin(user types.User) error {
+	// Administration isn't confined to a directory
+	if user.ScopeDirectoryID != "" {
+		return ErrForbidden
+	}
+	role, err := rolePrivileges(as.roles, user)
+	if err != nil {
+		return err
+	}
+	if !role.AddUsers {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (as *authorizationService) AuthorizeSpaceChange(user types.User, directoryID string) error {
+	if directoryID == "" {
+		return nil
+	}
+	dir, err := as.getDirectory(directoryID)
+	if err != nil {
+		return err
+	}
+	if dir.ParentDirectoryID != "" || dir.OwnerID == user.ID {
+		return nil
+	}
+	if _, err := as.db.GetGroup(dir.OwnerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Someone else's directory rather than a team space
+			return nil
+		}
+		return fmt.Errorf("error getting group: %v", err)
+	}
+	role, err := rolePrivileges(as.roles, user)
+	if err != nil {
+		return err
+	}
+	if !role.AddUsers {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (as *authorizationService) AuthorizeAclChange(user types.User, fileID, directoryID string) error {
+	role, err := rolePrivileges(as.roles, user)
+	if err != nil {
+		return err
+	}
+	// Handing out access writes to the item, whichever key it comes through
+	if !role.Write {
+		return ErrForbidden
+	}
+	if fileID != "" {
+		f, err := as.getFile(fileID)
+		if err != nil {
+			return err
+		}
+		if err := as.checkScopeDirectory(user, f.DirectoryID); err != nil {
+			return err
+		}
+		if role.AddUsers || f.OwnerID == user.ID {
+			return nil
+		}
+		directoryID = f.DirectoryID
+	} else {
+		if err := as.checkScopeDirectory(user, directoryID); err != nil {
+			return err
+		}
+		if role.AddUsers {
+			return nil
+		}
+		if err := as.AuthorizeSpaceChange(user, directoryID); err != nil {
+			return err
+		}
+	}
+	principals, err := as.principals(user)
+	if err != nil {
+		return err
+	}
+	// Only owners hand out access; a grant never lets its holder re-share
+	for depth := 0; directoryID != "" && depth < maxDirectoryDepth; depth++ {
+		dir, err := as.getDirectory(directoryID)
+		if err != nil {
+			return err
+		}
+		if principals[dir.OwnerID] {
+			return nil
+		}
+		directoryID = dir.ParentDirectoryID
+	}
+	return ErrForbidden
+}
+
+func (as *authorizationService) GrantAccess(entry types.AclEntry) (types.AclEntry, error) {
+	if (entry.UserID == "") == (entry.GroupID == "") || (entry.FileID == "") == (entry.DirectoryID == "") {
+		return types.AclEntry{}, ErrInvalidAclEntry
+	}
+	if entry.UserID != "" {
+		if _, err := as.db.GetUserByID(entry.UserID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return types.AclEntry{}, ErrUserNotFound
+			}
+			return types.AclEntry{}, fmt.Errorf("error getting user: %v", err)
+		}
+	} else if _, err := as.db.GetGroup(entry.GroupID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.AclEntry{}, ErrGroupNotFound
+		}
+		return types.AclEntry{}, fmt.Errorf("error getting group: %v", err)
+	}
+	if entry.FileID != "" {
+		if _, err := as.getFile(entry.FileID); err != nil {
+			return types.AclEntry{}, err
+		}
+	} else if _, err := as.getDirectory(entry.DirectoryID); err != nil {
+		return types.AclEntry{}, err
+	}
+
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.AclEntry{}, err
+	}
+	entry.ID = id
+	entry.Privileges.AddUsers = false
+	if err := as.db.InsertAclEntry(entry); err != nil {
+		return types.AclEntry{}, fmt.Errorf("error saving acl entry: %v", err)
+	}
+	return entry, nil
+}
+
+func (as *authorizationService) GetAclEntry(id string) (types.AclEntry, error) {
+	entry, err := as.db.GetAclEntry(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.AclEntry{}, ErrAclEntryNotFound
+		}
+		return types.AclEntry{}, fmt.Errorf("error getting acl entry: %v", err)
+	}
+	return entry, nil
+}
+
+func (as *authorizationService) ListAccess(fileID, directoryID string) ([]types.AclEntry, error) {
+	var entries []types.AclEntry
+	var err error
+	if fileID != "" {
+		entries, err = as.db.GetAclEntriesForFile(fileID)
+	} else {
+		entries, err = as.db.GetAclEntriesForDirectory(directoryID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting acl: %v", err)
+	}
+	if entries == nil {
+		entries = []types.AclEntry{}
+	}
+	return entries, nil
+}
+
+func (as *authorizationService) RevokeAccess(id string) error {
+	if _, err := as.GetAclEntry(id); err != nil {
+		return err
+	}
+	if err := as.db.DeleteAclEntry(id); err != nil {
+		return fmt.Errorf("error deleting acl entry: %v", err)
+	}
+	return nil
+}
+
+func (as *authorizationService) getDirectory(id string) (types.Directory, error) {
+	dir, err := as.db.GetDirectoryByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Directory{}, ErrDirectoryNotFound
+		}
+		return types.Directory{}, fmt.Errorf("error getting directory: %v", err)
+	}
+	return dir, nil
+}
+
+func (as *authorizationService) getFile(id string) (types.File, error) {
+	f, err := as.db.GetFileByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.File{}, ErrFileNotFound
+		}
+		return types.File{}, fmt.Errorf("error getting file: %v", err)
+	}
+	return f, nil
+}
+
+func (as *authorizationService) checkScopeDirectory(user types.User, directoryID string) error {
+	return checkScopeDirectory(as.db, user, directoryID)
+}
+
+// checkScopeDirectory returns ErrForbidden if user is confined to a
+// directory by an API key and directoryID is not it or below it
+func checkScopeDirectory(db types.Database, user types.User, directoryID string) error {
+	if user.ScopeDirectoryID == "" {
+		return nil
+	}
+	for depth := 0; directoryID != "" && depth < maxDirectoryDepth; depth++ {
+		if directoryID == user.ScopeDirectoryID {
+			return nil
+		}
+		dir, err := db.GetDirectoryByID(directoryID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrDirectoryNotFound
+			}
+			return fmt.Errorf("error getting directory: %v", err)
+		}
+		directoryID = dir.ParentDirectoryID
+	}
+	return ErrForbidden
+}
+
+func (as *authorizationService) principals(user types.User) (map[string]bool, error) {
+	return principals(as.db, user)
+}
+
+// principals are the IDs a user acts as: their own and those of the groups
+// they are a member of
+func principals(db types.Database, user types.User) (map[string]bool, error) {
+	groups, err := db.ListGroupsForUser(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting groups: %v", err)
+	}
+	principals := map[string]bool{user.ID: true}
+	for _, g := range groups {
+		principals[g.ID] = true
+	}
+	return principals, nil
+}
+
+// rolePrivileges is what the user's role allows, narrowed to the scope of the
+// API key they authenticated with, if any
+func rolePrivileges(roles RoleService, user types.User) (types.Privileges, error) {
+	role, err := roles.Privileges(user.Role)
+	if err != nil {
+		return types.Privileges{}, err
+	}
+	if user.Scope != nil {
+		return role.Intersect(*user.Scope), nil
+	}
+	return role, nil
+}
+
+func allows(p types.Privileges, action Action) bool {
+	switch action {
+	case ActionRead:
+		return p.Read
+	case ActionWrite:
+		return p.Write
+	case ActionDelete:
+		return p.Delete
+	case ActionCreateDirectories:
+		return p.CreateDirectories
+	}
+	return false
+}
+
+func grants(entries []types.AclEntry, principals map[string]bool, action Action) bool {
+	for _, e := range entries {
+		if (principals[e.UserID] || principals[e.GroupID]) && allows(e.Privileges, action) {
+			return true
+		}
+	}
+	return false
+}
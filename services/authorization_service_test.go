@@ -0,0 +1,159 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthorize(t *testing.T) {
+	db := newTestDatabase(t)
+	as := &authorizationService{db: db, roles: newTestRoleService(db)}
+	ds := &directoryService{db: db, fileService: newTestFileService(t, db)}
+
+	owner := types.User{ID: "u1", Username: "owner", Role: types.Owner}
+	reader := types.User{ID: "u2", Username: "reader", Role: types.Regular}
+	dev := types.User{ID: "u3", Username: "dev", Role: types.Developer}
+	admin := types.User{ID: "u4", Username: "admin", Role: types.Admin}
+	stranger := types.User{ID: "u5", Username: "stranger", Role: types.Owner}
+	for _, u := range []types.User{owner, reader, dev, admin, stranger} {
+		u.Password = "pw"
+		u.CreatedAt = time.Now()
+		if err := db.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shared, _ := ds.CreateDirectory(owner.ID, "shared", "")
+	nested, _ := ds.CreateDirectory(owner.ID, "nested", shared.ID)
+	private, _ := ds.CreateDirectory(owner.ID, "private", "")
+	nestedFile := types.File{ID: "f1", OwnerID: owner.ID, DirectoryID: nested.ID}
+	rootFile := types.File{ID: "f2", OwnerID: owner.ID}
+	if err := db.InsertFile(rootFile); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []types.AclEntry{
+		{UserID: reader.ID, DirectoryID: shared.ID, Privileges: types.Privileges{Read: true, Write: true}},
+		{UserID: dev.ID, DirectoryID: shared.ID, Privileges: types.Privileges{Write: true, Delete: true}},
+		{UserID: stranger.ID, FileID: rootFile.ID, Privileges: types.Privileges{Read: true}},
+	} {
+		if _, err := as.GrantAccess(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileTests := []struct {
+		name    string
+		user    types.User
+		file    types.File
+		action  Action
+		wantErr error
+	}{
+		{name: "OwnerDeletes", user: owner, file: nestedFile, action: ActionDelete},
+		{name: "InheritedRead", user: reader, file: nestedFile, action: ActionRead},
+		{name: "RoleCapsGrant", user: reader, file: nestedFile, action: ActionWrite, wantErr: ErrForbidden},
+		{name: "GrantWithoutAction", user: dev, file: nestedFile, action: ActionRead, wantErr: ErrForbidden},
+		{name: "InheritedWrite", user: dev, file: nestedFile, action: ActionWrite},
+		{name: "RoleForbidsDelete", user: dev, file: nestedFile, action: ActionDelete, wantErr: ErrForbidden},
+		{name: "NoGrant", user: stranger, file: nestedFile, action: ActionRead, wantErr: ErrForbidden},
+		{name: "FileGrant", user: stranger, file: rootFile, action: ActionRead},
+		{name: "FileGrantOnly", user: stranger, file: rootFile, action: ActionDelete, wantErr: ErrForbidden},
+		{name: "OthersRoot", user: reader, file: rootFile, action: ActionRead, wantErr: ErrForbidden},
+		{name: "AdminBypass", user: admin, file: rootFile, action: ActionDelete},
+	}
+	for _, tt := range fileTests {
+		t.Run("File"+tt.name, func(t *testing.T) {
+			if err := as.AuthorizeFile(tt.user, tt.file, tt.action); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AuthorizeFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	dirTests := []struct {
+		name        string
+		user        types.User
+		directoryID string
+		action      Action
+		wantErr     error
+	}{
+		{name: "OwnRoot", user: reader, directoryID: "", action: ActionRead},
+		{name: "OwnRootRoleCap", user: reader, directoryID: "", action: ActionCreateDirectories, wantErr: ErrForbidden},
+		{name: "Inherited", user: dev, directoryID: nested.ID, action: ActionWrite},
+		{name: "NotShared", user: dev, directoryID: private.ID, action: ActionWrite, wantErr: ErrForbidden},
+		{name: "Missing", user: dev, directoryID: "nope", action: ActionWrite, wantErr: ErrDirectoryNotFound},
+		{name: "AdminMissing", user: admin, directoryID: "nope", action: ActionRead, wantErr: ErrDirectoryNotFound},
+		{name: "AdminBypass", user: admin, directoryID: private.ID, action: ActionDelete},
+	}
+	for _, tt := range dirTests {
+		t.Run("Directory"+tt.name, func(t *testing.T) {
+			if err := as.AuthorizeDirectory(tt.user, tt.directoryID, tt.action); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AuthorizeDirectory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := as.AuthorizeAclChange(owner, "", nested.ID); err != nil {
+		t.Errorf("owner AuthorizeAclChange() error = %v", err)
+	}
+	if err := as.AuthorizeAclChange(reader, "", nested.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("grantee AuthorizeAclChange() error = %v, want %v", err, ErrForbidden)
+	}
+}
+
+func TestGrantAndRevokeAccess(t *testing.T) {
+	db := newTestDatabase(t)
+	as := &authorizationService{db: db, roles: newTestRoleService(db)}
+	ds := &directoryService{db: db, fileService: newTestFileService(t, db)}
+	if err := db.InsertUser(types.User{ID: "u2", Username: "bob", Password: "pw", Role: types.Regular, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := ds.CreateDirectory("u1", "docs", "")
+
+	invalid := []struct {
+		name    string
+		entry   types.AclEntry
+		wantErr error
+	}{
+		{name: "NoTarget", entry: types.AclEntry{UserID: "u2"}, wantErr: ErrInvalidAclEntry},
+		{name: "BothTargets", entry: types.AclEntry{UserID: "u2", FileID: "f", DirectoryID: dir.ID}, wantErr: ErrInvalidAclEntry},
+		{name: "UnknownUser", entry: types.AclEntry{UserID: "nobody", DirectoryID: dir.ID}, wantErr: ErrUserNotFound},
+		{name: "MissingDirectory", entry: types.AclEntry{UserID: "u2", DirectoryID: "nope"}, wantErr: ErrDirectoryNotFound},
+		{name: "MissingFile", entry: types.AclEntry{UserID: "u2", FileID: "nope"}, wantErr: ErrFileNotFound},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := as.GrantAccess(tt.entry); !errors.Is(err, tt.wantErr) {
+				t.Errorf("GrantAccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	entry, err := as.GrantAccess(types.AclEntry{UserID: "u2", DirectoryID: dir.ID, Privileges: types.Privileges{Read: true, AddUsers: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID == "" || entry.Privileges.AddUsers {
+		t.Errorf("GrantAccess() = %+v", entry)
+	}
+	entries, err := as.ListAccess("", dir.ID)
+	if err != nil || len(entries) != 1 || entries[0] != entry {
+		t.Errorf("ListAccess() = %+v, %v", entries, err)
+	}
+	if err := as.RevokeAccess(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.RevokeAccess(entry.ID); !errors.Is(err, ErrAclEntryNotFound) {
+		t.Errorf("RevokeAccess() twice error = %v, want %v", err, ErrAclEntryNotFound)
+	}
+
+	// Entries go with the directory they were granted on
+	entry, _ = as.GrantAccess(types.AclEntry{UserID: "u2", DirectoryID: dir.ID, Privileges: types.Privileges{Read: true}})
+	if err := ds.DeleteDirectory(dir.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.GetAclEntry(entry.ID); !errors.Is(err, ErrAclEntryNotFound) {
+		t.Errorf("entry survived its directory: %v", err)
+	}
+}
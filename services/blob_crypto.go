@@ -0,0 +1,351 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encrypted blobs are a header followed by the plaintext split into
+// encryptedChunkSize pieces, each sealed on its own with AES-256-GCM so any
+// chunk can be decrypted without reading the ones before it. The nonce is
+// the chunk index plus a flag marking the final chunk, which is safe because
+// every blob has its own data key and stops chunks being reordered or the
+// blob being truncated.
+const (
+	encryptedChunkSize = 64 << 10
+	encryptionOverhead = 16 // GCM tag per chunk
+	dataKeySize        = 32
+)
+
+var encryptedBlobMagic = []byte("SMDENC01")
+
+var (
+	ErrUnknownMasterKey = errors.New("data key was wrapped by a master key that is not configured")
+	ErrCorruptBlob      = errors.New("encrypted blob is corrupt or was tampered with")
+)
+
+// encryptedHeaderSize is the magic plus the chunk size
+var encryptedHeaderSize = int64(len(encryptedBlobMagic) + 4)
+
+// Keyring holds the master keys that wrap data keys. New data keys are always
+// wrapped by the active key; the others remain only so existing data keys can
+// be unwrapped until they are rotated.
+type Keyring struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+}
+
+// NewKeyring builds a keyring from 32 byte master keys. The last one is active.
+func NewKeyring(masterKeys ...[]byte) (*Keyring, error) {
+	if len(masterKeys) == 0 {
+		return nil, errors.New("no master keys")
+	}
+	kr := &Keyring{keys: map[string]cipher.AEAD{}}
+	for _, key := range masterKeys {
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("master keys must be %d bytes, got %d", dataKeySize, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		kr.activeID = masterKeyID(key)
+		kr.keys[kr.activeID] = aead
+	}
+	return kr, nil
+}
+
+// ParseKeyring reads base64 master keys separated by newlines or commas, as
+// found in a keyfile or environment variable. Blank lines and lines starting
+// with # are skipped. The last key is active.
+func ParseKeyring(text string) (*Keyring, error) {
+	var keys [][]byte
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// ActiveKeyID identifies the master key that wraps new data keys
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.activeID
+}
+
+// masterKeyID fingerprints a master key so rows record which key wrapped them
+// without revealing it
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("smd master key\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newDataKey generates a data key and returns it along with its wrapped form.
+// The blob hash is bound into the wrapping so a wrapped key can't be moved
+// onto another blob's rows.
+func (kr *Keyring) newDataKey(hash string) (dataKey []byte, wrapped string, err error) {
+	dataKey = make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+	wrapped, err = kr.wrap(dataKey, hash)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataKey, wrapped, nil
+}
+
+func (kr *Keyring) wrap(dataKey []byte, hash string) (string, error) {
+	aead := kr.keys[kr.activeID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(hash))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (kr *Keyring) unwrap(wrapped, keyID, hash string) ([]byte, error) {
+	aead, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMasterKey, keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped data key")
+	}
+	dataKey, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(hash))
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %v", err)
+	}
+	return dataKey, nil
+}
+
+// Rewrap unwraps a data key with whichever master key sealed it and wraps it
+// again with the active key. The blob itself is untouched.
+func (kr *Keyring) Rewrap(wrapped, keyID, hash string) (string, error) {
+	dataKey, err := kr.unwrap(wrapped, keyID, hash)
+	if err != nil {
+		return "", err
+	}
+	return kr.wrap(dataKey, hash)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedSize is the stored size of a blob with size bytes of plaintext
+func encryptedSize(size int64) int64 {
+	chunks := (size + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return encryptedHeaderSize + size + chunks*encryptionOverhead
+}
+
+// plaintextSize inverts encryptedSize
+func plaintextSize(stored int64) (int64, error) {
+	body := stored - encryptedHeaderSize
+	full := body / (encryptedChunkSize + encryptionOverhead)
+	rest := body % (encryptedChunkSize + encryptionOverhead)
+	switch {
+	case body < encryptionOverhead:
+		return 0, ErrCorruptBlob
+	case rest == 0:
+		return full * encryptedChunkSize, nil
+	case rest < encryptionOverhead:
+		return 0, ErrCorruptBlob
+	}
+	return full*encryptedChunkSize + rest - encryptionOverhead, nil
+}
+
+func chunkNonce(index int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader yields the encrypted form of size bytes read from src
+type encryptReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	pending   []byte
+	chunk     []byte
+	remaining int64
+	index     int64
+	done      bool
+}
+
+func newEncryptReader(src io.Reader, size int64, dataKey []byte) (io.Reader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedBlobMagic)
+	binary.BigEndian.PutUint32(header[len(encryptedBlobMagic):], encryptedChunkSize)
+	return &encryptReader{
+		src:       src,
+		aead:      aead,
+		pending:   header,
+		chunk:     make([]byte, encryptedChunkSize, encryptedChunkSize+encryptionOverhead),
+		remaining: size,
+	}, nil
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	if len(er.pending) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		n := int64(encryptedChunkSize)
+		if er.remaining < n {
+			n = er.remaining
+		}
+		if _, err := io.ReadFull(er.src, er.chunk[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		er.remaining -= n
+		er.done = er.remaining == 0
+		er.pending = er.aead.Seal(er.chunk[:0], chunkNonce(er.index, er.done), er.chunk[:n], nil)
+		er.index++
+	}
+	n := copy(p, er.pending)
+	er.pending = er.pending[n:]
+	return n, nil
+}
+
+// decryptReader presents the plaintext of an encrypted blob, decrypting
+// only the chunks that are actually read
+type decryptReader struct {
+	src        io.ReadSeekCloser
+	aead       cipher.AEAD
+	chunk      []byte
+	size       int64
+	offset     int64
+	chunkIndex int64 // index of the chunk decrypted into chunk, -1 for none
+	chunks     int64
+}
+
+func newDecryptReader(src io.ReadSeekCloser, dataKey []byte) (io.ReadSeekCloser, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	size, err := plaintextSize(stored)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(encryptedBlobMagic)], encryptedBlobMagic) || binary.BigEndian.Uint32(header[len(encryptedBlobMagic):]) != encryptedChunkSize {
+		return nil, ErrCorruptBlob
+	}
+	chunks := (size + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return &decryptReader{
+		src:        src,
+		aead:       aead,
+		chunk:      make([]byte, 0, encryptedChunkSize+encryptionOverhead),
+		size:       size,
+		chunkIndex: -1,
+		chunks:     chunks,
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	if dr.offset >= dr.size {
+		return 0, io.EOF
+	}
+	index := dr.offset / encryptedChunkSize
+	if index != dr.chunkIndex {
+		if err := dr.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.chunk[dr.offset%encryptedChunkSize:])
+	dr.offset += int64(n)
+	return n, nil
+}
+
+func (dr *decryptReader) load(index int64) error {
+	start := encryptedHeaderSize + index*(encryptedChunkSize+encryptionOverhead)
+	length := int64(encryptedChunkSize) + encryptionOverhead
+	if index == dr.chunks-1 {
+		length = dr.size - index*encryptedChunkSize + encryptionOverhead
+	}
+	if _, err := dr.src.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := dr.chunk[:length]
+	if _, err := io.ReadFull(dr.src, sealed); err != nil {
+		return err
+	}
+	plain, err := dr.aead.Open(sealed[:0], chunkNonce(index, index == dr.chunks-1), sealed, nil)
+	if err != nil {
+		dr.chunkIndex = -1
+		return ErrCorruptBlob
+	}
+	dr.chunk = plain
+	dr.chunkIndex = index
+	return nil
+}
+
+func (dr *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.offset
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	dr.offset = offset
+	return offset, nil
+}
+
+func (dr *decryptReader) Close() error {
+	return dr.src.Close()
+}
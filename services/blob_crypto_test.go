@@ -0,0 +1,270 @@
+package services
+
+import (
+	"Smd/types"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, n int) (*Keyring, [][]byte) {
+	t.Helper()
+	masterKeys := make([][]byte, n)
+	for i := range masterKeys {
+		masterKeys[i] = make([]byte, 32)
+		rand.Read(masterKeys[i])
+	}
+	kr, err := NewKeyring(masterKeys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr, masterKeys
+}
+
+type nopReadSeekCloser struct{ io.ReadSeeker }
+
+func (nopReadSeekCloser) Close() error { return nil }
+
+func encryptForTest(t *testing.T, plaintext, dataKey []byte) []byte {
+	t.Helper()
+	r, err := newEncryptReader(bytes.NewReader(plaintext), int64(len(plaintext)), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestEncryptedBlobRoundTrip(t *testing.T) {
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 5} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		sealed := encryptForTest(t, plaintext, dataKey)
+		if int64(len(sealed)) != encryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted to %d bytes, encryptedSize() = %d", size, len(sealed), encryptedSize(int64(size)))
+		}
+		if n, err := plaintextSize(int64(len(sealed))); err != nil || n != int64(size) {
+			t.Errorf("size %d: plaintextSize() = %d, %v", size, n, err)
+		}
+
+		dr, err := newDecryptReader(nopReadSeekCloser{bytes.NewReader(sealed)}, dataKey)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		got, err := io.ReadAll(dr)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: decrypted %d bytes, %v", size, len(got), err)
+		}
+
+		// Ranges starting anywhere, including across chunk boundaries
+		for _, offset := range []int{0, size / 2, size - 3, encryptedChunkSize - 2} {
+			if offset < 0 || offset >= size {
+				continue
+			}
+			if _, err := dr.Seek(int64(offset), io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			part := make([]byte, min(5, size-offset))
+			if _, err := io.ReadFull(dr, part); err != nil || !bytes.Equal(part, plaintext[offset:offset+len(part)]) {
+				t.Errorf("size %d: read at %d = %x, %v", size, offset, part, err)
+			}
+		}
+		if end, _ := dr.Seek(0, io.SeekEnd); end != int64(size) {
+			t.Errorf("size %d: Seek(0, SeekEnd) = %d", size, end)
+		}
+	}
+}
+
+func TestEncryptedBlobTampering(t *testing.T) {
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	plaintext := make([]byte, 2*encryptedChunkSize+100)
+	sealed := encryptForTest(t, plaintext, dataKey)
+	chunk := encryptedChunkSize + encryptionOverhead
+
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+	}{
+		{
+			name:   "FlippedBit",
+			mutate: func(b []byte) []byte { b[int(encryptedHeaderSize)+chunk+10] ^= 1; return b },
+		},
+		{
+			name: "SwappedChunks",
+			mutate: func(b []byte) []byte {
+				first := append([]byte{}, b[encryptedHeaderSize:int(encryptedHeaderSize)+chunk]...)
+				copy(b[encryptedHeaderSize:], b[int(encryptedHeaderSize)+chunk:int(encryptedHeaderSize)+2*chunk])
+				copy(b[int(encryptedHeaderSize)+chunk:], first)
+				return b
+			},
+		},
+		{
+			name:   "TruncatedToChunkBoundary",
+			mutate: func(b []byte) []byte { return b[:int(encryptedHeaderSize)+2*chunk] },
+		},
+		{
+			name:   "WrongKey",
+			mutate: func(b []byte) []byte { dataKey[0] ^= 1; return b },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := tt.mutate(append([]byte{}, sealed...))
+			dr, err := newDecryptReader(nopReadSeekCloser{bytes.NewReader(tampered)}, dataKey)
+			if err == nil {
+				_, err = io.ReadAll(dr)
+			}
+			if !errors.Is(err, ErrCorruptBlob) {
+				t.Errorf("error = %v, want ErrCorruptBlob", err)
+			}
+		})
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	if _, err := ParseKeyring("not base64"); err == nil {
+		t.Error("ParseKeyring() accepted an invalid key")
+	}
+	if _, err := ParseKeyring("c2hvcnQ="); err == nil {
+		t.Error("ParseKeyring() accepted a short key")
+	}
+	if _, err := ParseKeyring("# no keys\n"); err == nil {
+		t.Error("ParseKeyring() accepted an empty keyring")
+	}
+
+	old := strings.Repeat("A", 43) + "="
+	active := strings.Repeat("B", 43) + "="
+	kr, err := ParseKeyring("# retired\n" + old + "\n\n" + active + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kr.keys) != 2 {
+		t.Errorf("ParseKeyring() loaded %d keys, want 2", len(kr.keys))
+	}
+	single, _ := ParseKeyring(active)
+	if kr.ActiveKeyID() != single.ActiveKeyID() {
+		t.Error("ParseKeyring() did not make the last key active")
+	}
+}
+
+func TestFileServiceEncryption(t *testing.T) {
+	keys, _ := newTestKeyring(t, 1)
+	fs := newTestFileService(t, newTestDatabase(t))
+	fs.keys = keys
+	plaintext := strings.Repeat("confidential ", 10000)
+
+	stored, err := fs.StoreStream(strings.NewReader(plaintext), 1<<20, types.File{Name: "a.txt", OwnerID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.WrappedKey == "" || stored.KeyID != keys.ActiveKeyID() {
+		t.Fatalf("StoreStream() WrappedKey = %q, KeyID = %q", stored.WrappedKey, stored.KeyID)
+	}
+	raw, err := readBlob(fs.store, stored.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("confidential")) {
+		t.Error("blob stored in plaintext")
+	}
+
+	// A second copy shares the blob, so it needs the same data key
+	copied, err := fs.StoreStream(strings.NewReader(plaintext), 1<<20, types.File{Name: "b.txt", OwnerID: "u2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.WrappedKey != stored.WrappedKey {
+		t.Error("deduplicated file did not share the blob's data key")
+	}
+
+	for _, f := range []types.File{stored, copied} {
+		row, err := fs.GetFileByID(f.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := fs.OpenFile(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := content.Seek(13, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(content)
+		content.Close()
+		if string(data) != plaintext[13:] {
+			t.Errorf("OpenFile(%s) returned %d bytes, want %d", f.Name, len(data), len(plaintext)-13)
+		}
+	}
+
+	fs.keys = nil
+	if _, err := fs.OpenFile(stored); err == nil {
+		t.Error("OpenFile() opened an encrypted file without a master key")
+	}
+}
+
+func TestRewrapDataKeys(t *testing.T) {
+	db := newTestDatabase(t)
+	oldKeys, masterKeys := newTestKeyring(t, 1)
+	fs := newTestFileService(t, db)
+	fs.keys = oldKeys
+
+	var files []types.File
+	for _, content := range []string{"one", "two", "two"} {
+		f, err := fs.StoreStream(strings.NewReader(content), 100, types.File{Name: content, OwnerID: "u1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	newKey := make([]byte, 32)
+	rand.Read(newKey)
+	rotated, err := NewKeyring(masterKeys[0], newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := RewrapDataKeys(db, rotated)
+	if err != nil || n != len(files) {
+		t.Fatalf("RewrapDataKeys() = %d, %v, want %d", n, err, len(files))
+	}
+	if n, err := RewrapDataKeys(db, rotated); err != nil || n != 0 {
+		t.Errorf("second RewrapDataKeys() = %d, %v, want 0", n, err)
+	}
+
+	// The retired key is no longer needed
+	fs.keys, _ = NewKeyring(newKey)
+	for i, f := range files {
+		row, err := fs.GetFileByID(f.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row.KeyID != fs.keys.ActiveKeyID() {
+			t.Errorf("file %d KeyID = %q, want the new key", i, row.KeyID)
+		}
+		content, err := fs.OpenFile(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(content)
+		content.Close()
+		if string(data) != f.Name {
+			t.Errorf("file %d contents = %q, want %q", i, data, f.Name)
+		}
+	}
+
+	if _, err := RewrapDataKeys(db, fs.keys); err != nil {
+		t.Errorf("RewrapDataKeys() with nothing to do = %v", err)
+	}
+}
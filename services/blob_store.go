@@ -0,0 +1,180 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrInvalidBlobKey = errors.New("invalid blob key")
+)
+
+// BlobInfo describes one stored blob
+type BlobInfo struct {
+	ModTime time.Time
+	Key     string
+	Size    int64
+}
+
+// BlobStore keeps blob bytes under slash separated keys such as ab/cd/abcd...
+// Implementations stream in both directions and never hold a whole blob in
+// memory.
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing anything already
+	// there. size is -1 when unknown. Readers never see a partial blob.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens the blob for reading; ErrBlobNotFound if it doesn't exist
+	Get(key string) (io.ReadSeekCloser, error)
+	Stat(key string) (BlobInfo, error)
+	// Delete removes the blob. Deleting a missing blob is not an error.
+	Delete(key string) error
+	// List returns every blob whose key starts with prefix, ordered by key
+	List(prefix string) ([]BlobInfo, error)
+}
+
+// validateBlobKey rejects keys that are empty, absolute or escape the store
+func validateBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") || path.Clean(key) != key || !filepath.IsLocal(filepath.FromSlash(key)) {
+		return fmt.Errorf("%w %q", ErrInvalidBlobKey, key)
+	}
+	return nil
+}
+
+type localBlobStore struct {
+	root string
+}
+
+// NewLocalBlobStore keeps blobs as files below root, which is created on
+// first write
+func NewLocalBlobStore(root string) BlobStore {
+	return &localBlobStore{root: root}
+}
+
+func (ls *localBlobStore) Put(key string, r io.Reader, size int64) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write next to the final path and rename, so a crash never leaves a
+	// partial blob under a valid key
+	out, err := os.CreateTemp(filepath.Dir(p), ".tmp-"+path.Base(key))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	n, err := io.Copy(out, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("error storing blob: wrote %d bytes, expected %d", n, size)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	return os.Rename(out.Name(), p)
+}
+
+func (ls *localBlobStore) Get(key string) (io.ReadSeekCloser, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (ls *localBlobStore) Stat(key string) (BlobInfo, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (ls *localBlobStore) Delete(key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ls *localBlobStore) List(prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	err := filepath.WalkDir(ls.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == ls.root {
+				return fs.SkipAll
+			}
+			return err
+		}
+		// Staging areas and in-flight writes start with a dot
+		if p != ls.root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+func (ls *localBlobStore) path(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(ls.root, filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,303 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrDirectoryNotFound = errors.New("directory not found")
+	ErrDirectoryExists   = errors.New("a directory with that name already exists")
+	ErrDirectoryCycle    = errors.New("a directory cannot be moved inside itself")
+	ErrInvalidName       = errors.New("invalid name")
+	ErrInvalidRetention  = errors.New("version limits cannot be negative")
+	ErrSpaceMove         = errors.New("directories can't be moved into or out of a team space")
+)
+
+// MaxListLimit caps how many children one ListChildren page returns
+const MaxListLimit = 1000
+
+type DirectoryService interface {
+	// CreateDirectory creates a directory owned by ownerID, or by the group
+	// whose team space parentID is in
+	CreateDirectory(ownerID, name, parentID string) (types.Directory, error)
+	GetDirectory(id string) (types.Directory, error)
+	// ListChildren pages through subdirectories and then files of directoryID,
+	// or of ownerID's root when directoryID is empty
+	ListChildren(ownerID, directoryID string, limit, offset int) (types.DirectoryListing, error)
+	// MoveDirectory renames a directory and/or moves it under newParentID. It
+	// fails with ErrQuotaExceeded if the new parent can't take its contents.
+	MoveDirectory(id, newName, newParentID string) (types.Directory, error)
+	// DeleteDirectory removes a directory with everything below it
+	DeleteDirectory(id string) error
+	// SetRetention caps how many versions, and for how many days, the files
+	// directly in a directory keep. Zero removes a limit. Versions the new
+	// policy no longer keeps are dropped straight away.
+	SetRetention(id string, maxVersions, retentionDays int) (types.Directory, error)
+}
+
+type directoryService struct {
+	db          types.Database
+	fileService FileService
+}
+
+func NewDirectoryService(fileService FileService) DirectoryService {
+	ds := &directoryService{
+		db:          types.NewDatabase(),
+		fileService: fileService,
+	}
+	err := ds.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ds
+}
+
+func (ds *directoryService) CreateDirectory(ownerID, name, parentID string) (types.Directory, error) {
+	if err := validateName(name); err != nil {
+		return types.Directory{}, err
+	}
+	if parentID != "" {
+		if _, err := ds.GetDirectory(parentID); err != nil {
+			return types.Directory{}, err
+		}
+		groupID, err := ds.db.GetGroupOwner(parentID)
+		if err != nil {
+			return types.Directory{}, fmt.Errorf("error getting team space: %v", err)
+		}
+		if groupID != "" {
+			ownerID = groupID
+		}
+	}
+	if err := ds.checkNameFree(ownerID, parentID, name, ""); err != nil {
+		return types.Directory{}, err
+	}
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.Directory{}, err
+	}
+	dir := types.Directory{
+		ID:                id,
+		Name:              name,
+		OwnerID:           ownerID,
+		ParentDirectoryID: parentID,
+	}
+	if err := ds.db.InsertDirectory(dir); err != nil {
+		return types.Directory{}, fmt.Errorf("error creating directory: %v", err)
+	}
+	return dir, nil
+}
+
+func (ds *directoryService) GetDirectory(id string) (types.Directory, error) {
+	dir, err := ds.db.GetDirectoryByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Directory{}, ErrDirectoryNotFound
+		}
+		return types.Directory{}, fmt.Errorf("error getting directory: %v", err)
+	}
+	return dir, nil
+}
+
+func (ds *directoryService) ListChildren(ownerID, directoryID string, limit, offset int) (types.DirectoryListing, error) {
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	listing := types.DirectoryListing{
+		Directories: []types.Directory{},
+		Files:       []types.File{},
+		Limit:       limit,
+		Offset:      offset,
+	}
+
+	dirCount, err := ds.db.CountSubdirectories(ownerID, directoryID)
+	if err != nil {
+		return types.DirectoryListing{}, fmt.Errorf("error counting directories: %v", err)
+	}
+	fileCount, err := ds.db.CountFilesInDirectory(ownerID, directoryID)
+	if err != nil {
+		return types.DirectoryListing{}, fmt.Errorf("error counting files: %v", err)
+	}
+	listing.Total = dirCount + fileCount
+
+	if offset < dirCount {
+		dirs, err := ds.db.ListSubdirectories(ownerID, directoryID, limit, offset)
+		if err != nil {
+			return types.DirectoryListing{}, fmt.Errorf("error listing directories: %v", err)
+		}
+		listing.Directories = append(listing.Directories, dirs...)
+	}
+	if remaining := limit - len(listing.Directories); remaining > 0 {
+		fileOffset := offset - dirCount
+		if fileOffset < 0 {
+			fileOffset = 0
+		}
+		files, err := ds.db.ListFilesInDirectory(ownerID, directoryID, remaining, fileOffset)
+		if err != nil {
+			return types.DirectoryListing{}, fmt.Errorf("error listing files: %v", err)
+		}
+		listing.Files = append(listing.Files, files...)
+	}
+	return listing, nil
+}
+
+func (ds *directoryService) MoveDirectory(id, newName, newParentID string) (types.Directory, error) {
+	dir, err := ds.GetDirectory(id)
+	if err != nil {
+		return types.Directory{}, err
+	}
+	if err := validateName(newName); err != nil {
+		return types.Directory{}, err
+	}
+	if newParentID != "" {
+		// Walk up from the new parent; meeting the directory itself means the
+		// move would detach it into a loop
+		for ancestor := newParentID; ancestor != ""; {
+			if ancestor == dir.ID {
+				return types.Directory{}, ErrDirectoryCycle
+			}
+			parent, err := ds.GetDirectory(ancestor)
+			if err != nil {
+				return types.Directory{}, err
+			}
+			ancestor = parent.ParentDirectoryID
+		}
+	}
+	if newParentID != dir.ParentDirectoryID {
+		if err := ds.checkSameSpace(dir.ID, newParentID); err != nil {
+			return types.Directory{}, err
+		}
+	}
+	if newName != dir.Name || newParentID != dir.ParentDirectoryID {
+		if err := ds.checkNameFree(dir.OwnerID, newParentID, newName, dir.ID); err != nil {
+			return types.Directory{}, err
+		}
+	}
+
+	if err := ds.db.MoveDirectory(dir.ID, newName, newParentID); err != nil {
+		if errors.Is(err, types.ErrQuotaExceeded) {
+			return types.Directory{}, ErrQuotaExceeded
+		}
+		return types.Directory{}, fmt.Errorf("error updating directory: %v", err)
+	}
+	dir.Name = newName
+	dir.ParentDirectoryID = newParentID
+	return dir, nil
+}
+
+func (ds *directoryService) SetRetention(id string, maxVersions, retentionDays int) (types.Directory, error) {
+	if maxVersions < 0 || retentionDays < 0 {
+		return types.Directory{}, ErrInvalidRetention
+	}
+	dir, err := ds.GetDirectory(id)
+	if err != nil {
+		return types.Directory{}, err
+	}
+	dir.MaxVersions = maxVersions
+	dir.VersionRetentionDays = retentionDays
+	if err := ds.db.UpdateDirectory(dir); err != nil {
+		return types.Directory{}, fmt.Errorf("error updating directory: %v", err)
+	}
+	for offset := 0; ; offset += MaxListLimit {
+		files, err := ds.db.ListFilesInDirectory("", id, MaxListLimit, offset)
+		if err != nil {
+			return types.Directory{}, fmt.Errorf("error listing files: %v", err)
+		}
+		for _, f := range files {
+			if err := ds.fileService.PruneVersions(f.ID); err != nil && !errors.Is(err, ErrFileNotFound) {
+				return types.Directory{}, err
+			}
+		}
+		if len(files) < MaxListLimit {
+			break
+		}
+	}
+	return dir, nil
+}
+
+func (ds *directoryService) DeleteDirectory(id string) error {
+	if _, err := ds.GetDirectory(id); err != nil {
+		return err
+	}
+	// Collect the subtree breadth first, then remove it deepest first so a
+	// failure part way never leaves children without a parent
+	subtree := []string{id}
+	for i := 0; i < len(subtree); i++ {
+		children, err := ds.db.GetChildDirectoryIDs(subtree[i])
+		if err != nil {
+			return fmt.Errorf("error listing directories: %v", err)
+		}
+		subtree = append(subtree, children...)
+	}
+	for i := len(subtree) - 1; i >= 0; i-- {
+		for {
+			files, err := ds.db.ListFilesInDirectory("", subtree[i], MaxListLimit, 0)
+			if err != nil {
+				return fmt.Errorf("error listing files: %v", err)
+			}
+			if len(files) == 0 {
+				break
+			}
+			for _, f := range files {
+				if err := ds.fileService.DeleteFile(f.ID); err != nil && !errors.Is(err, ErrFileNotFound) {
+					return err
+				}
+			}
+		}
+		if err := ds.db.DeleteDirectoryByID(subtree[i]); err != nil {
+			return fmt.Errorf("error deleting directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkSameSpace returns ErrSpaceMove unless moving id under newParentID
+// keeps it in the same team space, or out of team spaces altogether, since
+// what is in a space belongs to its group
+func (ds *directoryService) checkSameSpace(id, newParentID string) error {
+	from, err := ds.db.GetGroupOwner(id)
+	if err != nil {
+		return fmt.Errorf("error getting team space: %v", err)
+	}
+	to := ""
+	if newParentID != "" {
+		to, err = ds.db.GetGroupOwner(newParentID)
+		if err != nil {
+			return fmt.Errorf("error getting team space: %v", err)
+		}
+	}
+	if from != to {
+		return ErrSpaceMove
+	}
+	return nil
+}
+
+// checkNameFree makes sure no sibling other than exceptID already uses name
+func (ds *directoryService) checkNameFree(ownerID, parentID, name, exceptID string) error {
+	sibling, err := ds.db.GetSubdirectoryByName(ownerID, parentID, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up directory: %v", err)
+	}
+	if sibling.ID != exceptID {
+		return ErrDirectoryExists
+	}
+	return nil
+}
+
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\\\x00") {
+		return ErrInvalidName
+	}
+	return nil
+}
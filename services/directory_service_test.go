@@ -0,0 +1,237 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestDirectoryService(t *testing.T) *directoryService {
+	t.Helper()
+	db := newTestDatabase(t)
+	return &directoryService{
+		db:          db,
+		fileService: newTestFileService(t, db),
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	ds := newTestDirectoryService(t)
+	docs, err := ds.CreateDirectory("u1", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		owner    string
+		dirName  string
+		parentID string
+		wantErr  error
+	}{
+		{name: "Nested", owner: "u1", dirName: "reports", parentID: docs.ID},
+		{name: "DuplicateSibling", owner: "u1", dirName: "docs", wantErr: ErrDirectoryExists},
+		{name: "SameNameOtherUser", owner: "u2", dirName: "docs"},
+		{name: "MissingParent", owner: "u1", dirName: "x", parentID: "nope", wantErr: ErrDirectoryNotFound},
+		{name: "Slash", owner: "u1", dirName: "a/b", wantErr: ErrInvalidName},
+		{name: "DotDot", owner: "u1", dirName: "..", wantErr: ErrInvalidName},
+		{name: "Empty", owner: "u1", dirName: "", wantErr: ErrInvalidName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ds.CreateDirectory(tt.owner, tt.dirName, tt.parentID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateDirectory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (dir.ID == "" || dir.ParentDirectoryID != tt.parentID || dir.OwnerID != tt.owner) {
+				t.Errorf("CreateDirectory() = %+v", dir)
+			}
+		})
+	}
+}
+
+func TestListChildren(t *testing.T) {
+	ds := newTestDirectoryService(t)
+	fs := ds.fileService.(*fileService)
+	parent, err := ds.CreateDirectory("u1", "parent", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c", "a", "b"} {
+		if _, err := ds.CreateDirectory("u1", name, parent.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"y.txt", "x.txt"} {
+		if _, err := fs.StoreStream(strings.NewReader(name), 100, types.File{Name: name, OwnerID: "u1", DirectoryID: parent.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.StoreStream(strings.NewReader("root"), 100, types.File{Name: "root.txt", OwnerID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		dirID     string
+		limit     int
+		offset    int
+		wantDirs  []string
+		wantFiles []string
+		wantTotal int
+	}{
+		{name: "All", dirID: parent.ID, limit: 10, wantDirs: []string{"a", "b", "c"}, wantFiles: []string{"x.txt", "y.txt"}, wantTotal: 5},
+		{name: "FirstPage", dirID: parent.ID, limit: 2, wantDirs: []string{"a", "b"}, wantTotal: 5},
+		{name: "SpansDirsAndFiles", dirID: parent.ID, limit: 2, offset: 2, wantDirs: []string{"c"}, wantFiles: []string{"x.txt"}, wantTotal: 5},
+		{name: "FilesOnly", dirID: parent.ID, limit: 2, offset: 4, wantFiles: []string{"y.txt"}, wantTotal: 5},
+		{name: "Root", dirID: "", limit: 10, wantDirs: []string{"parent"}, wantFiles: []string{"root.txt"}, wantTotal: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listing, err := ds.ListChildren("u1", tt.dirID, tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dirs, files []string
+			for _, d := range listing.Directories {
+				dirs = append(dirs, d.Name)
+			}
+			for _, f := range listing.Files {
+				files = append(files, f.Name)
+			}
+			if strings.Join(dirs, ",") != strings.Join(tt.wantDirs, ",") || strings.Join(files, ",") != strings.Join(tt.wantFiles, ",") || listing.Total != tt.wantTotal {
+				t.Errorf("ListChildren() = dirs %v files %v total %d, want dirs %v files %v total %d", dirs, files, listing.Total, tt.wantDirs, tt.wantFiles, tt.wantTotal)
+			}
+		})
+	}
+
+	other, err := ds.ListChildren("u2", "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Total != 0 {
+		t.Errorf("another user's root listed %d entries", other.Total)
+	}
+}
+
+func TestMoveDirectory(t *testing.T) {
+	ds := newTestDirectoryService(t)
+	a, _ := ds.CreateDirectory("u1", "a", "")
+	b, _ := ds.CreateDirectory("u1", "b", a.ID)
+	c, _ := ds.CreateDirectory("u1", "c", b.ID)
+	ds.CreateDirectory("u1", "taken", "")
+
+	tests := []struct {
+		name      string
+		id        string
+		newName   string
+		newParent string
+		wantErr   error
+	}{
+		{name: "IntoSelf", id: a.ID, newName: "a", newParent: a.ID, wantErr: ErrDirectoryCycle},
+		{name: "IntoDescendant", id: a.ID, newName: "a", newParent: c.ID, wantErr: ErrDirectoryCycle},
+		{name: "NameTaken", id: c.ID, newName: "taken", newParent: "", wantErr: ErrDirectoryExists},
+		{name: "MissingParent", id: c.ID, newName: "c", newParent: "nope", wantErr: ErrDirectoryNotFound},
+		{name: "Rename", id: c.ID, newName: "c2", newParent: b.ID},
+		{name: "MoveToRoot", id: c.ID, newName: "c2", newParent: ""},
+		{name: "MoveUnderSibling", id: b.ID, newName: "b", newParent: c.ID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ds.MoveDirectory(tt.id, tt.newName, tt.newParent)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("MoveDirectory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			stored, err := ds.GetDirectory(tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Name != tt.newName || stored.ParentDirectoryID != tt.newParent || dir.Name != stored.Name {
+				t.Errorf("stored directory = %+v, returned %+v", stored, dir)
+			}
+		})
+	}
+}
+
+func TestDeleteDirectoryRecursive(t *testing.T) {
+	ds := newTestDirectoryService(t)
+	fs := ds.fileService.(*fileService)
+	top, _ := ds.CreateDirectory("u1", "top", "")
+	mid, _ := ds.CreateDirectory("u1", "mid", top.ID)
+	keep, _ := ds.CreateDirectory("u1", "keep", "")
+
+	inMid, err := fs.StoreStream(strings.NewReader("nested"), 100, types.File{Name: "n.txt", OwnerID: "u1", DirectoryID: mid.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same bytes kept elsewhere must survive the delete
+	kept, err := fs.StoreStream(strings.NewReader("nested"), 100, types.File{Name: "k.txt", OwnerID: "u1", DirectoryID: keep.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.DeleteDirectory(top.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{top.ID, mid.ID} {
+		if _, err := ds.GetDirectory(id); !errors.Is(err, ErrDirectoryNotFound) {
+			t.Errorf("GetDirectory(%s) after delete error = %v", id, err)
+		}
+	}
+	if _, err := fs.GetFileByID(inMid.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("file in deleted directory still exists: %v", err)
+	}
+	if _, err := fs.store.Stat(kept.Location); err != nil {
+		t.Errorf("shared blob removed: %v", err)
+	}
+	if _, err := ds.GetDirectory(keep.ID); err != nil {
+		t.Errorf("unrelated directory removed: %v", err)
+	}
+	if err := ds.DeleteDirectory(top.ID); !errors.Is(err, ErrDirectoryNotFound) {
+		t.Errorf("DeleteDirectory() twice error = %v, want %v", err, ErrDirectoryNotFound)
+	}
+}
+
+func TestSetRetention(t *testing.T) {
+	ds := newTestDirectoryService(t)
+	docs, err := ds.CreateDirectory("u1", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f types.File
+	for _, content := range []string{"one", "two", "three"} {
+		f, err = ds.fileService.StoreStream(strings.NewReader(content), 100, types.File{Name: "a.txt", OwnerID: "u1", DirectoryID: docs.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ds.SetRetention(docs.ID, -1, 0); !errors.Is(err, ErrInvalidRetention) {
+		t.Errorf("SetRetention(-1) error = %v, want ErrInvalidRetention", err)
+	}
+	if _, err := ds.SetRetention("nope", 1, 0); !errors.Is(err, ErrDirectoryNotFound) {
+		t.Errorf("SetRetention() on missing directory error = %v, want ErrDirectoryNotFound", err)
+	}
+
+	dir, err := ds.SetRetention(docs.ID, 1, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.MaxVersions != 1 || dir.VersionRetentionDays != 30 {
+		t.Errorf("SetRetention() = %+v", dir)
+	}
+	if stored, _ := ds.GetDirectory(docs.ID); stored.MaxVersions != 1 || stored.VersionRetentionDays != 30 {
+		t.Errorf("retention not saved: %+v", stored)
+	}
+	versions, err := ds.fileService.ListVersions(f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Version != 3 {
+		t.Errorf("versions after SetRetention() = %+v, want only version 3", versions)
+	}
+}
@@ -2,34 +2,83 @@ package services
 
 import (
 	"Smd/types"
+	"Smd/utils"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
-	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrFileTooLarge = errors.New("file too large")
+	// ErrQuotaExceeded means the upload would take its owner or a directory
+	// over their storage quota
+	ErrQuotaExceeded = types.ErrQuotaExceeded
+)
+
 type FileService interface {
-	ParseAndValidateFile(r *http.Request, w http.ResponseWriter) (multipart.File, *multipart.FileHeader, error)
-	HashFile(file multipart.File) (string, error)
-	SaveAndUploadFile(file multipart.File, hashedFilename string, subdirectory string, f types.File) error
 	UploadFile(f types.File) error
-	SaveFile(file multipart.File, hashedFilename, subdirectory string) (string, error)
+	// SaveFile stores the contents and returns a File with Location, Hash and
+	// the blob's data key filled in, ready to be recorded
+	SaveFile(file multipart.File, hashedFilename string) (types.File, error)
 	GetFile(id string) (types.File, error)
+	GetFileByID(id string) (types.File, error)
+	OpenFile(f types.File) (io.ReadSeekCloser, error)
+	DeleteFile(id string) error
+	// StoreStream reads r in a single pass, hashing it while it is written to
+	// the store, and records f against the resulting blob with Hash and Size set.
+	// If a file with f's name already exists in its directory the contents
+	// become that file's next version, and that file is returned.
+	StoreStream(r io.Reader, maxSize int64, f types.File) (types.File, error)
+	ListVersions(fileID string) ([]types.FileVersion, error)
+	GetVersion(fileID string, version int) (types.FileVersion, error)
+	OpenVersion(v types.FileVersion) (io.ReadSeekCloser, error)
+	// RestoreVersion makes a copy of an old version the file's newest version
+	RestoreVersion(fileID string, version int, uploaderID string) (types.File, error)
+	// PruneVersions drops versions of the file its directory's retention
+	// policy no longer keeps
+	PruneVersions(fileID string) error
+	// PruneAllVersions applies every directory's retention policy, returning
+	// how many versions were dropped
+	PruneAllVersions() (int, error)
 }
 
 type fileService struct {
-	db types.Database
+	db    types.Database
+	store BlobStore
+	// keys wraps the data keys blobs are encrypted with; nil stores plaintext
+	keys *Keyring
+	// tmpDir stages streamed uploads until their hash, and so their key, is known
+	tmpDir string
+	// blobMu serializes writing and removing blob bytes with the reference
+	// count changes that decide whether they should exist
+	blobMu sync.Mutex
 }
 
+// NewFileService keeps blobs on local disk under ~/StoreMeDaddy
 func NewFileService() FileService {
+	root := DefaultStoreRoot()
+	return NewFileServiceWithStore(NewLocalBlobStore(root), filepath.Join(root, ".tmp"), nil)
+}
+
+// NewFileServiceWithStore keeps blobs in store, staging uploads in tmpDir.
+// New blobs are encrypted under data keys wrapped by keys, unless it is nil.
+func NewFileServiceWithStore(store BlobStore, tmpDir string, keys *Keyring) FileService {
 	fs := &fileService{
-		db: types.NewDatabase(),
+		db:     types.NewDatabase(),
+		store:  store,
+		keys:   keys,
+		tmpDir: tmpDir,
 	}
 	err := fs.db.Connect()
 	if err != nil {
@@ -39,105 +88,303 @@ func NewFileService() FileService {
 	return fs
 }
 
+// DefaultStoreRoot is ~/StoreMeDaddy
+func DefaultStoreRoot() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+	return filepath.Join(homeDir, "StoreMeDaddy")
+}
+
 func (fs *fileService) UploadFile(f types.File) error {
 	err := fs.db.InsertFile(f)
 	if err != nil {
+		if errors.Is(err, types.ErrQuotaExceeded) {
+			return ErrQuotaExceeded
+		}
 		return fmt.Errorf("error uploading file to database: %v", err)
 	}
 	return nil
 }
 
-func (fs *fileService) SaveFile(file multipart.File, hashedFilename string, subdirectory string) (path string, err error) {
+// SaveFile stores the contents under their hash, e.g. ab/cd/abcd..., so
+// identical uploads share one copy in the store
+func (fs *fileService) SaveFile(file multipart.File, hashedFilename string) (types.File, error) {
+	fs.blobMu.Lock()
+	defer fs.blobMu.Unlock()
+	return fs.saveBlob(file, hashedFilename)
+}
+
+// saveBlob writes the blob for hash unless it is already stored, and returns
+// where it lives along with the data key it is encrypted with
+func (fs *fileService) saveBlob(file io.ReadSeeker, hash string) (types.File, error) {
 	if file == nil {
-		return "", fmt.Errorf("file is nil")
+		return types.File{}, fmt.Errorf("file is nil")
 	}
-	flatFilename := hashedFilename
-	fmt.Println(subdirectory)
-	if subdirectory != "" {
-		flatFilename = subdirectory + "_" + hashedFilename
+	key, err := blobKey(hash)
+	if err != nil {
+		return types.File{}, err
+	}
+	stored := types.File{Hash: hash, Location: key}
+	if _, err := fs.store.Stat(key); err == nil {
+		// Every file in a blob shares its data key
+		stored.WrappedKey, stored.KeyID, err = fs.db.GetFileKeyByHash(hash)
+		if err == nil {
+			return stored, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return types.File{}, fmt.Errorf("error getting data key from database: %v", err)
+		}
+		// Left behind by a failed upload, so nothing holds its key. Write it again.
+	} else if !errors.Is(err, ErrBlobNotFound) {
+		return types.File{}, err
 	}
 
-	homeDir, err := os.UserHomeDir()
+	size, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
-		return "", err
+		return types.File{}, err
 	}
-	path = filepath.Join(homeDir, "StoreMeDaddy", flatFilename)
-	out, err := os.Create(path)
-	if err != nil {
-		return "", err
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return types.File{}, err
 	}
-	defer out.Close()
-
-	if _, err = file.Seek(0, 0); err != nil {
-		return "", err
+	var content io.Reader = file
+	if fs.keys != nil {
+		dataKey, wrapped, err := fs.keys.newDataKey(hash)
+		if err != nil {
+			return types.File{}, fmt.Errorf("error generating data key: %v", err)
+		}
+		if content, err = newEncryptReader(file, size, dataKey); err != nil {
+			return types.File{}, err
+		}
+		size = encryptedSize(size)
+		stored.WrappedKey = wrapped
+		stored.KeyID = fs.keys.ActiveKeyID()
+	}
+	if err := fs.store.Put(key, content, size); err != nil {
+		return types.File{}, fmt.Errorf("error storing blob: %v", err)
 	}
+	return stored, nil
+}
 
-	if _, err = io.Copy(out, file); err != nil {
-		return "", err
+func (fs *fileService) StoreStream(r io.Reader, maxSize int64, f types.File) (types.File, error) {
+	if err := os.MkdirAll(fs.tmpDir, os.ModePerm); err != nil {
+		return types.File{}, err
 	}
-	if err := out.Close(); err != nil {
-		return "", fmt.Errorf("error closing file: %v", err)
+	tmp, err := os.CreateTemp(fs.tmpDir, "upload-")
+	if err != nil {
+		return types.File{}, err
 	}
-	return path, nil
-}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-func (fs *fileService) SaveAndUploadFile(file multipart.File, hashedFilename string, subdirectory string, f types.File) error {
-	filepath, err := fs.SaveFile(file, hashedFilename, subdirectory)
+	hasher := sha256.New()
+	n, err := io.Copy(tmp, io.TeeReader(io.LimitReader(r, maxSize+1), hasher))
 	if err != nil {
-		return err
+		return types.File{}, err
+	}
+	if n > maxSize {
+		return types.File{}, ErrFileTooLarge
 	}
-	f.Location = filepath
-	err = fs.UploadFile(f)
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	fs.blobMu.Lock()
+	defer fs.blobMu.Unlock()
+
+	stored, err := fs.saveBlob(tmp, hash)
 	if err != nil {
-		return err
+		return types.File{}, err
 	}
-	return nil
+	f.Size = n
+	return fs.recordFile(f, stored)
 }
 
-func (fs *fileService) ParseAndValidateFile(r *http.Request, w http.ResponseWriter) (file multipart.File, header *multipart.FileHeader, err error) {
-	r.Body = http.MaxBytesReader(w, r.Body, 10<<20) // Max memory 10MB
-	if r.Body == nil || r.ContentLength == 0 {
-		return nil, nil, fmt.Errorf("request body empty")
+// recordFile records f against the blob saveBlob stored, either as a new file
+// or as the next version of the file already at its path. The caller holds
+// blobMu.
+func (fs *fileService) recordFile(f types.File, stored types.File) (types.File, error) {
+	if f.UploadDate.IsZero() {
+		f.UploadDate = time.Now()
+	}
+	f.Hash = stored.Hash
+	f.Location = stored.Location
+	f.WrappedKey = stored.WrappedKey
+	f.KeyID = stored.KeyID
+	if f.UploaderID == "" {
+		f.UploaderID = f.OwnerID
+	}
+	if f.DirectoryID != "" {
+		// Files stored in a team space belong to its group
+		groupID, err := fs.db.GetGroupOwner(f.DirectoryID)
+		if err != nil {
+			fs.removeBlobIfUnreferenced(f.Hash)
+			return types.File{}, fmt.Errorf("error getting team space: %v", err)
+		}
+		if groupID != "" {
+			f.OwnerID = groupID
+		}
 	}
-	err = r.ParseMultipartForm(10 << 20) // Max memory 10MB
 
-	if err != nil {
-		if err.Error() == "http: request body too large" {
-			return nil, nil, fmt.Errorf("file too big")
+	existing, err := fs.db.GetFileByPath(f.OwnerID, f.DirectoryID, f.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		if f.ID == "" {
+			f.ID, err = utils.GenerateToken(16)
+			if err != nil {
+				return types.File{}, err
+			}
 		}
-		switch err {
-		case http.ErrNotMultipart:
-			return nil, nil, fmt.Errorf("request body empty")
-		case http.ErrMissingFile:
-			return nil, nil, fmt.Errorf("no file in request body")
-		case http.ErrHandlerTimeout:
-			return nil, nil, fmt.Errorf("request timed out, file might be too big")
-		default:
-			return nil, nil, fmt.Errorf("error parsing form: %v", err)
+		f.Version = 1
+		if err := fs.UploadFile(f); err != nil {
+			fs.removeBlobIfUnreferenced(f.Hash)
+			return types.File{}, err
 		}
+		return f, nil
+	}
+	if err != nil {
+		fs.removeBlobIfUnreferenced(f.Hash)
+		return types.File{}, fmt.Errorf("error getting file from database: %v", err)
+	}
+
+	return fs.addVersion(existing, types.FileVersion{
+		CreatedAt:   f.UploadDate,
+		FileID:      existing.ID,
+		ContentType: f.ContentType,
+		Location:    f.Location,
+		Hash:        f.Hash,
+		WrappedKey:  f.WrappedKey,
+		KeyID:       f.KeyID,
+		UploaderID:  f.UploaderID,
+		Size:        f.Size,
+	})
+}
+
+// blobKey is where the blob with hash lives in the store
+func blobKey(hash string) (string, error) {
+	if len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid blob hash %q", hash)
 	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", fmt.Errorf("invalid blob hash %q", hash)
+	}
+	return hash[0:2] + "/" + hash[2:4] + "/" + hash, nil
+}
+
+// DeleteFile removes the file record with all its versions and any stored
+// blobs they held the last reference to
+func (fs *fileService) DeleteFile(id string) error {
+	fs.blobMu.Lock()
+	defer fs.blobMu.Unlock()
 
-	file, header, err = r.FormFile("uploadFile")
+	unreferenced, err := fs.db.ReleaseFile(id)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error retrieving the file")
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrFileNotFound
+		}
+		return fmt.Errorf("error deleting file from database: %v", err)
+	}
+	for _, hash := range unreferenced {
+		if err := fs.removeBlobIfUnreferenced(hash); err != nil {
+			return err
+		}
 	}
-	return file, header, nil
+	return nil
 }
 
-func (fs *fileService) HashFile(file multipart.File) (hashedFilename string, err error) {
-	if file == nil {
-		return "", fmt.Errorf("file is nil")
+func (fs *fileService) removeBlobIfUnreferenced(hash string) error {
+	key, err := blobKey(hash)
+	if err != nil {
+		return err
 	}
-	if _, err := file.Seek(0, 0); err != nil {
-		return "", err
+	unreferenced, err := fs.db.DeleteBlob(hash)
+	if err != nil {
+		return fmt.Errorf("error deleting blob from database: %v", err)
 	}
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return "", err
+	if !unreferenced {
+		// Either still referenced, or bytes that were never recorded
+		if _, err := fs.db.GetBlobRefCount(hash); !errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
 	}
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+	return fs.store.Delete(key)
 }
 
 func (fs *fileService) GetFile(fileName string) (types.File, error) {
 	return fs.db.GetFile(fileName)
 }
+
+func (fs *fileService) GetFileByID(id string) (types.File, error) {
+	f, err := fs.db.GetFileByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.File{}, ErrFileNotFound
+		}
+		return types.File{}, fmt.Errorf("error getting file from database: %v", err)
+	}
+	return f, nil
+}
+
+// OpenFile opens the stored contents of f for reading
+func (fs *fileService) OpenFile(f types.File) (io.ReadSeekCloser, error) {
+	return fs.openBlob(f.Hash, f.WrappedKey, f.KeyID)
+}
+
+// openBlob opens the blob with hash, decrypting it with the data key in
+// wrappedKey if it has one
+func (fs *fileService) openBlob(hash, wrappedKey, keyID string) (io.ReadSeekCloser, error) {
+	// Rows written before the blob store recorded a disk path as Location,
+	// so go by the hash
+	key, err := blobKey(hash)
+	if err != nil {
+		return nil, ErrFileNotFound
+	}
+	content, err := fs.store.Get(key)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil || wrappedKey == "" {
+		return content, err
+	}
+
+	if fs.keys == nil {
+		content.Close()
+		return nil, errors.New("file is encrypted but no master key is configured")
+	}
+	dataKey, err := fs.keys.unwrap(wrappedKey, keyID, hash)
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	plaintext, err := newDecryptReader(content, dataKey)
+	if err != nil {
+		content.Close()
+		return nil, fmt.Errorf("error opening encrypted blob: %v", err)
+	}
+	return plaintext, nil
+}
+
+// RewrapDataKeys wraps every data key that isn't already wrapped by the
+// active master key again with it, so retired master keys can be dropped.
+// Blobs are left as they are. It returns how many file versions were updated.
+func RewrapDataKeys(db types.Database, keys *Keyring) (int, error) {
+	const batchSize = 100
+	rewrapped := 0
+	for {
+		versions, err := db.ListVersionsWrappedWithOtherKey(keys.ActiveKeyID(), batchSize)
+		if err != nil {
+			return rewrapped, fmt.Errorf("error listing file versions from database: %v", err)
+		}
+		for _, v := range versions {
+			wrapped, err := keys.Rewrap(v.WrappedKey, v.KeyID, v.Hash)
+			if err != nil {
+				return rewrapped, fmt.Errorf("error rewrapping data key of file %s version %d: %v", v.FileID, v.Version, err)
+			}
+			if err := db.UpdateVersionKey(v.FileID, v.Version, wrapped, keys.ActiveKeyID()); err != nil {
+				return rewrapped, fmt.Errorf("error updating file version in database: %v", err)
+			}
+			rewrapped++
+		}
+		if len(versions) < batchSize {
+			return rewrapped, nil
+		}
+	}
+}
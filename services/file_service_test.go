@@ -2,114 +2,31 @@ package services
 
 import (
 	"Smd/types"
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"mime/multipart"
-	"net/http"
-	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestParseAndValidateFile(t *testing.T) {
-	fs := &fileService{}
-
-	tests := []struct {
-		name    string
-		errMsg  string
-		body    []byte
-		wantErr bool
-	}{
-		{
-			name:    "FileTooBig",
-			body:    bytes.Repeat([]byte("a"), 10<<20+1), // More than 10MB
-			wantErr: true,
-			errMsg:  "file too big",
-		},
-		{
-			name:    "Success",
-			body:    []byte("test data"), // Less than 10MB
-			wantErr: false,
-		},
-		{
-			name:    "EmptyBody",
-			body:    []byte(""),
-			wantErr: false,
-		},
-		{
-			name:    "NilBody",
-			body:    nil,
-			wantErr: true,
-			errMsg:  "error retrieving the file",
-		},
-		// Add more test cases here
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Create a buffer to hold the request body
-			body := &bytes.Buffer{}
-			writer := multipart.NewWriter(body)
-
-			// Only create a file part if the body is not empty or nil
-			if tt.body != nil {
-				// Create a form file writer for the file
-				part, err := writer.CreateFormFile("uploadFile", "testfile")
-				if err != nil {
-					t.Fatal(err)
-				}
-
-				// Copy the test data into the form file writer
-				_, err = part.Write(tt.body)
-				if err != nil {
-					t.Fatal(err)
-				}
-			}
-
-			// Close the multipart writer to finish writing the request body
-			err := writer.Close()
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			// Create a new request with the body
-			r, err := http.NewRequest("POST", "/upload", body)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			// Set the content type of the request to multipart/form-data
-			if writer != nil {
-				r.Header.Set("Content-Type", writer.FormDataContentType())
-			}
-
-			w := httptest.NewRecorder()
-
-			_, _, err = fs.ParseAndValidateFile(r, w)
-			if tt.wantErr {
-				if err == nil || err.Error() != tt.errMsg {
-					t.Errorf("expected '%s' error, got %v", tt.errMsg, err)
-				}
-			} else {
-				if err != nil {
-					t.Fatal(err)
-				}
-			}
-		})
-	}
-}
-
 func TestSaveFile(t *testing.T) {
-	fs := &fileService{}
+	fs := newTestFileService(t, nil)
 
 	tests := []struct {
 		name    string
 		file    multipart.File
-		subDir  string
+		hash    string
 		wantErr bool
 	}{
 		{
-			name:   "Success",
-			subDir: "",
+			name: "Success",
+			hash: testHash("test data"),
 			file: func() multipart.File {
 				file, err := os.CreateTemp("", "test")
 				if err != nil {
@@ -123,136 +40,235 @@ func TestSaveFile(t *testing.T) {
 		},
 		{
 			name:    "NilFile",
-			subDir:  "",
+			hash:    testHash(""),
 			file:    nil,
 			wantErr: true,
 		},
 		{
-			name:    "Subdirectory",
-			subDir:  "taco",
+			name:    "EmptyFile",
+			hash:    testHash(""),
 			file:    func() multipart.File { file, _ := os.CreateTemp("", "test"); return file }(), // Simulate an empty file
 			wantErr: false,
+		},
+		{
+			name:    "InvalidHash",
+			hash:    "../../etc/passwd",
+			file:    func() multipart.File { file, _ := os.CreateTemp("", "test"); return file }(),
+			wantErr: true,
 			// Add more test cases here
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := fs.SaveFile(tt.file, tt.name, tt.subDir)
+			stored, err := fs.SaveFile(tt.file, tt.hash)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("SaveFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if tt.wantErr {
+				return
+			}
+			want := tt.hash[0:2] + "/" + tt.hash[2:4] + "/" + tt.hash
+			if stored.Location != want {
+				t.Errorf("SaveFile() key = %v, want %v", stored.Location, want)
+			}
+			if _, err := fs.store.Stat(stored.Location); err != nil {
+				t.Errorf("SaveFile() did not write blob: %v", err)
+			}
 		})
 	}
 }
 
-func TestNewFileService(t *testing.T) {
-	fs := NewFileService()
+// newTestFileService returns a fileService keeping blobs on disk in a temp dir
+func newTestFileService(t *testing.T, db types.Database) *fileService {
+	t.Helper()
+	root := t.TempDir()
+	return &fileService{db: db, store: NewLocalBlobStore(root), tmpDir: filepath.Join(root, ".tmp")}
+}
 
-	if fs == nil {
-		t.Errorf("NewFileService() = %v, want non-nil", fs)
+func readBlob(store BlobStore, key string) ([]byte, error) {
+	content, err := store.Get(key)
+	if err != nil {
+		return nil, err
 	}
+	defer content.Close()
+	return io.ReadAll(content)
 }
 
-func TestUploadFile(t *testing.T) {
-	fs := NewFileService()
+func testHash(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBlobDeduplication(t *testing.T) {
+	fs := newTestFileService(t, newTestDatabase(t))
+	hash := testHash("shared bytes")
+
+	first := types.File{ID: "a", Name: "a.txt", OwnerID: "alice"}
+	second := types.File{ID: "b", Name: "b.txt", OwnerID: "bob"}
+	if _, err := fs.StoreStream(strings.NewReader("shared bytes"), 100, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("shared bytes"), 100, second); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := fs.db.GetFileByID("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.db.GetFileByID("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Location != b.Location || a.Hash != hash || b.Hash != hash {
+		t.Fatalf("expected both files to share blob %s, got %+v and %+v", hash, a, b)
+	}
+	if count, err := fs.db.GetBlobRefCount(hash); err != nil || count != 2 {
+		t.Fatalf("GetBlobRefCount() = %v, %v, want 2", count, err)
+	}
+
+	if err := fs.DeleteFile("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.store.Stat(b.Location); err != nil {
+		t.Fatalf("blob removed while still referenced: %v", err)
+	}
+	if count, err := fs.db.GetBlobRefCount(hash); err != nil || count != 1 {
+		t.Fatalf("GetBlobRefCount() = %v, %v, want 1", count, err)
+	}
+
+	if err := fs.DeleteFile("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.store.Stat(b.Location); err != ErrBlobNotFound {
+		t.Fatalf("blob not removed after last reference: %v", err)
+	}
+	if _, err := fs.db.GetBlobRefCount(hash); err == nil {
+		t.Fatalf("blob row not removed after last reference")
+	}
+
+	if err := fs.DeleteFile("b"); err != ErrFileNotFound {
+		t.Errorf("DeleteFile() on missing file error = %v, want %v", err, ErrFileNotFound)
+	}
+}
+
+func TestStoreStream(t *testing.T) {
+	fs := newTestFileService(t, newTestDatabase(t))
 
 	tests := []struct {
 		name    string
-		file    types.File
-		wantErr bool
+		data    string
+		maxSize int64
+		wantErr error
 	}{
-		{
-			name:    "Success",
-			file:    types.File{ID: "1", Name: "testfile", Location: "/tmp/testfile"},
-			wantErr: false,
-		},
-		// Add more test cases here
+		{name: "Success", data: "streamed data", maxSize: 100},
+		{name: "Duplicate", data: "streamed data", maxSize: 100},
+		{name: "ExactlyMaxSize", data: "12345", maxSize: 5},
+		{name: "TooLarge", data: "123456", maxSize: 5, wantErr: ErrFileTooLarge},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			os.Remove("smd.db")
-			types.Database.CreateDb(types.NewDatabase())
-			err := fs.UploadFile(tt.file)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("UploadFile() error = %v, wantErr %v", err, tt.wantErr)
+			f, err := fs.StoreStream(strings.NewReader(tt.data), tt.maxSize, types.File{Name: tt.name, OwnerID: "u1"})
+			if err != tt.wantErr {
+				t.Fatalf("StoreStream() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if blobs, _ := fs.store.List(testHash(tt.data)[0:2]); len(blobs) != 0 {
+					t.Errorf("rejected upload left a blob behind")
+				}
+				return
+			}
+			if f.ID == "" || f.Hash != testHash(tt.data) || f.Size != int64(len(tt.data)) {
+				t.Errorf("StoreStream() = %+v", f)
+			}
+			contents, err := readBlob(fs.store, f.Location)
+			if err != nil || string(contents) != tt.data {
+				t.Errorf("stored contents = %q, %v, want %q", contents, err, tt.data)
 			}
 		})
 	}
+
+	if count, err := fs.db.GetBlobRefCount(testHash("streamed data")); err != nil || count != 2 {
+		t.Errorf("GetBlobRefCount() = %v, %v, want 2", count, err)
+	}
+	leftovers, _ := os.ReadDir(fs.tmpDir)
+	if len(leftovers) != 0 {
+		t.Errorf("temp files left behind: %v", leftovers)
+	}
 }
 
-func TestSaveAndUploadFile(t *testing.T) {
-	fs := NewFileService()
+func TestGetFileByIDAndOpen(t *testing.T) {
+	fs := newTestFileService(t, newTestDatabase(t))
+	stored, err := fs.StoreStream(strings.NewReader("download me"), 100, types.File{Name: "d.txt", OwnerID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	tests := []struct {
-		name           string
-		file           multipart.File
-		hashedFilename string
-		subdirectory   string
-		f              types.File
-		wantErr        bool
-	}{
-		{
-			name:           "Success",
-			file:           func() multipart.File { file, _ := os.CreateTemp("", "test"); return file }(), // Simulate an empty file
-			hashedFilename: "hashedFilename",
-			subdirectory:   "",
-			f:              types.File{ID: "2", Name: "SaveAndUploadFile", Location: "/tmp/testfile"},
-			wantErr:        false,
-		},
-		// Add more test cases here
+	f, err := fs.GetFileByID(stored.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := fs.OpenFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil || string(data) != "download me" {
+		t.Errorf("OpenFile() contents = %q, %v", data, err)
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			types.Database.CreateDb(types.NewDatabase())
-			err := fs.SaveAndUploadFile(tt.file, tt.hashedFilename, tt.subdirectory, tt.f)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("SaveAndUploadFile() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
+	if _, err := fs.GetFileByID("missing"); err != ErrFileNotFound {
+		t.Errorf("GetFileByID(missing) error = %v, want %v", err, ErrFileNotFound)
 	}
 }
 
-func TestHashingFile(t *testing.T) {
+func TestNewFileService(t *testing.T) {
 	fs := NewFileService()
 
+	if fs == nil {
+		t.Errorf("NewFileService() = %v, want non-nil", fs)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	fs := newTestFileService(t, newTestDatabase(t))
+
 	tests := []struct {
-		file    multipart.File
 		name    string
+		file    types.File
 		wantErr bool
 	}{
 		{
-			name: "Success",
-			file: func() multipart.File {
-				file, _ := os.CreateTemp("", "test")
-				file.WriteString("test data")
-				file.Seek(0, 0)
-				return file
-			}(), // Simulate a file with "test data"
+			name:    "Success",
+			file:    types.File{ID: "1", Name: "testfile", Location: "/tmp/testfile"},
 			wantErr: false,
 		},
 		{
-			name:    "NilFile",
-			file:    nil,
+			name:    "DuplicateID",
+			file:    types.File{ID: "1", Name: "testfile copy"},
 			wantErr: true,
 		},
-		// Add more test cases here
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := fs.HashFile(tt.file)
+			err := fs.UploadFile(tt.file)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("HashFile() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("UploadFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
 func TestGetFile(t *testing.T) {
-	fs := NewFileService()
+	fs := newTestFileService(t, newTestDatabase(t))
+	if err := fs.UploadFile(types.File{ID: "1", Name: "testfile", OwnerID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
 		name     string
 		fileName string
@@ -260,22 +276,24 @@ func TestGetFile(t *testing.T) {
 	}{
 		{
 			name:     "Success",
-			fileName: "1",
+			fileName: "testfile",
 			wantErr:  false,
 		},
 		{
 			name:     "NonExistentFile",
-			fileName: "2",
+			fileName: "missing",
 			wantErr:  true,
 		},
-		// Add more test cases here
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := fs.GetFile(tt.fileName)
+			f, err := fs.GetFile(tt.fileName)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("GetFile() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if !tt.wantErr && f.ID != "1" {
+				t.Errorf("GetFile() = %+v, want file 1", f)
+			}
 		})
 	}
 }
@@ -311,3 +329,73 @@ func TestGetFile(t *testing.T) {
 // 	}
 // }
 //
+
+func TestConcurrentUploads(t *testing.T) {
+	// Uploads and session renewals go through pools of their own on the
+	// same file, as they do in the server
+	path := filepath.Join(t.TempDir(), "Smd.db")
+	if err := types.NewDatabaseWithPath(path).CreateDb(); err != nil {
+		t.Fatal(err)
+	}
+	connect := func() types.Database {
+		db := types.NewDatabaseWithPath(path)
+		if err := db.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Disconnect() })
+		return db
+	}
+	store := NewLocalBlobStore(t.TempDir())
+	sessions := &databaseSessionStore{db: connect()}
+	expires := time.Now().Add(time.Hour)
+	if err := sessions.Create(types.Session{ID: "s", UserID: "alice", Token: types.AuthToken{Token: "token", ExpiresAt: expires}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*20)
+	for i := 0; i < 8; i++ {
+		fs := &fileService{db: connect(), store: store, tmpDir: t.TempDir()}
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				content := fmt.Sprintf("upload %d-%d", i, j)
+				if _, err := fs.StoreStream(strings.NewReader(content), 100, types.File{Name: fmt.Sprintf("%d-%d.txt", i, j%3), OwnerID: "alice"}); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := sessions.Renew("token", expires, time.Now()); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent write error = %v", err)
+	}
+	db := connect()
+	total := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 3; j++ {
+			f, err := db.GetFileByPath("alice", "", fmt.Sprintf("%d-%d.txt", i, j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			versions, err := db.ListFileVersions(f.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += len(versions)
+		}
+	}
+	if total != 80 {
+		t.Errorf("recorded %d versions, want 80", total)
+	}
+}
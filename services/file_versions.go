@@ -0,0 +1,187 @@
+package services
+
+import (
+	"Smd/types"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrVersionNotFound = errors.New("version not found")
+
+func (fs *fileService) ListVersions(fileID string) ([]types.FileVersion, error) {
+	if _, err := fs.GetFileByID(fileID); err != nil {
+		return nil, err
+	}
+	versions, err := fs.db.ListFileVersions(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions from database: %v", err)
+	}
+	if versions == nil {
+		versions = []types.FileVersion{}
+	}
+	return versions, nil
+}
+
+func (fs *fileService) GetVersion(fileID string, version int) (types.FileVersion, error) {
+	v, err := fs.db.GetFileVersion(fileID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.FileVersion{}, ErrVersionNotFound
+		}
+		return types.FileVersion{}, fmt.Errorf("error getting version from database: %v", err)
+	}
+	return v, nil
+}
+
+// OpenVersion opens the stored contents of v for reading
+func (fs *fileService) OpenVersion(v types.FileVersion) (io.ReadSeekCloser, error) {
+	return fs.openBlob(v.Hash, v.WrappedKey, v.KeyID)
+}
+
+func (fs *fileService) RestoreVersion(fileID string, version int, uploaderID string) (types.File, error) {
+	fs.blobMu.Lock()
+	defer fs.blobMu.Unlock()
+
+	f, err := fs.GetFileByID(fileID)
+	if err != nil {
+		return types.File{}, err
+	}
+	v, err := fs.GetVersion(fileID, version)
+	if err != nil {
+		return types.File{}, err
+	}
+	if v.Version == f.Version {
+		return f, nil
+	}
+	// The old version keeps its place in the history and the restored copy
+	// shares its blob
+	v.CreatedAt = time.Now()
+	v.UploaderID = uploaderID
+	return fs.addVersion(f, v)
+}
+
+// addVersion records v as the newest version of f and applies the retention
+// policy. The caller holds blobMu and has saved v's blob.
+func (fs *fileService) addVersion(f types.File, v types.FileVersion) (types.File, error) {
+	added, err := fs.db.InsertFileVersion(v)
+	if err != nil {
+		fs.removeBlobIfUnreferenced(v.Hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.File{}, ErrFileNotFound
+		}
+		if errors.Is(err, types.ErrQuotaExceeded) {
+			return types.File{}, ErrQuotaExceeded
+		}
+		return types.File{}, fmt.Errorf("error adding version to database: %v", err)
+	}
+	f.Size = added.Size
+	f.ContentType = added.ContentType
+	f.Location = added.Location
+	f.UploadDate = added.CreatedAt
+	f.Hash = added.Hash
+	f.WrappedKey = added.WrappedKey
+	f.KeyID = added.KeyID
+	f.Version = added.Version
+
+	// The new version and its quota charge are committed, so failing here
+	// would only make the client upload it again. The next upload or sweep
+	// picks up what is left over.
+	if _, err := fs.pruneVersions(f); err != nil {
+		fmt.Printf("error pruning versions of file %s: %v\n", f.ID, err)
+	}
+	return f, nil
+}
+
+func (fs *fileService) PruneVersions(fileID string) error {
+	fs.blobMu.Lock()
+	defer fs.blobMu.Unlock()
+
+	f, err := fs.GetFileByID(fileID)
+	if err != nil {
+		return err
+	}
+	_, err = fs.pruneVersions(f)
+	return err
+}
+
+func (fs *fileService) PruneAllVersions() (int, error) {
+	directories, err := fs.db.ListDirectoriesWithRetention()
+	if err != nil {
+		return 0, fmt.Errorf("error listing directories: %v", err)
+	}
+	pruned := 0
+	for _, dir := range directories {
+		for offset := 0; ; offset += MaxListLimit {
+			files, err := fs.db.ListFilesInDirectory("", dir.ID, MaxListLimit, offset)
+			if err != nil {
+				return pruned, fmt.Errorf("error listing files: %v", err)
+			}
+			for _, f := range files {
+				fs.blobMu.Lock()
+				n, err := fs.pruneVersionsWithPolicy(f, dir)
+				fs.blobMu.Unlock()
+				pruned += n
+				if err != nil {
+					return pruned, err
+				}
+			}
+			if len(files) < MaxListLimit {
+				break
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// pruneVersions applies the retention policy of f's directory. Files at a
+// user's root have no policy. The caller holds blobMu.
+func (fs *fileService) pruneVersions(f types.File) (int, error) {
+	if f.DirectoryID == "" {
+		return 0, nil
+	}
+	dir, err := fs.db.GetDirectoryByID(f.DirectoryID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error getting directory: %v", err)
+	}
+	return fs.pruneVersionsWithPolicy(f, dir)
+}
+
+func (fs *fileService) pruneVersionsWithPolicy(f types.File, dir types.Directory) (int, error) {
+	if dir.MaxVersions <= 0 && dir.VersionRetentionDays <= 0 {
+		return 0, nil
+	}
+	versions, err := fs.db.ListFileVersions(f.ID)
+	if err != nil {
+		return 0, fmt.Errorf("error listing versions from database: %v", err)
+	}
+	cutoff := time.Now().AddDate(0, 0, -dir.VersionRetentionDays)
+
+	pruned := 0
+	for i, v := range versions {
+		if v.Version == f.Version {
+			continue
+		}
+		tooMany := dir.MaxVersions > 0 && i >= dir.MaxVersions
+		tooOld := dir.VersionRetentionDays > 0 && v.CreatedAt.Before(cutoff)
+		if !tooMany && !tooOld {
+			continue
+		}
+		remaining, err := fs.db.DeleteFileVersion(f.ID, v.Version)
+		if err != nil {
+			return pruned, fmt.Errorf("error deleting version from database: %v", err)
+		}
+		pruned++
+		if v.Hash != "" && remaining <= 0 {
+			if err := fs.removeBlobIfUnreferenced(v.Hash); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readVersion(t *testing.T, fs *fileService, v types.FileVersion) string {
+	t.Helper()
+	content, err := fs.OpenVersion(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	data, err := io.ReadAll(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileVersions(t *testing.T) {
+	fs := newTestFileService(t, newTestDatabase(t))
+
+	first, err := fs.StoreStream(strings.NewReader("draft"), 100, types.File{Name: "report.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := fs.StoreStream(strings.NewReader("final"), 100, types.File{Name: "report.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID || second.Version != 2 || second.Hash != testHash("final") {
+		t.Fatalf("re-upload = %+v, want version 2 of %s", second, first.ID)
+	}
+	// Same name at someone else's root is a different file
+	other, err := fs.StoreStream(strings.NewReader("draft"), 100, types.File{Name: "report.txt", OwnerID: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == first.ID || other.Version != 1 {
+		t.Errorf("upload by another user = %+v, want a new file", other)
+	}
+
+	versions, err := fs.ListVersions(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 1 {
+		t.Fatalf("ListVersions() = %+v, want versions 2 and 1", versions)
+	}
+	if versions[1].UploaderID != "alice" || versions[1].Size != 5 {
+		t.Errorf("version 1 = %+v", versions[1])
+	}
+	if got := readVersion(t, fs, versions[1]); got != "draft" {
+		t.Errorf("version 1 contents = %q, want draft", got)
+	}
+
+	restored, err := fs.RestoreVersion(first.ID, 1, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Version != 3 || restored.Hash != testHash("draft") {
+		t.Errorf("RestoreVersion() = %+v, want version 3 with the draft", restored)
+	}
+	current, err := fs.GetFileByID(first.ID)
+	if err != nil || current.Version != 3 || current.OwnerID != "alice" {
+		t.Errorf("GetFileByID() = %+v, %v", current, err)
+	}
+	v3, err := fs.GetVersion(first.ID, 3)
+	if err != nil || v3.UploaderID != "bob" {
+		t.Errorf("GetVersion(3) = %+v, %v, want uploaded by bob", v3, err)
+	}
+	if _, err := fs.GetVersion(first.ID, 9); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("GetVersion(9) error = %v, want ErrVersionNotFound", err)
+	}
+	if _, err := fs.RestoreVersion(first.ID, 9, "bob"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("RestoreVersion(9) error = %v, want ErrVersionNotFound", err)
+	}
+
+	// Versions 1 and 3 of alice's file and bob's file share the draft blob
+	if count, err := fs.db.GetBlobRefCount(testHash("draft")); err != nil || count != 3 {
+		t.Errorf("GetBlobRefCount(draft) = %v, %v, want 3", count, err)
+	}
+	if err := fs.DeleteFile(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.store.Stat(second.Location); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("blob of an old version survived deleting the file: %v", err)
+	}
+	if _, err := fs.store.Stat(other.Location); err != nil {
+		t.Errorf("blob still used by another file was removed: %v", err)
+	}
+	if _, err := fs.ListVersions(first.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("ListVersions() of deleted file error = %v, want ErrFileNotFound", err)
+	}
+}
+
+func TestVersionRetention(t *testing.T) {
+	db := newTestDatabase(t)
+	fs := newTestFileService(t, db)
+	if err := db.InsertDirectory(types.Directory{ID: "d1", Name: "docs", OwnerID: "alice", MaxVersions: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var uploads []types.File
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		f, err := fs.StoreStream(strings.NewReader(content), 100, types.File{Name: "a.txt", OwnerID: "alice", DirectoryID: "d1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploads = append(uploads, f)
+	}
+	versions, err := fs.ListVersions(uploads[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 4 || versions[1].Version != 3 {
+		t.Fatalf("ListVersions() = %+v, want versions 4 and 3", versions)
+	}
+	for _, f := range uploads[:2] {
+		if _, err := fs.store.Stat(f.Location); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("blob of pruned version %d left in the store: %v", f.Version, err)
+		}
+	}
+
+	// Back-date version 3 by adding it again ten days ago, then upload over it
+	// so it is no longer current. Age limits are enforced by the sweep.
+	old := versions[1]
+	if _, err := db.DeleteFileVersion(old.FileID, old.Version); err != nil {
+		t.Fatal(err)
+	}
+	old.CreatedAt = time.Now().AddDate(0, 0, -10)
+	if _, err := db.InsertFileVersion(old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("v5"), 100, types.File{Name: "a.txt", OwnerID: "alice", DirectoryID: "d1"}); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := db.GetDirectoryByID("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir.MaxVersions, dir.VersionRetentionDays = 0, 7
+	if err := db.UpdateDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fs.PruneAllVersions()
+	if err != nil || n != 1 {
+		t.Errorf("PruneAllVersions() = %d, %v, want 1", n, err)
+	}
+	versions, _ = fs.ListVersions(uploads[0].ID)
+	for _, v := range versions {
+		if v.CreatedAt.Before(time.Now().AddDate(0, 0, -7)) {
+			t.Errorf("version %d older than the retention period was kept", v.Version)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrGroupNotFound  = errors.New("group not found")
+	ErrInvalidGroup   = errors.New("a group needs a name")
+	ErrGroupTaken     = errors.New("a group with that name already exists")
+	ErrGroupHasSpaces = errors.New("group still owns team spaces")
+	ErrNotMember      = errors.New("user is not a member of the group")
+)
+
+// GroupService manages groups, their members and their team spaces. A team
+// space is a root directory owned by a group: everything stored in it
+// belongs to the group, counts against the group's quota and can be reached
+// by every member their role allows.
+type GroupService interface {
+	ListGroups() ([]types.Group, error)
+	GetGroup(id string) (types.Group, error)
+	CreateGroup(name string) (types.Group, error)
+	RenameGroup(id, name string) (types.Group, error)
+	// DeleteGroup deletes a group along with its memberships and access
+	// grants. Its team spaces have to be deleted first.
+	DeleteGroup(id string) error
+	ListMembers(id string) ([]types.User, error)
+	AddMember(id, userID string) error
+	RemoveMember(id, userID string) error
+	// ListUserGroups returns the groups userID is a member of
+	ListUserGroups(userID string) ([]types.Group, error)
+	ListSpaces(id string) ([]types.Directory, error)
+	CreateSpace(id, name string) (types.Directory, error)
+	// ListUserSpaces returns the team spaces of every group userID is a
+	// member of
+	ListUserSpaces(userID string) ([]types.Directory, error)
+}
+
+type groupService struct {
+	db  types.Database
+	now func() time.Time
+}
+
+func NewGroupService() GroupService {
+	gs := &groupService{
+		db:  types.NewDatabase(),
+		now: time.Now,
+	}
+	err := gs.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return gs
+}
+
+func (gs *groupService) ListGroups() ([]types.Group, error) {
+	groups, err := gs.db.ListGroups()
+	if err != nil {
+		return nil, fmt.Errorf("error listing groups: %v", err)
+	}
+	if groups == nil {
+		groups = []types.Group{}
+	}
+	return groups, nil
+}
+
+func (gs *groupService) GetGroup(id string) (types.Group, error) {
+	g, err := gs.db.GetGroup(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Group{}, ErrGroupNotFound
+		}
+		return types.Group{}, fmt.Errorf("error getting group: %v", err)
+	}
+	return g, nil
+}
+
+func (gs *groupService) CreateGroup(name string) (types.Group, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return types.Group{}, ErrInvalidGroup
+	}
+	if err := gs.checkNameFree(name, ""); err != nil {
+		return types.Group{}, err
+	}
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.Group{}, err
+	}
+	g := types.Group{CreatedAt: gs.now(), ID: id, Name: name}
+	if err := gs.db.InsertGroup(g); err != nil {
+		return types.Group{}, fmt.Errorf("error creating group: %v", err)
+	}
+	return g, nil
+}
+
+func (gs *groupService) RenameGroup(id, name string) (types.Group, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return types.Group{}, ErrInvalidGroup
+	}
+	g, err := gs.GetGroup(id)
+	if err != nil {
+		return types.Group{}, err
+	}
+	if err := gs.checkNameFree(name, id); err != nil {
+		return types.Group{}, err
+	}
+	g.Name = name
+	if err := gs.db.UpdateGroup(g); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Group{}, ErrGroupNotFound
+		}
+		return types.Group{}, fmt.Errorf("error updating group: %v", err)
+	}
+	return g, nil
+}
+
+func (gs *groupService) DeleteGroup(id string) error {
+	spaces, err := gs.ListSpaces(id)
+	if err != nil {
+		return err
+	}
+	if len(spaces) > 0 {
+		return ErrGroupHasSpaces
+	}
+	if err := gs.db.DeleteGroup(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrGroupNotFound
+		}
+		return fmt.Errorf("error deleting group: %v", err)
+	}
+	return nil
+}
+
+func (gs *groupService) ListMembers(id string) ([]types.User, error) {
+	if _, err := gs.GetGroup(id); err != nil {
+		return nil, err
+	}
+	members, err := gs.db.ListGroupMembers(id)
+	if err != nil {
+		return nil, fmt.Errorf("error listing members: %v", err)
+	}
+	if members == nil {
+		members = []types.User{}
+	}
+	return members, nil
+}
+
+func (gs *groupService) AddMember(id, userID string) error {
+	if _, err := gs.GetGroup(id); err != nil {
+		return err
+	}
+	if _, err := gs.db.GetUserByID(userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("error getting user: %v", err)
+	}
+	if err := gs.db.AddGroupMember(id, userID, gs.now()); err != nil {
+		return fmt.Errorf("error adding member: %v", err)
+	}
+	return nil
+}
+
+func (gs *groupService) RemoveMember(id, userID string) error {
+	if _, err := gs.GetGroup(id); err != nil {
+		return err
+	}
+	if err := gs.db.RemoveGroupMember(id, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotMember
+		}
+		return fmt.Errorf("error removing member: %v", err)
+	}
+	return nil
+}
+
+func (gs *groupService) ListUserGroups(userID string) ([]types.Group, error) {
+	groups, err := gs.db.ListGroupsForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing groups: %v", err)
+	}
+	if groups == nil {
+		groups = []types.Group{}
+	}
+	return groups, nil
+}
+
+func (gs *groupService) ListSpaces(id string) ([]types.Directory, error) {
+	if _, err := gs.GetGroup(id); err != nil {
+		return nil, err
+	}
+	// A group's root holds nothing but its team spaces
+	spaces, err := gs.db.ListSubdirectories(id, "", MaxListLimit, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error listing team spaces: %v", err)
+	}
+	if spaces == nil {
+		spaces = []types.Directory{}
+	}
+	return spaces, nil
+}
+
+func (gs *groupService) CreateSpace(id, name string) (types.Directory, error) {
+	if _, err := gs.GetGroup(id); err != nil {
+		return types.Directory{}, err
+	}
+	if err := validateName(name); err != nil {
+		return types.Directory{}, err
+	}
+	_, err := gs.db.GetSubdirectoryByName(id, "", name)
+	if err == nil {
+		return types.Directory{}, ErrDirectoryExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return types.Directory{}, fmt.Errorf("error looking up directory: %v", err)
+	}
+	dirID, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.Directory{}, err
+	}
+	space := types.Directory{ID: dirID, Name: name, OwnerID: id}
+	if err := gs.db.InsertDirectory(space); err != nil {
+		return types.Directory{}, fmt.Errorf("error creating team space: %v", err)
+	}
+	return space, nil
+}
+
+func (gs *groupService) ListUserSpaces(userID string) ([]types.Directory, error) {
+	groups, err := gs.ListUserGroups(userID)
+	if err != nil {
+		return nil, err
+	}
+	spaces := []types.Directory{}
+	for _, g := range groups {
+		dirs, err := gs.db.ListSubdirectories(g.ID, "", MaxListLimit, 0)
+		if err != nil {
+			return nil, fmt.Errorf("error listing team spaces: %v", err)
+		}
+		spaces = append(spaces, dirs...)
+	}
+	return spaces, nil
+}
+
+// checkNameFree returns ErrGroupTaken if a group other than exceptID is
+// called name
+func (gs *groupService) checkNameFree(name, exceptID string) error {
+	existing, err := gs.db.GetGroupByName(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up group: %v", err)
+	}
+	if existing.ID != exceptID {
+		return ErrGroupTaken
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGroupService(t *testing.T, db types.Database, usernames ...string) *groupService {
+	t.Helper()
+	for _, name := range usernames {
+		u := types.User{ID: name, Username: name, Password: "pw", Role: types.Owner, CreatedAt: time.Now()}
+		if err := db.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &groupService{db: db, now: time.Now}
+}
+
+func TestManageGroups(t *testing.T) {
+	db := newTestDatabase(t)
+	gs := newTestGroupService(t, db, "alice", "bob")
+
+	eng, err := gs.CreateGroup(" Engineering ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eng.Name != "Engineering" || eng.ID == "" {
+		t.Errorf("CreateGroup() = %+v", eng)
+	}
+	if _, err := gs.CreateGroup("engineering"); !errors.Is(err, ErrGroupTaken) {
+		t.Errorf("CreateGroup() error = %v, want ErrGroupTaken", err)
+	}
+	if _, err := gs.CreateGroup(" "); !errors.Is(err, ErrInvalidGroup) {
+		t.Errorf("CreateGroup() error = %v, want ErrInvalidGroup", err)
+	}
+	ops, err := gs.CreateGroup("Operations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.RenameGroup(ops.ID, "ENGINEERING"); !errors.Is(err, ErrGroupTaken) {
+		t.Errorf("RenameGroup() error = %v, want ErrGroupTaken", err)
+	}
+	if g, err := gs.RenameGroup(ops.ID, "Ops"); err != nil || g.Name != "Ops" {
+		t.Errorf("RenameGroup() = %+v, %v", g, err)
+	}
+
+	memberTests := []struct {
+		name    string
+		group   string
+		user    string
+		wantErr error
+	}{
+		{"Add", eng.ID, "alice", nil},
+		{"AddAgain", eng.ID, "alice", nil},
+		{"AddBob", eng.ID, "bob", nil},
+		{"UnknownUser", eng.ID, "carol", ErrUserNotFound},
+		{"UnknownGroup", "nope", "alice", ErrGroupNotFound},
+	}
+	for _, tt := range memberTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := gs.AddMember(tt.group, tt.user); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AddMember() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if members, err := gs.ListMembers(eng.ID); err != nil || len(members) != 2 || members[0].Username != "alice" {
+		t.Errorf("ListMembers() = %+v, %v", members, err)
+	}
+	if err := gs.RemoveMember(eng.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.RemoveMember(eng.ID, "bob"); !errors.Is(err, ErrNotMember) {
+		t.Errorf("RemoveMember() error = %v, want ErrNotMember", err)
+	}
+	if groups, err := gs.ListUserGroups("alice"); err != nil || len(groups) != 1 || groups[0].ID != eng.ID {
+		t.Errorf("ListUserGroups() = %+v, %v", groups, err)
+	}
+
+	space, err := gs.CreateSpace(eng.ID, "Designs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if space.OwnerID != eng.ID || space.ParentDirectoryID != "" {
+		t.Errorf("CreateSpace() = %+v", space)
+	}
+	if _, err := gs.CreateSpace(eng.ID, "Designs"); !errors.Is(err, ErrDirectoryExists) {
+		t.Errorf("CreateSpace() error = %v, want ErrDirectoryExists", err)
+	}
+	if spaces, err := gs.ListUserSpaces("alice"); err != nil || len(spaces) != 1 || spaces[0].ID != space.ID {
+		t.Errorf("ListUserSpaces() = %+v, %v", spaces, err)
+	}
+	if spaces, err := gs.ListUserSpaces("bob"); err != nil || len(spaces) != 0 {
+		t.Errorf("ListUserSpaces() = %+v, %v for a former member", spaces, err)
+	}
+
+	if err := gs.DeleteGroup(eng.ID); !errors.Is(err, ErrGroupHasSpaces) {
+		t.Errorf("DeleteGroup() error = %v, want ErrGroupHasSpaces", err)
+	}
+	if err := db.DeleteDirectoryByID(space.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.DeleteGroup(eng.ID); err != nil {
+		t.Fatal(err)
+	}
+	if groups, err := gs.ListUserGroups("alice"); err != nil || len(groups) != 0 {
+		t.Errorf("ListUserGroups() = %+v, %v after deleting the group", groups, err)
+	}
+	if err := gs.DeleteGroup(eng.ID); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("DeleteGroup() error = %v, want ErrGroupNotFound", err)
+	}
+}
+
+func TestTeamSpace(t *testing.T) {
+	db := newTestDatabase(t)
+	gs := newTestGroupService(t, db, "alice", "bob", "mallory")
+	fs := newTestFileService(t, db)
+	ds := &directoryService{db: db, fileService: fs}
+	qs := &quotaService{db: db}
+	as := &authorizationService{db: db, roles: newTestRoleService(db)}
+	alice := types.User{ID: "alice", Role: types.Owner}
+	bob := types.User{ID: "bob", Role: types.Owner}
+	mallory := types.User{ID: "mallory", Role: types.Owner}
+
+	team, err := gs.CreateGroup("Team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if err := gs.AddMember(team.ID, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	space, err := gs.CreateSpace(team.ID, "Shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What members store there belongs to the group, not to them
+	sub, err := ds.CreateDirectory(alice.ID, "Drafts", space.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.OwnerID != team.ID {
+		t.Errorf("CreateDirectory() owner = %q, want the group", sub.OwnerID)
+	}
+	f, err := fs.StoreStream(strings.NewReader("12345"), 100, types.File{Name: "plan.txt", OwnerID: alice.ID, DirectoryID: sub.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.OwnerID != team.ID {
+		t.Errorf("StoreStream() owner = %q, want the group", f.OwnerID)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("123"), 100, types.File{Name: "plan.txt", OwnerID: bob.ID, DirectoryID: sub.ID}); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := db.ListFileVersions(f.ID)
+	if err != nil || len(versions) != 2 || versions[0].UploaderID != bob.ID || versions[1].UploaderID != alice.ID {
+		t.Errorf("ListFileVersions() = %+v, %v, want uploads by bob and alice", versions, err)
+	}
+
+	if q, err := qs.GetQuota(types.QuotaGroup, team.ID); err != nil || q.UsedBytes != 8 {
+		t.Errorf("group quota = %+v, %v, want 8 bytes used", q, err)
+	}
+	if q, err := qs.GetQuota(types.QuotaUser, alice.ID); err != nil || q.UsedBytes != 0 {
+		t.Errorf("uploader quota = %+v, %v, want nothing used", q, err)
+	}
+	// Groups don't inherit the default meant for users
+	if _, err := qs.SetLimit(types.QuotaDefault, "", 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("123456"), 100, types.File{Name: "more.txt", OwnerID: alice.ID, DirectoryID: space.ID}); err != nil {
+		t.Errorf("StoreStream() error = %v under the user default", err)
+	}
+	if _, err := qs.SetLimit(types.QuotaGroup, team.ID, 16); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("too much"), 100, types.File{Name: "big.txt", OwnerID: bob.ID, DirectoryID: space.ID}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("StoreStream() error = %v, want ErrQuotaExceeded over the group limit", err)
+	}
+
+	authTests := []struct {
+		name    string
+		user    types.User
+		action  Action
+		wantErr error
+	}{
+		{"MemberReads", bob, ActionRead, nil},
+		{"MemberWrites", bob, ActionWrite, nil},
+		{"OutsiderReads", mallory, ActionRead, ErrForbidden},
+	}
+	for _, tt := range authTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := as.AuthorizeDirectory(tt.user, sub.ID, tt.action); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AuthorizeDirectory() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := as.AuthorizeFile(tt.user, f, tt.action); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AuthorizeFile() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if err := as.AuthorizeAclChange(bob, f.ID, ""); err != nil {
+		t.Errorf("AuthorizeAclChange() error = %v for a member", err)
+	}
+	// The space itself is left to admins
+	if err := as.AuthorizeSpaceChange(bob, space.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeSpaceChange() of the root error = %v, want ErrForbidden", err)
+	}
+	if err := as.AuthorizeSpaceChange(bob, sub.ID); err != nil {
+		t.Errorf("AuthorizeSpaceChange() below the root error = %v", err)
+	}
+	if err := as.AuthorizeSpaceChange(types.User{ID: "root", Role: types.Admin}, space.ID); err != nil {
+		t.Errorf("AuthorizeSpaceChange() by an admin error = %v", err)
+	}
+	if err := as.AuthorizeAclChange(bob, "", space.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeAclChange() of the root error = %v, want ErrForbidden", err)
+	}
+
+	// What one member deletes stays in reach of the others
+	trash := &trashService{db: db, fileService: fs, roles: newTestRoleService(db)}
+	item, err := trash.TrashFile(bob, f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, err := trash.ListTrash(alice); err != nil || len(items) != 1 || items[0].ID != item.ID {
+		t.Errorf("ListTrash() for another member = %+v, %v", items, err)
+	}
+	if _, err := trash.GetTrashItem(mallory, item.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("GetTrashItem() by an outsider error = %v, want ErrForbidden", err)
+	}
+	// but membership alone isn't enough to bring it back or destroy it
+	reader := types.User{ID: alice.ID, Role: types.Regular}
+	if err := trash.Purge(reader, item.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Purge() by a Regular member error = %v, want ErrForbidden", err)
+	}
+	if _, err := trash.Restore(reader, item.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Restore() by a Regular member error = %v, want ErrForbidden", err)
+	}
+	if _, err := trash.Restore(alice, item.ID); err != nil {
+		t.Errorf("Restore() by another member error = %v", err)
+	}
+
+	// Moving things in or out would change who they belong to
+	own, err := ds.CreateDirectory(alice.ID, "Mine", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.MoveDirectory(own.ID, own.Name, space.ID); !errors.Is(err, ErrSpaceMove) {
+		t.Errorf("MoveDirectory() into a space error = %v, want ErrSpaceMove", err)
+	}
+	if _, err := ds.MoveDirectory(sub.ID, sub.Name, ""); !errors.Is(err, ErrSpaceMove) {
+		t.Errorf("MoveDirectory() out of a space error = %v, want ErrSpaceMove", err)
+	}
+	if _, err := ds.MoveDirectory(sub.ID, "Final", space.ID); err != nil {
+		t.Errorf("MoveDirectory() rename in a space error = %v", err)
+	}
+
+	if err := gs.RemoveMember(team.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.AuthorizeDirectory(bob, sub.ID, ActionRead); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeDirectory() error = %v after leaving the group", err)
+	}
+}
+
+func TestGroupAccessGrant(t *testing.T) {
+	db := newTestDatabase(t)
+	gs := newTestGroupService(t, db, "alice", "bob", "mallory")
+	ds := &directoryService{db: db, fileService: newTestFileService(t, db)}
+	as := &authorizationService{db: db, roles: newTestRoleService(db)}
+	bob := types.User{ID: "bob", Role: types.Owner}
+	mallory := types.User{ID: "mallory", Role: types.Owner}
+
+	readers, err := gs.CreateGroup("Readers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.AddMember(readers.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ds.CreateDirectory("alice", "Reports", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grantTests := []struct {
+		name    string
+		entry   types.AclEntry
+		wantErr error
+	}{
+		{"UserAndGroup", types.AclEntry{UserID: bob.ID, GroupID: readers.ID, DirectoryID: dir.ID}, ErrInvalidAclEntry},
+		{"Neither", types.AclEntry{DirectoryID: dir.ID}, ErrInvalidAclEntry},
+		{"UnknownGroup", types.AclEntry{GroupID: "nope", DirectoryID: dir.ID}, ErrGroupNotFound},
+	}
+	for _, tt := range grantTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := as.GrantAccess(tt.entry); !errors.Is(err, tt.wantErr) {
+				t.Errorf("GrantAccess() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	entry, err := as.GrantAccess(types.AclEntry{GroupID: readers.ID, DirectoryID: dir.ID, Privileges: types.Privileges{Read: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := as.ListAccess("", dir.ID); err != nil || len(entries) != 1 || entries[0].GroupID != readers.ID || entries[0].UserID != "" {
+		t.Errorf("ListAccess() = %+v, %v", entries, err)
+	}
+	if err := as.AuthorizeDirectory(bob, dir.ID, ActionRead); err != nil {
+		t.Errorf("AuthorizeDirectory(read) error = %v for a member", err)
+	}
+	if err := as.AuthorizeDirectory(bob, dir.ID, ActionWrite); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeDirectory(write) error = %v beyond the grant", err)
+	}
+	if err := as.AuthorizeDirectory(mallory, dir.ID, ActionRead); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeDirectory(read) error = %v for a non-member", err)
+	}
+	// A grant doesn't let its holders share further
+	if err := as.AuthorizeAclChange(bob, "", dir.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeAclChange() error = %v for a grantee", err)
+	}
+
+	if err := gs.DeleteGroup(readers.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.GetAclEntry(entry.ID); !errors.Is(err, ErrAclEntryNotFound) {
+		t.Errorf("GetAclEntry() error = %v after deleting the group", err)
+	}
+}
@@ -0,0 +1,355 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrNotDirectoryUser means the directory can't log a user in, though a local
+// user of the same name may be able to
+var ErrNotDirectoryUser = errors.New("not a directory user")
+
+// defaultLdapTimeout bounds connecting and each request when LdapConfig has none
+const defaultLdapTimeout = 10 * time.Second
+
+type LdapConfig struct {
+	URL string // ldap://host[:389] or ldaps://host[:636]
+	// StartTLS upgrades an ldap:// connection before any credentials are sent
+	StartTLS  bool
+	TLSConfig *tls.Config // The system roots when nil
+	// BindDN and BindPassword are the service account users are looked up
+	// with. The search is anonymous when BindDN is empty.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the entry to log in as, with {username} replaced by
+	// the escaped username
+	UserFilter        string
+	UsernameAttribute string // As typed at login when empty or missing
+	EmailAttribute    string
+	// IDAttribute permanently identifies an entry, like entryUUID or
+	// objectGUID. Users are linked to their DN when it's empty, so moving an
+	// entry makes it a new user.
+	IDAttribute string
+	// GroupAttribute lists the user's groups on their own entry, like memberOf
+	GroupAttribute string
+	// GroupFilter additionally searches GroupBaseDN, or BaseDN when empty,
+	// for groups with {dn} replaced by the escaped DN of the user
+	GroupBaseDN string
+	GroupFilter string
+	// RoleMappings match groups by DN or by the value of its first RDN,
+	// usually the cn, ignoring case. The first mapping with a group the user
+	// is in wins, and DefaultRole applies if none match. With no mappings
+	// roles are only set on first login.
+	RoleMappings []RoleMapping
+	DefaultRole  types.Role
+	Timeout      time.Duration
+}
+
+// LdapService checks passwords against an LDAP directory such as OpenLDAP or
+// Active Directory, by searching for the user's entry and binding as it
+type LdapService interface {
+	// Authenticate returns the user linked to username's directory entry if
+	// password is theirs, creating them on first login and bringing their
+	// username, email and role up to date from the directory
+	Authenticate(username, password string) (types.User, error)
+}
+
+type ldapService struct {
+	db      types.Database
+	cfg     LdapConfig
+	host    string
+	timeout time.Duration
+	now     func() time.Time
+}
+
+func NewLdapService(cfg LdapConfig) (LdapService, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("ldap needs an ldap:// or ldaps:// URL")
+	}
+	if cfg.StartTLS && u.Scheme == "ldaps" {
+		return nil, fmt.Errorf("ldaps:// is already TLS, StartTLS is for ldap:// URLs")
+	}
+	if cfg.BaseDN == "" || !strings.Contains(cfg.UserFilter, "{username}") {
+		return nil, fmt.Errorf("ldap needs a base DN and a user filter containing {username}")
+	}
+	if cfg.GroupFilter != "" && !strings.Contains(cfg.GroupFilter, "{dn}") {
+		return nil, fmt.Errorf("ldap group filter must contain {dn}")
+	}
+	ls := &ldapService{
+		db:      types.NewDatabase(),
+		cfg:     cfg,
+		host:    u.Hostname(),
+		timeout: cfg.Timeout,
+		now:     time.Now,
+	}
+	if ls.timeout <= 0 {
+		ls.timeout = defaultLdapTimeout
+	}
+	err = ls.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ls, nil
+}
+
+func (ls *ldapService) Authenticate(username, password string) (types.User, error) {
+	// An empty password makes an unauthenticated bind, which servers accept
+	// for any DN
+	if username == "" || password == "" {
+		return types.User{}, ErrInvalidCredentials
+	}
+	conn, err := ls.connect()
+	if err != nil {
+		return types.User{}, err
+	}
+	defer conn.Close()
+
+	entry, err := ls.findUser(conn, username)
+	if err != nil {
+		return types.User{}, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return types.User{}, ErrInvalidCredentials
+		}
+		return types.User{}, fmt.Errorf("error binding as %s: %v", entry.DN, err)
+	}
+	groups, err := ls.groups(conn, entry)
+	if err != nil {
+		return types.User{}, err
+	}
+	return ls.provision(entry, username, groups)
+}
+
+// connect opens a connection, secured if configured to be, and binds it as
+// the service account
+func (ls *ldapService) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{}
+	if ls.cfg.TLSConfig != nil {
+		tlsConfig = ls.cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = ls.host
+	}
+	conn, err := ldap.DialURL(ls.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ls.timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ldap server: %v", err)
+	}
+	conn.SetTimeout(ls.timeout)
+	if ls.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error starting tls with ldap server: %v", err)
+		}
+	}
+	if err := ls.bindServiceAccount(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (ls *ldapService) bindServiceAccount(conn *ldap.Conn) error {
+	if ls.cfg.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(ls.cfg.BindDN, ls.cfg.BindPassword); err != nil {
+		return fmt.Errorf("error binding as ldap service account: %v", err)
+	}
+	return nil
+}
+
+// findUser returns the one entry the user filter matches for username
+func (ls *ldapService) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	var attributes []string
+	for _, a := range []string{ls.cfg.UsernameAttribute, ls.cfg.EmailAttribute, ls.cfg.IDAttribute, ls.cfg.GroupAttribute} {
+		if a != "" {
+			attributes = append(attributes, a)
+		}
+	}
+	if attributes == nil {
+		// No attributes at all, rather than all of them
+		attributes = []string{"1.1"}
+	}
+	filter := strings.ReplaceAll(ls.cfg.UserFilter, "{username}", ldap.EscapeFilter(username))
+	res, err := conn.Search(ldap.NewSearchRequest(ls.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ls.timeout.Seconds()), false, filter, attributes, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) || (err == nil && len(res.Entries) > 1) {
+		return nil, fmt.Errorf("username %q matches more than one directory entry", username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error searching for ldap user: %v", err)
+	}
+	if len(res.Entries) == 0 {
+		return nil, ErrNotDirectoryUser
+	}
+	return res.Entries[0], nil
+}
+
+// groups returns the DNs of the groups entry is in
+func (ls *ldapService) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	var groups []string
+	if ls.cfg.GroupAttribute != "" {
+		groups = entry.GetAttributeValues(ls.cfg.GroupAttribute)
+	}
+	if ls.cfg.GroupFilter == "" {
+		return groups, nil
+	}
+	// The connection is bound as the user now, who may not be allowed to
+	// search groups
+	if err := ls.bindServiceAccount(conn); err != nil {
+		return nil, err
+	}
+	base := ls.cfg.GroupBaseDN
+	if base == "" {
+		base = ls.cfg.BaseDN
+	}
+	filter := strings.ReplaceAll(ls.cfg.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+	res, err := conn.Search(ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, int(ls.timeout.Seconds()), false, filter, []string{"1.1"}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("error searching for ldap groups: %v", err)
+	}
+	for _, g := range res.Entries {
+		groups = append(groups, g.DN)
+	}
+	return groups, nil
+}
+
+// subject is what links entry to its user
+func (ls *ldapService) subject(entry *ldap.Entry) (string, error) {
+	if ls.cfg.IDAttribute == "" {
+		return "dn:" + strings.ToLower(entry.DN), nil
+	}
+	raw := entry.GetRawAttributeValue(ls.cfg.IDAttribute)
+	if len(raw) == 0 {
+		return "", fmt.Errorf("directory entry %s has no %s", entry.DN, ls.cfg.IDAttribute)
+	}
+	// Active Directory's objectGUID is binary
+	value := string(raw)
+	if !utf8.Valid(raw) {
+		value = hex.EncodeToString(raw)
+	}
+	return ls.cfg.IDAttribute + ":" + value, nil
+}
+
+func (ls *ldapService) provision(entry *ldap.Entry, typed string, groups []string) (types.User, error) {
+	subject, err := ls.subject(entry)
+	if err != nil {
+		return types.User{}, err
+	}
+	role, mapped := ls.mapRole(groups)
+	username := typed
+	if ls.cfg.UsernameAttribute != "" {
+		if v := entry.GetAttributeValue(ls.cfg.UsernameAttribute); v != "" {
+			username = v
+		}
+	}
+	email := ""
+	if ls.cfg.EmailAttribute != "" {
+		email = entry.GetAttributeValue(ls.cfg.EmailAttribute)
+	}
+
+	user, err := ls.db.GetLdapUser(subject)
+	if err == nil {
+		changed := false
+		if mapped && user.Role != role {
+			user.Role, changed = role, true
+		}
+		if email != "" && user.Email != email {
+			user.Email, changed = email, true
+		}
+		if username != user.Username {
+			// Follow renames in the directory, unless the name is taken here
+			if _, err := ls.db.GetUser(username); errors.Is(err, sql.ErrNoRows) {
+				user.Username, changed = username, true
+			}
+		}
+		if changed {
+			if err := ls.db.UpdateUser(user); err != nil {
+				return types.User{}, fmt.Errorf("error updating user: %v", err)
+			}
+		}
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return types.User{}, fmt.Errorf("error looking up ldap user: %v", err)
+	}
+
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.User{}, err
+	}
+	// Nobody knows the password, the user only logs in through the directory
+	password, err := utils.GenerateToken(32)
+	if err != nil {
+		return types.User{}, err
+	}
+	hash, err := types.HashPassword(password)
+	if err != nil {
+		return types.User{}, err
+	}
+	user = types.User{
+		CreatedAt: ls.now(),
+		ID:        id,
+		Username:  username,
+		Password:  hash,
+		Email:     email,
+		Role:      role,
+	}
+	err = ls.db.InsertLdapUser(user, subject)
+	if errors.Is(err, types.ErrUsernameTaken) {
+		// Linking to the local user by name would hand their account to
+		// whoever has the name in the directory
+		return types.User{}, fmt.Errorf("%w: username %q belongs to a local user", ErrNotDirectoryUser, username)
+	}
+	if err != nil {
+		// Another login for the same entry may have just created the user
+		if existing, getErr := ls.db.GetLdapUser(subject); getErr == nil {
+			return existing, nil
+		}
+		return types.User{}, fmt.Errorf("error creating ldap user: %v", err)
+	}
+	return ls.db.GetUserByID(id)
+}
+
+// mapRole returns the role groups map to, and whether there are mappings to
+// apply at all
+func (ls *ldapService) mapRole(groups []string) (types.Role, bool) {
+	if len(ls.cfg.RoleMappings) == 0 {
+		return ls.cfg.DefaultRole, false
+	}
+	for _, m := range ls.cfg.RoleMappings {
+		for _, g := range groups {
+			if strings.EqualFold(g, m.Group) || strings.EqualFold(groupName(g), m.Group) {
+				return m.Role, true
+			}
+		}
+	}
+	return ls.cfg.DefaultRole, true
+}
+
+// groupName returns the value of the first RDN of a group's DN, so
+// "cn=admins,ou=groups,dc=example,dc=com" is "admins"
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
@@ -0,0 +1,511 @@
+package services
+
+import (
+	"Smd/types"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+const (
+	ldapServiceDN       = "cn=smd,ou=services,dc=example,dc=com"
+	ldapServicePassword = "service-password"
+	startTLSOID         = "1.3.6.1.4.1.1466.20037"
+)
+
+// mockLdapEntry is a directory entry; password is empty for entries that
+// can't bind
+type mockLdapEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// mockLdapServer is an in-process LDAP directory speaking just enough of the
+// protocol for the client: simple binds, StartTLS, and searches with and, or,
+// not, equality and presence filters. Only the service account can search.
+type mockLdapServer struct {
+	t        *testing.T
+	listener net.Listener
+	tls      *tls.Config // Offered over StartTLS, or from the start for ldaps
+	ldaps    bool
+
+	mu         sync.Mutex
+	entries    []mockLdapEntry
+	plainBinds int
+}
+
+func newMockLdapServer(t *testing.T, ldaps bool) *mockLdapServer {
+	t.Helper()
+	// Borrow the test certificate httptest servers use, which is for 127.0.0.1
+	certs := httptest.NewUnstartedServer(nil)
+	certs.StartTLS()
+	certs.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mockLdapServer{t: t, listener: listener, tls: certs.TLS, ldaps: ldaps}
+	if ldaps {
+		s.listener = tls.NewListener(listener, s.tls)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+	s.entries = []mockLdapEntry{
+		{dn: ldapServiceDN, password: ldapServicePassword},
+		{dn: "uid=alice,ou=people,dc=example,dc=com", password: "alice-password", attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"alice"},
+			"mail":        {"alice@example.com"},
+			"entryUUID":   {"5a8f1c02-0b4e-4f6e-9a61-3f0c2d7e9b11"},
+			"memberOf":    {"cn=staff,ou=groups,dc=example,dc=com", "cn=storage-admins,ou=groups,dc=example,dc=com"},
+		}},
+		{dn: "uid=bob,ou=people,dc=example,dc=com", password: "bob-password", attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"bob"},
+			"mail":        {"bob@example.com"},
+			"entryUUID":   {"0d1e2f3a-4b5c-4d6e-8f70-8192a3b4c5d6"},
+		}},
+		{dn: "cn=developers,ou=groups,dc=example,dc=com", attributes: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"member":      {"uid=bob,ou=people,dc=example,dc=com"},
+		}},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *mockLdapServer) url() string {
+	if s.ldaps {
+		return "ldaps://" + s.listener.Addr().String()
+	}
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// passwordsInClear counts binds with a password that weren't over TLS
+func (s *mockLdapServer) passwordsInClear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.plainBinds
+}
+
+func (s *mockLdapServer) roots() *x509.CertPool {
+	cert, err := x509.ParseCertificate(s.tls.Certificates[0].Certificate[0])
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return roots
+}
+
+func (s *mockLdapServer) update(dn string, change func(e *mockLdapEntry)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.entries {
+		if s.entries[i].dn == dn {
+			change(&s.entries[i])
+		}
+	}
+}
+
+func (s *mockLdapServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *mockLdapServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }() // conn changes with StartTLS
+	_, isTLS := conn.(*tls.Conn)
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !isClosed(err) {
+				s.t.Logf("mock ldap server: %v", err)
+			}
+			return
+		}
+		if len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case 0: // BindRequest
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := int64(49) // invalidCredentials
+			if dn == "" && password == "" {
+				bound, code = "", 0
+			} else if e, ok := s.entry(dn); ok && e.password != "" && e.password == password {
+				bound, code = e.dn, 0
+			}
+			if password != "" && !isTLS {
+				s.mu.Lock()
+				s.plainBinds++
+				s.mu.Unlock()
+			}
+			s.respond(conn, id, ldapResult(1, code))
+		case 2: // UnbindRequest
+			return
+		case 3: // SearchRequest
+			s.search(conn, id, op, bound)
+		case 23: // ExtendedRequest
+			if op.Children[0].Data.String() != startTLSOID || isTLS {
+				s.respond(conn, id, ldapResult(24, 2))
+				continue
+			}
+			s.respond(conn, id, ldapResult(24, 0))
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, isTLS = tlsConn, true
+		default:
+			s.t.Errorf("mock ldap server: unexpected operation %d", op.Tag)
+			return
+		}
+	}
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "connection reset")
+}
+
+func (s *mockLdapServer) entry(dn string) (mockLdapEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if strings.EqualFold(e.dn, dn) {
+			return e, true
+		}
+	}
+	return mockLdapEntry{}, false
+}
+
+func (s *mockLdapServer) search(conn net.Conn, id int64, op *ber.Packet, bound string) {
+	if !strings.EqualFold(bound, ldapServiceDN) {
+		s.respond(conn, id, ldapResult(5, 50)) // insufficientAccessRights
+		return
+	}
+	base := strings.ToLower(op.Children[0].Value.(string))
+	sizeLimit := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var wanted []string
+	for _, a := range op.Children[7].Children {
+		wanted = append(wanted, a.Value.(string))
+	}
+
+	s.mu.Lock()
+	entries := append([]mockLdapEntry(nil), s.entries...)
+	s.mu.Unlock()
+	sent := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), base) || !matchesFilter(filter, e) {
+			continue
+		}
+		if sizeLimit > 0 && int64(sent) == sizeLimit {
+			s.respond(conn, id, ldapResult(5, 4)) // sizeLimitExceeded
+			return
+		}
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "Search Result Entry")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "DN"))
+		attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range e.attributes {
+			if !containsFold(wanted, name) {
+				continue
+			}
+			attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		result.AppendChild(attributes)
+		s.respond(conn, id, result)
+		sent++
+	}
+	s.respond(conn, id, ldapResult(5, 0))
+}
+
+func matchesFilter(filter *ber.Packet, e mockLdapEntry) bool {
+	switch filter.Tag {
+	case 0: // and
+		for _, f := range filter.Children {
+			if !matchesFilter(f, e) {
+				return false
+			}
+		}
+		return true
+	case 1: // or
+		for _, f := range filter.Children {
+			if matchesFilter(f, e) {
+				return true
+			}
+		}
+		return false
+	case 2: // not
+		return !matchesFilter(filter.Children[0], e)
+	case 3: // equalityMatch
+		name, value := filter.Children[0].Value.(string), filter.Children[1].Value.(string)
+		for attr, values := range e.attributes {
+			if strings.EqualFold(attr, name) && containsFold(values, value) {
+				return true
+			}
+		}
+		return false
+	case 7: // present
+		for attr := range e.attributes {
+			if strings.EqualFold(attr, filter.Data.String()) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func ldapResult(tag ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
+
+func (s *mockLdapServer) respond(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func newTestLdapService(t *testing.T, db types.Database, s *mockLdapServer) *ldapService {
+	t.Helper()
+	return &ldapService{
+		db: db,
+		cfg: LdapConfig{
+			URL:               s.url(),
+			TLSConfig:         &tls.Config{RootCAs: s.roots()},
+			BindDN:            ldapServiceDN,
+			BindPassword:      ldapServicePassword,
+			BaseDN:            "ou=people,dc=example,dc=com",
+			UserFilter:        "(&(objectClass=person)(uid={username}))",
+			UsernameAttribute: "uid",
+			EmailAttribute:    "mail",
+			IDAttribute:       "entryUUID",
+			GroupAttribute:    "memberOf",
+			RoleMappings: []RoleMapping{
+				{Group: "storage-admins", Role: types.Admin},
+				{Group: "cn=developers,ou=groups,dc=example,dc=com", Role: types.Developer},
+			},
+			DefaultRole: types.Regular,
+		},
+		host:    "127.0.0.1",
+		timeout: 5 * time.Second,
+		now:     time.Now,
+	}
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	db := newTestDatabase(t)
+	s := newMockLdapServer(t, false)
+	ls := newTestLdapService(t, db, s)
+
+	user, err := ls.Authenticate("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Email != "alice@example.com" || user.Role != types.Admin {
+		t.Errorf("provisioned %+v", user)
+	}
+	if stored, err := db.GetUser("alice"); err != nil || stored.ID != user.ID {
+		t.Errorf("stored user %+v, %v", stored, err)
+	}
+
+	// Changes in the directory reach the user on their next login
+	s.update("uid=alice,ou=people,dc=example,dc=com", func(e *mockLdapEntry) {
+		e.attributes["uid"] = []string{"alice.smith"}
+		e.attributes["mail"] = []string{"alice.smith@example.com"}
+		e.attributes["memberOf"] = []string{"cn=staff,ou=groups,dc=example,dc=com"}
+	})
+	again, err := ls.Authenticate("alice.smith", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID || again.Username != "alice.smith" || again.Email != "alice.smith@example.com" || again.Role != types.Regular {
+		t.Errorf("second login got %+v", again)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+	}{
+		{name: "WrongPassword", username: "alice.smith", password: "guess", wantErr: ErrInvalidCredentials},
+		{name: "EmptyPassword", username: "alice.smith", password: "", wantErr: ErrInvalidCredentials},
+		{name: "UnknownUser", username: "mallory", password: "mallory-password", wantErr: ErrNotDirectoryUser},
+		{name: "Wildcard", username: "*", password: "alice-password", wantErr: ErrNotDirectoryUser},
+		{name: "FilterInjection", username: "x)(uid=alice.smith", password: "alice-password", wantErr: ErrNotDirectoryUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ls.Authenticate(tt.username, tt.password); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLdapAuthenticateLocalUserConflict(t *testing.T) {
+	db := newTestDatabase(t)
+	s := newMockLdapServer(t, false)
+	ls := newTestLdapService(t, db, s)
+	if err := db.InsertUser(types.User{ID: "u1", Username: "bob", Password: "local-password", Role: types.Regular, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ls.Authenticate("bob", "bob-password"); !errors.Is(err, ErrNotDirectoryUser) {
+		t.Errorf("got %v, want ErrNotDirectoryUser", err)
+	}
+	if user, _ := db.GetUser("bob"); user.ID != "u1" {
+		t.Errorf("local user changed: %+v", user)
+	}
+}
+
+func TestLdapGroupSearch(t *testing.T) {
+	db := newTestDatabase(t)
+	s := newMockLdapServer(t, false)
+	ls := newTestLdapService(t, db, s)
+	ls.cfg.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	ls.cfg.GroupFilter = "(&(objectClass=groupOfNames)(member={dn}))"
+	// Linked by DN now
+	ls.cfg.IDAttribute = ""
+
+	user, err := ls.Authenticate("bob", "bob-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != types.Developer {
+		t.Errorf("got role %v, want Developer", user.Role)
+	}
+	if again, err := ls.Authenticate("BOB", "bob-password"); err != nil || again.ID != user.ID {
+		t.Errorf("second login got %+v, %v", again, err)
+	}
+}
+
+func TestLdapTLS(t *testing.T) {
+	t.Run("LDAPS", func(t *testing.T) {
+		s := newMockLdapServer(t, true)
+		ls := newTestLdapService(t, newTestDatabase(t), s)
+		if !strings.HasPrefix(ls.cfg.URL, "ldaps://") {
+			t.Fatalf("got URL %s", ls.cfg.URL)
+		}
+		if _, err := ls.Authenticate("alice", "alice-password"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("StartTLS", func(t *testing.T) {
+		s := newMockLdapServer(t, false)
+		ls := newTestLdapService(t, newTestDatabase(t), s)
+		ls.cfg.StartTLS = true
+		if _, err := ls.Authenticate("alice", "alice-password"); err != nil {
+			t.Fatal(err)
+		}
+		if n := s.passwordsInClear(); n != 0 {
+			t.Errorf("%d passwords sent before TLS started", n)
+		}
+	})
+
+	t.Run("UntrustedCertificate", func(t *testing.T) {
+		s := newMockLdapServer(t, false)
+		ls := newTestLdapService(t, newTestDatabase(t), s)
+		ls.cfg.StartTLS = true
+		ls.cfg.TLSConfig = nil
+		_, err := ls.Authenticate("alice", "alice-password")
+		if err == nil || errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrNotDirectoryUser) {
+			t.Errorf("got %v, want a connection error", err)
+		}
+		if n := s.passwordsInClear(); n != 0 {
+			t.Errorf("%d passwords sent without TLS", n)
+		}
+	})
+}
+
+// stubDirectory answers for a directory in auth service tests
+type stubDirectory struct {
+	user types.User
+	err  error
+}
+
+func (sd stubDirectory) Authenticate(username, password string) (types.User, error) {
+	return sd.user, sd.err
+}
+
+func TestLoginWithDirectory(t *testing.T) {
+	db := newTestDatabase(t)
+	local := types.User{ID: "u1", Username: "admin", Password: "local-password", Role: types.Admin, CreatedAt: time.Now()}
+	directoryUser := types.User{ID: "u2", Username: "alice", Password: "unguessable", Role: types.Regular, CreatedAt: time.Now()}
+	for _, u := range []types.User{local, directoryUser} {
+		if err := db.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		directory stubDirectory
+		username  string
+		password  string
+		wantUser  string
+		wantErr   error
+	}{
+		{name: "DirectoryUser", directory: stubDirectory{user: directoryUser}, username: "alice", password: "alice-password", wantUser: "u2"},
+		{name: "DirectoryRejects", directory: stubDirectory{err: ErrInvalidCredentials}, username: "alice", password: "guess", wantErr: ErrInvalidCredentials},
+		{name: "LocalUser", directory: stubDirectory{err: ErrNotDirectoryUser}, username: "admin", password: "local-password", wantUser: "u1"},
+		{name: "LocalUserWithDirectoryNamesake", directory: stubDirectory{err: ErrInvalidCredentials}, username: "admin", password: "local-password", wantUser: "u1"},
+		{name: "DirectoryDown", directory: stubDirectory{err: errors.New("connection refused")}, username: "admin", password: "local-password", wantUser: "u1"},
+		{name: "DirectoryDownForDirectoryUser", directory: stubDirectory{err: errors.New("connection refused")}, username: "alice", password: "alice-password", wantErr: ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: &twoFactorService{db: db, now: time.Now}, directory: tt.directory, sessionTTL: time.Hour}
+			session, _, err := as.Login(tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if session.UserID != tt.wantUser {
+				t.Errorf("logged in as %q, want %q", session.UserID, tt.wantUser)
+			}
+		})
+	}
+}
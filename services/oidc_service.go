@@ -0,0 +1,631 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidOidcState = errors.New("unknown or expired single sign-on login")
+	ErrOidcLoginFailed  = errors.New("single sign-on login failed")
+)
+
+const (
+	// OidcLoginTTL is how long a user has to log in at the identity provider
+	OidcLoginTTL = 10 * time.Minute
+	// oidcClockSkew is how far the provider's clock may be from ours
+	oidcClockSkew = time.Minute
+	// oidcKeyRefreshInterval limits how often an unknown key ID refetches the
+	// provider's keys, so tokens with made up key IDs can't hammer it
+	oidcKeyRefreshInterval = time.Minute
+)
+
+// RoleMapping gives members of Group the role Role
+type RoleMapping struct {
+	Group string
+	Role  types.Role
+}
+
+type OidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // Empty for a public client, which PKCE alone protects
+	RedirectURL  string
+	Scopes       []string // "openid" is always requested
+	// UsernameClaim names new users, falling back to email and then sub
+	UsernameClaim string
+	// GroupsClaim holds the groups RoleMappings are matched against. The
+	// first mapping with a group the user is in wins, and DefaultRole applies
+	// if none match. With no mappings roles are only set on first login.
+	GroupsClaim  string
+	RoleMappings []RoleMapping
+	DefaultRole  types.Role
+	Client       *http.Client // http.DefaultClient when nil
+}
+
+// OidcService logs users in through an OpenID Connect identity provider with
+// the authorization code flow and PKCE. The provider's endpoints and keys are
+// discovered from its issuer URL on first use.
+type OidcService interface {
+	// Begin starts a login, returning the provider URL to send the user to
+	// and the state it will come back with
+	Begin() (authURL, state string, err error)
+	// Complete exchanges the code the provider came back with for an ID
+	// token and returns the user it identifies, creating them on first login
+	Complete(state, code string) (types.User, error)
+}
+
+type oidcService struct {
+	db     types.Database
+	cfg    OidcConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	provider    *oidcProvider
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidcProvider is the part of the discovery document the flow needs
+type oidcProvider struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	JwksURI                       string   `json:"jwks_uri"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+func NewOidcService(cfg OidcConfig) (OidcService, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc needs an issuer, client ID and redirect URL")
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	oidc := &oidcService{
+		db:     types.NewDatabase(),
+		cfg:    cfg,
+		client: client,
+		now:    time.Now,
+	}
+	err := oidc.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return oidc, nil
+}
+
+func (oidc *oidcService) Begin() (string, string, error) {
+	provider, err := oidc.discover()
+	if err != nil {
+		return "", "", err
+	}
+	state, err := utils.GenerateToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := utils.GenerateToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := utils.GenerateToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	now := oidc.now()
+	// Logins that never came back are cleared out here, there's no job for it
+	if _, err := oidc.db.DeleteExpiredOidcLogins(now); err != nil {
+		fmt.Printf("error deleting expired oidc logins: %v\n", err)
+	}
+	err = oidc.db.InsertOidcLogin(types.OidcLogin{
+		ExpiresAt:    now.Add(OidcLoginTTL),
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error saving oidc login: %v", err)
+	}
+
+	scopes := []string{"openid"}
+	for _, scope := range oidc.cfg.Scopes {
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", oidc.cfg.ClientID)
+	query.Set("redirect_uri", oidc.cfg.RedirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return provider.AuthorizationEndpoint + sep + query.Encode(), state, nil
+}
+
+func (oidc *oidcService) Complete(state, code string) (types.User, error) {
+	login, err := oidc.db.TakeOidcLogin(state)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrInvalidOidcState
+		}
+		return types.User{}, fmt.Errorf("error looking up oidc login: %v", err)
+	}
+	if !login.ExpiresAt.After(oidc.now()) {
+		return types.User{}, ErrInvalidOidcState
+	}
+
+	rawIDToken, err := oidc.exchange(code, login.CodeVerifier)
+	if err != nil {
+		return types.User{}, err
+	}
+	claims, err := oidc.verifyIDToken(rawIDToken, login.Nonce)
+	if err != nil {
+		return types.User{}, err
+	}
+	user, err := oidc.provision(claims)
+	if err != nil {
+		return types.User{}, err
+	}
+	if user.Disabled {
+		return types.User{}, ErrAccountDisabled
+	}
+	return user, nil
+}
+
+// discover fetches the provider's discovery document, once
+func (oidc *oidcService) discover() (oidcProvider, error) {
+	oidc.mu.Lock()
+	defer oidc.mu.Unlock()
+	if oidc.provider != nil {
+		return *oidc.provider, nil
+	}
+	var provider oidcProvider
+	if err := oidc.getJSON(strings.TrimSuffix(oidc.cfg.Issuer, "/")+"/.well-known/openid-configuration", &provider); err != nil {
+		return oidcProvider{}, fmt.Errorf("error discovering oidc provider: %v", err)
+	}
+	// The issuer is what ID tokens are checked against, so a document for
+	// some other issuer can't be trusted
+	if provider.Issuer != oidc.cfg.Issuer {
+		return oidcProvider{}, fmt.Errorf("oidc provider reports issuer %q, expected %q", provider.Issuer, oidc.cfg.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksURI == "" {
+		return oidcProvider{}, fmt.Errorf("oidc provider is missing endpoints")
+	}
+	if len(provider.CodeChallengeMethodsSupported) > 0 && !slices.Contains(provider.CodeChallengeMethodsSupported, "S256") {
+		return oidcProvider{}, fmt.Errorf("oidc provider doesn't support PKCE with S256")
+	}
+	oidc.provider = &provider
+	return provider, nil
+}
+
+func (oidc *oidcService) getJSON(url string, v interface{}) error {
+	resp, err := oidc.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// exchange redeems code at the token endpoint, returning the raw ID token
+func (oidc *oidcService) exchange(code, verifier string) (string, error) {
+	provider, err := oidc.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oidc.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if oidc.cfg.ClientSecret == "" {
+		form.Set("client_id", oidc.cfg.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oidc.cfg.ClientSecret != "" {
+		// RFC 6749 2.3.1 has the credentials form encoded before they're
+		// put in the header
+		req.SetBasicAuth(url.QueryEscape(oidc.cfg.ClientID), url.QueryEscape(oidc.cfg.ClientSecret))
+	}
+	resp, err := oidc.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error calling oidc token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("error reading oidc token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if body.Error != "" {
+			return "", fmt.Errorf("%w: %s %s", ErrOidcLoginFailed, body.Error, body.ErrorDescription)
+		}
+		return "", fmt.Errorf("error calling oidc token endpoint: %s", resp.Status)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("%w: no ID token was issued", ErrOidcLoginFailed)
+	}
+	return body.IDToken, nil
+}
+
+// audience is the aud claim, which is a string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// idTokenClaims are the checked claims of an ID token, with all of them in
+// Raw for mapping to a user
+type idTokenClaims struct {
+	Issuer          string                 `json:"iss"`
+	Subject         string                 `json:"sub"`
+	Audience        audience               `json:"aud"`
+	AuthorizedParty string                 `json:"azp"`
+	Expiry          float64                `json:"exp"`
+	NotBefore       float64                `json:"nbf"`
+	Nonce           string                 `json:"nonce"`
+	Raw             map[string]interface{} `json:"-"`
+}
+
+// verifyIDToken checks the token's signature against the provider's keys and
+// that it was issued by the provider, to us, for this login and is current
+func (oidc *oidcService) verifyIDToken(raw, nonce string) (idTokenClaims, error) {
+	invalid := func(reason string) (idTokenClaims, error) {
+		return idTokenClaims{}, fmt.Errorf("%w: ID token %s", ErrOidcLoginFailed, reason)
+	}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return invalid("is malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return invalid("header is malformed")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return invalid("signature is malformed")
+	}
+	key, err := oidc.signingKey(header.Kid)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return invalid(err.Error())
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return invalid("claims are malformed")
+	}
+	if err := decodeJWTPart(parts[1], &claims.Raw); err != nil {
+		return invalid("claims are malformed")
+	}
+	now := oidc.now()
+	switch {
+	case claims.Issuer != oidc.cfg.Issuer:
+		return invalid("is from another issuer")
+	case !slices.Contains(claims.Audience, oidc.cfg.ClientID):
+		return invalid("is for another client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != oidc.cfg.ClientID:
+		return invalid("was issued to another party")
+	case claims.Expiry == 0 || now.Add(-oidcClockSkew).After(time.Unix(int64(claims.Expiry), 0)):
+		return invalid("has expired")
+	case claims.NotBefore != 0 && now.Add(oidcClockSkew).Before(time.Unix(int64(claims.NotBefore), 0)):
+		return invalid("is not valid yet")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return invalid("is for another login")
+	case claims.Subject == "":
+		return invalid("has no subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWTSignature supports the RSA and ECDSA algorithms providers sign ID
+// tokens with. "none" and the HMAC algorithms, which would make the client
+// secret a signing key, are refused.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("uses unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' || rsa.VerifyPKCS1v15(key, hash, digest, signature) != nil {
+			return errors.New("signature is invalid")
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return errors.New("signature is invalid")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("signature is invalid")
+		}
+	default:
+		return errors.New("signing key has an unsupported type")
+	}
+	return nil
+}
+
+// signingKey returns the provider key with ID kid, refetching the provider's
+// keys when it isn't known in case they were rotated
+func (oidc *oidcService) signingKey(kid string) (crypto.PublicKey, error) {
+	provider, err := oidc.discover()
+	if err != nil {
+		return nil, err
+	}
+	oidc.mu.Lock()
+	defer oidc.mu.Unlock()
+	if key, ok := oidc.lookupKey(kid); ok {
+		return key, nil
+	}
+	if oidc.now().Sub(oidc.keysFetched) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("%w: ID token is signed with an unknown key", ErrOidcLoginFailed)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := oidc.getJSON(provider.JwksURI, &set); err != nil {
+		return nil, fmt.Errorf("error fetching oidc provider keys: %v", err)
+	}
+	oidc.keys = map[string]crypto.PublicKey{}
+	oidc.keysFetched = oidc.now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			oidc.keys[k.Kid] = key
+		}
+	}
+	if key, ok := oidc.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: ID token is signed with an unknown key", ErrOidcLoginFailed)
+}
+
+// lookupKey finds kid among the cached keys. Tokens without a key ID can only
+// be checked when the provider has a single key. The caller holds mu.
+func (oidc *oidcService) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(oidc.keys) == 1 {
+		for _, key := range oidc.keys {
+			return key, true
+		}
+	}
+	key, ok := oidc.keys[kid]
+	return key, ok
+}
+
+// jwk is an RSA or EC public key from a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || len(n) < 2048/8 {
+			return nil, errors.New("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return key, nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
+// provision returns the user linked to the token's subject, creating them on
+// first login. Their role follows the groups claim when mappings are set.
+func (oidc *oidcService) provision(claims idTokenClaims) (types.User, error) {
+	role, mapped := oidc.mapRole(claims)
+	email, _ := claims.Raw["email"].(string)
+
+	user, err := oidc.db.GetOidcUser(claims.Issuer, claims.Subject)
+	if err == nil {
+		if (mapped && user.Role != role) || (email != "" && user.Email != email) {
+			if mapped {
+				user.Role = role
+			}
+			if email != "" {
+				user.Email = email
+			}
+			if err := oidc.db.UpdateUser(user); err != nil {
+				return types.User{}, fmt.Errorf("error updating user: %v", err)
+			}
+		}
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return types.User{}, fmt.Errorf("error looking up oidc user: %v", err)
+	}
+
+	username := ""
+	for _, claim := range []string{oidc.cfg.UsernameClaim, "email"} {
+		if v, ok := claims.Raw[claim].(string); ok && claim != "" && v != "" {
+			username = v
+			break
+		}
+	}
+	if username == "" {
+		username = claims.Subject
+	}
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.User{}, err
+	}
+	// Nobody knows the password, the user only logs in through the provider
+	password, err := utils.GenerateToken(32)
+	if err != nil {
+		return types.User{}, err
+	}
+	hash, err := types.HashPassword(password)
+	if err != nil {
+		return types.User{}, err
+	}
+	user = types.User{
+		CreatedAt: oidc.now(),
+		ID:        id,
+		Username:  username,
+		Password:  hash,
+		Email:     email,
+		Role:      role,
+	}
+	err = oidc.db.InsertOidcUser(user, claims.Issuer, claims.Subject)
+	if errors.Is(err, types.ErrUsernameTaken) {
+		// Linking to an existing account by name would let whoever controls
+		// the name at the provider take it over
+		return types.User{}, fmt.Errorf("%w: username %q is already taken", ErrOidcLoginFailed, username)
+	}
+	if err != nil {
+		// Another login for the same subject may have just created the user
+		if existing, getErr := oidc.db.GetOidcUser(claims.Issuer, claims.Subject); getErr == nil {
+			return existing, nil
+		}
+		return types.User{}, fmt.Errorf("error creating oidc user: %v", err)
+	}
+	return oidc.db.GetUserByID(id)
+}
+
+// mapRole returns the role the token's groups map to, and whether there are
+// mappings to apply at all
+func (oidc *oidcService) mapRole(claims idTokenClaims) (types.Role, bool) {
+	if len(oidc.cfg.RoleMappings) == 0 {
+		return oidc.cfg.DefaultRole, false
+	}
+	var groups []string
+	switch v := claims.Raw[oidc.cfg.GroupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	for _, m := range oidc.cfg.RoleMappings {
+		if slices.Contains(groups, m.Group) {
+			return m.Role, true
+		}
+	}
+	return oidc.cfg.DefaultRole, true
+}
@@ -0,0 +1,407 @@
+package services
+
+import (
+	"Smd/types"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockOidcKey is a provider signing key
+type mockOidcKey struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+// mockOidcProvider is an in-process identity provider. Tests stand in for
+// the browser by calling authorize with the URL the service redirects to.
+type mockOidcProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu      sync.Mutex
+	keys    []mockOidcKey // Published at the JWKS endpoint
+	signing mockOidcKey   // Signs ID tokens; normally one of keys
+	codes   map[string]mockOidcAuthorization
+}
+
+type mockOidcAuthorization struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+const (
+	mockClientID     = "smd"
+	mockClientSecret = "s3cret&more"
+	mockRedirectURL  = "https://smd.example/login/oidc/callback"
+)
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	t.Helper()
+	p := &mockOidcProvider{t: t, codes: map[string]mockOidcAuthorization{}}
+	p.signing = mockOidcKey{kid: "rsa1", alg: "RS256", key: newMockRSAKey(t)}
+	p.keys = []mockOidcKey{p.signing}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                           p.server.URL,
+			"authorization_endpoint":           p.server.URL + "/authorize",
+			"token_endpoint":                   p.server.URL + "/token",
+			"jwks_uri":                         p.server.URL + "/jwks",
+			"code_challenge_methods_supported": []string{"plain", "S256"},
+		})
+	})
+	mux.HandleFunc("/jwks", p.serveKeys)
+	mux.HandleFunc("/token", p.serveToken)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func newMockRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func (p *mockOidcProvider) serveKeys(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b64 := base64.RawURLEncoding.EncodeToString
+	var keys []map[string]string
+	for _, k := range p.keys {
+		switch pub := k.key.Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{"kty": "RSA", "kid": k.kid, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{"kty": "EC", "kid": k.kid, "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (p *mockOidcProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if r.Method != http.MethodPost || id != mockClientID || secret != mockClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != mockRedirectURL {
+		tokenError("invalid_request")
+		return
+	}
+
+	p.mu.Lock()
+	auth, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.mu.Unlock()
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     p.sign(auth.claims),
+	})
+}
+
+// sign makes an ID token with the signing key
+func (p *mockOidcProvider) sign(claims map[string]interface{}) string {
+	p.mu.Lock()
+	k := p.signing
+	p.mu.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	switch k.alg {
+	case "none":
+		signature = nil
+	case "HS256":
+		// Signed with the client secret, the classic algorithm confusion
+		mac := hmac.New(sha256.New, []byte(mockClientSecret))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// authorize plays the user logging in at the provider: it checks the request
+// the service sent them with and returns the code they come back with. The ID
+// token gets the standard claims for the request, overridden by claims, where
+// nil values drop a claim.
+func (p *mockOidcProvider) authorize(authURL string, claims map[string]interface{}) string {
+	p.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("response_type") != "code" || query.Get("client_id") != mockClientID ||
+		query.Get("redirect_uri") != mockRedirectURL || query.Get("code_challenge_method") != "S256" ||
+		!strings.Contains(" "+query.Get("scope")+" ", " openid ") {
+		p.t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	now := time.Now()
+	token := map[string]interface{}{
+		"iss":   p.server.URL,
+		"aud":   mockClientID,
+		"sub":   "subject-1",
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"iat":   now.Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(token, k)
+		} else {
+			token[k] = v
+		}
+	}
+	code := "code-" + query.Get("state")
+	p.mu.Lock()
+	p.codes[code] = mockOidcAuthorization{challenge: query.Get("code_challenge"), claims: token}
+	p.mu.Unlock()
+	return code
+}
+
+func newTestOidcService(t *testing.T, db types.Database, p *mockOidcProvider) *oidcService {
+	t.Helper()
+	return &oidcService{
+		db: db,
+		cfg: OidcConfig{
+			Issuer:        p.server.URL,
+			ClientID:      mockClientID,
+			ClientSecret:  mockClientSecret,
+			RedirectURL:   mockRedirectURL,
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+			RoleMappings: []RoleMapping{
+				{Group: "storage-admins", Role: types.Admin},
+				{Group: "developers", Role: types.Developer},
+			},
+			DefaultRole: types.Regular,
+		},
+		client: p.server.Client(),
+		now:    time.Now,
+	}
+}
+
+// oidcLogin runs a whole login, with the provider issuing claims
+func oidcLogin(t *testing.T, oidc *oidcService, p *mockOidcProvider, claims map[string]interface{}) (types.User, error) {
+	t.Helper()
+	authURL, state, err := oidc.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oidc.Complete(state, p.authorize(authURL, claims))
+}
+
+func TestOidcLogin(t *testing.T) {
+	db := newTestDatabase(t)
+	p := newMockOidcProvider(t)
+	oidc := newTestOidcService(t, db, p)
+
+	user, err := oidcLogin(t, oidc, p, map[string]interface{}{
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"groups":             []string{"everyone", "developers", "storage-admins"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Email != "alice@example.com" || user.Role != types.Admin {
+		t.Errorf("provisioned %+v", user)
+	}
+	if stored, err := db.GetUser("alice"); err != nil || stored.ID != user.ID {
+		t.Errorf("stored user %+v, %v", stored, err)
+	}
+
+	// Later logins find the same user, with their role following their groups
+	again, err := oidcLogin(t, oidc, p, map[string]interface{}{
+		"preferred_username": "alice-renamed",
+		"email":              "alice@example.com",
+		"groups":             "developers",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != user.ID || again.Username != "alice" || again.Role != types.Developer {
+		t.Errorf("second login got %+v", again)
+	}
+	if stored, _ := db.GetUserByID(user.ID); stored.Role != types.Developer {
+		t.Errorf("role not updated: %+v", stored)
+	}
+
+	// No matching group falls back to the default role; no usable name to sub
+	other, err := oidcLogin(t, oidc, p, map[string]interface{}{"sub": "subject-2", "groups": []string{"sales"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Username != "subject-2" || other.Role != types.Regular {
+		t.Errorf("provisioned %+v", other)
+	}
+}
+
+func TestOidcRejectsTokens(t *testing.T) {
+	db := newTestDatabase(t)
+	p := newMockOidcProvider(t)
+	oidc := newTestOidcService(t, db, p)
+	now := time.Now()
+	attackerKey := mockOidcKey{kid: "rsa1", alg: "RS256", key: newMockRSAKey(t)}
+
+	tests := []struct {
+		name    string
+		claims  map[string]interface{}
+		signing *mockOidcKey
+	}{
+		{name: "OtherIssuer", claims: map[string]interface{}{"iss": "https://evil.example"}},
+		{name: "OtherAudience", claims: map[string]interface{}{"aud": "someone-else"}},
+		{name: "SharedAudienceWithoutAzp", claims: map[string]interface{}{"aud": []string{mockClientID, "someone-else"}}},
+		{name: "Expired", claims: map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}},
+		{name: "NoExpiry", claims: map[string]interface{}{"exp": nil}},
+		{name: "NotYetValid", claims: map[string]interface{}{"nbf": now.Add(10 * time.Minute).Unix()}},
+		{name: "OtherNonce", claims: map[string]interface{}{"nonce": "replayed"}},
+		{name: "NoSubject", claims: map[string]interface{}{"sub": nil}},
+		{name: "ForgedSignature", signing: &attackerKey},
+		{name: "UnknownKey", signing: &mockOidcKey{kid: "rsa9", alg: "RS256", key: attackerKey.key}},
+		{name: "AlgNone", signing: &mockOidcKey{kid: "rsa1", alg: "none", key: attackerKey.key}},
+		{name: "HMACWithClientSecret", signing: &mockOidcKey{kid: "rsa1", alg: "HS256", key: attackerKey.key}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.mu.Lock()
+			p.signing = p.keys[0]
+			if tt.signing != nil {
+				p.signing = *tt.signing
+			}
+			p.mu.Unlock()
+			_, err := oidcLogin(t, oidc, p, tt.claims)
+			if !errors.Is(err, ErrOidcLoginFailed) {
+				t.Errorf("got %v, want ErrOidcLoginFailed", err)
+			}
+		})
+	}
+	if users, _ := db.GetAllUsers(); len(users) != 0 {
+		t.Errorf("rejected logins created users: %+v", users)
+	}
+}
+
+func TestOidcState(t *testing.T) {
+	db := newTestDatabase(t)
+	p := newMockOidcProvider(t)
+	oidc := newTestOidcService(t, db, p)
+
+	if _, err := oidc.Complete("unknown", "code"); !errors.Is(err, ErrInvalidOidcState) {
+		t.Errorf("unknown state: got %v", err)
+	}
+
+	authURL, state, err := oidc.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := p.authorize(authURL, nil)
+	if _, err := oidc.Complete(state, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oidc.Complete(state, code); !errors.Is(err, ErrInvalidOidcState) {
+		t.Errorf("reused state: got %v", err)
+	}
+
+	// A code from one login can't complete another, PKCE ties it to its own
+	authURL, _, _ = oidc.Begin()
+	_, otherState, _ := oidc.Begin()
+	if _, err := oidc.Complete(otherState, p.authorize(authURL, nil)); !errors.Is(err, ErrOidcLoginFailed) {
+		t.Errorf("code injected into another login: got %v", err)
+	}
+
+	authURL, state, _ = oidc.Begin()
+	code = p.authorize(authURL, nil)
+	oidc.now = func() time.Time { return time.Now().Add(OidcLoginTTL + time.Second) }
+	if _, err := oidc.Complete(state, code); !errors.Is(err, ErrInvalidOidcState) {
+		t.Errorf("expired state: got %v", err)
+	}
+}
+
+func TestOidcKeyRotation(t *testing.T) {
+	db := newTestDatabase(t)
+	p := newMockOidcProvider(t)
+	oidc := newTestOidcService(t, db, p)
+	if _, err := oidcLogin(t, oidc, p, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.signing = mockOidcKey{kid: "ec1", alg: "ES256", key: ecKey}
+	p.keys = append(p.keys, p.signing)
+	p.mu.Unlock()
+
+	// Keys were just fetched, so the new one isn't looked for yet
+	if _, err := oidcLogin(t, oidc, p, nil); !errors.Is(err, ErrOidcLoginFailed) {
+		t.Errorf("right after a fetch: got %v", err)
+	}
+	oidc.mu.Lock()
+	oidc.keysFetched = time.Now().Add(-oidcKeyRefreshInterval)
+	oidc.mu.Unlock()
+	if _, err := oidcLogin(t, oidc, p, nil); err != nil {
+		t.Errorf("after rotating to an EC key: %v", err)
+	}
+}
+
+func TestOidcUsernameTaken(t *testing.T) {
+	db := newTestDatabase(t)
+	p := newMockOidcProvider(t)
+	oidc := newTestOidcService(t, db, p)
+	if err := db.InsertUser(types.User{ID: "u1", Username: "alice", Password: "secret", Role: types.Admin, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := oidcLogin(t, oidc, p, map[string]interface{}{"preferred_username": "alice"})
+	if !errors.Is(err, ErrOidcLoginFailed) {
+		t.Errorf("got %v, want ErrOidcLoginFailed", err)
+	}
+}
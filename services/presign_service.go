@@ -0,0 +1,230 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSignature      = errors.New("invalid or expired signature")
+	ErrInvalidPresign        = errors.New("a presigned URL is for a GET of one file or a POST of one named file, expiring within 7 days")
+	ErrSignedContentMismatch = errors.New("upload does not match the size or hash the URL was signed for")
+)
+
+const (
+	// DefaultPresignTTL is how long a presigned URL is valid unless asked otherwise
+	DefaultPresignTTL = 10 * time.Minute
+	MaxPresignTTL     = 7 * 24 * time.Hour
+)
+
+// PresignService issues URLs that let their holder make one kind of request
+// as the user who asked for them, without a session
+type PresignService interface {
+	// Sign returns the path and query of a URL allowing req until req.ExpiresAt
+	Sign(req types.SignedRequest) (string, error)
+	// Verify checks the signature on r against its method and path, returning
+	// what it allows and the user who signed it, so long as they are enabled
+	Verify(r *http.Request) (types.SignedRequest, types.User, error)
+}
+
+type presignService struct {
+	db     types.Database
+	secret []byte
+}
+
+func NewPresignService(secret []byte) PresignService {
+	ps := &presignService{
+		db:     types.NewDatabase(),
+		secret: secret,
+	}
+	err := ps.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ps
+}
+
+func (ps *presignService) Sign(req types.SignedRequest) (string, error) {
+	req.Hash = strings.ToLower(req.Hash)
+	if err := validatePresign(req); err != nil {
+		return "", err
+	}
+	path := presignPath(req)
+
+	query := url.Values{}
+	query.Set("user", req.UserID)
+	query.Set("expires", strconv.FormatInt(req.ExpiresAt.Unix(), 10))
+	if req.Method == http.MethodPost {
+		if req.DirectoryID != "" {
+			query.Set("directory_id", req.DirectoryID)
+		}
+		query.Set("name", req.Name)
+		if req.ContentLength > 0 {
+			query.Set("content_length", strconv.FormatInt(req.ContentLength, 10))
+		}
+		if req.Hash != "" {
+			query.Set("hash", req.Hash)
+		}
+	}
+	query.Set(utils.SignatureParam, ps.signature(req))
+	return path + "?" + query.Encode(), nil
+}
+
+func validatePresign(req types.SignedRequest) error {
+	now := time.Now()
+	if req.UserID == "" || !req.ExpiresAt.After(now) || req.ExpiresAt.After(now.Add(MaxPresignTTL)) {
+		return ErrInvalidPresign
+	}
+	switch req.Method {
+	case http.MethodGet:
+		if req.FileID == "" || strings.Contains(req.FileID, "/") ||
+			req.DirectoryID != "" || req.Name != "" || req.Hash != "" || req.ContentLength != 0 {
+			return ErrInvalidPresign
+		}
+	case http.MethodPost:
+		if req.FileID != "" || req.ContentLength < 0 {
+			return ErrInvalidPresign
+		}
+		if req.Name == "" || req.Name == "." || req.Name == ".." || strings.ContainsAny(req.Name, `/\`) {
+			return ErrInvalidPresign
+		}
+		if req.Hash != "" {
+			if _, err := hex.DecodeString(req.Hash); err != nil || len(req.Hash) != sha256.Size*2 {
+				return ErrInvalidPresign
+			}
+		}
+	default:
+		return ErrInvalidPresign
+	}
+	return nil
+}
+
+// presignPath is the endpoint a signed request goes to
+func presignPath(req types.SignedRequest) string {
+	if req.Method == http.MethodGet {
+		return "/files/" + req.FileID
+	}
+	return "/upload"
+}
+
+// signature is the HMAC of everything req allows, so none of it can be
+// changed without the secret
+func (ps *presignService) signature(req types.SignedRequest) string {
+	mac := hmac.New(sha256.New, ps.secret)
+	mac.Write([]byte(strings.Join([]string{
+		req.Method,
+		presignPath(req),
+		req.UserID,
+		req.FileID,
+		req.DirectoryID,
+		req.Name,
+		strconv.FormatInt(req.ExpiresAt.Unix(), 10),
+		strconv.FormatInt(req.ContentLength, 10),
+		req.Hash,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (ps *presignService) Verify(r *http.Request) (types.SignedRequest, types.User, error) {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+	}
+	req := types.SignedRequest{
+		ExpiresAt: time.Unix(expires, 0),
+		Method:    r.Method,
+		UserID:    query.Get("user"),
+	}
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		// HEAD is allowed by the same signature as GET
+		req.Method = http.MethodGet
+		req.FileID = strings.TrimPrefix(r.URL.Path, "/files/")
+		if req.FileID == r.URL.Path {
+			return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/upload":
+		req.DirectoryID = query.Get("directory_id")
+		req.Name = query.Get("name")
+		req.Hash = query.Get("hash")
+		if v := query.Get("content_length"); v != "" {
+			req.ContentLength, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+			}
+		}
+	default:
+		return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+	}
+
+	given, err := hex.DecodeString(query.Get(utils.SignatureParam))
+	if err != nil {
+		return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+	}
+	want, _ := hex.DecodeString(ps.signature(req))
+	if !hmac.Equal(given, want) || time.Now().After(req.ExpiresAt) {
+		return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+	}
+
+	user, err := ps.db.GetUserByID(req.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+		}
+		return types.SignedRequest{}, types.User{}, fmt.Errorf("error looking up user: %v", err)
+	}
+	// Disabling an account revokes the URLs it signed along with its sessions
+	if user.Disabled {
+		return types.SignedRequest{}, types.User{}, ErrInvalidSignature
+	}
+	return req, user, nil
+}
+
+// CheckSignedContent wraps r so that reading it to the end fails with
+// ErrSignedContentMismatch unless it has the size and hash req requires
+func CheckSignedContent(r io.Reader, req types.SignedRequest) io.Reader {
+	if req.ContentLength == 0 && req.Hash == "" {
+		return r
+	}
+	return &signedContentReader{r: r, req: req, hasher: sha256.New()}
+}
+
+type signedContentReader struct {
+	r      io.Reader
+	req    types.SignedRequest
+	hasher hash.Hash
+	n      int64
+}
+
+func (s *signedContentReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	s.hasher.Write(p[:n])
+	if s.req.ContentLength > 0 && s.n > s.req.ContentLength {
+		return n, ErrSignedContentMismatch
+	}
+	if err == io.EOF {
+		if s.req.ContentLength > 0 && s.n != s.req.ContentLength {
+			return n, ErrSignedContentMismatch
+		}
+		if s.req.Hash != "" && hex.EncodeToString(s.hasher.Sum(nil)) != s.req.Hash {
+			return n, ErrSignedContentMismatch
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPresignService(t *testing.T) *presignService {
+	t.Helper()
+	db := newTestDatabase(t)
+	if err := db.InsertUser(types.User{ID: "u1", Username: "ci", Password: "secret", Role: types.Regular, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	return &presignService{db: db, secret: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func TestPresignDownload(t *testing.T) {
+	ps := newTestPresignService(t)
+	url, err := ps.Sign(types.SignedRequest{Method: http.MethodGet, UserID: "u1", FileID: "f1", ExpiresAt: time.Now().Add(10 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(url, "/files/f1?") {
+		t.Fatalf("Sign() = %q, want a /files/f1 URL", url)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		signed, user, err := ps.Verify(httptest.NewRequest(method, url, nil))
+		if err != nil || user.ID != "u1" || signed.FileID != "f1" || signed.Method != http.MethodGet {
+			t.Errorf("Verify(%s) = %+v, %+v, %v", method, signed, user, err)
+		}
+	}
+
+	for name, req := range map[string]*http.Request{
+		"OtherFile":   httptest.NewRequest(http.MethodGet, strings.Replace(url, "/files/f1", "/files/f2", 1), nil),
+		"Versions":    httptest.NewRequest(http.MethodGet, strings.Replace(url, "/files/f1", "/files/f1/versions", 1), nil),
+		"Delete":      httptest.NewRequest(http.MethodDelete, url, nil),
+		"OtherUser":   httptest.NewRequest(http.MethodGet, strings.Replace(url, "user=u1", "user=u2", 1), nil),
+		"Extended":    httptest.NewRequest(http.MethodGet, strings.Replace(url, "expires=", "expires=1", 1), nil),
+		"NoSignature": httptest.NewRequest(http.MethodGet, "/files/f1?user=u1", nil),
+	} {
+		if _, _, err := ps.Verify(req); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: Verify() error = %v, want ErrInvalidSignature", name, err)
+		}
+	}
+
+	other := &presignService{db: ps.db, secret: []byte("another secret, another server..")}
+	if _, _, err := other.Verify(httptest.NewRequest(http.MethodGet, url, nil)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() with another secret error = %v, want ErrInvalidSignature", err)
+	}
+
+	if err := ps.db.SetUserDisabled("u1", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ps.Verify(httptest.NewRequest(http.MethodGet, url, nil)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() for a disabled user error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestPresignExpiry(t *testing.T) {
+	ps := newTestPresignService(t)
+	req := types.SignedRequest{Method: http.MethodGet, UserID: "u1", FileID: "f1", ExpiresAt: time.Now().Add(-time.Second)}
+	if _, err := ps.Sign(req); !errors.Is(err, ErrInvalidPresign) {
+		t.Errorf("Sign() of an expired request error = %v, want ErrInvalidPresign", err)
+	}
+	req.ExpiresAt = time.Now().Add(MaxPresignTTL + time.Hour)
+	if _, err := ps.Sign(req); !errors.Is(err, ErrInvalidPresign) {
+		t.Errorf("Sign() past MaxPresignTTL error = %v, want ErrInvalidPresign", err)
+	}
+
+	// Sign through the back door to get a URL that has already lapsed
+	req.ExpiresAt = time.Now().Add(-time.Minute)
+	url := "/files/f1?expires=" + strconv.FormatInt(req.ExpiresAt.Unix(), 10) + "&user=u1&signature=" + ps.signature(req)
+	if _, _, err := ps.Verify(httptest.NewRequest(http.MethodGet, url, nil)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() of an expired URL error = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestPresignUpload(t *testing.T) {
+	ps := newTestPresignService(t)
+	content := "build artifact"
+	req := types.SignedRequest{
+		Method:        http.MethodPost,
+		UserID:        "u1",
+		DirectoryID:   "d1",
+		Name:          "out.tar",
+		ContentLength: int64(len(content)),
+		Hash:          strings.ToUpper(testHash(content)),
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}
+	url, err := ps.Sign(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _, err := ps.Verify(httptest.NewRequest(http.MethodPost, url, nil))
+	if err != nil || signed.Name != "out.tar" || signed.DirectoryID != "d1" || signed.Hash != testHash(content) {
+		t.Fatalf("Verify() = %+v, %v", signed, err)
+	}
+	if _, _, err := ps.Verify(httptest.NewRequest(http.MethodPost, strings.Replace(url, "name=out.tar", "name=evil.sh", 1), nil)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() with another name error = %v, want ErrInvalidSignature", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{name: "Matches", body: content},
+		{name: "Shorter", body: content[:4], wantErr: ErrSignedContentMismatch},
+		{name: "Longer", body: content + "!", wantErr: ErrSignedContentMismatch},
+		{name: "SameSizeOtherHash", body: strings.ToUpper(content), wantErr: ErrSignedContentMismatch},
+	} {
+		if _, err := io.ReadAll(CheckSignedContent(strings.NewReader(tt.body), signed)); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: reading error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	for name, bad := range map[string]types.SignedRequest{
+		"NoName":    {Method: http.MethodPost, UserID: "u1", ExpiresAt: req.ExpiresAt},
+		"PathName":  {Method: http.MethodPost, UserID: "u1", Name: "../x", ExpiresAt: req.ExpiresAt},
+		"BadHash":   {Method: http.MethodPost, UserID: "u1", Name: "x", Hash: "abc", ExpiresAt: req.ExpiresAt},
+		"WithFile":  {Method: http.MethodPost, UserID: "u1", Name: "x", FileID: "f1", ExpiresAt: req.ExpiresAt},
+		"Delete":    {Method: http.MethodDelete, UserID: "u1", FileID: "f1", ExpiresAt: req.ExpiresAt},
+		"GetByName": {Method: http.MethodGet, UserID: "u1", FileID: "f1", Name: "x", ExpiresAt: req.ExpiresAt},
+	} {
+		if _, err := ps.Sign(bad); !errors.Is(err, ErrInvalidPresign) {
+			t.Errorf("%s: Sign() error = %v, want ErrInvalidPresign", name, err)
+		}
+	}
+}
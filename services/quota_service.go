@@ -0,0 +1,115 @@
+package services
+
+import (
+	"Smd/types"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidQuota = errors.New("quota limits must be a non-negative number of bytes")
+
+// QuotaService reads and sets storage quotas. Usage itself is kept up to date
+// by the database as versions are added and removed.
+type QuotaService interface {
+	// GetQuota returns the limit and usage of a user, group or directory, or
+	// of the default quota when subjectType is types.QuotaDefault
+	GetQuota(subjectType, subjectID string) (types.Quota, error)
+	// SetLimit sets a limit in bytes, zero meaning unlimited
+	SetLimit(subjectType, subjectID string, limitBytes int64) (types.Quota, error)
+	// ClearLimit removes a limit, so a user falls back to the default
+	ClearLimit(subjectType, subjectID string) (types.Quota, error)
+	// CheckUpload returns ErrQuotaExceeded if size more bytes for ownerID in
+	// directoryID would go over a quota
+	CheckUpload(ownerID, directoryID string, size int64) error
+}
+
+type quotaService struct {
+	db types.Database
+}
+
+func NewQuotaService() QuotaService {
+	qs := &quotaService{
+		db: types.NewDatabase(),
+	}
+	err := qs.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return qs
+}
+
+func (qs *quotaService) GetQuota(subjectType, subjectID string) (types.Quota, error) {
+	if err := qs.checkSubject(subjectType, subjectID); err != nil {
+		return types.Quota{}, err
+	}
+	q, err := qs.db.GetQuota(subjectType, subjectID)
+	if err != nil {
+		return types.Quota{}, fmt.Errorf("error getting quota: %v", err)
+	}
+	return q, nil
+}
+
+func (qs *quotaService) SetLimit(subjectType, subjectID string, limitBytes int64) (types.Quota, error) {
+	if limitBytes < 0 {
+		return types.Quota{}, ErrInvalidQuota
+	}
+	if err := qs.checkSubject(subjectType, subjectID); err != nil {
+		return types.Quota{}, err
+	}
+	if err := qs.db.SetQuotaLimit(subjectType, subjectID, limitBytes); err != nil {
+		return types.Quota{}, fmt.Errorf("error setting quota: %v", err)
+	}
+	return qs.GetQuota(subjectType, subjectID)
+}
+
+func (qs *quotaService) ClearLimit(subjectType, subjectID string) (types.Quota, error) {
+	if err := qs.checkSubject(subjectType, subjectID); err != nil {
+		return types.Quota{}, err
+	}
+	if err := qs.db.ClearQuotaLimit(subjectType, subjectID); err != nil {
+		return types.Quota{}, fmt.Errorf("error clearing quota: %v", err)
+	}
+	return qs.GetQuota(subjectType, subjectID)
+}
+
+func (qs *quotaService) CheckUpload(ownerID, directoryID string, size int64) error {
+	err := qs.db.CheckQuota(ownerID, directoryID, size)
+	if errors.Is(err, types.ErrQuotaExceeded) {
+		return ErrQuotaExceeded
+	}
+	if err != nil {
+		return fmt.Errorf("error checking quota: %v", err)
+	}
+	return nil
+}
+
+// checkSubject makes sure the user, group or directory a quota is for exists
+func (qs *quotaService) checkSubject(subjectType, subjectID string) error {
+	var err error
+	switch subjectType {
+	case types.QuotaUser:
+		if _, err = qs.db.GetUserByID(subjectID); errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+	case types.QuotaDirectory:
+		if _, err = qs.db.GetDirectoryByID(subjectID); errors.Is(err, sql.ErrNoRows) {
+			return ErrDirectoryNotFound
+		}
+	case types.QuotaGroup:
+		if _, err = qs.db.GetGroup(subjectID); errors.Is(err, sql.ErrNoRows) {
+			return ErrGroupNotFound
+		}
+	case types.QuotaDefault:
+		if subjectID != "" {
+			return ErrInvalidQuota
+		}
+	default:
+		return ErrInvalidQuota
+	}
+	if err != nil {
+		return fmt.Errorf("error checking quota subject: %v", err)
+	}
+	return nil
+}
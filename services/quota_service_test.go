@@ -0,0 +1,185 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaAccounting(t *testing.T) {
+	db := newTestDatabase(t)
+	fs := newTestFileService(t, db)
+	qs := &quotaService{db: db}
+	if err := db.InsertUser(types.User{ID: "alice", Username: "alice", Password: "secret", Role: types.Regular, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	used := func() int64 {
+		t.Helper()
+		q, err := qs.GetQuota(types.QuotaUser, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.UsedBytes
+	}
+
+	if _, err := qs.SetLimit(types.QuotaUser, "alice", 10); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.StoreStream(strings.NewReader("12345"), 100, types.File{Name: "a.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := used(); got != 5 {
+		t.Errorf("usage after upload = %d, want 5", got)
+	}
+	// Every version counts
+	if _, err := fs.StoreStream(strings.NewReader("1234"), 100, types.File{Name: "a.txt", OwnerID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := used(); got != 9 {
+		t.Errorf("usage after second version = %d, want 9", got)
+	}
+
+	over, err := fs.StoreStream(strings.NewReader("too much"), 100, types.File{Name: "b.txt", OwnerID: "alice"})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("StoreStream() over quota = %+v, %v, want ErrQuotaExceeded", over, err)
+	}
+	if _, err := db.GetBlobRefCount(testHash("too much")); err == nil {
+		t.Error("blob of the rejected upload is still recorded")
+	}
+	if got := used(); got != 9 {
+		t.Errorf("usage after rejected upload = %d, want 9", got)
+	}
+	if err := qs.CheckUpload("alice", "", 2); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("CheckUpload() error = %v, want ErrQuotaExceeded", err)
+	}
+
+	// Clearing the override falls back to the unlimited default
+	q, err := qs.ClearLimit(types.QuotaUser, "alice")
+	if err != nil || q.LimitBytes != 0 || !q.Inherited || q.UsedBytes != 9 {
+		t.Errorf("ClearLimit() = %+v, %v", q, err)
+	}
+	if _, err := qs.SetLimit(types.QuotaDefault, "", 12); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := qs.GetQuota(types.QuotaUser, "alice"); err != nil || q.LimitBytes != 12 || !q.Inherited {
+		t.Errorf("GetQuota() with a default = %+v, %v", q, err)
+	}
+	if err := qs.CheckUpload("alice", "", 4); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("CheckUpload() over the default error = %v, want ErrQuotaExceeded", err)
+	}
+
+	if _, err := db.DeleteFileVersion(f.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := used(); got != 4 {
+		t.Errorf("usage after pruning version 1 = %d, want 4", got)
+	}
+	if err := fs.DeleteFile(f.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := used(); got != 0 {
+		t.Errorf("usage after delete = %d, want 0", got)
+	}
+
+	if _, err := qs.SetLimit(types.QuotaUser, "alice", -1); !errors.Is(err, ErrInvalidQuota) {
+		t.Errorf("SetLimit(-1) error = %v, want ErrInvalidQuota", err)
+	}
+	if _, err := qs.SetLimit(types.QuotaUser, "nobody", 1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("SetLimit() for a missing user error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestDirectoryQuota(t *testing.T) {
+	ds := newTestDirectoryService(t)
+	fs := ds.fileService.(*fileService)
+	qs := &quotaService{db: ds.db}
+
+	shared, err := ds.CreateDirectory("alice", "shared", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := ds.CreateDirectory("alice", "inner", shared.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qs.SetLimit(types.QuotaDirectory, shared.ID, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uploads by anyone, anywhere below the directory, count against it
+	if _, err := fs.StoreStream(strings.NewReader("12345"), 100, types.File{Name: "a.txt", OwnerID: "bob", DirectoryID: inner.ID}); err != nil {
+		t.Fatal(err)
+	}
+	q, err := qs.GetQuota(types.QuotaDirectory, shared.ID)
+	if err != nil || q.UsedBytes != 5 || q.LimitBytes != 8 {
+		t.Errorf("GetQuota() = %+v, %v, want 5 of 8 bytes used", q, err)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("6789"), 100, types.File{Name: "b.txt", OwnerID: "alice", DirectoryID: shared.ID}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("StoreStream() over directory quota error = %v, want ErrQuotaExceeded", err)
+	}
+	if err := qs.CheckUpload("alice", inner.ID, 4); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("CheckUpload() below the directory error = %v, want ErrQuotaExceeded", err)
+	}
+	// The user's own root is not affected
+	if _, err := fs.StoreStream(strings.NewReader("6789"), 100, types.File{Name: "b.txt", OwnerID: "alice"}); err != nil {
+		t.Errorf("StoreStream() outside the directory error = %v", err)
+	}
+
+	if _, err := qs.GetQuota(types.QuotaDirectory, "nope"); !errors.Is(err, ErrDirectoryNotFound) {
+		t.Errorf("GetQuota() of a missing directory error = %v, want ErrDirectoryNotFound", err)
+	}
+}
+
+func TestDirectoryQuotaOnMoveAndRestore(t *testing.T) {
+	ts, ds := newTestTrashService(t)
+	fs := ds.fileService.(*fileService)
+	qs := &quotaService{db: ds.db}
+	alice := types.User{ID: "alice", Role: types.Owner}
+
+	shared, err := ds.CreateDirectory("alice", "shared", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := qs.SetLimit(types.QuotaDirectory, shared.ID, 8); err != nil {
+		t.Fatal(err)
+	}
+	a, err := fs.StoreStream(strings.NewReader("12345"), 100, types.File{Name: "a.txt", OwnerID: "alice", DirectoryID: shared.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := ts.TrashFile(alice, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("6789"), 100, types.File{Name: "b.txt", OwnerID: "alice", DirectoryID: shared.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring the trashed file would put 9 bytes in the directory
+	if _, err := ts.Restore(alice, item.ID); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Restore() over directory quota error = %v, want ErrQuotaExceeded", err)
+	}
+	if _, err := ts.GetTrashItem(alice, item.ID); err != nil {
+		t.Errorf("GetTrashItem() after the rejected restore error = %v", err)
+	}
+
+	big, err := ds.CreateDirectory("alice", "big", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.StoreStream(strings.NewReader("abcde"), 100, types.File{Name: "c.txt", OwnerID: "alice", DirectoryID: big.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.MoveDirectory(big.ID, "big", shared.ID); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("MoveDirectory() over directory quota error = %v, want ErrQuotaExceeded", err)
+	}
+	if got, err := ds.GetDirectory(big.ID); err != nil || got.ParentDirectoryID != "" {
+		t.Errorf("GetDirectory() after the rejected move = %+v, %v", got, err)
+	}
+	if _, err := ds.MoveDirectory(big.ID, "bigger", ""); err != nil {
+		t.Errorf("MoveDirectory() renaming in place error = %v", err)
+	}
+}
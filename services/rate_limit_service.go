@@ -0,0 +1,130 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrAccountLocked = errors.New("too many failed logins, try again later")
+
+const (
+	// MaxLoginFailures in a row lock a username out for BaseLockout, with
+	// each further failure doubling it up to MaxLockout
+	MaxLoginFailures = 5
+	BaseLockout      = time.Minute
+	MaxLockout       = time.Hour
+	// LoginFailureMemory is how long a failure counts towards a lockout
+	LoginFailureMemory = 24 * time.Hour
+)
+
+// AccountLockedError is ErrAccountLocked along with when the lockout ends
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return ErrAccountLocked.Error()
+}
+
+func (e *AccountLockedError) Unwrap() error {
+	return ErrAccountLocked
+}
+
+// RateLimitService throttles requests with token buckets and locks usernames
+// out after repeated failed logins
+type RateLimitService interface {
+	// Allow takes a token from key's bucket, returning how long until one is
+	// available instead when it's empty
+	Allow(key string, limit types.RateLimit) (time.Duration, error)
+	// CheckLogin returns an *AccountLockedError while username is locked out
+	CheckLogin(username string) error
+	// LoginFailed counts a failed login, locking username out once there
+	// have been MaxLoginFailures in a row
+	LoginFailed(username string) error
+	LoginSucceeded(username string) error
+	ListLockouts() ([]types.Lockout, error)
+	// Unlock lifts username's lockout and forgets its failures, or returns
+	// ErrLockoutNotFound
+	Unlock(username string) error
+	// PurgeExpired drops state that no longer limits anyone, returning how much
+	PurgeExpired() (int, error)
+}
+
+type rateLimitService struct {
+	store RateLimitStore
+	now   func() time.Time
+}
+
+func NewRateLimitService(store RateLimitStore) RateLimitService {
+	return &rateLimitService{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+func (rs *rateLimitService) Allow(key string, limit types.RateLimit) (time.Duration, error) {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return 0, nil
+	}
+	return rs.store.Take(key, limit, rs.now())
+}
+
+func (rs *rateLimitService) CheckLogin(username string) error {
+	l, err := rs.store.GetLockout(lockoutKey(username))
+	if err != nil {
+		return err
+	}
+	if l.LockedUntil.After(rs.now()) {
+		return &AccountLockedError{Until: l.LockedUntil}
+	}
+	return nil
+}
+
+func (rs *rateLimitService) LoginFailed(username string) error {
+	now := rs.now()
+	key := lockoutKey(username)
+	failures, err := rs.store.AddLoginFailure(key, now, now.Add(-LoginFailureMemory))
+	if err != nil || failures < MaxLoginFailures {
+		return err
+	}
+	return rs.store.LockLogin(key, now.Add(lockoutDuration(failures)))
+}
+
+// lockoutDuration is how long failures failed logins in a row lock a
+// username out for
+func lockoutDuration(failures int) time.Duration {
+	d := BaseLockout
+	for i := MaxLoginFailures; i < failures && d < MaxLockout; i++ {
+		d *= 2
+	}
+	return min(d, MaxLockout)
+}
+
+func (rs *rateLimitService) LoginSucceeded(username string) error {
+	err := rs.store.DeleteLockout(lockoutKey(username))
+	if errors.Is(err, ErrLockoutNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (rs *rateLimitService) ListLockouts() ([]types.Lockout, error) {
+	return rs.store.ListLockouts(rs.now())
+}
+
+func (rs *rateLimitService) Unlock(username string) error {
+	return rs.store.DeleteLockout(lockoutKey(username))
+}
+
+func (rs *rateLimitService) PurgeExpired() (int, error) {
+	now := rs.now()
+	return rs.store.PurgeExpired(now, now.Add(-LoginFailureMemory))
+}
+
+// lockoutKey is the username failures are counted against. Case is ignored
+// so variations of one name can't each have their own count.
+func lockoutKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimitStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) RateLimitStore{
+		"Memory": func(t *testing.T) RateLimitStore { return NewMemoryRateLimitStore() },
+		"Database": func(t *testing.T) RateLimitStore {
+			return &databaseRateLimitStore{db: newTestDatabase(t)}
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			limit := types.RateLimit{Requests: 3, Period: 3 * time.Second}
+			now := time.Now()
+
+			// A full bucket allows a burst, then one request a second
+			for i := 0; i < 3; i++ {
+				if wait, err := store.Take("login:ip:192.0.2.1", limit, now); err != nil || wait != 0 {
+					t.Fatalf("request %d: waited %v, %v", i, wait, err)
+				}
+			}
+			wait, err := store.Take("login:ip:192.0.2.1", limit, now)
+			if err != nil || wait != time.Second {
+				t.Errorf("empty bucket: got wait %v, %v, want 1s", wait, err)
+			}
+			if wait, _ := store.Take("login:ip:192.0.2.2", limit, now); wait != 0 {
+				t.Errorf("another caller waited %v", wait)
+			}
+			if wait, _ := store.Take("login:ip:192.0.2.1", limit, now.Add(time.Second)); wait != 0 {
+				t.Errorf("after refilling a token: waited %v", wait)
+			}
+			if wait, _ := store.Take("login:ip:192.0.2.1", limit, now.Add(1500*time.Millisecond)); wait != 500*time.Millisecond {
+				t.Errorf("got wait %v, want 500ms", wait)
+			}
+
+			// Failed logins count up until forgotten
+			for i := 1; i <= 3; i++ {
+				if n, err := store.AddLoginFailure("alice", now, now.Add(-time.Hour)); err != nil || n != i {
+					t.Fatalf("failure %d: got %d, %v", i, n, err)
+				}
+			}
+			if n, _ := store.AddLoginFailure("alice", now.Add(2*time.Hour), now.Add(time.Hour)); n != 1 {
+				t.Errorf("after the count was forgotten: got %d, want 1", n)
+			}
+			if l, err := store.GetLockout("nobody"); err != nil || l != (types.Lockout{}) {
+				t.Errorf("no failures: got %+v, %v", l, err)
+			}
+
+			// Locks only ever get longer
+			if err := store.LockLogin("alice", now.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			store.LockLogin("alice", now.Add(30*time.Second))
+			l, err := store.GetLockout("alice")
+			if err != nil || l.Failures != 1 || !l.LockedUntil.Equal(now.Add(time.Minute)) {
+				t.Errorf("got %+v, %v", l, err)
+			}
+			lockouts, err := store.ListLockouts(now)
+			if err != nil || len(lockouts) != 1 || lockouts[0].Username != "alice" {
+				t.Errorf("listed %+v, %v", lockouts, err)
+			}
+			if lockouts, _ := store.ListLockouts(now.Add(time.Minute)); len(lockouts) != 0 {
+				t.Errorf("expired lockout listed: %+v", lockouts)
+			}
+
+			// Lockouts that still hold aren't purged with their old failures
+			store.AddLoginFailure("bob", now, now.Add(-time.Hour))
+			n, err := store.PurgeExpired(now.Add(2*time.Hour), now.Add(time.Hour))
+			if err != nil || n != 3 {
+				t.Errorf("purged %d, %v, want both buckets and bob", n, err)
+			}
+			if l, _ := store.GetLockout("alice"); l.Failures != 1 {
+				t.Errorf("alice's failures were purged: %+v", l)
+			}
+
+			if err := store.DeleteLockout("alice"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteLockout("alice"); !errors.Is(err, ErrLockoutNotFound) {
+				t.Errorf("deleting twice: got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Now()
+	rs := &rateLimitService{store: NewMemoryRateLimitStore(), now: func() time.Time { return now }}
+
+	for i := 1; i < MaxLoginFailures; i++ {
+		rs.LoginFailed("Alice")
+		if err := rs.CheckLogin("alice"); err != nil {
+			t.Fatalf("locked after %d failures: %v", i, err)
+		}
+	}
+	rs.LoginFailed("alice")
+	var locked *AccountLockedError
+	if err := rs.CheckLogin("ALICE"); !errors.As(err, &locked) || !locked.Until.Equal(now.Add(BaseLockout)) {
+		t.Fatalf("got %v, want locked for %v", err, BaseLockout)
+	}
+
+	// Each failure past the limit doubles the lockout, up to MaxLockout
+	now = now.Add(BaseLockout)
+	rs.LoginFailed("alice")
+	if err := rs.CheckLogin("alice"); !errors.As(err, &locked) || !locked.Until.Equal(now.Add(2*BaseLockout)) {
+		t.Errorf("got %v, want locked for %v", err, 2*BaseLockout)
+	}
+	if d := lockoutDuration(100); d != MaxLockout {
+		t.Errorf("lockoutDuration(100) = %v, want %v", d, MaxLockout)
+	}
+
+	lockouts, err := rs.ListLockouts()
+	if err != nil || len(lockouts) != 1 || lockouts[0].Failures != MaxLoginFailures+1 {
+		t.Errorf("listed %+v, %v", lockouts, err)
+	}
+	if err := rs.Unlock("Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.CheckLogin("alice"); err != nil {
+		t.Errorf("still locked after unlocking: %v", err)
+	}
+	if err := rs.Unlock("alice"); !errors.Is(err, ErrLockoutNotFound) {
+		t.Errorf("unlocking twice: got %v", err)
+	}
+}
+
+func TestLoginWithLockout(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.InsertUser(types.User{ID: "u1", Username: "alice", Password: "secret", Role: types.Regular, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	limits := NewRateLimitService(NewMemoryRateLimitStore())
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: &twoFactorService{db: db, now: time.Now}, limits: limits, sessionTTL: time.Hour}
+
+	// A success clears earlier failures
+	as.Login("alice", "wrong")
+	if _, _, err := as.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxLoginFailures; i++ {
+		if _, _, err := as.Login("alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("failure %d: got %v", i, err)
+		}
+	}
+	// Even the right password is turned away while locked
+	if _, _, err := as.Login("alice", "secret"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("got %v, want ErrAccountLocked", err)
+	}
+	// Unknown usernames lock the same way, so lockouts don't give away who exists
+	for i := 0; i < MaxLoginFailures; i++ {
+		as.Login("mallory", "guess")
+	}
+	if _, _, err := as.Login("mallory", "guess"); !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("unknown username: got %v, want ErrAccountLocked", err)
+	}
+
+	if err := limits.Unlock("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := as.Login("alice", "secret"); err != nil {
+		t.Errorf("after unlocking: %v", err)
+	}
+}
+
+func TestSecondFactorLockout(t *testing.T) {
+	db := newTestDatabase(t)
+	tf := newTestTwoFactorService(db)
+	limits := NewRateLimitService(NewMemoryRateLimitStore())
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: tf, limits: limits, sessionTTL: time.Hour}
+	user := types.User{ID: "u1", Username: "alice", Password: "secret", Role: types.Regular, CreatedAt: time.Now()}
+	if err := db.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	enrollTotp(t, tf, user)
+
+	// Knowing the password doesn't reset the count, so codes can't be
+	// guessed a challenge at a time without end
+	for i := 0; i < MaxLoginFailures; i++ {
+		_, challenge, err := as.Login("alice", "secret")
+		if err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+		if _, _, err := as.CompleteLogin(challenge.Token, "000000"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+			t.Fatalf("code %d: got %v", i, err)
+		}
+	}
+	if _, _, err := as.Login("alice", "secret"); !errors.Is(err, ErrAccountLocked) {
+		t.Errorf("got %v, want ErrAccountLocked", err)
+	}
+}
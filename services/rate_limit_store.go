@@ -0,0 +1,244 @@
+package services
+
+import (
+	"Smd/types"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrLockoutNotFound = errors.New("no failed logins for username")
+
+// RateLimitStore keeps token buckets and failed login counts. Implementations
+// are safe for concurrent use.
+type RateLimitStore interface {
+	// Take takes a token from key's bucket, returning how long until one is
+	// available instead when it's empty
+	Take(key string, limit types.RateLimit, now time.Time) (time.Duration, error)
+	// AddLoginFailure counts a failed login for username and returns how many
+	// there have been, starting over if the last was before forgetBefore
+	AddLoginFailure(username string, now, forgetBefore time.Time) (int, error)
+	// LockLogin locks username out until until, unless it already is for longer
+	LockLogin(username string, until time.Time) error
+	// GetLockout returns a zero Lockout for usernames without failed logins
+	GetLockout(username string) (types.Lockout, error)
+	// ListLockouts returns usernames locked out at now, longest lockout first
+	ListLockouts(now time.Time) ([]types.Lockout, error)
+	// DeleteLockout forgets username's failed logins, or returns
+	// ErrLockoutNotFound
+	DeleteLockout(username string) error
+	// PurgeExpired drops buckets that have refilled and failures from before
+	// forgetBefore that aren't keeping anyone locked out, returning how many
+	PurgeExpired(now, forgetBefore time.Time) (int, error)
+}
+
+// bucketInterval is how long limit's buckets take to refill a token
+func bucketInterval(limit types.RateLimit) time.Duration {
+	return limit.Period / time.Duration(limit.Requests)
+}
+
+// memoryRateLimitStore keeps buckets and failures in process; they are lost
+// on restart and not shared between servers
+type memoryRateLimitStore struct {
+	mu sync.Mutex
+	// fullAt is when each bucket will have refilled, see
+	// types.Database.TakeRateLimitToken
+	fullAt   map[string]time.Time
+	lockouts map[string]types.Lockout
+}
+
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		fullAt:   map[string]time.Time{},
+		lockouts: map[string]types.Lockout{},
+	}
+}
+
+func (ms *memoryRateLimitStore) Take(key string, limit types.RateLimit, now time.Time) (time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	fullAt := ms.fullAt[key]
+	if fullAt.Before(now) {
+		fullAt = now
+	}
+	next := fullAt.Add(bucketInterval(limit))
+	if empty := now.Add(limit.Period); next.After(empty) {
+		return next.Sub(empty), nil
+	}
+	ms.fullAt[key] = next
+	return 0, nil
+}
+
+func (ms *memoryRateLimitStore) AddLoginFailure(username string, now, forgetBefore time.Time) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	l := ms.lockouts[username]
+	if l.LastFailureAt.Before(forgetBefore) {
+		l.Failures = 0
+	}
+	l.Username = username
+	l.Failures++
+	l.LastFailureAt = now
+	ms.lockouts[username] = l
+	return l.Failures, nil
+}
+
+func (ms *memoryRateLimitStore) LockLogin(username string, until time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	l, ok := ms.lockouts[username]
+	if ok && l.LockedUntil.Before(until) {
+		l.LockedUntil = until
+		ms.lockouts[username] = l
+	}
+	return nil
+}
+
+func (ms *memoryRateLimitStore) GetLockout(username string) (types.Lockout, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.lockouts[username], nil
+}
+
+func (ms *memoryRateLimitStore) ListLockouts(now time.Time) ([]types.Lockout, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	lockouts := []types.Lockout{}
+	for _, l := range ms.lockouts {
+		if l.LockedUntil.After(now) {
+			lockouts = append(lockouts, l)
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if !lockouts[i].LockedUntil.Equal(lockouts[j].LockedUntil) {
+			return lockouts[i].LockedUntil.After(lockouts[j].LockedUntil)
+		}
+		return lockouts[i].Username < lockouts[j].Username
+	})
+	return lockouts, nil
+}
+
+func (ms *memoryRateLimitStore) DeleteLockout(username string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.lockouts[username]; !ok {
+		return ErrLockoutNotFound
+	}
+	delete(ms.lockouts, username)
+	return nil
+}
+
+func (ms *memoryRateLimitStore) PurgeExpired(now, forgetBefore time.Time) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n := 0
+	for key, fullAt := range ms.fullAt {
+		if !fullAt.After(now) {
+			delete(ms.fullAt, key)
+			n++
+		}
+	}
+	for username, l := range ms.lockouts {
+		if l.LastFailureAt.Before(forgetBefore) && !l.LockedUntil.After(now) {
+			delete(ms.lockouts, username)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// databaseRateLimitStore keeps buckets and failures in the database, so
+// limits and lockouts survive restarts and apply across every server using it
+type databaseRateLimitStore struct {
+	db types.Database
+}
+
+func NewDatabaseRateLimitStore() RateLimitStore {
+	ds := &databaseRateLimitStore{
+		db: types.NewDatabase(),
+	}
+	err := ds.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ds
+}
+
+func (ds *databaseRateLimitStore) Take(key string, limit types.RateLimit, now time.Time) (time.Duration, error) {
+	interval := bucketInterval(limit)
+	fullAt, taken, err := ds.db.TakeRateLimitToken(key, now, interval, limit.Period)
+	if err != nil {
+		return 0, fmt.Errorf("error taking rate limit token: %v", err)
+	}
+	if taken {
+		return 0, nil
+	}
+	if fullAt.Before(now) {
+		fullAt = now
+	}
+	return fullAt.Add(interval).Sub(now.Add(limit.Period)), nil
+}
+
+func (ds *databaseRateLimitStore) AddLoginFailure(username string, now, forgetBefore time.Time) (int, error) {
+	n, err := ds.db.AddLoginFailure(username, now, forgetBefore)
+	if err != nil {
+		return 0, fmt.Errorf("error counting failed login: %v", err)
+	}
+	return n, nil
+}
+
+func (ds *databaseRateLimitStore) LockLogin(username string, until time.Time) error {
+	if err := ds.db.LockLogin(username, until); err != nil {
+		return fmt.Errorf("error locking login: %v", err)
+	}
+	return nil
+}
+
+func (ds *databaseRateLimitStore) GetLockout(username string) (types.Lockout, error) {
+	l, err := ds.db.GetLockout(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Lockout{}, nil
+	}
+	if err != nil {
+		return types.Lockout{}, fmt.Errorf("error getting lockout: %v", err)
+	}
+	return l, nil
+}
+
+func (ds *databaseRateLimitStore) ListLockouts(now time.Time) ([]types.Lockout, error) {
+	lockouts, err := ds.db.ListLockouts(now)
+	if err != nil {
+		return nil, fmt.Errorf("error listing lockouts: %v", err)
+	}
+	if lockouts == nil {
+		lockouts = []types.Lockout{}
+	}
+	return lockouts, nil
+}
+
+func (ds *databaseRateLimitStore) DeleteLockout(username string) error {
+	err := ds.db.DeleteLockout(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLockoutNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting lockout: %v", err)
+	}
+	return nil
+}
+
+func (ds *databaseRateLimitStore) PurgeExpired(now, forgetBefore time.Time) (int, error) {
+	buckets, err := ds.db.DeleteFullRateLimits(now)
+	if err != nil {
+		return 0, fmt.Errorf("error purging rate limits: %v", err)
+	}
+	lockouts, err := ds.db.DeleteStaleLockouts(forgetBefore, now)
+	if err != nil {
+		return 0, fmt.Errorf("error purging lockouts: %v", err)
+	}
+	return int(buckets + lockouts), nil
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"Smd/types"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrInvalidRole  = errors.New("a role needs a name")
+	ErrRoleTaken    = errors.New("a role with that name already exists")
+	ErrBuiltInRole  = errors.New("built-in roles can't be renamed or deleted, and the admin role can't be changed")
+	ErrRoleInUse    = errors.New("role is still assigned to users")
+)
+
+// RoleCacheTTL is how long privileges are cached for. Changes made through
+// this server apply at once; ones made by another server sharing the
+// database apply within this long.
+const RoleCacheTTL = time.Minute
+
+// RoleService manages roles and what they allow. The built-in Admin, Owner,
+// Regular and Developer roles can have their privileges changed, except for
+// Admin which always allows everything; custom roles can also be renamed and
+// deleted once no user has them.
+type RoleService interface {
+	ListRoles() ([]types.RoleDefinition, error)
+	GetRole(id types.Role) (types.RoleDefinition, error)
+	CreateRole(name string, privileges types.Privileges) (types.RoleDefinition, error)
+	UpdateRole(id types.Role, name string, privileges types.Privileges) (types.RoleDefinition, error)
+	DeleteRole(id types.Role) error
+	// Privileges returns what role allows from a cache of every role. A role
+	// that doesn't exist allows nothing.
+	Privileges(role types.Role) (types.Privileges, error)
+	// Invalidate makes the next Privileges call reload the roles
+	Invalidate()
+}
+
+type roleService struct {
+	db  types.Database
+	now func() time.Time
+	ttl time.Duration
+
+	mu       sync.RWMutex
+	cache    map[types.Role]types.Privileges
+	loadedAt time.Time
+}
+
+func NewRoleService() RoleService {
+	rs := &roleService{
+		db:  types.NewDatabase(),
+		now: time.Now,
+		ttl: RoleCacheTTL,
+	}
+	err := rs.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return rs
+}
+
+func (rs *roleService) ListRoles() ([]types.RoleDefinition, error) {
+	roles, err := rs.db.ListRoles()
+	if err != nil {
+		return nil, fmt.Errorf("error listing roles: %v", err)
+	}
+	if roles == nil {
+		roles = []types.RoleDefinition{}
+	}
+	return roles, nil
+}
+
+func (rs *roleService) GetRole(id types.Role) (types.RoleDefinition, error) {
+	role, err := rs.db.GetRole(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.RoleDefinition{}, ErrRoleNotFound
+		}
+		return types.RoleDefinition{}, fmt.Errorf("error getting role: %v", err)
+	}
+	return role, nil
+}
+
+func (rs *roleService) CreateRole(name string, privileges types.Privileges) (types.RoleDefinition, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return types.RoleDefinition{}, ErrInvalidRole
+	}
+	if err := rs.checkNameFree(name, -1); err != nil {
+		return types.RoleDefinition{}, err
+	}
+	role := types.RoleDefinition{Name: name, Privileges: privileges}
+	id, err := rs.db.InsertRole(role)
+	if err != nil {
+		return types.RoleDefinition{}, fmt.Errorf("error creating role: %v", err)
+	}
+	role.ID = id
+	rs.Invalidate()
+	return role, nil
+}
+
+func (rs *roleService) UpdateRole(id types.Role, name string, privileges types.Privileges) (types.RoleDefinition, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return types.RoleDefinition{}, ErrInvalidRole
+	}
+	role, err := rs.GetRole(id)
+	if err != nil {
+		return types.RoleDefinition{}, err
+	}
+	if role.BuiltIn && name != role.Name {
+		return types.RoleDefinition{}, ErrBuiltInRole
+	}
+	// Admins must always be able to undo a mistake
+	if id == types.Admin && privileges != role.Privileges {
+		return types.RoleDefinition{}, ErrBuiltInRole
+	}
+	if err := rs.checkNameFree(name, id); err != nil {
+		return types.RoleDefinition{}, err
+	}
+
+	role.Name = name
+	role.Privileges = privileges
+	if err := rs.db.UpdateRole(role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.RoleDefinition{}, ErrRoleNotFound
+		}
+		return types.RoleDefinition{}, fmt.Errorf("error updating role: %v", err)
+	}
+	rs.Invalidate()
+	return role, nil
+}
+
+func (rs *roleService) DeleteRole(id types.Role) error {
+	role, err := rs.GetRole(id)
+	if err != nil {
+		return err
+	}
+	if role.BuiltIn {
+		return ErrBuiltInRole
+	}
+	users, err := rs.db.CountUsersWithRole(id)
+	if err != nil {
+		return fmt.Errorf("error counting users: %v", err)
+	}
+	if users > 0 {
+		return ErrRoleInUse
+	}
+	if err := rs.db.DeleteRole(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRoleNotFound
+		}
+		return fmt.Errorf("error deleting role: %v", err)
+	}
+	rs.Invalidate()
+	return nil
+}
+
+func (rs *roleService) Privileges(role types.Role) (types.Privileges, error) {
+	rs.mu.RLock()
+	if rs.cache != nil && rs.now().Before(rs.loadedAt.Add(rs.ttl)) {
+		privileges := rs.cache[role]
+		rs.mu.RUnlock()
+		return privileges, nil
+	}
+	rs.mu.RUnlock()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	// Another caller may have reloaded while we waited for the lock
+	if rs.cache == nil || !rs.now().Before(rs.loadedAt.Add(rs.ttl)) {
+		roles, err := rs.db.ListRoles()
+		if err != nil {
+			return types.Privileges{}, fmt.Errorf("error loading roles: %v", err)
+		}
+		rs.cache = make(map[types.Role]types.Privileges, len(roles))
+		for _, r := range roles {
+			rs.cache[r.ID] = r.Privileges
+		}
+		rs.loadedAt = rs.now()
+	}
+	return rs.cache[role], nil
+}
+
+func (rs *roleService) Invalidate() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.cache = nil
+}
+
+// checkNameFree returns ErrRoleTaken if a role other than exceptID is called
+// name
+func (rs *roleService) checkNameFree(name string, exceptID types.Role) error {
+	existing, err := rs.db.GetRoleByName(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up role: %v", err)
+	}
+	if existing.ID != exceptID {
+		return ErrRoleTaken
+	}
+	return nil
+}
+
+// checkRoleExists returns ErrUnknownRole unless role is in the roles table
+func checkRoleExists(db types.Database, role types.Role) error {
+	_, err := db.GetRole(role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownRole
+	}
+	if err != nil {
+		return fmt.Errorf("error getting role: %v", err)
+	}
+	return nil
+}
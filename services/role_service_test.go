@@ -0,0 +1,186 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestRoleService(db types.Database) *roleService {
+	return &roleService{db: db, now: time.Now, ttl: RoleCacheTTL}
+}
+
+func TestBuiltInRoles(t *testing.T) {
+	rs := newTestRoleService(newTestDatabase(t))
+	roles, err := rs.ListRoles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"admin", "owner", "regular", "developer"}
+	if len(roles) != len(want) {
+		t.Fatalf("ListRoles() = %+v", roles)
+	}
+	for i, role := range roles {
+		if role.ID != types.Role(i) || role.Name != want[i] || !role.BuiltIn {
+			t.Errorf("role %d = %+v, want built-in %s", i, role, want[i])
+		}
+	}
+
+	tests := []struct {
+		role types.Role
+		want types.Privileges
+	}{
+		{types.Admin, types.Privileges{Read: true, Write: true, Delete: true, CreateDirectories: true, AddUsers: true}},
+		{types.Owner, types.Privileges{Read: true, Write: true, Delete: true, CreateDirectories: true}},
+		{types.Regular, types.Privileges{Read: true}},
+		{types.Developer, types.Privileges{Read: true, Write: true, CreateDirectories: true}},
+		{types.Role(42), types.Privileges{}},
+	}
+	for _, tt := range tests {
+		if got, err := rs.Privileges(tt.role); err != nil || got != tt.want {
+			t.Errorf("Privileges(%d) = %+v, %v, want %+v", tt.role, got, err, tt.want)
+		}
+	}
+}
+
+func TestManageRoles(t *testing.T) {
+	db := newTestDatabase(t)
+	rs := newTestRoleService(db)
+	uploader, err := rs.CreateRole(" Uploader ", types.Privileges{Read: true, Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploader.Name != "Uploader" || uploader.BuiltIn || uploader.ID <= types.Developer {
+		t.Errorf("CreateRole() = %+v", uploader)
+	}
+
+	createTests := []struct {
+		name    string
+		role    string
+		wantErr error
+	}{
+		{"Taken", "uploader", ErrRoleTaken},
+		{"TakenByBuiltIn", "Admin", ErrRoleTaken},
+		{"NoName", " ", ErrInvalidRole},
+	}
+	for _, tt := range createTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := rs.CreateRole(tt.role, types.Privileges{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CreateRole() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	updateTests := []struct {
+		name       string
+		id         types.Role
+		role       string
+		privileges types.Privileges
+		wantErr    error
+	}{
+		{"RenameCustom", uploader.ID, "Contributor", types.Privileges{Read: true, Write: true, Delete: true}, nil},
+		{"RenameToTaken", uploader.ID, "owner", types.Privileges{}, ErrRoleTaken},
+		{"RenameBuiltIn", types.Owner, "Manager", types.Privileges{Read: true}, ErrBuiltInRole},
+		{"EditBuiltIn", types.Regular, "regular", types.Privileges{Read: true, Write: true}, nil},
+		{"EditAdmin", types.Admin, "admin", types.Privileges{Read: true}, ErrBuiltInRole},
+		{"Missing", types.Role(42), "ghost", types.Privileges{}, ErrRoleNotFound},
+	}
+	for _, tt := range updateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, err := rs.UpdateRole(tt.id, tt.role, tt.privileges)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("UpdateRole() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (role.Name != tt.role || role.Privileges != tt.privileges) {
+				t.Errorf("UpdateRole() = %+v", role)
+			}
+		})
+	}
+
+	if got, err := rs.Privileges(types.Regular); err != nil || !got.Write {
+		t.Errorf("Privileges(Regular) = %+v, %v after editing the role", got, err)
+	}
+
+	user := types.User{ID: "u1", Username: "carol", Password: "pw", Role: uploader.ID, CreatedAt: time.Now()}
+	if err := db.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.DeleteRole(uploader.ID); !errors.Is(err, ErrRoleInUse) {
+		t.Errorf("DeleteRole() error = %v, want ErrRoleInUse", err)
+	}
+	if err := rs.DeleteRole(types.Developer); !errors.Is(err, ErrBuiltInRole) {
+		t.Errorf("DeleteRole() error = %v, want ErrBuiltInRole", err)
+	}
+	if err := db.DeleteUser(user.Username); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.DeleteRole(uploader.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rs.Privileges(uploader.ID); err != nil || got != (types.Privileges{}) {
+		t.Errorf("Privileges() = %+v, %v for a deleted role", got, err)
+	}
+	if _, err := rs.CreateRole("Uploader", types.Privileges{}); err != nil {
+		t.Errorf("CreateRole() error = %v after deleting the role by that name", err)
+	}
+}
+
+func TestRolePrivilegesCache(t *testing.T) {
+	db := newTestDatabase(t)
+	now := time.Now()
+	rs := newTestRoleService(db)
+	rs.now = func() time.Time { return now }
+
+	if got, _ := rs.Privileges(types.Regular); got.Write {
+		t.Fatalf("Privileges(Regular) = %+v", got)
+	}
+	// A change made by another server sharing the database
+	other := newTestRoleService(db)
+	if _, err := other.UpdateRole(types.Regular, "regular", types.Privileges{Read: true, Write: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := rs.Privileges(types.Regular); got.Write {
+		t.Error("Privileges() reloaded before the cache expired")
+	}
+	now = now.Add(RoleCacheTTL)
+	if got, _ := rs.Privileges(types.Regular); !got.Write {
+		t.Error("Privileges() didn't reload once the cache expired")
+	}
+
+	if _, err := other.UpdateRole(types.Regular, "regular", types.Privileges{Read: true}); err != nil {
+		t.Fatal(err)
+	}
+	rs.Invalidate()
+	if got, _ := rs.Privileges(types.Regular); got.Write {
+		t.Error("Privileges() didn't reload after Invalidate()")
+	}
+}
+
+func TestAuthorizeCustomRole(t *testing.T) {
+	db := newTestDatabase(t)
+	rs := newTestRoleService(db)
+	as := &authorizationService{db: db, roles: rs}
+
+	auditor, err := rs.CreateRole("auditor", types.Privileges{Read: true, AddUsers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := types.User{ID: "u1", Username: "carol", Role: auditor.ID}
+	if err := as.AuthorizeAdmin(user); err != nil {
+		t.Errorf("AuthorizeAdmin() error = %v for a role that can add users", err)
+	}
+
+	if _, err := rs.UpdateRole(auditor.ID, "auditor", types.Privileges{Read: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := as.AuthorizeAdmin(user); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeAdmin() error = %v after taking the privilege away", err)
+	}
+	if err := as.AuthorizeDirectory(user, "", ActionRead); err != nil {
+		t.Errorf("AuthorizeDirectory(read) error = %v", err)
+	}
+	if err := as.AuthorizeDirectory(user, "", ActionWrite); !errors.Is(err, ErrForbidden) {
+		t.Errorf("AuthorizeDirectory(write) error = %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+package services
+
+import (
+	"Smd/types"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore keeps the sessions auth tokens resolve to. Implementations
+// are safe for concurrent use.
+type SessionStore interface {
+	Create(s types.Session) error
+	// Get returns the session for token, or ErrInvalidSession if there is
+	// none or it has expired
+	Get(token string) (types.Session, error)
+	// Renew moves the session's expiry to expiresAt and marks it seen at seenAt
+	Renew(token string, expiresAt, seenAt time.Time) error
+	Delete(token string) error
+	// ListByUser returns the user's unexpired sessions, most recently used
+	// first. Their tokens may be left empty.
+	ListByUser(userID string) ([]types.Session, error)
+	// DeleteByID ends one of the user's sessions, or returns ErrSessionNotFound
+	DeleteByID(userID, id string) error
+	// DeleteByUser ends all of the user's sessions, returning how many there were
+	DeleteByUser(userID string) (int, error)
+	// PurgeExpired drops sessions that expired by now, returning how many
+	PurgeExpired(now time.Time) (int, error)
+}
+
+// memorySessionStore keeps sessions in process; they are lost on restart
+type memorySessionStore struct {
+	mu      sync.RWMutex
+	byToken map[string]types.Session
+	// byUser indexes tokens by the user they belong to
+	byUser map[string]map[string]struct{}
+}
+
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		byToken: map[string]types.Session{},
+		byUser:  map[string]map[string]struct{}{},
+	}
+}
+
+func (ms *memorySessionStore) Create(s types.Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.byToken[s.Token.Token]; ok {
+		return errors.New("session already exists")
+	}
+	ms.byToken[s.Token.Token] = s
+	if ms.byUser[s.UserID] == nil {
+		ms.byUser[s.UserID] = map[string]struct{}{}
+	}
+	ms.byUser[s.UserID][s.Token.Token] = struct{}{}
+	return nil
+}
+
+func (ms *memorySessionStore) Get(token string) (types.Session, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	s, ok := ms.byToken[token]
+	if !ok || !s.Token.ExpiresAt.After(time.Now()) {
+		return types.Session{}, ErrInvalidSession
+	}
+	return s, nil
+}
+
+func (ms *memorySessionStore) Renew(token string, expiresAt, seenAt time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s, ok := ms.byToken[token]
+	if !ok {
+		return ErrInvalidSession
+	}
+	s.Token.ExpiresAt = expiresAt
+	s.LastSeenAt = seenAt
+	ms.byToken[token] = s
+	return nil
+}
+
+func (ms *memorySessionStore) Delete(token string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.remove(token)
+	return nil
+}
+
+// remove drops the session for token; the caller holds mu
+func (ms *memorySessionStore) remove(token string) {
+	s, ok := ms.byToken[token]
+	if !ok {
+		return
+	}
+	delete(ms.byToken, token)
+	delete(ms.byUser[s.UserID], token)
+	if len(ms.byUser[s.UserID]) == 0 {
+		delete(ms.byUser, s.UserID)
+	}
+}
+
+func (ms *memorySessionStore) ListByUser(userID string) ([]types.Session, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	now := time.Now()
+	sessions := []types.Session{}
+	for token := range ms.byUser[userID] {
+		if s := ms.byToken[token]; s.Token.ExpiresAt.After(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastSeenAt.Equal(sessions[j].LastSeenAt) {
+			return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (ms *memorySessionStore) DeleteByID(userID, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for token := range ms.byUser[userID] {
+		if ms.byToken[token].ID == id {
+			ms.remove(token)
+			return nil
+		}
+	}
+	return ErrSessionNotFound
+}
+
+func (ms *memorySessionStore) DeleteByUser(userID string) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n := len(ms.byUser[userID])
+	for token := range ms.byUser[userID] {
+		delete(ms.byToken, token)
+	}
+	delete(ms.byUser, userID)
+	return n, nil
+}
+
+func (ms *memorySessionStore) PurgeExpired(now time.Time) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n := 0
+	for token, s := range ms.byToken {
+		if !s.Token.ExpiresAt.After(now) {
+			ms.remove(token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// databaseSessionStore keeps sessions in the active_sessions table, so they
+// survive restarts and are shared by every server using the database. Only
+// the SHA-256 of each token is stored, so reading the database doesn't hand
+// out sessions.
+type databaseSessionStore struct {
+	db types.Database
+}
+
+func NewDatabaseSessionStore() SessionStore {
+	ds := &databaseSessionStore{
+		db: types.NewDatabase(),
+	}
+	err := ds.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ds
+}
+
+// hashSessionToken needs no salt or stretching: tokens are random, not
+// something a person picked
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ds *databaseSessionStore) Create(s types.Session) error {
+	s.Token.Token = hashSessionToken(s.Token.Token)
+	if err := ds.db.InsertSession(s); err != nil {
+		return fmt.Errorf("error saving session: %v", err)
+	}
+	return nil
+}
+
+func (ds *databaseSessionStore) Get(token string) (types.Session, error) {
+	s, err := ds.db.GetSessionByToken(hashSessionToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Session{}, ErrInvalidSession
+		}
+		return types.Session{}, fmt.Errorf("error looking up session: %v", err)
+	}
+	if !s.Token.ExpiresAt.After(time.Now()) {
+		return types.Session{}, ErrInvalidSession
+	}
+	s.Token.Token = token
+	return s, nil
+}
+
+func (ds *databaseSessionStore) Renew(token string, expiresAt, seenAt time.Time) error {
+	err := ds.db.RenewSession(hashSessionToken(token), expiresAt, seenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidSession
+	}
+	if err != nil {
+		return fmt.Errorf("error renewing session: %v", err)
+	}
+	return nil
+}
+
+func (ds *databaseSessionStore) Delete(token string) error {
+	if err := ds.db.DeleteSessionByToken(hashSessionToken(token)); err != nil {
+		return fmt.Errorf("error deleting session: %v", err)
+	}
+	return nil
+}
+
+func (ds *databaseSessionStore) ListByUser(userID string) ([]types.Session, error) {
+	all, err := ds.db.ListSessionsByUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %v", err)
+	}
+	now := time.Now()
+	sessions := []types.Session{}
+	for _, s := range all {
+		if s.Token.ExpiresAt.After(now) {
+			// Only the hash is known
+			s.Token.Token = ""
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func (ds *databaseSessionStore) DeleteByID(userID, id string) error {
+	err := ds.db.DeleteSession(userID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting session: %v", err)
+	}
+	return nil
+}
+
+func (ds *databaseSessionStore) DeleteByUser(userID string) (int, error) {
+	n, err := ds.db.DeleteSessionsByUser(userID)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting sessions: %v", err)
+	}
+	return int(n), nil
+}
+
+func (ds *databaseSessionStore) PurgeExpired(now time.Time) (int, error) {
+	n, err := ds.db.DeleteExpiredSessions(now)
+	if err != nil {
+		return 0, fmt.Errorf("error purging sessions: %v", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) SessionStore{
+		"Memory": func(t *testing.T) SessionStore { return NewMemorySessionStore() },
+		"Database": func(t *testing.T) SessionStore {
+			return &databaseSessionStore{db: newTestDatabase(t)}
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			now := time.Now()
+			session := func(id, userID string, ttl time.Duration, seen time.Duration) types.Session {
+				return types.Session{
+					CreatedAt:  now.Add(-time.Hour),
+					LastSeenAt: now.Add(seen),
+					ID:         id,
+					UserID:     userID,
+					Token:      types.AuthToken{Token: "token-" + id, ExpiresAt: now.Add(ttl)},
+				}
+			}
+			for _, s := range []types.Session{
+				session("a1", "alice", time.Hour, -time.Minute),
+				session("a2", "alice", time.Hour, -time.Second),
+				session("a3", "alice", -time.Minute, 0),
+				session("b1", "bob", time.Hour, 0),
+			} {
+				if err := store.Create(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if s, err := store.Get("token-a1"); err != nil || s.ID != "a1" || s.UserID != "alice" || s.Token.Token != "token-a1" {
+				t.Errorf("Get() = %+v, %v", s, err)
+			}
+			if ds, ok := store.(*databaseSessionStore); ok {
+				if _, err := ds.db.GetSessionByToken("token-a1"); err == nil {
+					t.Error("the database holds the token itself rather than its hash")
+				}
+			}
+			if _, err := store.Get("token-a3"); !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("Get() of an expired session error = %v, want ErrInvalidSession", err)
+			}
+			if _, err := store.Get("nope"); !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("Get() of an unknown token error = %v, want ErrInvalidSession", err)
+			}
+
+			// Renewing slides the expiry and moves the session to the top
+			if err := store.Renew("token-a1", now.Add(2*time.Hour), now); err != nil {
+				t.Fatal(err)
+			}
+			if s, err := store.Get("token-a1"); err != nil || !s.Token.ExpiresAt.Equal(now.Add(2*time.Hour)) {
+				t.Errorf("Get() after Renew() = %+v, %v", s, err)
+			}
+			if err := store.Renew("nope", now, now); !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("Renew() of an unknown token error = %v, want ErrInvalidSession", err)
+			}
+			sessions, err := store.ListByUser("alice")
+			if err != nil || len(sessions) != 2 || sessions[0].ID != "a1" || sessions[1].ID != "a2" {
+				t.Errorf("ListByUser() = %+v, %v, want a1 then a2", sessions, err)
+			}
+
+			if err := store.DeleteByID("bob", "a2"); !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("DeleteByID() of another user's session error = %v, want ErrSessionNotFound", err)
+			}
+			if err := store.DeleteByID("alice", "a2"); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := store.PurgeExpired(now); err != nil || n != 1 {
+				t.Errorf("PurgeExpired() = %d, %v, want 1", n, err)
+			}
+			if n, err := store.DeleteByUser("alice"); err != nil || n != 1 {
+				t.Errorf("DeleteByUser() = %d, %v, want 1", n, err)
+			}
+			if _, err := store.Get("token-a1"); !errors.Is(err, ErrInvalidSession) {
+				t.Errorf("Get() after DeleteByUser() error = %v, want ErrInvalidSession", err)
+			}
+			if _, err := store.Get("token-b1"); err != nil {
+				t.Errorf("Get() of another user's session after DeleteByUser() error = %v", err)
+			}
+			if err := store.Delete("token-b1"); err != nil {
+				t.Fatal(err)
+			}
+			if sessions, err := store.ListByUser("bob"); err != nil || len(sessions) != 0 {
+				t.Errorf("ListByUser() after Delete() = %+v, %v", sessions, err)
+			}
+		})
+	}
+}
+
+func TestMemorySessionStoreConcurrency(t *testing.T) {
+	store := NewMemorySessionStore()
+	expires := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				token := fmt.Sprintf("%d-%d", i, j)
+				store.Create(types.Session{ID: token, UserID: "u", Token: types.AuthToken{Token: token, ExpiresAt: expires}})
+				store.Get(token)
+				store.Renew(token, expires, time.Now())
+				store.ListByUser("u")
+				if j%2 == 0 {
+					store.Delete(token)
+				}
+			}
+			store.PurgeExpired(time.Now())
+		}(i)
+	}
+	wg.Wait()
+	if sessions, _ := store.ListByUser("u"); len(sessions) != 400 {
+		t.Errorf("ListByUser() = %d sessions, want 400", len(sessions))
+	}
+	if n, _ := store.DeleteByUser("u"); n != 400 {
+		t.Errorf("DeleteByUser() = %d, want 400", n)
+	}
+}
+
+func TestAuthenticateSlidesExpiry(t *testing.T) {
+	db := newTestDatabase(t)
+	sessions := NewMemorySessionStore()
+	as := &authService{db: db, sessions: sessions, twoFactor: &twoFactorService{db: db, now: time.Now}, sessionTTL: time.Hour}
+	if err := db.InsertUser(types.User{ID: "u1", Username: "alice", Password: "secret", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := as.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fresh sessions are left alone
+	if _, err := as.Authenticate(session.Token.Token); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := sessions.Get(session.Token.Token); !s.Token.ExpiresAt.Equal(session.Token.ExpiresAt) {
+		t.Errorf("fresh session renewed to %v", s.Token.ExpiresAt)
+	}
+
+	// Half way through it is pushed back to a full TTL
+	sessions.Renew(session.Token.Token, time.Now().Add(30*time.Minute), session.LastSeenAt)
+	if _, err := as.Authenticate(session.Token.Token); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := sessions.Get(session.Token.Token)
+	if time.Until(s.Token.ExpiresAt) < 59*time.Minute || !s.LastSeenAt.After(session.LastSeenAt) {
+		t.Errorf("session after Authenticate() = %+v, want renewed", s)
+	}
+
+	if _, _, err := as.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := as.ListSessions("u1"); err != nil || len(list) != 2 {
+		t.Errorf("ListSessions() = %d, %v, want 2", len(list), err)
+	}
+	if n, err := as.LogoutEverywhere("u1"); err != nil || n != 2 {
+		t.Errorf("LogoutEverywhere() = %d, %v, want 2", n, err)
+	}
+	if _, err := as.Authenticate(session.Token.Token); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("Authenticate() after LogoutEverywhere() error = %v, want ErrInvalidSession", err)
+	}
+}
+
+func TestDatabaseSessionStoreConcurrency(t *testing.T) {
+	// Like the services, each store has a connection pool of its own on the
+	// same file
+	path := filepath.Join(t.TempDir(), "Smd.db")
+	if err := types.NewDatabaseWithPath(path).CreateDb(); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*50)
+	for i := 0; i < 8; i++ {
+		db := types.NewDatabaseWithPath(path)
+		if err := db.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Disconnect() })
+		store := &databaseSessionStore{db: db}
+		token := fmt.Sprintf("token-%d", i)
+		if err := store.Create(types.Session{ID: fmt.Sprint(i), UserID: "u", Token: types.AuthToken{Token: token, ExpiresAt: expires}}); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := store.Renew(token, expires.Add(time.Duration(j)*time.Second), time.Now()); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Renew() error = %v", err)
+	}
+}
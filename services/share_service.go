@@ -0,0 +1,345 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+var (
+	ErrShareLinkNotFound  = errors.New("share link not found")
+	ErrShareLinkExpired   = errors.New("share link has expired")
+	ErrShareLinkExhausted = errors.New("share link has been used as many times as allowed")
+	ErrSharePassword      = errors.New("share link needs a valid password")
+	ErrShareMode          = errors.New("share link does not allow that")
+	ErrInvalidShareLink   = errors.New("a share link needs exactly one of a file or a directory, a known mode and an expiry in the future")
+	ErrShareNameTaken     = errors.New("a file with that name already exists")
+)
+
+// ShareService manages links that give people without an account access to
+// one file or directory
+type ShareService interface {
+	// CreateLink saves a new link for l's target with a fresh token. An
+	// empty password leaves the link open to anyone with the token.
+	CreateLink(l types.ShareLink, password string) (types.ShareLink, error)
+	GetLink(id string) (types.ShareLink, error)
+	ListLinks(ownerID string) ([]types.ShareLink, error)
+	RevokeLink(id string) error
+	// OpenLink returns the link for token if it is still usable and password
+	// matches
+	OpenLink(token, password string) (types.ShareLink, error)
+	// CountUse records a download, or an upload for upload links, failing
+	// with ErrShareLinkExhausted once the limit is reached
+	CountUse(l types.ShareLink) error
+	// SharedFile returns the shared file, or a file anywhere below the shared
+	// directory
+	SharedFile(l types.ShareLink, fileID string) (types.File, error)
+	// SharedDirectory returns the directory a read link shares
+	SharedDirectory(l types.ShareLink) (types.Directory, error)
+	// ListShared lists the shared directory, or a directory below it
+	ListShared(l types.ShareLink, directoryID string, limit, offset int) (types.DirectoryListing, error)
+	// WriteZip writes the shared directory and everything below it to w
+	WriteZip(l types.ShareLink, w io.Writer) error
+	// Upload stores a file in the directory of an upload link on behalf of
+	// the link's owner
+	Upload(l types.ShareLink, r io.Reader, maxSize int64, name, contentType string) (types.File, error)
+}
+
+type shareService struct {
+	db               types.Database
+	fileService      FileService
+	directoryService DirectoryService
+}
+
+func NewShareService(fileService FileService, directoryService DirectoryService) ShareService {
+	ss := &shareService{
+		db:               types.NewDatabase(),
+		fileService:      fileService,
+		directoryService: directoryService,
+	}
+	err := ss.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ss
+}
+
+func (ss *shareService) CreateLink(l types.ShareLink, password string) (types.ShareLink, error) {
+	if (l.FileID == "") == (l.DirectoryID == "") || l.MaxDownloads < 0 {
+		return types.ShareLink{}, ErrInvalidShareLink
+	}
+	if l.Mode == "" {
+		l.Mode = types.ShareRead
+	}
+	switch {
+	case l.Mode == types.ShareUpload && l.DirectoryID == "",
+		l.Mode != types.ShareRead && l.Mode != types.ShareUpload,
+		!l.ExpiresAt.IsZero() && !l.ExpiresAt.After(time.Now()):
+		return types.ShareLink{}, ErrInvalidShareLink
+	}
+	if l.FileID != "" {
+		if _, err := ss.fileService.GetFileByID(l.FileID); err != nil {
+			return types.ShareLink{}, err
+		}
+	} else if _, err := ss.directoryService.GetDirectory(l.DirectoryID); err != nil {
+		return types.ShareLink{}, err
+	}
+
+	var err error
+	if password != "" {
+		l.PasswordHash, err = types.HashPassword(password)
+		if err != nil {
+			return types.ShareLink{}, err
+		}
+	}
+	l.ID, err = utils.GenerateToken(16)
+	if err != nil {
+		return types.ShareLink{}, err
+	}
+	l.Token, err = utils.GenerateToken(32)
+	if err != nil {
+		return types.ShareLink{}, err
+	}
+	l.CreatedAt = time.Now()
+	l.DownloadCount = 0
+	if err := ss.db.InsertShareLink(l); err != nil {
+		return types.ShareLink{}, fmt.Errorf("error saving share link: %v", err)
+	}
+	return l, nil
+}
+
+func (ss *shareService) GetLink(id string) (types.ShareLink, error) {
+	l, err := ss.db.GetShareLink(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.ShareLink{}, ErrShareLinkNotFound
+		}
+		return types.ShareLink{}, fmt.Errorf("error getting share link: %v", err)
+	}
+	return l, nil
+}
+
+func (ss *shareService) ListLinks(ownerID string) ([]types.ShareLink, error) {
+	links, err := ss.db.ListShareLinks(ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing share links: %v", err)
+	}
+	if links == nil {
+		links = []types.ShareLink{}
+	}
+	return links, nil
+}
+
+func (ss *shareService) RevokeLink(id string) error {
+	if err := ss.db.DeleteShareLink(id); err != nil {
+		return fmt.Errorf("error deleting share link: %v", err)
+	}
+	return nil
+}
+
+func (ss *shareService) OpenLink(token, password string) (types.ShareLink, error) {
+	l, err := ss.db.GetShareLinkByToken(token)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.ShareLink{}, ErrShareLinkNotFound
+		}
+		return types.ShareLink{}, fmt.Errorf("error getting share link: %v", err)
+	}
+	if !l.ExpiresAt.IsZero() && time.Now().After(l.ExpiresAt) {
+		return types.ShareLink{}, ErrShareLinkExpired
+	}
+	if l.MaxDownloads > 0 && l.DownloadCount >= l.MaxDownloads {
+		return types.ShareLink{}, ErrShareLinkExhausted
+	}
+	if l.PasswordHash != "" {
+		if password == "" {
+			return types.ShareLink{}, ErrSharePassword
+		}
+		match, _, err := types.VerifyPassword(password, l.PasswordHash)
+		if err != nil {
+			return types.ShareLink{}, fmt.Errorf("error checking share link password: %v", err)
+		}
+		if !match {
+			return types.ShareLink{}, ErrSharePassword
+		}
+	}
+	return l, nil
+}
+
+func (ss *shareService) CountUse(l types.ShareLink) error {
+	err := ss.db.CountShareLinkUse(l.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrShareLinkExhausted
+	}
+	if err != nil {
+		return fmt.Errorf("error counting share link use: %v", err)
+	}
+	return nil
+}
+
+func (ss *shareService) SharedFile(l types.ShareLink, fileID string) (types.File, error) {
+	if l.Mode != types.ShareRead {
+		return types.File{}, ErrShareMode
+	}
+	if l.FileID != "" {
+		if fileID != "" && fileID != l.FileID {
+			return types.File{}, ErrFileNotFound
+		}
+		return ss.fileService.GetFileByID(l.FileID)
+	}
+	f, err := ss.fileService.GetFileByID(fileID)
+	if err != nil {
+		return types.File{}, err
+	}
+	below, err := ss.isBelow(f.DirectoryID, l.DirectoryID)
+	if err != nil {
+		return types.File{}, err
+	}
+	if !below {
+		// Don't tell visitors about files outside the share
+		return types.File{}, ErrFileNotFound
+	}
+	return f, nil
+}
+
+func (ss *shareService) SharedDirectory(l types.ShareLink) (types.Directory, error) {
+	if l.Mode != types.ShareRead || l.DirectoryID == "" {
+		return types.Directory{}, ErrShareMode
+	}
+	return ss.directoryService.GetDirectory(l.DirectoryID)
+}
+
+func (ss *shareService) ListShared(l types.ShareLink, directoryID string, limit, offset int) (types.DirectoryListing, error) {
+	if l.Mode != types.ShareRead || l.DirectoryID == "" {
+		return types.DirectoryListing{}, ErrShareMode
+	}
+	if directoryID == "" {
+		directoryID = l.DirectoryID
+	}
+	below, err := ss.isBelow(directoryID, l.DirectoryID)
+	if err != nil {
+		return types.DirectoryListing{}, err
+	}
+	if !below {
+		return types.DirectoryListing{}, ErrDirectoryNotFound
+	}
+	if _, err := ss.directoryService.GetDirectory(directoryID); err != nil {
+		return types.DirectoryListing{}, err
+	}
+	return ss.directoryService.ListChildren("", directoryID, limit, offset)
+}
+
+// isBelow reports whether directoryID is rootID or somewhere below it
+func (ss *shareService) isBelow(directoryID, rootID string) (bool, error) {
+	for depth := 0; directoryID != "" && depth < maxDirectoryDepth; depth++ {
+		if directoryID == rootID {
+			return true, nil
+		}
+		dir, err := ss.db.GetDirectoryByID(directoryID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, fmt.Errorf("error getting directory: %v", err)
+		}
+		directoryID = dir.ParentDirectoryID
+	}
+	return false, nil
+}
+
+func (ss *shareService) WriteZip(l types.ShareLink, w io.Writer) error {
+	dir, err := ss.SharedDirectory(l)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	if err := ss.zipDirectory(zw, dir.ID, dir.Name, 0); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (ss *shareService) zipDirectory(zw *zip.Writer, directoryID, prefix string, depth int) error {
+	if depth >= maxDirectoryDepth {
+		return nil
+	}
+	for offset := 0; ; offset += MaxListLimit {
+		files, err := ss.db.ListFilesInDirectory("", directoryID, MaxListLimit, offset)
+		if err != nil {
+			return fmt.Errorf("error listing files: %v", err)
+		}
+		for _, f := range files {
+			if err := ss.zipFile(zw, f, path.Join(prefix, f.Name)); err != nil {
+				return err
+			}
+		}
+		if len(files) < MaxListLimit {
+			break
+		}
+	}
+	for offset := 0; ; offset += MaxListLimit {
+		dirs, err := ss.db.ListSubdirectories("", directoryID, MaxListLimit, offset)
+		if err != nil {
+			return fmt.Errorf("error listing directories: %v", err)
+		}
+		for _, dir := range dirs {
+			if err := ss.zipDirectory(zw, dir.ID, path.Join(prefix, dir.Name), depth+1); err != nil {
+				return err
+			}
+		}
+		if len(dirs) < MaxListLimit {
+			return nil
+		}
+	}
+}
+
+func (ss *shareService) zipFile(zw *zip.Writer, f types.File, name string) error {
+	content, err := ss.fileService.OpenFile(f)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: f.UploadDate,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+func (ss *shareService) Upload(l types.ShareLink, r io.Reader, maxSize int64, name, contentType string) (types.File, error) {
+	if l.Mode != types.ShareUpload {
+		return types.File{}, ErrShareMode
+	}
+	if name == "" || name == "." || name == ".." {
+		return types.File{}, ErrInvalidName
+	}
+	// Visitors can't see what is there, so they don't get to add versions to it
+	_, err := ss.db.GetFileByPath(l.OwnerID, l.DirectoryID, name)
+	if err == nil {
+		return types.File{}, ErrShareNameTaken
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return types.File{}, fmt.Errorf("error getting file from database: %v", err)
+	}
+	if err := ss.CountUse(l); err != nil {
+		return types.File{}, err
+	}
+	return ss.fileService.StoreStream(r, maxSize, types.File{
+		Name:        name,
+		ContentType: contentType,
+		OwnerID:     l.OwnerID,
+		DirectoryID: l.DirectoryID,
+	})
+}
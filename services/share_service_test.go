@@ -0,0 +1,235 @@
+package services
+
+import (
+	"Smd/types"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShareService(t *testing.T) (*shareService, *directoryService) {
+	t.Helper()
+	ds := newTestDirectoryService(t)
+	return &shareService{db: ds.db, fileService: ds.fileService, directoryService: ds}, ds
+}
+
+func TestCreateShareLink(t *testing.T) {
+	ss, ds := newTestShareService(t)
+	docs, err := ds.CreateDirectory("alice", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ds.fileService.StoreStream(strings.NewReader("hello"), 100, types.File{Name: "a.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		link    types.ShareLink
+		wantErr error
+	}{
+		{name: "File", link: types.ShareLink{OwnerID: "alice", FileID: f.ID}},
+		{name: "UploadDirectory", link: types.ShareLink{OwnerID: "alice", DirectoryID: docs.ID, Mode: types.ShareUpload}},
+		{name: "Expiring", link: types.ShareLink{OwnerID: "alice", FileID: f.ID, ExpiresAt: time.Now().Add(time.Hour), MaxDownloads: 3}},
+		{name: "NoTarget", link: types.ShareLink{OwnerID: "alice"}, wantErr: ErrInvalidShareLink},
+		{name: "BothTargets", link: types.ShareLink{OwnerID: "alice", FileID: f.ID, DirectoryID: docs.ID}, wantErr: ErrInvalidShareLink},
+		{name: "UploadFile", link: types.ShareLink{OwnerID: "alice", FileID: f.ID, Mode: types.ShareUpload}, wantErr: ErrInvalidShareLink},
+		{name: "UnknownMode", link: types.ShareLink{OwnerID: "alice", FileID: f.ID, Mode: "write"}, wantErr: ErrInvalidShareLink},
+		{name: "AlreadyExpired", link: types.ShareLink{OwnerID: "alice", FileID: f.ID, ExpiresAt: time.Now().Add(-time.Hour)}, wantErr: ErrInvalidShareLink},
+		{name: "NegativeLimit", link: types.ShareLink{OwnerID: "alice", FileID: f.ID, MaxDownloads: -1}, wantErr: ErrInvalidShareLink},
+		{name: "MissingFile", link: types.ShareLink{OwnerID: "alice", FileID: "nope"}, wantErr: ErrFileNotFound},
+		{name: "MissingDirectory", link: types.ShareLink{OwnerID: "alice", DirectoryID: "nope"}, wantErr: ErrDirectoryNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link, err := ss.CreateLink(tt.link, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateLink() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if link.ID == "" || len(link.Token) != 64 || link.Mode == "" {
+				t.Errorf("CreateLink() = %+v", link)
+			}
+			got, err := ss.GetLink(link.ID)
+			if err != nil || got.Token != link.Token || !got.ExpiresAt.Equal(link.ExpiresAt) {
+				t.Errorf("GetLink() = %+v, %v, want %+v", got, err, link)
+			}
+		})
+	}
+
+	links, err := ss.ListLinks("alice")
+	if err != nil || len(links) != 3 {
+		t.Errorf("ListLinks() = %d links, %v, want 3", len(links), err)
+	}
+	if err := ss.RevokeLink(links[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.OpenLink(links[0].Token, ""); !errors.Is(err, ErrShareLinkNotFound) {
+		t.Errorf("OpenLink() of revoked link error = %v, want ErrShareLinkNotFound", err)
+	}
+}
+
+func TestOpenShareLink(t *testing.T) {
+	ss, ds := newTestShareService(t)
+	f, err := ds.fileService.StoreStream(strings.NewReader("hello"), 100, types.File{Name: "a.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected, err := ss.CreateLink(types.ShareLink{OwnerID: "alice", FileID: f.ID, MaxDownloads: 2}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protected.PasswordHash == "" || protected.PasswordHash == "s3cret" {
+		t.Fatalf("password stored as %q", protected.PasswordHash)
+	}
+	expired := types.ShareLink{ID: "old", Token: "oldtoken", OwnerID: "alice", FileID: f.ID, Mode: types.ShareRead, ExpiresAt: time.Now().Add(-time.Minute), CreatedAt: time.Now()}
+	if err := ss.db.InsertShareLink(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		token    string
+		password string
+		wantErr  error
+	}{
+		{name: "NoPassword", token: protected.Token, wantErr: ErrSharePassword},
+		{name: "WrongPassword", token: protected.Token, password: "guess", wantErr: ErrSharePassword},
+		{name: "RightPassword", token: protected.Token, password: "s3cret"},
+		{name: "Expired", token: expired.Token, wantErr: ErrShareLinkExpired},
+		{name: "Unknown", token: "nope", wantErr: ErrShareLinkNotFound},
+	} {
+		if _, err := ss.OpenLink(tt.token, tt.password); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: OpenLink() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := ss.CountUse(protected); err != nil {
+			t.Fatalf("CountUse() #%d error = %v", i+1, err)
+		}
+	}
+	if err := ss.CountUse(protected); !errors.Is(err, ErrShareLinkExhausted) {
+		t.Errorf("CountUse() past the limit error = %v, want ErrShareLinkExhausted", err)
+	}
+	if _, err := ss.OpenLink(protected.Token, "s3cret"); !errors.Is(err, ErrShareLinkExhausted) {
+		t.Errorf("OpenLink() of used up link error = %v, want ErrShareLinkExhausted", err)
+	}
+}
+
+func TestSharedDirectory(t *testing.T) {
+	ss, ds := newTestShareService(t)
+	fs := ds.fileService
+	docs, err := ds.CreateDirectory("alice", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := ds.CreateDirectory("alice", "reports", docs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ds.CreateDirectory("alice", "private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := fs.StoreStream(strings.NewReader("top"), 100, types.File{Name: "top.txt", OwnerID: "alice", DirectoryID: docs.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep, err := fs.StoreStream(strings.NewReader("deep"), 100, types.File{Name: "q1.txt", OwnerID: "alice", DirectoryID: reports.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := fs.StoreStream(strings.NewReader("secret"), 100, types.File{Name: "s.txt", OwnerID: "alice", DirectoryID: private.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := ss.CreateLink(types.ShareLink{OwnerID: "alice", DirectoryID: docs.ID}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := ss.SharedFile(link, deep.ID); err != nil || got.ID != deep.ID {
+		t.Errorf("SharedFile() below the share = %+v, %v", got, err)
+	}
+	if _, err := ss.SharedFile(link, secret.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("SharedFile() outside the share error = %v, want ErrFileNotFound", err)
+	}
+	listing, err := ss.ListShared(link, "", 10, 0)
+	if err != nil || len(listing.Directories) != 1 || len(listing.Files) != 1 || listing.Files[0].ID != top.ID {
+		t.Errorf("ListShared() = %+v, %v", listing, err)
+	}
+	if _, err := ss.ListShared(link, reports.ID, 10, 0); err != nil {
+		t.Errorf("ListShared() of a subdirectory error = %v", err)
+	}
+	if _, err := ss.ListShared(link, private.ID, 10, 0); !errors.Is(err, ErrDirectoryNotFound) {
+		t.Errorf("ListShared() outside the share error = %v, want ErrDirectoryNotFound", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ss.WriteZip(link, &buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, entry := range zr.File {
+		rc, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[entry.Name] = string(data)
+	}
+	want := map[string]string{"docs/top.txt": "top", "docs/reports/q1.txt": "deep"}
+	if len(contents) != len(want) {
+		t.Errorf("zip holds %v, want %v", contents, want)
+	}
+	for name, data := range want {
+		if contents[name] != data {
+			t.Errorf("zip entry %s = %q, want %q", name, contents[name], data)
+		}
+	}
+}
+
+func TestShareUpload(t *testing.T) {
+	ss, ds := newTestShareService(t)
+	inbox, err := ds.CreateDirectory("alice", "inbox", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := ss.CreateLink(types.ShareLink{OwnerID: "alice", DirectoryID: inbox.ID, Mode: types.ShareUpload, MaxDownloads: 2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ss.Upload(link, strings.NewReader("from a visitor"), 100, "note.txt", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.OwnerID != "alice" || f.DirectoryID != inbox.ID {
+		t.Errorf("Upload() = %+v, want it in alice's inbox", f)
+	}
+	if _, err := ss.Upload(link, strings.NewReader("overwrite"), 100, "note.txt", "text/plain"); !errors.Is(err, ErrShareNameTaken) {
+		t.Errorf("Upload() over an existing file error = %v, want ErrShareNameTaken", err)
+	}
+	if _, err := ss.ListShared(link, "", 10, 0); !errors.Is(err, ErrShareMode) {
+		t.Errorf("ListShared() of an upload link error = %v, want ErrShareMode", err)
+	}
+	if _, err := ss.Upload(link, strings.NewReader("second"), 100, "second.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Upload(link, strings.NewReader("third"), 100, "third.txt", ""); !errors.Is(err, ErrShareLinkExhausted) {
+		t.Errorf("Upload() past the limit error = %v, want ErrShareLinkExhausted", err)
+	}
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut to six digits
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTotp(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{name: "Current", code: "050471", want: true},
+		{name: "PreviousPeriod", code: totpCode([]byte("12345678901234567890"), step-1), want: true},
+		{name: "NextPeriod", code: totpCode([]byte("12345678901234567890"), step+1), want: true},
+		{name: "TooOld", code: totpCode([]byte("12345678901234567890"), step-2)},
+		{name: "Wrong", code: "000000"},
+		{name: "Short", code: "05047"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := matchTotp(secret, tt.code, now)
+			if ok != tt.want {
+				t.Errorf("matchTotp(%q) = %v, want %v", tt.code, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestTotpURI(t *testing.T) {
+	uri := totpURI("ABC", "alice smith")
+	for _, want := range []string{"otpauth://totp/Smd:alice%20smith?", "secret=ABC", "issuer=Smd", "digits=6", "period=30"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("%s does not contain %s", uri, want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrTrashItemNotFound = errors.New("trash item not found")
+	ErrRestoreConflict   = errors.New("an item with that name already exists where it would be restored")
+)
+
+// TrashService soft deletes files and directories into their owner's trash,
+// from where they can be restored until they are purged for good
+type TrashService interface {
+	TrashFile(user types.User, fileID string) (types.TrashItem, error)
+	// TrashDirectory moves a directory into the trash with everything below it
+	TrashDirectory(user types.User, directoryID string) (types.TrashItem, error)
+	// ListTrash returns the items the user or one of their groups owns, and
+	// those the user deleted. An API key
+	// confined to a directory only sees what was deleted from below it.
+	ListTrash(user types.User) ([]types.TrashItem, error)
+	GetTrashItem(user types.User, id string) (types.TrashItem, error)
+	// Restore puts the item back where it was deleted from, or at the owner's
+	// root if that directory is gone. The user's role, and the API key they
+	// used, need Write, and directory quotas apply as they do to uploads.
+	Restore(user types.User, id string) (types.TrashItem, error)
+	// Purge deletes the item for good. The user's role, and the API key they
+	// used, need Delete.
+	Purge(user types.User, id string) error
+	// EmptyTrash purges every item ListTrash would return
+	EmptyTrash(user types.User) (int, error)
+	// PurgeDeletedBefore purges every item deleted before t, whoever owns it
+	PurgeDeletedBefore(t time.Time) (int, error)
+}
+
+type trashService struct {
+	db          types.Database
+	fileService FileService
+	roles       RoleService
+}
+
+func NewTrashService(fileService FileService, roles RoleService) TrashService {
+	ts := &trashService{
+		db:          types.NewDatabase(),
+		fileService: fileService,
+		roles:       roles,
+	}
+	err := ts.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ts
+}
+
+func (ts *trashService) TrashFile(user types.User, fileID string) (types.TrashItem, error) {
+	f, err := ts.fileService.GetFileByID(fileID)
+	if err != nil {
+		return types.TrashItem{}, err
+	}
+	item, err := ts.trash(user, types.TrashFile, f.ID, f.Name, f.OwnerID, f.DirectoryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.TrashItem{}, ErrFileNotFound
+	}
+	return item, err
+}
+
+func (ts *trashService) TrashDirectory(user types.User, directoryID string) (types.TrashItem, error) {
+	dir, err := ts.db.GetDirectoryByID(directoryID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.TrashItem{}, ErrDirectoryNotFound
+		}
+		return types.TrashItem{}, fmt.Errorf("error getting directory: %v", err)
+	}
+	item, err := ts.trash(user, types.TrashDirectory, dir.ID, dir.Name, dir.OwnerID, dir.ParentDirectoryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.TrashItem{}, ErrDirectoryNotFound
+	}
+	return item, err
+}
+
+func (ts *trashService) trash(user types.User, itemType, itemID, name, ownerID, parentID string) (types.TrashItem, error) {
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.TrashItem{}, err
+	}
+	item := types.TrashItem{
+		DeletedAt: time.Now(),
+		ID:        id,
+		OwnerID:   ownerID,
+		DeletedBy: user.ID,
+		ItemType:  itemType,
+		ItemID:    itemID,
+		Name:      name,
+		ParentID:  parentID,
+	}
+	if err := ts.db.InsertTrashItem(item); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.TrashItem{}, err
+		}
+		return types.TrashItem{}, fmt.Errorf("error moving item to trash: %v", err)
+	}
+	return item, nil
+}
+
+func (ts *trashService) ListTrash(user types.User) ([]types.TrashItem, error) {
+	items, err := ts.db.ListTrashItems(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing trash: %v", err)
+	}
+	visible := []types.TrashItem{}
+	for _, item := range items {
+		err := ts.checkScopeDirectory(user, item)
+		if errors.Is(err, ErrForbidden) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		visible = append(visible, item)
+	}
+	return visible, nil
+}
+
+// GetTrashItem returns ErrForbidden unless the user or one of their groups
+// owns the item, the user deleted it, or their role can add users. Restoring
+// or purging it also takes the role's Write or Delete, so a member of the
+// owning group can't undo or destroy what others deleted on membership alone.
+func (ts *trashService) GetTrashItem(user types.User, id string) (types.TrashItem, error) {
+	item, err := ts.db.GetTrashItem(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.TrashItem{}, ErrTrashItemNotFound
+		}
+		return types.TrashItem{}, fmt.Errorf("error getting trash item: %v", err)
+	}
+	principals, err := principals(ts.db, user)
+	if err != nil {
+		return types.TrashItem{}, err
+	}
+	if !principals[item.OwnerID] && item.DeletedBy != user.ID {
+		role, err := rolePrivileges(ts.roles, user)
+		if err != nil {
+			return types.TrashItem{}, err
+		}
+		if !role.AddUsers {
+			return types.TrashItem{}, ErrForbidden
+		}
+	}
+	if err := ts.checkScopeDirectory(user, item); err != nil {
+		return types.TrashItem{}, err
+	}
+	return item, nil
+}
+
+// checkScopeDirectory returns ErrForbidden if user is confined to a
+// directory by an API key and item wasn't deleted from it or below it
+func (ts *trashService) checkScopeDirectory(user types.User, item types.TrashItem) error {
+	if item.ItemType == types.TrashDirectory && item.ItemID == user.ScopeDirectoryID {
+		return nil
+	}
+	err := checkScopeDirectory(ts.db, user, item.ParentID)
+	if errors.Is(err, ErrDirectoryNotFound) {
+		// It would be restored at the owner's root
+		return ErrForbidden
+	}
+	return err
+}
+
+// authorizeRole returns ErrForbidden unless the user's role, narrowed by the
+// API key they authenticated with, allows action. Owning or having deleted
+// an item doesn't make up for a role that can't write or delete.
+func (ts *trashService) authorizeRole(user types.User, action Action) error {
+	role, err := rolePrivileges(ts.roles, user)
+	if err != nil {
+		return err
+	}
+	if !allows(role, action) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (ts *trashService) Restore(user types.User, id string) (types.TrashItem, error) {
+	if err := ts.authorizeRole(user, ActionWrite); err != nil {
+		return types.TrashItem{}, err
+	}
+	item, err := ts.GetTrashItem(user, id)
+	if err != nil {
+		return types.TrashItem{}, err
+	}
+	if item.ParentID != "" {
+		if _, err := ts.db.GetDirectoryByID(item.ParentID); errors.Is(err, sql.ErrNoRows) {
+			item.ParentID = ""
+		} else if err != nil {
+			return types.TrashItem{}, fmt.Errorf("error getting directory: %v", err)
+		}
+	}
+
+	if item.ItemType == types.TrashFile {
+		_, err = ts.db.GetFileByPath(item.OwnerID, item.ParentID, item.Name)
+	} else {
+		_, err = ts.db.GetSubdirectoryByName(item.OwnerID, item.ParentID, item.Name)
+	}
+	if err == nil {
+		return types.TrashItem{}, ErrRestoreConflict
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return types.TrashItem{}, fmt.Errorf("error checking for name conflicts: %v", err)
+	}
+
+	if err := ts.db.RestoreTrashItem(item.ID, item.ParentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.TrashItem{}, ErrTrashItemNotFound
+		}
+		if errors.Is(err, types.ErrQuotaExceeded) {
+			return types.TrashItem{}, ErrQuotaExceeded
+		}
+		return types.TrashItem{}, fmt.Errorf("error restoring item: %v", err)
+	}
+	return item, nil
+}
+
+func (ts *trashService) Purge(user types.User, id string) error {
+	if err := ts.authorizeRole(user, ActionDelete); err != nil {
+		return err
+	}
+	item, err := ts.GetTrashItem(user, id)
+	if err != nil {
+		return err
+	}
+	return ts.purge(item)
+}
+
+func (ts *trashService) EmptyTrash(user types.User) (int, error) {
+	if err := ts.authorizeRole(user, ActionDelete); err != nil {
+		return 0, err
+	}
+	items, err := ts.ListTrash(user)
+	if err != nil {
+		return 0, err
+	}
+	for i, item := range items {
+		if err := ts.purge(item); err != nil {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
+
+func (ts *trashService) PurgeDeletedBefore(t time.Time) (int, error) {
+	const batchSize = 100
+	purged := 0
+	for {
+		items, err := ts.db.ListTrashItemsDeletedBefore(t, batchSize)
+		if err != nil {
+			return purged, fmt.Errorf("error listing trash: %v", err)
+		}
+		for _, item := range items {
+			if err := ts.purge(item); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+		if len(items) < batchSize {
+			return purged, nil
+		}
+	}
+}
+
+// purge deletes the item's files through the file service, so blobs nothing
+// else references are removed, and then the rest of the item
+func (ts *trashService) purge(item types.TrashItem) error {
+	fileIDs, err := ts.db.ListTrashedFileIDs(item.ID)
+	if err != nil {
+		return fmt.Errorf("error listing trashed files: %v", err)
+	}
+	for _, id := range fileIDs {
+		if err := ts.fileService.DeleteFile(id); err != nil && !errors.Is(err, ErrFileNotFound) {
+			return err
+		}
+	}
+	if err := ts.db.DeleteTrashItem(item.ID); err != nil {
+		return fmt.Errorf("error purging trash item: %v", err)
+	}
+	return nil
+}
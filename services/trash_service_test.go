@@ -0,0 +1,328 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTrashService(t *testing.T) (*trashService, *directoryService) {
+	t.Helper()
+	ds := newTestDirectoryService(t)
+	return &trashService{db: ds.db, fileService: ds.fileService, roles: newTestRoleService(ds.db)}, ds
+}
+
+func TestTrashFile(t *testing.T) {
+	ts, ds := newTestTrashService(t)
+	fs := ds.fileService.(*fileService)
+	alice := types.User{ID: "alice", Role: types.Owner}
+	bob := types.User{ID: "bob", Role: types.Owner}
+	admin := types.User{ID: "root", Role: types.Admin}
+
+	docs, err := ds.CreateDirectory("alice", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.StoreStream(strings.NewReader("notes"), 100, types.File{Name: "a.txt", OwnerID: "alice", DirectoryID: docs.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := ts.TrashFile(bob, f.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.OwnerID != "alice" || item.DeletedBy != "bob" || item.ParentID != docs.ID || item.Name != "a.txt" {
+		t.Errorf("TrashFile() = %+v", item)
+	}
+	if _, err := fs.GetFileByID(f.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("GetFileByID() of trashed file error = %v, want ErrFileNotFound", err)
+	}
+	if _, err := ts.TrashFile(bob, f.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("trashing twice error = %v, want ErrFileNotFound", err)
+	}
+
+	for _, user := range []types.User{alice, bob} {
+		items, err := ts.ListTrash(user)
+		if err != nil || len(items) != 1 || items[0].ID != item.ID {
+			t.Errorf("ListTrash(%s) = %+v, %v", user.ID, items, err)
+		}
+	}
+	if items, err := ts.ListTrash(types.User{ID: "carol"}); err != nil || items == nil || len(items) != 0 {
+		t.Errorf("ListTrash(carol) = %#v, %v, want an empty list", items, err)
+	}
+	if _, err := ts.Restore(types.User{ID: "carol", Role: types.Owner}, item.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Restore() by a stranger error = %v, want ErrForbidden", err)
+	}
+	if _, err := ts.GetTrashItem(admin, item.ID); err != nil {
+		t.Errorf("GetTrashItem() by an admin error = %v", err)
+	}
+	// Owning the file doesn't help a role that can't write or delete
+	reader := types.User{ID: "alice", Role: types.Regular}
+	if _, err := ts.Restore(reader, item.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Restore() by a Regular owner error = %v, want ErrForbidden", err)
+	}
+	if err := ts.Purge(reader, item.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Purge() by a Regular owner error = %v, want ErrForbidden", err)
+	}
+	if _, err := ts.EmptyTrash(reader); !errors.Is(err, ErrForbidden) {
+		t.Errorf("EmptyTrash() by a Regular owner error = %v, want ErrForbidden", err)
+	}
+
+	// A new file took the name, so the trashed one can't come back
+	taken, err := fs.StoreStream(strings.NewReader("other"), 100, types.File{Name: "a.txt", OwnerID: "alice", DirectoryID: docs.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Restore(alice, item.ID); !errors.Is(err, ErrRestoreConflict) {
+		t.Errorf("Restore() over a live file error = %v, want ErrRestoreConflict", err)
+	}
+	if err := fs.DeleteFile(taken.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := ts.Restore(alice, item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ParentID != docs.ID {
+		t.Errorf("Restore() parent = %q, want %q", restored.ParentID, docs.ID)
+	}
+	got, err := fs.GetFileByID(f.ID)
+	if err != nil || got.DirectoryID != docs.ID {
+		t.Errorf("GetFileByID() after restore = %+v, %v", got, err)
+	}
+	if _, err := ts.GetTrashItem(alice, item.ID); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("GetTrashItem() after restore error = %v, want ErrTrashItemNotFound", err)
+	}
+}
+
+func TestTrashDirectory(t *testing.T) {
+	ts, ds := newTestTrashService(t)
+	fs := ds.fileService.(*fileService)
+	alice := types.User{ID: "alice", Role: types.Owner}
+
+	docs, err := ds.CreateDirectory("alice", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := ds.CreateDirectory("alice", "reports", docs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep, err := fs.StoreStream(strings.NewReader("q1"), 100, types.File{Name: "q1.txt", OwnerID: "alice", DirectoryID: reports.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trashed on its own first, so it stays in the trash when docs comes back
+	loose, err := fs.StoreStream(strings.NewReader("loose"), 100, types.File{Name: "loose.txt", OwnerID: "alice", DirectoryID: docs.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	looseItem, err := ts.TrashFile(alice, loose.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := ts.TrashDirectory(alice, docs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{docs.ID, reports.ID} {
+		if _, err := ds.GetDirectory(id); !errors.Is(err, ErrDirectoryNotFound) {
+			t.Errorf("GetDirectory(%s) error = %v, want ErrDirectoryNotFound", id, err)
+		}
+	}
+	if _, err := fs.GetFileByID(deep.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("GetFileByID() below trashed directory error = %v, want ErrFileNotFound", err)
+	}
+	if listing, err := ds.ListChildren("alice", "", 10, 0); err != nil || len(listing.Directories) != 0 {
+		t.Errorf("ListChildren() at root = %+v, %v, want nothing", listing, err)
+	}
+
+	if _, err := ts.Restore(alice, item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.GetFileByID(deep.ID); err != nil {
+		t.Errorf("GetFileByID() after restoring the directory error = %v", err)
+	}
+	if _, err := ds.GetDirectory(reports.ID); err != nil {
+		t.Errorf("GetDirectory() after restoring the parent error = %v", err)
+	}
+	if _, err := fs.GetFileByID(loose.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("separately trashed file came back with its directory: %v", err)
+	}
+
+	// With its directory gone the file is restored at the owner's root
+	if _, err := ts.TrashDirectory(alice, docs.ID); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ts.Restore(alice, looseItem.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ParentID != "" {
+		t.Errorf("Restore() parent = %q, want the root", restored.ParentID)
+	}
+	if got, err := fs.GetFileByID(loose.ID); err != nil || got.DirectoryID != "" {
+		t.Errorf("GetFileByID() = %+v, %v, want it at the root", got, err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	ts, ds := newTestTrashService(t)
+	fs := ds.fileService.(*fileService)
+	alice := types.User{ID: "alice", Role: types.Owner}
+
+	docs, err := ds.CreateDirectory("alice", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unique, err := fs.StoreStream(strings.NewReader("only here"), 100, types.File{Name: "a.txt", OwnerID: "alice", DirectoryID: docs.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := fs.StoreStream(strings.NewReader("everywhere"), 100, types.File{Name: "b.txt", OwnerID: "alice", DirectoryID: docs.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := fs.StoreStream(strings.NewReader("everywhere"), 100, types.File{Name: "b.txt", OwnerID: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := ts.TrashDirectory(alice, docs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trashed blobs stay until the purge
+	if _, err := fs.store.Stat(unique.Location); err != nil {
+		t.Errorf("blob of trashed file is gone before the purge: %v", err)
+	}
+
+	if err := ts.Purge(alice, item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.store.Stat(unique.Location); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Stat() of purged blob error = %v, want ErrBlobNotFound", err)
+	}
+	if _, err := fs.store.Stat(shared.Location); err != nil {
+		t.Errorf("blob still used by %s was removed: %v", kept.ID, err)
+	}
+	if _, err := ts.GetTrashItem(alice, item.ID); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("GetTrashItem() after purge error = %v, want ErrTrashItemNotFound", err)
+	}
+	if dirs, err := ts.db.GetAllDirectories(); err != nil || len(dirs) != 0 {
+		t.Errorf("GetAllDirectories() after purge = %+v, %v", dirs, err)
+	}
+}
+
+func TestTrashApiKeyScope(t *testing.T) {
+	ts, ds := newTestTrashService(t)
+	fs := ds.fileService.(*fileService)
+	alice := types.User{ID: "alice", Role: types.Owner}
+
+	build, err := ds.CreateDirectory("alice", "build", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside, err := fs.StoreStream(strings.NewReader("inside"), 100, types.File{Name: "a.txt", OwnerID: "alice", DirectoryID: build.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := fs.StoreStream(strings.NewReader("outside"), 100, types.File{Name: "b.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insideItem, err := ts.TrashFile(alice, inside.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsideItem, err := ts.TrashFile(alice, outside.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly := alice
+	readOnly.Scope = &types.Privileges{Read: true}
+	if _, err := ts.EmptyTrash(readOnly); !errors.Is(err, ErrForbidden) {
+		t.Errorf("EmptyTrash() with a read only key error = %v, want ErrForbidden", err)
+	}
+	if err := ts.Purge(readOnly, insideItem.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Purge() with a read only key error = %v, want ErrForbidden", err)
+	}
+	if _, err := ts.Restore(readOnly, insideItem.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Restore() with a read only key error = %v, want ErrForbidden", err)
+	}
+
+	confined := alice
+	confined.Scope = &types.Privileges{Read: true, Write: true, Delete: true}
+	confined.ScopeDirectoryID = build.ID
+	items, err := ts.ListTrash(confined)
+	if err != nil || len(items) != 1 || items[0].ID != insideItem.ID {
+		t.Errorf("ListTrash() with a confined key = %+v, %v", items, err)
+	}
+	if _, err := ts.Restore(confined, outsideItem.ID); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Restore() from outside a confined key's directory error = %v, want ErrForbidden", err)
+	}
+	if n, err := ts.EmptyTrash(confined); err != nil || n != 1 {
+		t.Errorf("EmptyTrash() with a confined key = %d, %v, want 1", n, err)
+	}
+	if _, err := ts.GetTrashItem(alice, outsideItem.ID); err != nil {
+		t.Errorf("item outside a confined key's directory was purged: %v", err)
+	}
+}
+
+func TestPurgeDeletedBefore(t *testing.T) {
+	ts, ds := newTestTrashService(t)
+	fs := ds.fileService.(*fileService)
+	alice := types.User{ID: "alice", Role: types.Owner}
+
+	old, err := fs.StoreStream(strings.NewReader("old"), 100, types.File{Name: "old.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, err := fs.StoreStream(strings.NewReader("recent"), 100, types.File{Name: "recent.txt", OwnerID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trashed straight through the database so it can be backdated past the
+	// retention window
+	oldItem := types.TrashItem{
+		DeletedAt: time.Now().AddDate(0, 0, -40),
+		ID:        "old",
+		OwnerID:   "alice",
+		DeletedBy: "alice",
+		ItemType:  types.TrashFile,
+		ItemID:    old.ID,
+		Name:      old.Name,
+	}
+	if err := ts.db.InsertTrashItem(oldItem); err != nil {
+		t.Fatal(err)
+	}
+	recentItem, err := ts.TrashFile(alice, recent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ts.PurgeDeletedBefore(time.Now().AddDate(0, 0, -30))
+	if err != nil || n != 1 {
+		t.Fatalf("PurgeDeletedBefore() = %d, %v, want 1", n, err)
+	}
+	if _, err := fs.store.Stat(old.Location); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Stat() of purged blob error = %v, want ErrBlobNotFound", err)
+	}
+	if _, err := ts.GetTrashItem(alice, recentItem.ID); err != nil {
+		t.Errorf("recent item was purged: %v", err)
+	}
+	if _, err := fs.store.Stat(recent.Location); err != nil {
+		t.Errorf("blob of recent item was removed: %v", err)
+	}
+
+	n, err = ts.EmptyTrash(alice)
+	if err != nil || n != 1 {
+		t.Errorf("EmptyTrash() = %d, %v, want 1", n, err)
+	}
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidTwoFactorCode  = errors.New("invalid authentication code")
+	ErrTwoFactorEnabled      = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled   = errors.New("two-factor authentication is not enabled")
+	ErrNoTwoFactorEnrollment = errors.New("two-factor enrollment has not been started")
+	ErrTwoFactorRequired     = errors.New("two-factor authentication is required for this role")
+	ErrUnknownRole           = errors.New("unknown role")
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+// TwoFactorService manages TOTP two-factor authentication: enrolling
+// authenticator apps, checking their codes and the recovery codes that stand
+// in for them, and which roles have to use it
+type TwoFactorService interface {
+	Status(user types.User) (types.TwoFactorStatus, error)
+	// BeginEnrollment generates a secret for user to add to an authenticator
+	// app, replacing any that was never confirmed
+	BeginEnrollment(user types.User) (types.TotpEnrollment, error)
+	// ConfirmEnrollment turns two-factor authentication on once code shows
+	// the app was set up, returning the user's recovery codes
+	ConfirmEnrollment(user types.User, code string) ([]string, error)
+	// Verify checks a code from the user's authenticator app, or one of their
+	// recovery codes, which is then used up
+	Verify(user types.User, code string) error
+	// RegenerateRecoveryCodes replaces the user's recovery codes if code verifies
+	RegenerateRecoveryCodes(user types.User, code string) ([]string, error)
+	// Disable turns two-factor authentication off if code verifies and the
+	// user's role doesn't require it
+	Disable(user types.User, code string) error
+	// RequiredRoles lists the roles that can't log in without two-factor
+	// authentication
+	RequiredRoles() ([]types.Role, error)
+	SetRequiredRoles(roles []types.Role) error
+}
+
+type twoFactorService struct {
+	db  types.Database
+	now func() time.Time
+}
+
+func NewTwoFactorService() TwoFactorService {
+	ts := &twoFactorService{
+		db:  types.NewDatabase(),
+		now: time.Now,
+	}
+	err := ts.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return ts
+}
+
+func (ts *twoFactorService) Status(user types.User) (types.TwoFactorStatus, error) {
+	var status types.TwoFactorStatus
+	s, err := ts.db.GetTotpSecret(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return types.TwoFactorStatus{}, fmt.Errorf("error getting totp secret: %v", err)
+	}
+	status.Enabled = err == nil && s.Confirmed
+	if status.Enabled {
+		status.RecoveryCodesLeft, err = ts.db.CountRecoveryCodes(user.ID)
+		if err != nil {
+			return types.TwoFactorStatus{}, fmt.Errorf("error counting recovery codes: %v", err)
+		}
+	}
+	roles, err := ts.db.GetTwoFactorRoles()
+	if err != nil {
+		return types.TwoFactorStatus{}, fmt.Errorf("error getting two-factor roles: %v", err)
+	}
+	status.Required = slices.Contains(roles, user.Role)
+	return status, nil
+}
+
+func (ts *twoFactorService) BeginEnrollment(user types.User) (types.TotpEnrollment, error) {
+	secret, err := newTotpSecret()
+	if err != nil {
+		return types.TotpEnrollment{}, err
+	}
+	err = ts.db.SaveTotpSecret(types.TotpSecret{
+		CreatedAt: ts.now(),
+		UserID:    user.ID,
+		Secret:    secret,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.TotpEnrollment{}, ErrTwoFactorEnabled
+	}
+	if err != nil {
+		return types.TotpEnrollment{}, fmt.Errorf("error saving totp secret: %v", err)
+	}
+	return types.TotpEnrollment{
+		Secret: secret,
+		URI:    totpURI(secret, user.Username),
+	}, nil
+}
+
+func (ts *twoFactorService) ConfirmEnrollment(user types.User, code string) ([]string, error) {
+	s, err := ts.db.GetTotpSecret(user.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoTwoFactorEnrollment
+		}
+		return nil, fmt.Errorf("error getting totp secret: %v", err)
+	}
+	if s.Confirmed {
+		return nil, ErrTwoFactorEnabled
+	}
+	step, ok := matchTotp(s.Secret, normalizeTwoFactorCode(code), ts.now())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = ts.db.EnableTotp(user.ID, step, hashes)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Confirmed, or started over, since it was read
+		return nil, ErrTwoFactorEnabled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error enabling totp: %v", err)
+	}
+	return codes, nil
+}
+
+func (ts *twoFactorService) Verify(user types.User, code string) error {
+	s, err := ts.db.GetTotpSecret(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error getting totp secret: %v", err)
+	}
+	if err != nil || !s.Confirmed {
+		return ErrTwoFactorNotEnabled
+	}
+
+	code = normalizeTwoFactorCode(code)
+	if len(code) == totpDigits {
+		step, ok := matchTotp(s.Secret, code, ts.now())
+		if !ok || step <= s.LastStep {
+			return ErrInvalidTwoFactorCode
+		}
+		// Checked again in the update, so a code raced in twice only works once
+		err = ts.db.UseTotpStep(user.ID, step)
+	} else {
+		err = ts.db.UseRecoveryCode(user.ID, hashRecoveryCode(code))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidTwoFactorCode
+	}
+	if err != nil {
+		return fmt.Errorf("error using authentication code: %v", err)
+	}
+	return nil
+}
+
+func (ts *twoFactorService) RegenerateRecoveryCodes(user types.User, code string) ([]string, error) {
+	if err := ts.Verify(user, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := ts.db.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		return nil, fmt.Errorf("error saving recovery codes: %v", err)
+	}
+	return codes, nil
+}
+
+func (ts *twoFactorService) Disable(user types.User, code string) error {
+	status, err := ts.Status(user)
+	if err != nil {
+		return err
+	}
+	if status.Required {
+		return ErrTwoFactorRequired
+	}
+	if err := ts.Verify(user, code); err != nil {
+		return err
+	}
+	if err := ts.db.DeleteTotp(user.ID); err != nil {
+		return fmt.Errorf("error deleting totp secret: %v", err)
+	}
+	return nil
+}
+
+func (ts *twoFactorService) RequiredRoles() ([]types.Role, error) {
+	roles, err := ts.db.GetTwoFactorRoles()
+	if err != nil {
+		return nil, fmt.Errorf("error getting two-factor roles: %v", err)
+	}
+	return roles, nil
+}
+
+func (ts *twoFactorService) SetRequiredRoles(roles []types.Role) error {
+	for _, role := range roles {
+		if err := checkRoleExists(ts.db, role); err != nil {
+			return err
+		}
+	}
+	if err := ts.db.SetTwoFactorRoles(roles); err != nil {
+		return fmt.Errorf("error saving two-factor roles: %v", err)
+	}
+	return nil
+}
+
+// normalizeTwoFactorCode drops the spaces and dashes people type codes with
+func normalizeTwoFactorCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// newRecoveryCodes returns recovery codes formatted for the user along with
+// the hashes that are stored
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := utils.GenerateToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode needs no salt or stretching for the same reason API keys
+// don't, and logins are limited to a few guesses per password
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,298 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestTwoFactorService returns a service whose clock is stopped in the
+// middle of the current period, so codes can't roll over during a test
+func newTestTwoFactorService(db types.Database) *twoFactorService {
+	now := time.Unix(time.Now().Unix()/totpPeriod*totpPeriod+totpPeriod/2, 0)
+	return &twoFactorService{db: db, now: func() time.Time { return now }}
+}
+
+// totpNow returns the code an authenticator app would show for secret at the
+// service's time, offset by whole periods
+func totpNow(t *testing.T, ts *twoFactorService, secret string, periods int64) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, ts.now().Unix()/totpPeriod+periods)
+}
+
+// enrollTotp turns two-factor authentication on for user, returning the
+// secret and recovery codes
+func enrollTotp(t *testing.T, ts *twoFactorService, user types.User) (string, []string) {
+	t.Helper()
+	enrollment, err := ts.BeginEnrollment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := ts.ConfirmEnrollment(user, totpNow(t, ts, enrollment.Secret, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enrollment.Secret, codes
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	db := newTestDatabase(t)
+	ts := newTestTwoFactorService(db)
+	user := types.User{ID: "u1", Username: "alice", Role: types.Regular}
+
+	if _, err := ts.ConfirmEnrollment(user, "123456"); !errors.Is(err, ErrNoTwoFactorEnrollment) {
+		t.Fatalf("confirm before enrolling: got %v", err)
+	}
+	enrollment, err := ts.BeginEnrollment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.ConfirmEnrollment(user, totpNow(t, ts, enrollment.Secret, 2)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Fatalf("confirm with wrong code: got %v", err)
+	}
+	// Starting over replaces a secret that was never confirmed
+	enrollment, err = ts.BeginEnrollment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := ts.Status(user)
+	if status.Enabled {
+		t.Fatal("enabled before confirming")
+	}
+
+	codes, err := ts.ConfirmEnrollment(user, totpNow(t, ts, enrollment.Secret, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes", len(codes))
+	}
+	status, err = ts.Status(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Enabled || status.RecoveryCodesLeft != recoveryCodeCount {
+		t.Errorf("status after confirming: %+v", status)
+	}
+	if _, err := ts.BeginEnrollment(user); !errors.Is(err, ErrTwoFactorEnabled) {
+		t.Errorf("enrolling again: got %v", err)
+	}
+}
+
+func TestTwoFactorVerify(t *testing.T) {
+	db := newTestDatabase(t)
+	ts := newTestTwoFactorService(db)
+	user := types.User{ID: "u1", Username: "alice", Role: types.Regular}
+
+	if err := ts.Verify(user, "123456"); !errors.Is(err, ErrTwoFactorNotEnabled) {
+		t.Fatalf("verify without 2fa: got %v", err)
+	}
+	secret, codes := enrollTotp(t, ts, user)
+
+	// Confirming used up the current code
+	if err := ts.Verify(user, totpNow(t, ts, secret, 0)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("replayed code: got %v", err)
+	}
+	if err := ts.Verify(user, totpNow(t, ts, secret, 1)); err != nil {
+		t.Errorf("next code: %v", err)
+	}
+	if err := ts.Verify(user, totpNow(t, ts, secret, -1)); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("code older than the last one used: got %v", err)
+	}
+
+	// Recovery codes work once, typed however
+	if err := ts.Verify(user, " "+codes[0]+" "); err != nil {
+		t.Errorf("recovery code: %v", err)
+	}
+	if err := ts.Verify(user, codes[0]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("reused recovery code: got %v", err)
+	}
+	status, _ := ts.Status(user)
+	if status.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Errorf("got %d recovery codes left", status.RecoveryCodesLeft)
+	}
+
+	fresh, err := ts.RegenerateRecoveryCodes(user, codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Verify(user, codes[2]); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("replaced recovery code: got %v", err)
+	}
+	if err := ts.Verify(user, fresh[0]); err != nil {
+		t.Errorf("new recovery code: %v", err)
+	}
+}
+
+func TestTwoFactorPolicy(t *testing.T) {
+	db := newTestDatabase(t)
+	ts := newTestTwoFactorService(db)
+	admin := types.User{ID: "u1", Username: "root", Role: types.Admin}
+	_, codes := enrollTotp(t, ts, admin)
+
+	if err := ts.SetRequiredRoles([]types.Role{types.Admin, 42}); !errors.Is(err, ErrUnknownRole) {
+		t.Fatalf("unknown role: got %v", err)
+	}
+	if err := ts.SetRequiredRoles([]types.Role{types.Admin, types.Admin}); err != nil {
+		t.Fatal(err)
+	}
+	roles, err := ts.RequiredRoles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 1 || roles[0] != types.Admin {
+		t.Errorf("got roles %v", roles)
+	}
+
+	if err := ts.Disable(admin, codes[0]); !errors.Is(err, ErrTwoFactorRequired) {
+		t.Errorf("disable while required: got %v", err)
+	}
+	if err := ts.SetRequiredRoles(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Disable(admin, "nope"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("disable with wrong code: got %v", err)
+	}
+	if err := ts.Disable(admin, codes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := ts.Status(admin); status.Enabled || status.RecoveryCodesLeft != 0 {
+		t.Errorf("status after disabling: %+v", status)
+	}
+}
+
+func TestLoginWithSecondFactor(t *testing.T) {
+	db := newTestDatabase(t)
+	ts := newTestTwoFactorService(db)
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: ts, sessionTTL: time.Hour}
+	user := types.User{ID: "u1", Username: "alice", Password: "secret", Role: types.Regular, CreatedAt: time.Now()}
+	if err := db.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	secret, codes := enrollTotp(t, ts, user)
+
+	session, challenge, err := as.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Token.Token != "" || challenge.Token == "" || challenge.EnrollmentRequired {
+		t.Fatalf("expected a challenge, got %+v and %+v", session, challenge)
+	}
+	if _, err := as.Authenticate(challenge.Token); err == nil {
+		t.Error("challenge works as a session token")
+	}
+	if _, _, err := as.CompleteLogin(challenge.Token, "nope"); !errors.Is(err, ErrInvalidTwoFactorCode) {
+		t.Errorf("wrong code: got %v", err)
+	}
+	session, recoveryCodes, err := as.CompleteLogin(challenge.Token, totpNow(t, ts, secret, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recoveryCodes != nil {
+		t.Errorf("got recovery codes %v", recoveryCodes)
+	}
+	if got, err := as.Authenticate(session.Token.Token); err != nil || got.ID != "u1" {
+		t.Errorf("authenticate with the new session: %+v, %v", got, err)
+	}
+	if _, _, err := as.CompleteLogin(challenge.Token, codes[0]); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("challenge reused: got %v", err)
+	}
+
+	// A challenge only takes so many guesses
+	_, challenge, _ = as.Login("alice", "secret")
+	for i := 0; i < maxChallengeAttempts; i++ {
+		as.CompleteLogin(challenge.Token, "nope")
+	}
+	if _, _, err := as.CompleteLogin(challenge.Token, codes[0]); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("after %d wrong codes: got %v", maxChallengeAttempts, err)
+	}
+
+	// Expired challenges are refused
+	expired := types.LoginChallenge{Token: "expired", UserID: "u1", ExpiresAt: time.Now().Add(-time.Second)}
+	if err := db.InsertLoginChallenge(expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := as.CompleteLogin("expired", codes[0]); !errors.Is(err, ErrInvalidChallenge) {
+		t.Errorf("expired challenge: got %v", err)
+	}
+}
+
+func TestLoginEnrollmentRequired(t *testing.T) {
+	db := newTestDatabase(t)
+	ts := newTestTwoFactorService(db)
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: ts, sessionTTL: time.Hour}
+	if err := db.InsertUser(types.User{ID: "u1", Username: "root", Password: "secret", Role: types.Admin, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertUser(types.User{ID: "u2", Username: "alice", Password: "secret", Role: types.Regular, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.SetRequiredRoles([]types.Role{types.Admin}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Roles the policy doesn't cover log in as before
+	session, _, err := as.Login("alice", "secret")
+	if err != nil || session.Token.Token == "" {
+		t.Fatalf("regular login: %+v, %v", session, err)
+	}
+
+	_, challenge, err := as.Login("root", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.EnrollmentRequired {
+		t.Fatalf("expected enrollment to be required: %+v", challenge)
+	}
+	if _, _, err := as.CompleteLogin(challenge.Token, "123456"); !errors.Is(err, ErrNoTwoFactorEnrollment) {
+		t.Errorf("answering before enrolling: got %v", err)
+	}
+	enrollment, err := as.EnrollForLogin(challenge.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, recoveryCodes, err := as.CompleteLogin(challenge.Token, totpNow(t, ts, enrollment.Secret, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Token.Token == "" || len(recoveryCodes) != recoveryCodeCount {
+		t.Errorf("got session %+v and %d recovery codes", session, len(recoveryCodes))
+	}
+	if status, _ := ts.Status(types.User{ID: "u1", Role: types.Admin}); !status.Enabled {
+		t.Error("enrolling through the challenge didn't enable 2fa")
+	}
+}
+
+func TestLoginVerifiedAsksForSecondFactor(t *testing.T) {
+	db := newTestDatabase(t)
+	ts := newTestTwoFactorService(db)
+	as := &authService{db: db, sessions: &databaseSessionStore{db: db}, twoFactor: ts, sessionTTL: time.Hour}
+	user := types.User{ID: "u1", Username: "root", Role: types.Admin, CreatedAt: time.Now()}
+	if err := db.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	session, challenge, err := as.LoginVerified(user)
+	if err != nil || session.Token.Token == "" || challenge.Token != "" {
+		t.Fatalf("without 2fa: %+v, %+v, %v", session, challenge, err)
+	}
+
+	enrollTotp(t, ts, user)
+	session, challenge, err = as.LoginVerified(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Token.Token != "" || challenge.Token == "" {
+		t.Errorf("expected a challenge, got %+v and %+v", session, challenge)
+	}
+
+	user.Disabled = true
+	if _, _, err := as.LoginVerified(user); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("disabled user: got %v, want ErrAccountDisabled", err)
+	}
+}
@@ -0,0 +1,313 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUploadNotFound       = errors.New("upload not found")
+	ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+	ErrUploadTooLarge       = errors.New("upload exceeds declared length")
+)
+
+// UploadTTL is how long an upload may go without a chunk arriving before
+// PurgeAbandoned removes it
+const UploadTTL = 24 * time.Hour
+
+// UploadService stages resumable uploads chunk by chunk and hands the
+// finished file to the FileService once every byte has arrived
+type UploadService interface {
+	CreateUpload(ownerID string, length int64, metadata string) (types.Upload, error)
+	GetUpload(id string) (types.Upload, error)
+	// AppendChunk writes r at offset and returns the updated upload. Once the
+	// upload is complete the stored file is returned as well.
+	AppendChunk(id string, offset int64, r io.Reader) (types.Upload, *types.File, error)
+	TerminateUpload(id string) error
+	// PurgeAbandoned removes the uploads no chunk has arrived for since t,
+	// along with their staged chunks, returning how many it removed
+	PurgeAbandoned(t time.Time) (int, error)
+}
+
+type uploadService struct {
+	db          types.Database
+	fileService FileService
+	stagingDir  string
+	locks       sync.Map // upload ID -> *sync.Mutex
+}
+
+// NewUploadService stages chunks under ~/StoreMeDaddy/.uploads
+func NewUploadService(fileService FileService) UploadService {
+	return NewUploadServiceWithStagingDir(fileService, filepath.Join(DefaultStoreRoot(), ".uploads"))
+}
+
+// NewUploadServiceWithStagingDir stages chunks in stagingDir, which must be
+// local disk whatever BlobStore the finished files go to
+func NewUploadServiceWithStagingDir(fileService FileService, stagingDir string) UploadService {
+	us := &uploadService{
+		db:          types.NewDatabase(),
+		fileService: fileService,
+		stagingDir:  stagingDir,
+	}
+	err := us.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return us
+}
+
+func (us *uploadService) CreateUpload(ownerID string, length int64, metadata string) (types.Upload, error) {
+	if _, err := ParseUploadMetadata(metadata); err != nil {
+		return types.Upload{}, err
+	}
+	// Finished uploads land in the owner's root
+	if err := us.db.CheckQuota(ownerID, "", length); err != nil {
+		if errors.Is(err, types.ErrQuotaExceeded) {
+			return types.Upload{}, ErrQuotaExceeded
+		}
+		return types.Upload{}, fmt.Errorf("error checking quota: %v", err)
+	}
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.Upload{}, err
+	}
+	if err := os.MkdirAll(us.stagingDir, os.ModePerm); err != nil {
+		return types.Upload{}, err
+	}
+	staged, err := os.Create(us.stagingPath(id))
+	if err != nil {
+		return types.Upload{}, err
+	}
+	staged.Close()
+
+	now := time.Now()
+	upload := types.Upload{
+		ID:        id,
+		OwnerID:   ownerID,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := us.db.InsertUpload(upload); err != nil {
+		os.Remove(us.stagingPath(id))
+		return types.Upload{}, fmt.Errorf("error saving upload: %v", err)
+	}
+	return upload, nil
+}
+
+func (us *uploadService) GetUpload(id string) (types.Upload, error) {
+	upload, err := us.db.GetUpload(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.Upload{}, ErrUploadNotFound
+		}
+		return types.Upload{}, fmt.Errorf("error getting upload: %v", err)
+	}
+	return upload, nil
+}
+
+func (us *uploadService) AppendChunk(id string, offset int64, r io.Reader) (types.Upload, *types.File, error) {
+	unlock := us.lock(id)
+	defer unlock()
+
+	upload, err := us.GetUpload(id)
+	if err != nil {
+		return types.Upload{}, nil, err
+	}
+	if offset != upload.Offset {
+		return upload, nil, ErrUploadOffsetMismatch
+	}
+
+	staged, err := os.OpenFile(us.stagingPath(id), os.O_RDWR, 0)
+	if err != nil {
+		return upload, nil, err
+	}
+	defer staged.Close()
+	// Drop anything past the recorded offset left behind by a write that
+	// failed before the offset was saved
+	if err := staged.Truncate(upload.Offset); err != nil {
+		return upload, nil, err
+	}
+	if _, err := staged.Seek(upload.Offset, io.SeekStart); err != nil {
+		return upload, nil, err
+	}
+
+	remaining := upload.Length - upload.Offset
+	n, copyErr := io.Copy(staged, io.LimitReader(r, remaining))
+	if copyErr == nil && n == remaining {
+		// More bytes than Upload-Length declared. The offset isn't saved, so
+		// the chunk is dropped and the upload can carry on from before it.
+		var probe [1]byte
+		if extra, _ := r.Read(probe[:]); extra > 0 {
+			return upload, nil, ErrUploadTooLarge
+		}
+	}
+	// Keep whatever arrived before a dropped connection so the client can resume
+	if n > 0 {
+		if err := staged.Sync(); err != nil {
+			return upload, nil, err
+		}
+		upload.Offset += n
+		upload.UpdatedAt = time.Now()
+		if err := us.db.UpdateUploadOffset(id, upload.Offset, upload.UpdatedAt); err != nil {
+			return upload, nil, fmt.Errorf("error saving upload offset: %v", err)
+		}
+	}
+	if copyErr != nil {
+		return upload, nil, copyErr
+	}
+	if upload.Offset < upload.Length {
+		return upload, nil, nil
+	}
+
+	file, err := us.finalize(upload, staged)
+	if err != nil {
+		return upload, nil, err
+	}
+	return upload, &file, nil
+}
+
+// finalize moves a complete upload into the store through the normal upload path
+func (us *uploadService) finalize(upload types.Upload, staged *os.File) (types.File, error) {
+	metadata, err := ParseUploadMetadata(upload.Metadata)
+	if err != nil {
+		return types.File{}, err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return types.File{}, err
+	}
+	name := metadata["filename"]
+	if name == "" {
+		name = upload.ID
+	}
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.File{}, err
+	}
+	f := types.File{
+		ID:          id,
+		Name:        filepath.Base(name),
+		Size:        upload.Length,
+		ContentType: metadata["filetype"],
+		OwnerID:     upload.OwnerID,
+		UploadDate:  time.Now(),
+	}
+	f, err = us.fileService.StoreStream(staged, upload.Length, f)
+	if err != nil {
+		return types.File{}, err
+	}
+	us.cleanup(upload.ID)
+	return f, nil
+}
+
+func (us *uploadService) TerminateUpload(id string) error {
+	unlock := us.lock(id)
+	defer unlock()
+
+	if _, err := us.GetUpload(id); err != nil {
+		return err
+	}
+	return us.cleanup(id)
+}
+
+func (us *uploadService) PurgeAbandoned(t time.Time) (int, error) {
+	const batchSize = 100
+	purged := 0
+	for {
+		uploads, err := us.db.ListUploadsIdleSince(t, batchSize)
+		if err != nil {
+			return purged, fmt.Errorf("error listing uploads: %v", err)
+		}
+		for _, upload := range uploads {
+			removed, err := us.purgeIfIdle(upload.ID, t)
+			if err != nil {
+				return purged, err
+			}
+			if removed {
+				purged++
+			}
+		}
+		if len(uploads) < batchSize {
+			return purged, nil
+		}
+	}
+}
+
+// purgeIfIdle removes the upload unless a chunk arrived for it since t, which
+// is checked again under its lock in case one was being written
+func (us *uploadService) purgeIfIdle(id string, t time.Time) (bool, error) {
+	unlock := us.lock(id)
+	defer unlock()
+
+	upload, err := us.GetUpload(id)
+	if errors.Is(err, ErrUploadNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !upload.UpdatedAt.Before(t) {
+		return false, nil
+	}
+	return true, us.cleanup(id)
+}
+
+// cleanup removes a finished or abandoned upload. The caller holds its lock.
+func (us *uploadService) cleanup(id string) error {
+	if err := us.db.DeleteUpload(id); err != nil {
+		return fmt.Errorf("error deleting upload: %v", err)
+	}
+	// Anyone still waiting on the lock finds the upload gone
+	us.locks.Delete(id)
+	if err := os.Remove(us.stagingPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (us *uploadService) stagingPath(id string) string {
+	return filepath.Join(us.stagingDir, filepath.Base(id))
+}
+
+// lock serializes chunks for one upload so concurrent PATCHes can't interleave
+func (us *uploadService) lock(id string) func() {
+	mu, _ := us.locks.LoadOrStore(id, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// ParseUploadMetadata decodes a tus Upload-Metadata header, a comma separated
+// list of keys each followed by an optional space and base64 encoded value
+func ParseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid upload metadata")
+		}
+		if _, exists := metadata[key]; exists {
+			return nil, fmt.Errorf("duplicate upload metadata key %q", key)
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestUploadService(t *testing.T) *uploadService {
+	t.Helper()
+	db := newTestDatabase(t)
+	return &uploadService{
+		db:          db,
+		fileService: newTestFileService(t, db),
+		stagingDir:  filepath.Join(t.TempDir(), ".uploads"),
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	us := newTestUploadService(t)
+	data := "hello resumable world"
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("greeting.txt")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+
+	upload, err := us.CreateUpload("u1", int64(len(data)), metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, file, err := us.AppendChunk(upload.ID, 0, strings.NewReader(data[:5]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Offset != 5 || file != nil {
+		t.Fatalf("AppendChunk() = %+v, %v, want offset 5 and no file", upload, file)
+	}
+
+	if _, _, err := us.AppendChunk(upload.ID, 3, strings.NewReader(data[3:])); !errors.Is(err, ErrUploadOffsetMismatch) {
+		t.Fatalf("AppendChunk() with stale offset error = %v, want %v", err, ErrUploadOffsetMismatch)
+	}
+
+	upload, file, err = us.AppendChunk(upload.ID, 5, strings.NewReader(data[5:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == nil {
+		t.Fatalf("AppendChunk() did not finalize complete upload")
+	}
+	if file.Name != "greeting.txt" || file.ContentType != "text/plain" || file.OwnerID != "u1" || file.Hash != testHash(data) {
+		t.Errorf("finalized file = %+v", file)
+	}
+
+	stored, err := us.db.GetFileByID(file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := readBlob(us.fileService.(*fileService).store, stored.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != data {
+		t.Errorf("stored contents = %q, want %q", contents, data)
+	}
+	if _, err := us.GetUpload(upload.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("GetUpload() after finalize error = %v, want %v", err, ErrUploadNotFound)
+	}
+	if _, err := os.Stat(us.stagingPath(upload.ID)); !os.IsNotExist(err) {
+		t.Errorf("staged chunks not removed after finalize: %v", err)
+	}
+}
+
+func TestAppendChunkTooLarge(t *testing.T) {
+	us := newTestUploadService(t)
+	upload, err := us.CreateUpload("u1", 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := us.AppendChunk(upload.ID, 0, bytes.NewReader([]byte("too many bytes"))); !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("AppendChunk() error = %v, want %v", err, ErrUploadTooLarge)
+	}
+	// The oversized chunk is dropped rather than leaving the upload full but
+	// never finished
+	if upload, err := us.GetUpload(upload.ID); err != nil || upload.Offset != 0 {
+		t.Fatalf("GetUpload() = %+v, %v, want offset 0", upload, err)
+	}
+	if _, file, err := us.AppendChunk(upload.ID, 0, strings.NewReader("abcd")); err != nil || file == nil {
+		t.Errorf("AppendChunk() after an oversized chunk = %v, %v, want the stored file", file, err)
+	}
+}
+
+func TestPurgeAbandonedUploads(t *testing.T) {
+	us := newTestUploadService(t)
+	idle, err := us.CreateUpload("u1", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := us.CreateUpload("u1", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cutoff := time.Now()
+	if _, _, err := us.AppendChunk(active.ID, 0, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := us.PurgeAbandoned(cutoff)
+	if err != nil || n != 1 {
+		t.Fatalf("PurgeAbandoned() = %d, %v, want 1", n, err)
+	}
+	if _, err := us.GetUpload(idle.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("GetUpload() of an abandoned upload error = %v, want %v", err, ErrUploadNotFound)
+	}
+	if _, err := os.Stat(us.stagingPath(idle.ID)); !os.IsNotExist(err) {
+		t.Errorf("staged chunks of an abandoned upload not removed: %v", err)
+	}
+	if _, err := us.GetUpload(active.ID); err != nil {
+		t.Errorf("GetUpload() of an active upload error = %v", err)
+	}
+	if _, ok := us.locks.Load(idle.ID); ok {
+		t.Error("lock of a purged upload is still held in the map")
+	}
+}
+
+func TestTerminateUpload(t *testing.T) {
+	us := newTestUploadService(t)
+	upload, err := us.CreateUpload("u1", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := us.AppendChunk(upload.ID, 0, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.TerminateUpload(upload.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(us.stagingPath(upload.ID)); !os.IsNotExist(err) {
+		t.Errorf("staged chunks not removed after terminate: %v", err)
+	}
+	if err := us.TerminateUpload(upload.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("TerminateUpload() twice error = %v, want %v", err, ErrUploadNotFound)
+	}
+}
+
+func TestParseUploadMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "Empty", header: "", want: map[string]string{}},
+		{name: "Pairs", header: "filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential", want: map[string]string{"filename": "world_domination_plan.pdf", "is_confidential": ""}},
+		{name: "BadBase64", header: "filename !!!", wantErr: true},
+		{name: "DuplicateKey", header: "a YQ==,a Yg==", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUploadMetadata(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUploadMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseUploadMetadata() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("ParseUploadMetadata()[%q] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package services
+
+import (
+	"Smd/types"
+	"Smd/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidUser     = errors.New("a user needs a username and a password")
+	ErrUsernameTaken   = errors.New("username is already taken")
+	ErrLastAdmin       = errors.New("the last enabled admin can't be demoted, disabled or deleted")
+	ErrDeleteSelf      = errors.New("you can't delete your own account")
+	ErrInvalidTransfer = errors.New("files go to the trash or are transferred to another existing user")
+)
+
+// What happens to the files of a deleted user
+const (
+	// DeletedFilesTrash moves them to the trash of the admin deleting the
+	// user, from where they can be restored until the trash is purged
+	DeletedFilesTrash = "trash"
+	// DeletedFilesTransfer gives them to another user
+	DeletedFilesTransfer = "transfer"
+)
+
+// UserService lets admins manage accounts
+type UserService interface {
+	// ListUsers pages through users whose username or email contains search,
+	// ordered by username
+	ListUsers(search string, limit, offset int) (types.UserListing, error)
+	GetUser(id string) (types.User, error)
+	CreateUser(username, password, email string, role types.Role) (types.User, error)
+	// UpdateUser renames a user and changes their email and role
+	UpdateUser(id, username, email string, role types.Role) (types.User, error)
+	// ResetPassword sets a new password and ends the user's sessions
+	ResetPassword(id, password string) error
+	// SetDisabled disables or re-enables a user. Disabling ends their
+	// sessions; their API keys stop working until they are enabled again.
+	SetDisabled(id string, disabled bool) (types.User, error)
+	// DeleteUser deletes a user along with their sessions, API keys and
+	// access grants. Everything they owned goes to the trash of admin, or with
+	// DeletedFilesTransfer to transferTo, with the files and directories that
+	// were at their root gathered in a directory named after them. Files they
+	// kept in other users' directories stay where they are.
+	DeleteUser(admin types.User, id, files, transferTo string) error
+}
+
+type userService struct {
+	db       types.Database
+	sessions SessionStore
+	trash    TrashService
+	now      func() time.Time
+}
+
+func NewUserService(sessions SessionStore, trash TrashService) UserService {
+	us := &userService{
+		db:       types.NewDatabase(),
+		sessions: sessions,
+		trash:    trash,
+		now:      time.Now,
+	}
+	err := us.db.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	return us
+}
+
+func (us *userService) ListUsers(search string, limit, offset int) (types.UserListing, error) {
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	total, err := us.db.CountUsers(search)
+	if err != nil {
+		return types.UserListing{}, fmt.Errorf("error counting users: %v", err)
+	}
+	users, err := us.db.ListUsers(search, limit, offset)
+	if err != nil {
+		return types.UserListing{}, fmt.Errorf("error listing users: %v", err)
+	}
+	if users == nil {
+		users = []types.User{}
+	}
+	return types.UserListing{
+		Users:  users,
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	}, nil
+}
+
+func (us *userService) GetUser(id string) (types.User, error) {
+	user, err := us.db.GetUserByID(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrUserNotFound
+		}
+		return types.User{}, fmt.Errorf("error getting user: %v", err)
+	}
+	return user, nil
+}
+
+func (us *userService) CreateUser(username, password, email string, role types.Role) (types.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || password == "" {
+		return types.User{}, ErrInvalidUser
+	}
+	if err := checkRoleExists(us.db, role); err != nil {
+		return types.User{}, err
+	}
+	if err := us.checkUsernameFree(username, ""); err != nil {
+		return types.User{}, err
+	}
+
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.User{}, err
+	}
+	hash, err := types.HashPassword(password)
+	if err != nil {
+		return types.User{}, fmt.Errorf("error hashing password: %v", err)
+	}
+	user := types.User{
+		CreatedAt: us.now(),
+		ID:        id,
+		Username:  username,
+		Password:  hash,
+		Email:     email,
+		Role:      role,
+	}
+	if err := us.db.InsertUser(user); err != nil {
+		return types.User{}, fmt.Errorf("error creating user: %v", err)
+	}
+	return us.GetUser(id)
+}
+
+func (us *userService) UpdateUser(id, username, email string, role types.Role) (types.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return types.User{}, ErrInvalidUser
+	}
+	if err := checkRoleExists(us.db, role); err != nil {
+		return types.User{}, err
+	}
+	user, err := us.GetUser(id)
+	if err != nil {
+		return types.User{}, err
+	}
+	if username != user.Username {
+		if err := us.checkUsernameFree(username, id); err != nil {
+			return types.User{}, err
+		}
+	}
+	if user.Role == types.Admin && role != types.Admin && !user.Disabled {
+		if err := us.checkNotLastAdmin(); err != nil {
+			return types.User{}, err
+		}
+	}
+
+	user.Username = username
+	user.Email = email
+	user.Role = role
+	if err := us.db.UpdateUser(user); err != nil {
+		return types.User{}, fmt.Errorf("error updating user: %v", err)
+	}
+	return user, nil
+}
+
+func (us *userService) ResetPassword(id, password string) error {
+	if password == "" {
+		return ErrInvalidUser
+	}
+	if _, err := us.GetUser(id); err != nil {
+		return err
+	}
+	hash, err := types.HashPassword(password)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %v", err)
+	}
+	if err := us.db.UpdateUserPassword(id, hash); err != nil {
+		return fmt.Errorf("error updating password: %v", err)
+	}
+	// Whoever knew the old password may be logged in with it
+	if _, err := us.sessions.DeleteByUser(id); err != nil {
+		return fmt.Errorf("error ending sessions: %v", err)
+	}
+	return nil
+}
+
+func (us *userService) SetDisabled(id string, disabled bool) (types.User, error) {
+	user, err := us.GetUser(id)
+	if err != nil {
+		return types.User{}, err
+	}
+	if disabled && !user.Disabled && user.Role == types.Admin {
+		if err := us.checkNotLastAdmin(); err != nil {
+			return types.User{}, err
+		}
+	}
+	if err := us.db.SetUserDisabled(id, disabled); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return types.User{}, ErrUserNotFound
+		}
+		return types.User{}, fmt.Errorf("error updating user: %v", err)
+	}
+	user.Disabled = disabled
+	if disabled {
+		if _, err := us.sessions.DeleteByUser(id); err != nil {
+			return types.User{}, fmt.Errorf("error ending sessions: %v", err)
+		}
+	}
+	return user, nil
+}
+
+func (us *userService) DeleteUser(admin types.User, id, files, transferTo string) error {
+	if id == admin.ID {
+		return ErrDeleteSelf
+	}
+	var heirID string
+	switch files {
+	case DeletedFilesTrash:
+		heirID = admin.ID
+	case DeletedFilesTransfer:
+		if transferTo == "" || transferTo == id {
+			return ErrInvalidTransfer
+		}
+		heir, err := us.GetUser(transferTo)
+		if errors.Is(err, ErrUserNotFound) {
+			return ErrInvalidTransfer
+		}
+		if err != nil {
+			return err
+		}
+		heirID = heir.ID
+	default:
+		return ErrInvalidTransfer
+	}
+	user, err := us.GetUser(id)
+	if err != nil {
+		return err
+	}
+	if user.Role == types.Admin && !user.Disabled {
+		if err := us.checkNotLastAdmin(); err != nil {
+			return err
+		}
+	}
+
+	dir, err := us.transferDirectory(heirID, user)
+	if err != nil {
+		return err
+	}
+	owned, err := us.db.DeleteUserAndTransfer(id, heirID, dir)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+	// Sessions kept outside the database aren't deleted with the user
+	if _, err := us.sessions.DeleteByUser(id); err != nil {
+		fmt.Printf("error ending sessions of deleted user %s: %v\n", id, err)
+	}
+	if owned && files == DeletedFilesTrash {
+		if _, err := us.trash.TrashDirectory(admin, dir.ID); err != nil {
+			return fmt.Errorf("error moving files of deleted user to the trash: %v", err)
+		}
+	}
+	return nil
+}
+
+// transferDirectory returns the directory a deleted user's files are
+// gathered in at the root of heirID, named after them and numbered if the
+// heir already has one by that name
+func (us *userService) transferDirectory(heirID string, user types.User) (types.Directory, error) {
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		return types.Directory{}, err
+	}
+	base := user.Username
+	if validateName(base) != nil {
+		base = "user " + user.ID
+	}
+	name := base
+	for n := 2; ; n++ {
+		_, err := us.db.GetSubdirectoryByName(heirID, "", name)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return types.Directory{}, fmt.Errorf("error checking directory name: %v", err)
+		}
+		name = fmt.Sprintf("%s (%d)", base, n)
+	}
+	return types.Directory{ID: id, Name: name, OwnerID: heirID}, nil
+}
+
+// checkUsernameFree returns ErrUsernameTaken if anyone but exceptID has
+// username
+func (us *userService) checkUsernameFree(username, exceptID string) error {
+	existing, err := us.db.GetUser(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up user: %v", err)
+	}
+	if existing.ID != exceptID {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// checkNotLastAdmin returns ErrLastAdmin unless there is another enabled
+// admin to take over from one being demoted, disabled or deleted
+func (us *userService) checkNotLastAdmin() error {
+	admins, err := us.db.CountEnabledUsersWithRole(types.Admin)
+	if err != nil {
+		return fmt.Errorf("error counting admins: %v", err)
+	}
+	if admins <= 1 {
+		return ErrLastAdmin
+	}
+	return nil
+}
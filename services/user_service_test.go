@@ -0,0 +1,328 @@
+package services
+
+import (
+	"Smd/types"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestUserService(t *testing.T) (*userService, *directoryService) {
+	t.Helper()
+	ts, ds := newTestTrashService(t)
+	return &userService{db: ds.db, sessions: NewMemorySessionStore(), trash: ts, now: time.Now}, ds
+}
+
+func TestCreateAndListUsers(t *testing.T) {
+	us, _ := newTestUserService(t)
+	for _, name := range []string{"carol", "alice", "al_ex", "bob"} {
+		if _, err := us.CreateUser(name, "secret", name+"@example.com", types.Regular); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		role     types.Role
+		wantErr  error
+	}{
+		{"Taken", "alice", "secret", types.Regular, ErrUsernameTaken},
+		{"TakenWithSpace", " alice ", "secret", types.Regular, ErrUsernameTaken},
+		{"NoUsername", " ", "secret", types.Regular, ErrInvalidUser},
+		{"NoPassword", "dave", "", types.Regular, ErrInvalidUser},
+		{"UnknownRole", "dave", "secret", types.Role(42), ErrUnknownRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := us.CreateUser(tt.username, tt.password, "", tt.role); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CreateUser() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	listing, err := us.ListUsers("", 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing.Total != 4 || len(listing.Users) != 2 || listing.Users[0].Username != "alice" || listing.Users[1].Username != "bob" {
+		t.Errorf("ListUsers() = %+v", listing)
+	}
+	if listing.Users[0].Password == "secret" {
+		t.Error("CreateUser() stored the password in plain text")
+	}
+
+	// Wildcards in the search term are matched literally
+	for search, want := range map[string]int{"AL": 2, "_": 1, "%": 0, "example.com": 4} {
+		listing, err := us.ListUsers(search, 10, 0)
+		if err != nil || listing.Total != want || len(listing.Users) != want {
+			t.Errorf("ListUsers(%q) = %+v, %v, want %d users", search, listing, err, want)
+		}
+	}
+	if listing, err := us.ListUsers("nobody", 10, 0); err != nil || listing.Users == nil {
+		t.Errorf("ListUsers() with no matches = %#v, %v, want an empty list", listing, err)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	us, _ := newTestUserService(t)
+	root, err := us.CreateUser("root", "secret", "", types.Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := us.CreateUser("alice", "secret", "", types.Regular)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := us.UpdateUser(alice.ID, "root", "", types.Regular); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("renaming to a taken username error = %v, want ErrUsernameTaken", err)
+	}
+	if _, err := us.UpdateUser(root.ID, "root", "", types.Owner); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("demoting the last admin error = %v, want ErrLastAdmin", err)
+	}
+	if _, err := us.UpdateUser("missing", "x", "", types.Regular); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("UpdateUser() of a missing user error = %v, want ErrUserNotFound", err)
+	}
+
+	updated, err := us.UpdateUser(alice.ID, "alicia", "alicia@example.com", types.Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := us.GetUser(alice.ID)
+	if err != nil || got.Username != "alicia" || got.Email != "alicia@example.com" || got.Role != types.Admin || got != updated {
+		t.Errorf("GetUser() after update = %+v, %v", got, err)
+	}
+	// With a second admin the first can step down
+	if _, err := us.UpdateUser(root.ID, "root", "", types.Owner); err != nil {
+		t.Errorf("demoting one of two admins error = %v", err)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	us, _ := newTestUserService(t)
+	as := &authService{db: us.db, sessions: us.sessions, twoFactor: &twoFactorService{db: us.db, now: time.Now}, sessionTTL: time.Hour}
+	ks := &apiKeyService{db: us.db}
+	root, err := us.CreateUser("root", "secret", "", types.Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := us.CreateUser("alice", "secret", "", types.Regular)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := as.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ks.CreateKey(types.ApiKey{UserID: alice.ID, Name: "ci", Scope: types.Privileges{Read: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := us.SetDisabled(root.ID, true); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("disabling the last admin error = %v, want ErrLastAdmin", err)
+	}
+	disabled, err := us.SetDisabled(alice.ID, true)
+	if err != nil || !disabled.Disabled {
+		t.Fatalf("SetDisabled() = %+v, %v", disabled, err)
+	}
+	if _, err := as.Authenticate(session.Token.Token); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("Authenticate() after disabling error = %v, want ErrInvalidSession", err)
+	}
+	if _, _, err := as.Login("alice", "secret"); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("Login() while disabled error = %v, want ErrAccountDisabled", err)
+	}
+	if _, _, err := as.Login("alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Login() with a wrong password while disabled error = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := ks.Authenticate(key); !errors.Is(err, ErrInvalidApiKey) {
+		t.Errorf("api key of a disabled user error = %v, want ErrInvalidApiKey", err)
+	}
+
+	if _, err := us.SetDisabled(alice.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := as.Login("alice", "secret"); err != nil {
+		t.Errorf("Login() after enabling error = %v", err)
+	}
+	if _, err := ks.Authenticate(key); err != nil {
+		t.Errorf("api key after enabling error = %v", err)
+	}
+	if _, err := us.SetDisabled("missing", true); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("SetDisabled() of a missing user error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	us, _ := newTestUserService(t)
+	as := &authService{db: us.db, sessions: us.sessions, twoFactor: &twoFactorService{db: us.db, now: time.Now}, sessionTTL: time.Hour}
+	alice, err := us.CreateUser("alice", "secret", "", types.Regular)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := as.Login("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := us.ResetPassword(alice.ID, ""); !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("ResetPassword() to nothing error = %v, want ErrInvalidUser", err)
+	}
+	if err := us.ResetPassword(alice.ID, "new secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.Authenticate(session.Token.Token); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("Authenticate() after reset error = %v, want ErrInvalidSession", err)
+	}
+	if _, _, err := as.Login("alice", "secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Login() with the old password error = %v, want ErrInvalidCredentials", err)
+	}
+	if _, _, err := as.Login("alice", "new secret"); err != nil {
+		t.Errorf("Login() with the new password error = %v", err)
+	}
+}
+
+func TestDeleteUserTransfer(t *testing.T) {
+	us, ds := newTestUserService(t)
+	fs := ds.fileService.(*fileService)
+	root, _ := us.CreateUser("root", "secret", "", types.Admin)
+	alice, _ := us.CreateUser("alice", "secret", "", types.Regular)
+	bob, _ := us.CreateUser("bob", "secret", "", types.Regular)
+
+	docs, err := ds.CreateDirectory(alice.ID, "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := fs.StoreStream(strings.NewReader("nested"), 100, types.File{Name: "a.txt", OwnerID: alice.ID, DirectoryID: docs.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := fs.StoreStream(strings.NewReader("top"), 100, types.File{Name: "b.txt", OwnerID: alice.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := fs.StoreStream(strings.NewReader("old"), 100, types.File{Name: "c.txt", OwnerID: alice.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := us.trash.TrashFile(alice, trashed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files kept in someone else's directory stay there
+	shared, err := ds.CreateDirectory(bob.ID, "shared", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contributed, err := fs.StoreStream(strings.NewReader("contributed"), 100, types.File{Name: "d.txt", OwnerID: alice.ID, DirectoryID: shared.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := us.db.InsertAclEntry(types.AclEntry{ID: "acl1", UserID: alice.ID, DirectoryID: shared.ID, Privileges: types.Privileges{Read: true}}); err != nil {
+		t.Fatal(err)
+	}
+	// bob already has a directory with alice's name
+	if _, err := ds.CreateDirectory(bob.ID, "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name, files, to string
+		wantErr         error
+	}{
+		{"NoPolicy", "", "", ErrInvalidTransfer},
+		{"UnknownPolicy", "shred", "", ErrInvalidTransfer},
+		{"NoRecipient", DeletedFilesTransfer, "", ErrInvalidTransfer},
+		{"MissingRecipient", DeletedFilesTransfer, "missing", ErrInvalidTransfer},
+		{"ToThemselves", DeletedFilesTransfer, alice.ID, ErrInvalidTransfer},
+	} {
+		if err := us.DeleteUser(root, alice.ID, tt.files, tt.to); !errors.Is(err, tt.wantErr) {
+			t.Errorf("DeleteUser() %s error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if err := us.DeleteUser(root, alice.ID, DeletedFilesTransfer, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.GetUser(alice.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("GetUser() after delete error = %v, want ErrUserNotFound", err)
+	}
+	if err := us.DeleteUser(root, alice.ID, DeletedFilesTransfer, bob.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("deleting twice error = %v, want ErrUserNotFound", err)
+	}
+
+	inherited, err := us.db.GetSubdirectoryByName(bob.ID, "", "alice (2)")
+	if err != nil {
+		t.Fatalf("inherited directory not found: %v", err)
+	}
+	for _, want := range []struct {
+		id, dir string
+	}{{nested.ID, docs.ID}, {top.ID, inherited.ID}, {contributed.ID, shared.ID}} {
+		f, err := us.db.GetFileByID(want.id)
+		if err != nil || f.OwnerID != bob.ID || f.DirectoryID != want.dir {
+			t.Errorf("GetFileByID(%s) = %+v, %v, want owned by bob in %s", want.id, f, err, want.dir)
+		}
+	}
+	if dir, err := us.db.GetDirectoryByID(docs.ID); err != nil || dir.OwnerID != bob.ID || dir.ParentDirectoryID != inherited.ID {
+		t.Errorf("GetDirectoryByID(docs) = %+v, %v", dir, err)
+	}
+	if got, err := us.db.GetTrashItem(item.ID); err != nil || got.OwnerID != bob.ID || got.ParentID != inherited.ID {
+		t.Errorf("GetTrashItem() = %+v, %v", got, err)
+	}
+	if q, err := us.db.GetQuota(types.QuotaUser, bob.ID); err != nil || q.UsedBytes != int64(len("nestedtopoldcontributed")) {
+		t.Errorf("GetQuota(bob) = %+v, %v", q, err)
+	}
+	if entries, err := us.db.GetAclEntriesForDirectory(shared.ID); err != nil || len(entries) != 0 {
+		t.Errorf("acl entries of deleted user = %+v, %v", entries, err)
+	}
+}
+
+func TestDeleteUserTrash(t *testing.T) {
+	us, ds := newTestUserService(t)
+	fs := ds.fileService.(*fileService)
+	root, _ := us.CreateUser("root", "secret", "", types.Admin)
+	alice, _ := us.CreateUser("alice", "secret", "", types.Regular)
+	bob, _ := us.CreateUser("bob", "secret", "", types.Regular)
+	f, err := fs.StoreStream(strings.NewReader("notes"), 100, types.File{Name: "a.txt", OwnerID: alice.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := (&authService{db: us.db, sessions: us.sessions, sessionTTL: time.Hour}).startSession(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := us.DeleteUser(root, root.ID, DeletedFilesTrash, ""); !errors.Is(err, ErrDeleteSelf) {
+		t.Errorf("deleting yourself error = %v, want ErrDeleteSelf", err)
+	}
+	if err := us.DeleteUser(root, alice.ID, DeletedFilesTrash, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.sessions.Get(session.Token.Token); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("session of deleted user error = %v, want ErrInvalidSession", err)
+	}
+	if _, err := fs.GetFileByID(f.ID); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("GetFileByID() of a deleted user's file error = %v, want ErrFileNotFound", err)
+	}
+	items, err := us.trash.ListTrash(root)
+	if err != nil || len(items) != 1 || items[0].Name != "alice" || items[0].ItemType != types.TrashDirectory || items[0].OwnerID != root.ID {
+		t.Fatalf("ListTrash(root) = %+v, %v", items, err)
+	}
+	if _, err := us.trash.Restore(root, items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.GetFileByID(f.ID); err != nil || got.OwnerID != root.ID || got.DirectoryID != items[0].ItemID {
+		t.Errorf("GetFileByID() after restore = %+v, %v", got, err)
+	}
+
+	// Users without files leave nothing behind
+	if err := us.DeleteUser(root, bob.ID, DeletedFilesTrash, ""); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := us.trash.ListTrash(root); err != nil || len(items) != 0 {
+		t.Errorf("ListTrash(root) after deleting bob = %+v, %v", items, err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"Smd/services"
+	"Smd/types"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newBlobStore builds the BlobStore named by STORAGE_DRIVER. "local", the
+// default, keeps blobs under root; "s3" talks to S3_ENDPOINT/S3_BUCKET.
+func newBlobStore(root string) (services.BlobStore, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		return services.NewLocalBlobStore(root), nil
+	case "s3":
+		return services.NewS3BlobStore(services.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+// newKeyring loads the master keys that wrap blob data keys from the file
+// named by MASTER_KEY_FILE, or else from MASTER_KEY. Each holds base64 32 byte
+// keys, one per line or comma separated, with the active key last. With
+// neither set it fails, unless ALLOW_UNENCRYPTED_BLOBS=true opts into storing
+// blobs unencrypted, in which case the keyring is nil.
+func newKeyring() (*services.Keyring, error) {
+	text := os.Getenv("MASTER_KEY")
+	if path := os.Getenv("MASTER_KEY_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading MASTER_KEY_FILE: %v", err)
+		}
+		text = string(content)
+	}
+	if text == "" {
+		if os.Getenv("ALLOW_UNENCRYPTED_BLOBS") != "true" {
+			return nil, fmt.Errorf("set MASTER_KEY_FILE or MASTER_KEY, or ALLOW_UNENCRYPTED_BLOBS=true to store blobs unencrypted")
+		}
+		return nil, nil
+	}
+	return services.ParseKeyring(text)
+}
+
+// newPresignSecret loads the key presigned URLs are signed with from the file
+// named by PRESIGN_SECRET_FILE, or else from PRESIGN_SECRET. With neither set
+// a random key is used, so URLs stop working when the server restarts.
+func newPresignSecret() ([]byte, error) {
+	text := os.Getenv("PRESIGN_SECRET")
+	if path := os.Getenv("PRESIGN_SECRET_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading PRESIGN_SECRET_FILE: %v", err)
+		}
+		text = strings.TrimSpace(string(content))
+	}
+	if text != "" {
+		if len(text) < 32 {
+			return nil, fmt.Errorf("presign secret must be at least 32 characters")
+		}
+		return []byte(text), nil
+	}
+	fmt.Println("No PRESIGN_SECRET_FILE or PRESIGN_SECRET set, presigned URLs will not survive a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// newSessionStore builds the SessionStore named by SESSION_STORE. "database",
+// the default, keeps sessions across restarts; "memory" keeps them in process.
+func newSessionStore() (services.SessionStore, error) {
+	switch store := os.Getenv("SESSION_STORE"); store {
+	case "", "database":
+		return services.NewDatabaseSessionStore(), nil
+	case "memory":
+		return services.NewMemorySessionStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q", store)
+	}
+}
+
+// newRateLimitStore builds the RateLimitStore named by RATE_LIMIT_STORE.
+// "memory", the default, keeps limits in process; "database" keeps them across
+// restarts and shares them between servers.
+func newRateLimitStore() (services.RateLimitStore, error) {
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		return services.NewMemoryRateLimitStore(), nil
+	case "database":
+		return services.NewDatabaseRateLimitStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", store)
+	}
+}
+
+// rateLimitFromEnv reads a limit like "10/m" from key, or fallback when it's
+// unset: that many requests a second, minute or hour. "off" turns it off.
+func rateLimitFromEnv(key, fallback string) (types.RateLimit, error) {
+	v := envOr(key, fallback)
+	if v == "off" {
+		return types.RateLimit{}, nil
+	}
+	count, unit, _ := strings.Cut(v, "/")
+	requests, err := strconv.Atoi(count)
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	if err != nil || requests <= 0 || periods[unit] == 0 {
+		return types.RateLimit{}, fmt.Errorf("invalid %s %q, want a limit like 10/m or off", key, v)
+	}
+	return types.RateLimit{Requests: requests, Period: periods[unit]}, nil
+}
+
+// newOidcService configures single sign-on from OIDC_ISSUER, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET (or OIDC_CLIENT_SECRET_FILE) and OIDC_REDIRECT_URL, the
+// callback URL registered with the provider. OIDC_ROLE_GROUPS maps groups to
+// roles as "group=role,...", first match first; users in none of them get
+// OIDC_DEFAULT_ROLE. With no OIDC_ISSUER single sign-on is off and the
+// service is nil.
+func newOidcService() (services.OidcService, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := services.OidcConfig{
+		Issuer:        issuer,
+		ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:        strings.Fields(strings.ReplaceAll(envOr("OIDC_SCOPES", "openid profile email"), ",", " ")),
+		UsernameClaim: envOr("OIDC_USERNAME_CLAIM", "preferred_username"),
+		GroupsClaim:   envOr("OIDC_GROUPS_CLAIM", "groups"),
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+	if path := os.Getenv("OIDC_CLIENT_SECRET_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading OIDC_CLIENT_SECRET_FILE: %v", err)
+		}
+		cfg.ClientSecret = strings.TrimSpace(string(content))
+	}
+	var err error
+	if cfg.DefaultRole, err = roleFromEnv("OIDC_DEFAULT_ROLE", types.Regular); err != nil {
+		return nil, err
+	}
+	if cfg.RoleMappings, err = roleMappingsFromEnv("OIDC_ROLE_GROUPS"); err != nil {
+		return nil, err
+	}
+	return services.NewOidcService(cfg)
+}
+
+// newLdapService configures password checks against the directory at LDAP_URL
+// (ldap:// or ldaps://, upgraded when LDAP_START_TLS is true, trusting
+// LDAP_CA_FILE if set). Users are looked up under LDAP_BASE_DN with
+// LDAP_USER_FILTER, as LDAP_BIND_DN with LDAP_BIND_PASSWORD (or
+// LDAP_BIND_PASSWORD_FILE) or anonymously. LDAP_ROLE_GROUPS maps groups by cn
+// to roles as "group=role,...", first match first; users in none of them get
+// LDAP_DEFAULT_ROLE. With no LDAP_URL the service is nil and only
+// local users can log in with a password.
+func newLdapService() (services.LdapService, error) {
+	ldapURL := os.Getenv("LDAP_URL")
+	if ldapURL == "" {
+		return nil, nil
+	}
+	cfg := services.LdapConfig{
+		URL:               ldapURL,
+		StartTLS:          os.Getenv("LDAP_START_TLS") == "true",
+		BindDN:            os.Getenv("LDAP_BIND_DN"),
+		BindPassword:      os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:            os.Getenv("LDAP_BASE_DN"),
+		UserFilter:        envOr("LDAP_USER_FILTER", "(&(objectClass=person)(uid={username}))"),
+		UsernameAttribute: envOr("LDAP_USERNAME_ATTRIBUTE", "uid"),
+		EmailAttribute:    envOr("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		IDAttribute:       os.Getenv("LDAP_ID_ATTRIBUTE"),
+		GroupAttribute:    envOr("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		GroupBaseDN:       os.Getenv("LDAP_GROUP_BASE_DN"),
+		GroupFilter:       os.Getenv("LDAP_GROUP_FILTER"),
+	}
+	if path := os.Getenv("LDAP_BIND_PASSWORD_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading LDAP_BIND_PASSWORD_FILE: %v", err)
+		}
+		cfg.BindPassword = strings.TrimSpace(string(content))
+	}
+	if path := os.Getenv("LDAP_CA_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading LDAP_CA_FILE: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates in LDAP_CA_FILE")
+		}
+		cfg.TLSConfig = &tls.Config{RootCAs: roots}
+	}
+	var err error
+	if cfg.DefaultRole, err = roleFromEnv("LDAP_DEFAULT_ROLE", types.Regular); err != nil {
+		return nil, err
+	}
+	if cfg.RoleMappings, err = roleMappingsFromEnv("LDAP_ROLE_GROUPS"); err != nil {
+		return nil, err
+	}
+	return services.NewLdapService(cfg)
+}
+
+// roleFromEnv reads the role named by key, or fallback when it's unset
+func roleFromEnv(key string, fallback types.Role) (types.Role, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	role, ok := types.ParseRole(v)
+	if !ok {
+		return fallback, fmt.Errorf("unknown %s %q", key, v)
+	}
+	return role, nil
+}
+
+// roleMappingsFromEnv reads "group=role,..." from key
+func roleMappingsFromEnv(key string) ([]services.RoleMapping, error) {
+	var mappings []services.RoleMapping
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, name, ok := strings.Cut(pair, "=")
+		role, known := types.ParseRole(strings.TrimSpace(name))
+		if !ok || !known || strings.TrimSpace(group) == "" {
+			return nil, fmt.Errorf("invalid %s entry %q", key, pair)
+		}
+		mappings = append(mappings, services.RoleMapping{Group: strings.TrimSpace(group), Role: role})
+	}
+	return mappings, nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -2,94 +2,346 @@ package types
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
+// ErrQuotaExceeded is returned when a new version would take its owner, or a
+// directory it is in, over their storage limit
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// ErrUsernameTaken is returned when a new user would share a username
+var ErrUsernameTaken = errors.New("username already taken")
+
+// Database lookups and listings of files and directories only see live rows.
+// Trashed ones are reached through their TrashItem.
 type Database interface {
 	CreateDb() error
 	Connect() error
 	Disconnect() error
+	Migrate() error
+	Rollback(steps int) error
+	MigrationStatus() ([]MigrationStatus, error)
 	InsertUser(u User) error
 	InsertFile(f File) error
 	InsertDirectory(d Directory) error
 	GetUser(username string) (User, error)
+	GetUserByID(id string) (User, error)
 	GetFile(filename string) (File, error)
 	GetDirectory(directoryName string) (Directory, error)
+	GetDirectoryByID(id string) (Directory, error)
+	ListSubdirectories(ownerID, parentID string, limit, offset int) ([]Directory, error)
+	CountSubdirectories(ownerID, parentID string) (int, error)
+	GetSubdirectoryByName(ownerID, parentID, name string) (Directory, error)
+	GetChildDirectoryIDs(parentID string) ([]string, error)
+	ListFilesInDirectory(ownerID, directoryID string, limit, offset int) ([]File, error)
+	CountFilesInDirectory(ownerID, directoryID string) (int, error)
 	GetAllFiles() ([]File, error)
 	GetAllDirectories() ([]Directory, error)
 	GetAllUsers() ([]User, error)
 	UpdateUser(u User) error
-	UpdateUserPassword(userID string, newPassword string) error
+	UpdateUserPassword(userID string, passwordHash string) error
 	UpdateFile(f File) error
 	UpdateDirectory(d Directory) error
+	MoveDirectory(id, name, parentID string) error
 	DeleteUser(username string) error
+	ListUsers(search string, limit, offset int) ([]User, error)
+	CountUsers(search string) (int, error)
+	CountEnabledUsersWithRole(role Role) (int, error)
+	SetUserDisabled(id string, disabled bool) error
+	DeleteUserAndTransfer(id, heirID string, dir Directory) (bool, error)
 	DeleteFile(filename string) error
+	GetFileByID(id string) (File, error)
+	GetFileByPath(ownerID, directoryID, name string) (File, error)
+	ReleaseFile(id string) (unreferenced []string, err error)
+	DeleteBlob(hash string) (bool, error)
+	GetBlobRefCount(hash string) (int, error)
+	GetFileKeyByHash(hash string) (wrappedKey, keyID string, err error)
+	InsertFileVersion(v FileVersion) (FileVersion, error)
+	GetFileVersion(fileID string, version int) (FileVersion, error)
+	ListFileVersions(fileID string) ([]FileVersion, error)
+	DeleteFileVersion(fileID string, version int) (remaining int, err error)
+	ListVersionsWrappedWithOtherKey(keyID string, limit int) ([]FileVersion, error)
+	UpdateVersionKey(fileID string, version int, wrappedKey, keyID string) error
+	ListDirectoriesWithRetention() ([]Directory, error)
 	DeleteDirectory(directoryName string) error
+	DeleteDirectoryByID(id string) error
+	InsertUpload(u Upload) error
+	GetUpload(id string) (Upload, error)
+	UpdateUploadOffset(id string, offset int64, now time.Time) error
+	ListUploadsIdleSince(t time.Time, limit int) ([]Upload, error)
+	DeleteUpload(id string) error
+	InsertSession(s Session) error
+	GetSessionByToken(token string) (Session, error)
+	RenewSession(token string, expiresAt, lastSeenAt time.Time) error
+	ListSessionsByUser(userID string) ([]Session, error)
+	DeleteSessionByToken(token string) error
+	DeleteSession(userID, id string) error
+	DeleteSessionsByUser(userID string) (int64, error)
+	DeleteExpiredSessions(before time.Time) (int64, error)
+	InsertAclEntry(e AclEntry) error
+	GetAclEntry(id string) (AclEntry, error)
+	GetAclEntriesForFile(fileID string) ([]AclEntry, error)
+	GetAclEntriesForDirectory(directoryID string) ([]AclEntry, error)
+	DeleteAclEntry(id string) error
+	InsertTrashItem(item TrashItem) error
+	GetTrashItem(id string) (TrashItem, error)
+	ListTrashItems(userID string) ([]TrashItem, error)
+	ListTrashItemsDeletedBefore(t time.Time, limit int) ([]TrashItem, error)
+	ListTrashedFileIDs(trashID string) ([]string, error)
+	RestoreTrashItem(id, parentID string) error
+	DeleteTrashItem(id string) error
+	GetQuota(subjectType, subjectID string) (Quota, error)
+	SetQuotaLimit(subjectType, subjectID string, limitBytes int64) error
+	ClearQuotaLimit(subjectType, subjectID string) error
+	CheckQuota(ownerID, directoryID string, size int64) error
+	InsertShareLink(l ShareLink) error
+	GetShareLink(id string) (ShareLink, error)
+	GetShareLinkByToken(token string) (ShareLink, error)
+	ListShareLinks(ownerID string) ([]ShareLink, error)
+	CountShareLinkUse(id string) error
+	DeleteShareLink(id string) error
+	InsertApiKey(k ApiKey) error
+	GetApiKeyByPrefix(prefix string) (ApiKey, error)
+	ListApiKeys(userID string) ([]ApiKey, error)
+	TouchApiKey(id string, usedAt time.Time) error
+	DeleteApiKey(userID, id string) error
+	SaveTotpSecret(s TotpSecret) error
+	GetTotpSecret(userID string) (TotpSecret, error)
+	EnableTotp(userID string, step int64, recoveryCodeHashes []string) error
+	UseTotpStep(userID string, step int64) error
+	DeleteTotp(userID string) error
+	ReplaceRecoveryCodes(userID string, codeHashes []string) error
+	UseRecoveryCode(userID, codeHash string) error
+	CountRecoveryCodes(userID string) (int, error)
+	GetTwoFactorRoles() ([]Role, error)
+	SetTwoFactorRoles(roles []Role) error
+	InsertLoginChallenge(c LoginChallenge) error
+	GetLoginChallenge(token string) (LoginChallenge, error)
+	UseLoginChallengeAttempt(token string, maxAttempts int, now time.Time) error
+	DeleteLoginChallenge(token string) error
+	DeleteExpiredLoginChallenges(before time.Time) (int64, error)
+	InsertOidcLogin(l OidcLogin) error
+	TakeOidcLogin(state string) (OidcLogin, error)
+	DeleteExpiredOidcLogins(before time.Time) (int64, error)
+	GetOidcUser(issuer, subject string) (User, error)
+	InsertOidcUser(u User, issuer, subject string) error
+	GetLdapUser(subject string) (User, error)
+	InsertLdapUser(u User, subject string) error
+	TakeRateLimitToken(key string, now time.Time, interval, window time.Duration) (time.Time, bool, error)
+	DeleteFullRateLimits(now time.Time) (int64, error)
+	AddLoginFailure(username string, now, forgetBefore time.Time) (int, error)
+	LockLogin(username string, until time.Time) error
+	GetLockout(username string) (Lockout, error)
+	ListLockouts(now time.Time) ([]Lockout, error)
+	DeleteLockout(username string) error
+	DeleteStaleLockouts(forgetBefore, now time.Time) (int64, error)
+	ListRoles() ([]RoleDefinition, error)
+	GetRole(id Role) (RoleDefinition, error)
+	GetRoleByName(name string) (RoleDefinition, error)
+	InsertRole(r RoleDefinition) (Role, error)
+	UpdateRole(r RoleDefinition) error
+	DeleteRole(id Role) error
+	CountUsersWithRole(role Role) (int, error)
+	InsertGroup(g Group) error
+	GetGroup(id string) (Group, error)
+	GetGroupByName(name string) (Group, error)
+	ListGroups() ([]Group, error)
+	UpdateGroup(g Group) error
+	DeleteGroup(id string) error
+	AddGroupMember(groupID, userID string, now time.Time) error
+	RemoveGroupMember(groupID, userID string) error
+	ListGroupMembers(groupID string) ([]User, error)
+	ListGroupsForUser(userID string) ([]Group, error)
+	GetGroupOwner(directoryID string) (string, error)
 }
 
 type database struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
 }
 
 func NewDatabase() Database {
-	return &database{}
+	return NewDatabaseWithPath("./Smd.db")
+}
+
+// NewDatabaseWithPath returns a Database backed by the sqlite file at path
+func NewDatabaseWithPath(path string) Database {
+	return &database{path: path}
 }
 
+// CreateDb brings the schema up to date by applying any pending migrations
 func (d *database) CreateDb() error {
-	d.Connect()
+	if err := d.Connect(); err != nil {
+		return err
+	}
 	defer d.Disconnect()
-	_, err := d.db.Exec("CREATE TABLE IF NOT EXISTS users (id TEXT PRIMARY KEY, username TEXT, password TEXT, email TEXT, role TEXT, created_at TEXT)")
+	return d.Migrate()
+}
+
+// connectParams let the pools every service opens on the same file write
+// concurrently: WAL keeps readers from blocking the writer, a writer waits
+// for the lock instead of failing with SQLITE_BUSY, and transactions take the
+// write lock up front so two of them can't deadlock upgrading to it
+const connectParams = "?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate"
+
+func (d *database) Connect() error {
+	db, err := sql.Open("sqlite3", d.path+connectParams)
 	if err != nil {
 		return err
 	}
-	_, err = d.db.Exec("CREATE TABLE IF NOT EXISTS files (id TEXT PRIMARY KEY, name TEXT, size TEXT, content_type TEXT, location TEXT, upload_date TEXT, owner_id TEXT)")
+	d.db = db
+	return nil
+}
+
+func (d *database) Disconnect() error {
+	return d.db.Close()
+}
+
+// DeleteDirectory in database
+func (d *database) DeleteDirectory(directoryName string) error {
+	_, err := d.db.Exec("DELETE FROM directories WHERE name = ?", directoryName)
 	if err != nil {
 		return err
 	}
-	_, err = d.db.Exec("CREATE TABLE IF NOT EXISTS directories (id TEXT PRIMARY KEY, name TEXT, owner_id TEXT, parent_directory_id TEXT)")
+	return nil
+}
+
+// DeleteDirectoryByID in database, along with the ACL entries on it
+func (d *database) DeleteDirectoryByID(id string) error {
+	tx, err := d.db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = d.db.Exec("CREATE TABLE IF NOT EXISTS access_control_lists (id TEXT PRIMARY KEY, user_id TEXT, file_id TEXT, directory_id TEXT)")
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM access_control_lists WHERE directory_id = ?", id)
 	if err != nil {
 		return err
 	}
-	_, err = d.db.Exec("CREATE TABLE IF NOT EXISTS active_sessions (id TEXT PRIMARY KEY, user_id INTEGER, token TEXT, expires_at TEXT)")
+	_, err = tx.Exec("DELETE FROM directories WHERE id = ?", id)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return tx.Commit()
 }
 
-func (d *database) Connect() error {
-	db, err := sql.Open("sqlite3", "./Smd.db")
+// DeleteFile in database. Blob references held by the deleted files' versions
+// are dropped, leaving blobs at zero references for the caller to clean up.
+func (d *database) DeleteFile(filename string) error {
+	tx, err := d.db.Begin()
 	if err != nil {
 		return err
 	}
-	d.db = db
-	return nil
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE blobs SET ref_count = ref_count - (SELECT COUNT(*) FROM file_versions v JOIN files ON files.id = v.file_id WHERE files.name = ? AND v.hash = blobs.hash) WHERE hash IN (SELECT v.hash FROM file_versions v JOIN files ON files.id = v.file_id WHERE files.name = ?)", filename, filename)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM file_versions WHERE file_id IN (SELECT id FROM files WHERE name = ?)", filename)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM files WHERE name = ?", filename)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (d *database) Disconnect() error {
-	return d.db.Close()
+// ReleaseFile deletes the file row with all its versions and drops their
+// references on blobs, returning the hashes of blobs nothing references any
+// more so the caller knows which bytes can go
+func (d *database) ReleaseFile(id string) (unreferenced []string, err error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var size int64
+	err = tx.QueryRow("SELECT COALESCE(SUM(size), 0) FROM file_versions WHERE file_id = ?", id).Scan(&size)
+	if err != nil {
+		return nil, err
+	}
+	if err := releaseQuota(tx, id, size); err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec("DELETE FROM files WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	_, err = tx.Exec("DELETE FROM access_control_lists WHERE file_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := queryStrings(tx, "DELETE FROM file_versions WHERE file_id = ? RETURNING COALESCE(hash, '')", id)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+		var remaining int
+		err = tx.QueryRow("UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ? RETURNING ref_count", hash).Scan(&remaining)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if remaining <= 0 && !slices.Contains(unreferenced, hash) {
+			unreferenced = append(unreferenced, hash)
+		}
+	}
+	return unreferenced, tx.Commit()
 }
 
-// DeleteDirectory in database
-func (d *database) DeleteDirectory(directoryName string) error {
-	_, err := d.db.Exec("DELETE FROM directories WHERE name = ?", directoryName)
+func queryStrings(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
 }
 
-// DeleteFile in database
-func (d *database) DeleteFile(filename string) error {
-	_, err := d.db.Exec("DELETE FROM files WHERE name = ?", filename)
+// GetBlobRefCount in database
+func (d *database) GetBlobRefCount(hash string) (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT ref_count FROM blobs WHERE hash = ?", hash).Scan(&count)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return count, nil
+}
+
+// DeleteBlob removes the blob row if nothing references it any more and
+// reports whether it did, in which case the stored bytes can be removed
+func (d *database) DeleteBlob(hash string) (bool, error) {
+	res, err := d.db.Exec("DELETE FROM blobs WHERE hash = ? AND ref_count <= 0", hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
 }
 
 // DeleteUser in database
@@ -103,7 +355,7 @@ func (d *database) DeleteUser(username string) error {
 
 // GetAllDirectories in database
 func (d *database) GetAllDirectories() ([]Directory, error) {
-	rows, err := d.db.Query("SELECT * FROM directories")
+	rows, err := d.db.Query("SELECT " + directoryColumns + " FROM directories")
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +363,7 @@ func (d *database) GetAllDirectories() ([]Directory, error) {
 	var directories []Directory
 	for rows.Next() {
 		var directory Directory
-		err := rows.Scan(&directory.ID, &directory.Name, &directory.OwnerID, &directory.ParentDirectoryID)
+		err := rows.Scan(directoryFields(&directory)...)
 		if err != nil {
 			return nil, err
 		}
@@ -123,7 +375,7 @@ func (d *database) GetAllDirectories() ([]Directory, error) {
 
 // GetAllFiles in database
 func (d *database) GetAllFiles() ([]File, error) {
-	rows, err := d.db.Query("SELECT * FROM files")
+	rows, err := d.db.Query("SELECT " + fileColumns + " FROM files")
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +383,7 @@ func (d *database) GetAllFiles() ([]File, error) {
 	var files []File
 	for rows.Next() {
 		var file File
-		err := rows.Scan(&file.ID, &file.Name, &file.Size, &file.ContentType, &file.Location, &file.UploadDate, &file.OwnerID)
+		err := rows.Scan(fileFields(&file)...)
 		if err != nil {
 			return nil, err
 		}
@@ -142,7 +394,7 @@ func (d *database) GetAllFiles() ([]File, error) {
 
 // GetAllUsers
 func (d *database) GetAllUsers() ([]User, error) {
-	rows, err := d.db.Query("SELECT * FROM users")
+	rows, err := d.db.Query("SELECT " + userColumns + " FROM users")
 	if err != nil {
 		return nil, err
 	}
@@ -150,7 +402,7 @@ func (d *database) GetAllUsers() ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.Role, &user.CreatedAt)
+		err := rows.Scan(userFields(&user)...)
 		if err != nil {
 			return nil, err
 		}
@@ -159,97 +411,2012 @@ func (d *database) GetAllUsers() ([]User, error) {
 	return users, nil
 }
 
+// userSearch matches users whose username or email contains the search
+// term, or every user when it is empty
+const userSearch = "(? = '' OR username LIKE ? ESCAPE '\\' OR email LIKE ? ESCAPE '\\')"
+
+func userSearchArgs(search string) []interface{} {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search) + "%"
+	return []interface{}{search, pattern, pattern}
+}
+
+// ListUsers in database, ordered by username
+func (d *database) ListUsers(search string, limit, offset int) ([]User, error) {
+	args := append(userSearchArgs(search), limit, offset)
+	rows, err := d.db.Query("SELECT "+userColumns+" FROM users WHERE "+userSearch+" ORDER BY username, id LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var user User
+		err := rows.Scan(userFields(&user)...)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// CountUsers in database
+func (d *database) CountUsers(search string) (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM users WHERE "+userSearch, userSearchArgs(search)...).Scan(&count)
+	return count, err
+}
+
+// CountEnabledUsersWithRole in database
+func (d *database) CountEnabledUsersWithRole(role Role) (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ? AND disabled = 0", role).Scan(&count)
+	return count, err
+}
+
+// SetUserDisabled in database
+func (d *database) SetUserDisabled(id string, disabled bool) error {
+	res, err := d.db.Exec("UPDATE users SET disabled = ? WHERE id = ?", disabled, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteUserAndTransfer deletes a user along with their sessions, API keys,
+// second factor, linked identities, quota and access grants, and hands
+// everything they owned to heirID in the same transaction. Their files and
+// directories at the root, trashed ones included, are moved into dir, which
+// is created in the heir's root only if the user owned anything; the
+// returned bool reports whether it was.
+func (d *database) DeleteUserAndTransfer(id, heirID string, dir Directory) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n == 0 {
+		return false, sql.ErrNoRows
+	}
+
+	var owned bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE owner_id = ?) OR EXISTS (SELECT 1 FROM directories WHERE owner_id = ?)", id, id).Scan(&owned)
+	if err != nil {
+		return false, err
+	}
+	if owned {
+		_, err = tx.Exec("INSERT INTO directories (id, name, owner_id, parent_directory_id, max_versions, version_retention_days) VALUES (?, ?, ?, '', ?, ?)", dir.ID, dir.Name, heirID, dir.MaxVersions, dir.VersionRetentionDays)
+		if err != nil {
+			return false, err
+		}
+		transfers := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"UPDATE files SET directory_id = ? WHERE owner_id = ? AND directory_id = ''", []interface{}{dir.ID, id}},
+			{"UPDATE directories SET parent_directory_id = ? WHERE owner_id = ? AND COALESCE(parent_directory_id, '') = ''", []interface{}{dir.ID, id}},
+			{"UPDATE trash SET parent_id = ? WHERE owner_id = ? AND parent_id = ''", []interface{}{dir.ID, id}},
+			{"UPDATE files SET owner_id = ? WHERE owner_id = ?", []interface{}{heirID, id}},
+			{"UPDATE directories SET owner_id = ? WHERE owner_id = ?", []interface{}{heirID, id}},
+			{"UPDATE trash SET owner_id = ? WHERE owner_id = ?", []interface{}{heirID, id}},
+			{"UPDATE share_links SET owner_id = ? WHERE owner_id = ?", []interface{}{heirID, id}},
+			{"INSERT INTO quotas (subject_type, subject_id, used_bytes) SELECT subject_type, ?, used_bytes FROM quotas WHERE subject_type = ? AND subject_id = ? ON CONFLICT(subject_type, subject_id) DO UPDATE SET used_bytes = used_bytes + excluded.used_bytes", []interface{}{heirID, QuotaUser, id}},
+		}
+		for _, t := range transfers {
+			if _, err := tx.Exec(t.query, t.args...); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM quotas WHERE subject_type = ? AND subject_id = ?", QuotaUser, id); err != nil {
+		return false, err
+	}
+	for _, query := range []string{
+		"DELETE FROM access_control_lists WHERE user_id = ?",
+		"DELETE FROM active_sessions WHERE user_id = ?",
+		"DELETE FROM api_keys WHERE user_id = ?",
+		"DELETE FROM user_totp WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM login_challenges WHERE user_id = ?",
+		"DELETE FROM oidc_identities WHERE user_id = ?",
+		"DELETE FROM ldap_identities WHERE user_id = ?",
+		"DELETE FROM group_members WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return false, err
+		}
+	}
+	return owned, tx.Commit()
+}
+
 // GetDirectory in database
 func (d *database) GetDirectory(directoryName string) (Directory, error) {
-	row := d.db.QueryRow("SELECT * FROM directories WHERE name = ?", directoryName)
+	row := d.db.QueryRow("SELECT "+directoryColumns+" FROM directories WHERE trash_id = '' AND name = ?", directoryName)
 	var directory Directory
-	err := row.Scan(&directory.ID, &directory.Name, &directory.OwnerID, &directory.ParentDirectoryID)
+	err := row.Scan(directoryFields(&directory)...)
 	if err != nil {
 		return Directory{}, err
 	}
 	return directory, nil
 }
 
-// GetFile in database
-func (d *database) GetFile(filename string) (File, error) {
-	row := d.db.QueryRow("SELECT * FROM files WHERE name = ?", filename)
-	var file File
-	err := row.Scan(&file.ID, &file.Name, &file.Size, &file.ContentType, &file.Location, &file.UploadDate, &file.OwnerID)
+// GetDirectoryByID in database
+func (d *database) GetDirectoryByID(id string) (Directory, error) {
+	row := d.db.QueryRow("SELECT "+directoryColumns+" FROM directories WHERE trash_id = '' AND id = ?", id)
+	var directory Directory
+	err := row.Scan(directoryFields(&directory)...)
 	if err != nil {
-		return File{}, err
+		return Directory{}, err
 	}
-	return file, nil
+	return directory, nil
 }
 
-// GetUser in database
-func (d *database) GetUser(username string) (User, error) {
-	row := d.db.QueryRow("SELECT * FROM users WHERE username = ?", username)
-	var user User
-	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.Role, &user.CreatedAt)
+// ListSubdirectories returns a page of the directories directly under parentID,
+// ordered by name. Top level directories have an empty parentID and are
+// scoped to ownerID; below that ownerID is ignored.
+func (d *database) ListSubdirectories(ownerID, parentID string, limit, offset int) ([]Directory, error) {
+	rows, err := d.db.Query("SELECT "+directoryColumns+" FROM directories WHERE trash_id = '' AND parent_directory_id = ? AND (? != '' OR owner_id = ?) ORDER BY name, id LIMIT ? OFFSET ?", parentID, parentID, ownerID, limit, offset)
 	if err != nil {
-		return User{}, err
+		return nil, err
 	}
-	return user, nil
+	defer rows.Close()
+	var directories []Directory
+	for rows.Next() {
+		var directory Directory
+		err := rows.Scan(directoryFields(&directory)...)
+		if err != nil {
+			return nil, err
+		}
+		directories = append(directories, directory)
+	}
+	return directories, rows.Err()
 }
 
-// InsertDirectory in database
-func (d *database) InsertDirectory(dir Directory) error {
-	_, err := d.db.Exec("INSERT INTO directories (id, name, owner_id, parent_directory_id) VALUES (?, ?, ?, ?)", dir.ID, dir.Name, dir.OwnerID, dir.ParentDirectoryID)
+// CountSubdirectories in database
+func (d *database) CountSubdirectories(ownerID, parentID string) (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM directories WHERE trash_id = '' AND parent_directory_id = ? AND (? != '' OR owner_id = ?)", parentID, parentID, ownerID).Scan(&count)
+	return count, err
+}
+
+// GetSubdirectoryByName in database
+func (d *database) GetSubdirectoryByName(ownerID, parentID, name string) (Directory, error) {
+	row := d.db.QueryRow("SELECT "+directoryColumns+" FROM directories WHERE trash_id = '' AND parent_directory_id = ? AND (? != '' OR owner_id = ?) AND name = ?", parentID, parentID, ownerID, name)
+	var directory Directory
+	err := row.Scan(directoryFields(&directory)...)
 	if err != nil {
-		return err
+		return Directory{}, err
 	}
-	return nil
+	return directory, nil
 }
 
-// InsertFile in database
-func (d *database) InsertFile(f File) error {
-	_, err := d.db.Exec("INSERT INTO files (id, name, size, content_type, location, upload_date, owner_id) VALUES (?, ?, ?, ?, ?, ?, ?)", f.ID, f.Name, f.Size, f.ContentType, f.Location, f.UploadDate, f.OwnerID)
+// GetChildDirectoryIDs in database
+func (d *database) GetChildDirectoryIDs(parentID string) ([]string, error) {
+	rows, err := d.db.Query("SELECT id FROM directories WHERE trash_id = '' AND parent_directory_id = ?", parentID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
-// InsertUser in database
-func (d *database) InsertUser(u User) error {
-	_, err := d.db.Exec("INSERT INTO users (id, username, password, email, role, created_at) VALUES (?, ?, ?, ?, ?, ?)", u.ID, u.Username, u.Password, u.Email, u.Role, u.CreatedAt)
+// ListFilesInDirectory returns a page of the files directly in directoryID,
+// ordered by name, with the same owner scoping as ListSubdirectories
+func (d *database) ListFilesInDirectory(ownerID, directoryID string, limit, offset int) ([]File, error) {
+	rows, err := d.db.Query("SELECT "+fileColumns+" FROM files WHERE trash_id = '' AND directory_id = ? AND (? != '' OR owner_id = ?) ORDER BY name, id LIMIT ? OFFSET ?", directoryID, directoryID, ownerID, limit, offset)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+	var files []File
+	for rows.Next() {
+		var file File
+		err := rows.Scan(fileFields(&file)...)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
 }
 
-// UpdateDirectory in database
-func (d *database) UpdateDirectory(dir Directory) error {
-	_, err := d.db.Exec("UPDATE directories SET name = ?, owner_id = ?, parent_directory_id = ? WHERE id = ?", dir.Name, dir.OwnerID, dir.ParentDirectoryID, dir.ID)
+// CountFilesInDirectory in database
+func (d *database) CountFilesInDirectory(ownerID, directoryID string) (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM files WHERE trash_id = '' AND directory_id = ? AND (? != '' OR owner_id = ?)", directoryID, directoryID, ownerID).Scan(&count)
+	return count, err
+}
+
+const directoryColumns = "id, name, owner_id, COALESCE(parent_directory_id, ''), max_versions, version_retention_days"
+
+func directoryFields(dir *Directory) []interface{} {
+	return []interface{}{&dir.ID, &dir.Name, &dir.OwnerID, &dir.ParentDirectoryID, &dir.MaxVersions, &dir.VersionRetentionDays}
+}
+
+// ListDirectoriesWithRetention returns the directories that limit how many
+// versions of their files are kept
+func (d *database) ListDirectoriesWithRetention() ([]Directory, error) {
+	rows, err := d.db.Query("SELECT " + directoryColumns + " FROM directories WHERE trash_id = '' AND (max_versions > 0 OR version_retention_days > 0) ORDER BY id")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+	var directories []Directory
+	for rows.Next() {
+		var directory Directory
+		if err := rows.Scan(directoryFields(&directory)...); err != nil {
+			return nil, err
+		}
+		directories = append(directories, directory)
+	}
+	return directories, rows.Err()
 }
 
-// UpdateFile in database
-func (d *database) UpdateFile(f File) error {
-	_, err := d.db.Exec("UPDATE files SET name = ?, size = ?, content_type = ?, location = ?, upload_date = ?, owner_id = ? WHERE id = ?", f.Name, f.Size, f.ContentType, f.Location, f.UploadDate, f.OwnerID, f.ID)
+// GetFile in database. Rows from before versioning may share a name, in which
+// case the most recent upload wins.
+func (d *database) GetFile(filename string) (File, error) {
+	row := d.db.QueryRow("SELECT "+fileColumns+" FROM files WHERE trash_id = '' AND name = ? ORDER BY upload_date DESC, id LIMIT 1", filename)
+	var file File
+	err := row.Scan(fileFields(&file)...)
 	if err != nil {
-		return err
+		return File{}, err
 	}
-	return nil
+	return file, nil
 }
 
-// UpdateUser in database
-func (d *database) UpdateUser(u User) error {
-	_, err := d.db.Exec("UPDATE users SET username = ?, password = ?, email = ?, role = ?, created_at = ? WHERE id = ?", u.Username, u.Password, u.Email, u.Role, u.CreatedAt, u.ID)
+// GetFileByID in database
+func (d *database) GetFileByID(id string) (File, error) {
+	row := d.db.QueryRow("SELECT "+fileColumns+" FROM files WHERE trash_id = '' AND id = ?", id)
+	var file File
+	err := row.Scan(fileFields(&file)...)
 	if err != nil {
-		return err
+		return File{}, err
 	}
-	return nil
+	return file, nil
+}
+
+// GetFileByPath returns the file called name directly in directoryID, with the
+// same owner scoping as ListFilesInDirectory
+func (d *database) GetFileByPath(ownerID, directoryID, name string) (File, error) {
+	row := d.db.QueryRow("SELECT "+fileColumns+" FROM files WHERE trash_id = '' AND directory_id = ? AND (? != '' OR owner_id = ?) AND name = ? ORDER BY upload_date DESC, id LIMIT 1", directoryID, directoryID, ownerID, name)
+	var file File
+	err := row.Scan(fileFields(&file)...)
+	if err != nil {
+		return File{}, err
+	}
+	return file, nil
+}
+
+const fileColumns = "id, name, size, content_type, location, upload_date, owner_id, COALESCE(hash, ''), directory_id, wrapped_key, key_id, version"
+
+func fileFields(f *File) []interface{} {
+	return []interface{}{&f.ID, &f.Name, &f.Size, &f.ContentType, &f.Location, timeColumn{&f.UploadDate}, &f.OwnerID, &f.Hash, &f.DirectoryID, &f.WrappedKey, &f.KeyID, &f.Version}
+}
+
+// GetFileKeyByHash returns the wrapped data key of any version stored in the
+// blob with hash, since they all share the blob's key
+func (d *database) GetFileKeyByHash(hash string) (wrappedKey, keyID string, err error) {
+	err = d.db.QueryRow("SELECT wrapped_key, key_id FROM file_versions WHERE hash = ? LIMIT 1", hash).Scan(&wrappedKey, &keyID)
+	return wrappedKey, keyID, err
+}
+
+// InsertFileVersion adds v as the newest version of its file and makes it
+// current, taking a reference on its blob. The version number is assigned
+// here and returned in the result.
+func (d *database) InsertFileVersion(v FileVersion) (FileVersion, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return FileVersion{}, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM file_versions WHERE file_id = ?", v.FileID).Scan(&v.Version)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	res, err := tx.Exec("UPDATE files SET size = ?, content_type = ?, location = ?, upload_date = ?, hash = ?, wrapped_key = ?, key_id = ?, version = ? WHERE id = ?",
+		v.Size, v.ContentType, v.Location, v.CreatedAt, v.Hash, v.WrappedKey, v.KeyID, v.Version, v.FileID)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return FileVersion{}, err
+	} else if n == 0 {
+		return FileVersion{}, sql.ErrNoRows
+	}
+	if err := insertFileVersion(tx, v); err != nil {
+		return FileVersion{}, err
+	}
+	return v, tx.Commit()
 }
 
-func (d *database) UpdateUserPassword(userID string, newPassword string) error {
-	_, err := d.db.Exec("UPDATE users SET password = ? WHERE id = ?", newPassword, userID)
+// insertFileVersion writes the version row, takes its blob reference and
+// charges its size to the file's owner
+func insertFileVersion(tx *sql.Tx, v FileVersion) error {
+	_, err := tx.Exec("INSERT INTO file_versions (file_id, version, size, content_type, location, hash, wrapped_key, key_id, uploader_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		v.FileID, v.Version, v.Size, v.ContentType, v.Location, v.Hash, v.WrappedKey, v.KeyID, v.UploaderID, v.CreatedAt)
 	if err != nil {
 		return err
 	}
-	return nil
+	if v.Hash != "" {
+		_, err = tx.Exec("INSERT INTO blobs (hash, size, ref_count, created_at) VALUES (?, ?, 1, ?) ON CONFLICT(hash) DO UPDATE SET ref_count = ref_count + 1", v.Hash, v.Size, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return chargeQuota(tx, v.FileID, v.Size)
+}
+
+// GetFileVersion in database
+func (d *database) GetFileVersion(fileID string, version int) (FileVersion, error) {
+	row := d.db.QueryRow("SELECT "+versionColumns+" FROM file_versions WHERE file_id = ? AND version = ?", fileID, version)
+	var v FileVersion
+	err := row.Scan(versionFields(&v)...)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	return v, nil
+}
+
+// ListFileVersions returns every version of the file, newest first
+func (d *database) ListFileVersions(fileID string) ([]FileVersion, error) {
+	return d.queryFileVersions("SELECT "+versionColumns+" FROM file_versions WHERE file_id = ? ORDER BY version DESC", fileID)
+}
+
+// DeleteFileVersion removes one version and drops its reference on the blob,
+// returning how many references remain so the caller knows when the bytes
+// can go. The files row is not touched, so this is not for the current version.
+func (d *database) DeleteFileVersion(fileID string, version int) (remaining int, err error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var hash string
+	var size int64
+	err = tx.QueryRow("DELETE FROM file_versions WHERE file_id = ? AND version = ? RETURNING COALESCE(hash, ''), COALESCE(size, 0)", fileID, version).Scan(&hash, &size)
+	if err != nil {
+		return 0, err
+	}
+	if err := releaseQuota(tx, fileID, size); err != nil {
+		return 0, err
+	}
+	if hash != "" {
+		err = tx.QueryRow("UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ? RETURNING ref_count", hash).Scan(&remaining)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+	}
+	return remaining, tx.Commit()
+}
+
+// ListVersionsWrappedWithOtherKey returns up to limit encrypted versions whose
+// data key was not wrapped by keyID
+func (d *database) ListVersionsWrappedWithOtherKey(keyID string, limit int) ([]FileVersion, error) {
+	return d.queryFileVersions("SELECT "+versionColumns+" FROM file_versions WHERE wrapped_key != '' AND key_id != ? ORDER BY file_id, version LIMIT ?", keyID, limit)
+}
+
+// UpdateVersionKey in database, and in the files row when it is the current version
+func (d *database) UpdateVersionKey(fileID string, version int, wrappedKey, keyID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE file_versions SET wrapped_key = ?, key_id = ? WHERE file_id = ? AND version = ?", wrappedKey, keyID, fileID, version)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE files SET wrapped_key = ?, key_id = ? WHERE id = ? AND version = ?", wrappedKey, keyID, fileID, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *database) queryFileVersions(query string, args ...interface{}) ([]FileVersion, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []FileVersion
+	for rows.Next() {
+		var v FileVersion
+		if err := rows.Scan(versionFields(&v)...); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+const versionColumns = "file_id, version, COALESCE(size, 0), COALESCE(content_type, ''), COALESCE(location, ''), COALESCE(hash, ''), wrapped_key, key_id, COALESCE(uploader_id, ''), created_at"
+
+func versionFields(v *FileVersion) []interface{} {
+	return []interface{}{&v.FileID, &v.Version, &v.Size, &v.ContentType, &v.Location, &v.Hash, &v.WrappedKey, &v.KeyID, &v.UploaderID, timeColumn{&v.CreatedAt}}
+}
+
+// userColumns are qualified so they can be selected alongside the identity
+// tables users are joined with
+const userColumns = "users.id, users.username, users.password, users.email, users.role, users.created_at, users.disabled"
+
+func userFields(u *User) []interface{} {
+	return []interface{}{&u.ID, &u.Username, &u.Password, &u.Email, &u.Role, timeColumn{&u.CreatedAt}, &u.Disabled}
+}
+
+// GetUser in database
+func (d *database) GetUser(username string) (User, error) {
+	row := d.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username)
+	var user User
+	err := row.Scan(userFields(&user)...)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// GetUserByID in database
+func (d *database) GetUserByID(id string) (User, error) {
+	row := d.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id)
+	var user User
+	err := row.Scan(userFields(&user)...)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// InsertDirectory in database
+func (d *database) InsertDirectory(dir Directory) error {
+	_, err := d.db.Exec("INSERT INTO directories (id, name, owner_id, parent_directory_id, max_versions, version_retention_days) VALUES (?, ?, ?, ?, ?, ?)", dir.ID, dir.Name, dir.OwnerID, dir.ParentDirectoryID, dir.MaxVersions, dir.VersionRetentionDays)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertFile in database along with its first version, uploaded by
+// UploaderID or else the owner. Files with a Hash take a reference on that
+// blob in the same transaction.
+func (d *database) InsertFile(f File) error {
+	uploaderID := f.UploaderID
+	if uploaderID == "" {
+		uploaderID = f.OwnerID
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO files (id, name, size, content_type, location, upload_date, owner_id, hash, directory_id, wrapped_key, key_id, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)", f.ID, f.Name, f.Size, f.ContentType, f.Location, f.UploadDate, f.OwnerID, f.Hash, f.DirectoryID, f.WrappedKey, f.KeyID)
+	if err != nil {
+		return err
+	}
+	err = insertFileVersion(tx, FileVersion{
+		CreatedAt:   f.UploadDate,
+		FileID:      f.ID,
+		ContentType: f.ContentType,
+		Location:    f.Location,
+		Hash:        f.Hash,
+		WrappedKey:  f.WrappedKey,
+		KeyID:       f.KeyID,
+		UploaderID:  uploaderID,
+		Size:        f.Size,
+		Version:     1,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertUser in database
+func (d *database) InsertUser(u User) error {
+	_, err := d.db.Exec("INSERT INTO users (id, username, password, email, role, created_at) VALUES (?, ?, ?, ?, ?, ?)", u.ID, u.Username, u.Password, u.Email, u.Role, u.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateDirectory in database
+func (d *database) UpdateDirectory(dir Directory) error {
+	_, err := d.db.Exec("UPDATE directories SET name = ?, owner_id = ?, parent_directory_id = ?, max_versions = ?, version_retention_days = ? WHERE id = ?", dir.Name, dir.OwnerID, dir.ParentDirectoryID, dir.MaxVersions, dir.VersionRetentionDays, dir.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// MoveDirectory renames a directory and puts it under parentID, failing with
+// ErrQuotaExceeded if that takes a directory above its new place over its
+// limit
+func (d *database) MoveDirectory(id, name, parentID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var oldParentID string
+	if err := tx.QueryRow("SELECT parent_directory_id FROM directories WHERE id = ?", id).Scan(&oldParentID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE directories SET name = ?, parent_directory_id = ? WHERE id = ?", name, parentID, id); err != nil {
+		return err
+	}
+	if parentID != oldParentID {
+		if err := checkDirectoryQuotas(tx, parentID, 0); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateFile in database
+func (d *database) UpdateFile(f File) error {
+	_, err := d.db.Exec("UPDATE files SET name = ?, size = ?, content_type = ?, location = ?, upload_date = ?, owner_id = ?, directory_id = ? WHERE id = ?", f.Name, f.Size, f.ContentType, f.Location, f.UploadDate, f.OwnerID, f.DirectoryID, f.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateUser in database
+func (d *database) UpdateUser(u User) error {
+	_, err := d.db.Exec("UPDATE users SET username = ?, password = ?, email = ?, role = ?, created_at = ? WHERE id = ?", u.Username, u.Password, u.Email, u.Role, u.CreatedAt, u.ID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateUserPassword in database. passwordHash is stored as given, so callers
+// hash the password with HashPassword first.
+func (d *database) UpdateUserPassword(userID string, passwordHash string) error {
+	_, err := d.db.Exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertUpload in database
+func (d *database) InsertUpload(u Upload) error {
+	_, err := d.db.Exec("INSERT INTO uploads (id, owner_id, length, offset, metadata, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)", u.ID, u.OwnerID, u.Length, u.Offset, u.Metadata, u.CreatedAt, u.UpdatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetUpload in database
+func (d *database) GetUpload(id string) (Upload, error) {
+	row := d.db.QueryRow("SELECT "+uploadColumns+" FROM uploads WHERE id = ?", id)
+	var upload Upload
+	err := row.Scan(uploadFields(&upload)...)
+	if err != nil {
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// UpdateUploadOffset in database
+func (d *database) UpdateUploadOffset(id string, offset int64, now time.Time) error {
+	_, err := d.db.Exec("UPDATE uploads SET offset = ?, updated_at = ? WHERE id = ?", offset, now.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListUploadsIdleSince returns up to limit uploads no chunk has arrived for
+// since t, longest idle first
+func (d *database) ListUploadsIdleSince(t time.Time, limit int) ([]Upload, error) {
+	rows, err := d.db.Query("SELECT "+uploadColumns+" FROM uploads WHERE updated_at < ? ORDER BY updated_at, id LIMIT ?", t.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var uploads []Upload
+	for rows.Next() {
+		var upload Upload
+		if err := rows.Scan(uploadFields(&upload)...); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+const uploadColumns = "id, owner_id, length, offset, metadata, created_at, updated_at"
+
+func uploadFields(u *Upload) []interface{} {
+	return []interface{}{&u.ID, &u.OwnerID, &u.Length, &u.Offset, &u.Metadata, timeColumn{&u.CreatedAt}, timeColumn{&u.UpdatedAt}}
+}
+
+// DeleteUpload in database
+func (d *database) DeleteUpload(id string) error {
+	_, err := d.db.Exec("DELETE FROM uploads WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertSession in database
+func (d *database) InsertSession(s Session) error {
+	_, err := d.db.Exec("INSERT INTO active_sessions (id, user_id, token, expires_at, created_at, last_seen_at) VALUES (?, ?, ?, ?, ?, ?)",
+		s.ID, s.UserID, s.Token.Token, s.Token.ExpiresAt.UTC(), s.CreatedAt.UTC(), s.LastSeenAt.UTC())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetSessionByToken in database
+func (d *database) GetSessionByToken(token string) (Session, error) {
+	row := d.db.QueryRow("SELECT "+sessionColumns+" FROM active_sessions WHERE token = ?", token)
+	var session Session
+	err := row.Scan(sessionFields(&session)...)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// RenewSession in database, returning sql.ErrNoRows if there is no such session
+func (d *database) RenewSession(token string, expiresAt, lastSeenAt time.Time) error {
+	res, err := d.db.Exec("UPDATE active_sessions SET expires_at = ?, last_seen_at = ? WHERE token = ?", expiresAt.UTC(), lastSeenAt.UTC(), token)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListSessionsByUser in database, most recently used first
+func (d *database) ListSessionsByUser(userID string) ([]Session, error) {
+	rows, err := d.db.Query("SELECT "+sessionColumns+" FROM active_sessions WHERE user_id = ? ORDER BY last_seen_at DESC, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(sessionFields(&session)...); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSessionByToken in database
+func (d *database) DeleteSessionByToken(token string) error {
+	_, err := d.db.Exec("DELETE FROM active_sessions WHERE token = ?", token)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteSession in database, returning sql.ErrNoRows if the user has no
+// session with id
+func (d *database) DeleteSession(userID, id string) error {
+	res, err := d.db.Exec("DELETE FROM active_sessions WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteSessionsByUser in database
+func (d *database) DeleteSessionsByUser(userID string) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM active_sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions in database
+func (d *database) DeleteExpiredSessions(before time.Time) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM active_sessions WHERE expires_at <= ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const sessionColumns = "id, user_id, token, expires_at, created_at, last_seen_at"
+
+func sessionFields(s *Session) []interface{} {
+	return []interface{}{&s.ID, &s.UserID, &s.Token.Token, timeColumn{&s.Token.ExpiresAt}, timeColumn{&s.CreatedAt}, timeColumn{&s.LastSeenAt}}
+}
+
+// InsertAclEntry in database
+func (d *database) InsertAclEntry(e AclEntry) error {
+	_, err := d.db.Exec("INSERT INTO access_control_lists (id, user_id, group_id, file_id, directory_id, can_read, can_write, can_delete, can_create_directories) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.ID, e.UserID, e.GroupID, e.FileID, e.DirectoryID, e.Privileges.Read, e.Privileges.Write, e.Privileges.Delete, e.Privileges.CreateDirectories)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetAclEntry in database
+func (d *database) GetAclEntry(id string) (AclEntry, error) {
+	row := d.db.QueryRow("SELECT "+aclColumns+" FROM access_control_lists WHERE id = ?", id)
+	var entry AclEntry
+	err := row.Scan(aclFields(&entry)...)
+	if err != nil {
+		return AclEntry{}, err
+	}
+	return entry, nil
+}
+
+// GetAclEntriesForFile in database
+func (d *database) GetAclEntriesForFile(fileID string) ([]AclEntry, error) {
+	return d.queryAclEntries("SELECT "+aclColumns+" FROM access_control_lists WHERE file_id = ? ORDER BY user_id, group_id, id", fileID)
+}
+
+// GetAclEntriesForDirectory in database
+func (d *database) GetAclEntriesForDirectory(directoryID string) ([]AclEntry, error) {
+	return d.queryAclEntries("SELECT "+aclColumns+" FROM access_control_lists WHERE directory_id = ? ORDER BY user_id, group_id, id", directoryID)
+}
+
+func (d *database) queryAclEntries(query string, args ...interface{}) ([]AclEntry, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AclEntry
+	for rows.Next() {
+		var entry AclEntry
+		if err := rows.Scan(aclFields(&entry)...); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteAclEntry in database
+func (d *database) DeleteAclEntry(id string) error {
+	_, err := d.db.Exec("DELETE FROM access_control_lists WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+const aclColumns = "id, COALESCE(user_id, ''), group_id, COALESCE(file_id, ''), COALESCE(directory_id, ''), can_read, can_write, can_delete, can_create_directories"
+
+func aclFields(e *AclEntry) []interface{} {
+	return []interface{}{&e.ID, &e.UserID, &e.GroupID, &e.FileID, &e.DirectoryID, &e.Privileges.Read, &e.Privileges.Write, &e.Privileges.Delete, &e.Privileges.CreateDirectories}
+}
+
+// InsertTrashItem records item and moves what it names into the trash: the
+// file, or the directory with every live file and directory below it
+func (d *database) InsertTrashItem(item TrashItem) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO trash (id, owner_id, deleted_by, item_type, item_id, name, parent_id, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		item.ID, item.OwnerID, item.DeletedBy, item.ItemType, item.ItemID, item.Name, item.ParentID, item.DeletedAt.UTC())
+	if err != nil {
+		return err
+	}
+	switch item.ItemType {
+	case TrashFile:
+		return commitIfTrashed(tx, "UPDATE files SET trash_id = ? WHERE id = ? AND trash_id = ''", item.ID, item.ItemID)
+	case TrashDirectory:
+		const subtree = "WITH RECURSIVE subtree(id) AS (SELECT ? UNION SELECT directories.id FROM directories JOIN subtree ON directories.parent_directory_id = subtree.id WHERE directories.trash_id = '') "
+		_, err = tx.Exec(subtree+"UPDATE files SET trash_id = ? WHERE trash_id = '' AND directory_id IN subtree", item.ItemID, item.ID)
+		if err != nil {
+			return err
+		}
+		return commitIfTrashed(tx, subtree+"UPDATE directories SET trash_id = ? WHERE trash_id = '' AND id IN subtree", item.ItemID, item.ID)
+	default:
+		return fmt.Errorf("unknown trash item type %q", item.ItemType)
+	}
+}
+
+// commitIfTrashed runs the statement moving rows into the trash and commits,
+// or returns sql.ErrNoRows if there was nothing live to move
+func commitIfTrashed(tx *sql.Tx, query string, args ...interface{}) error {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// GetTrashItem in database
+func (d *database) GetTrashItem(id string) (TrashItem, error) {
+	row := d.db.QueryRow("SELECT "+trashColumns+" FROM trash WHERE id = ?", id)
+	var item TrashItem
+	err := row.Scan(trashFields(&item)...)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	return item, nil
+}
+
+// ListTrashItems returns the items owned or deleted by the user or owned by
+// one of their groups, most recently deleted first
+func (d *database) ListTrashItems(userID string) ([]TrashItem, error) {
+	return d.queryTrashItems("SELECT "+trashColumns+" FROM trash WHERE owner_id = ? OR deleted_by = ? OR owner_id IN (SELECT group_id FROM group_members WHERE user_id = ?) ORDER BY deleted_at DESC, id", userID, userID, userID)
+}
+
+// ListTrashItemsDeletedBefore returns up to limit items deleted before t,
+// oldest first
+func (d *database) ListTrashItemsDeletedBefore(t time.Time, limit int) ([]TrashItem, error) {
+	return d.queryTrashItems("SELECT "+trashColumns+" FROM trash WHERE deleted_at < ? ORDER BY deleted_at, id LIMIT ?", t.UTC(), limit)
+}
+
+func (d *database) queryTrashItems(query string, args ...interface{}) ([]TrashItem, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []TrashItem
+	for rows.Next() {
+		var item TrashItem
+		if err := rows.Scan(trashFields(&item)...); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// ListTrashedFileIDs returns the files deleted along with a trash item
+func (d *database) ListTrashedFileIDs(trashID string) ([]string, error) {
+	rows, err := d.db.Query("SELECT id FROM files WHERE trash_id = ?", trashID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// RestoreTrashItem brings back everything deleted with the item, putting the
+// item itself in parentID, and removes the trash entry. It fails with
+// ErrQuotaExceeded if that takes a directory above parentID over its limit.
+func (d *database) RestoreTrashItem(id, parentID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var item TrashItem
+	if err := tx.QueryRow("SELECT "+trashColumns+" FROM trash WHERE id = ?", id).Scan(trashFields(&item)...); err != nil {
+		return err
+	}
+	if item.ItemType == TrashFile {
+		_, err = tx.Exec("UPDATE files SET directory_id = ? WHERE id = ?", parentID, item.ItemID)
+	} else {
+		_, err = tx.Exec("UPDATE directories SET parent_directory_id = ? WHERE id = ?", parentID, item.ItemID)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE files SET trash_id = '' WHERE trash_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE directories SET trash_id = '' WHERE trash_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM trash WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := checkDirectoryQuotas(tx, parentID, 0); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteTrashItem removes the trash entry with the directories deleted along
+// with it and their ACL entries. Its files must already have been released.
+func (d *database) DeleteTrashItem(id string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM access_control_lists WHERE directory_id != '' AND directory_id IN (SELECT id FROM directories WHERE trash_id = ?)", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM directories WHERE trash_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM trash WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const trashColumns = "id, owner_id, deleted_by, item_type, item_id, name, parent_id, deleted_at"
+
+func trashFields(item *TrashItem) []interface{} {
+	return []interface{}{&item.ID, &item.OwnerID, &item.DeletedBy, &item.ItemType, &item.ItemID, &item.Name, &item.ParentID, timeColumn{&item.DeletedAt}}
+}
+
+// timeColumn scans the TEXT timestamp columns written by the sqlite driver
+// back into a time.Time, which database/sql can't do on its own
+type timeColumn struct {
+	t *time.Time
+}
+
+func (tc timeColumn) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*tc.t = time.Time{}
+		return nil
+	case time.Time:
+		*tc.t = v
+		return nil
+	case []byte:
+		return tc.parse(string(v))
+	case string:
+		return tc.parse(v)
+	default:
+		return fmt.Errorf("cannot scan %T into time.Time", value)
+	}
+}
+
+func (tc timeColumn) parse(s string) error {
+	if s == "" {
+		*tc.t = time.Time{}
+		return nil
+	}
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			*tc.t = t
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse %q as a timestamp", s)
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// userLimit is the limit that applies to the user of the quotas row in scope
+const userLimit = "COALESCE(limit_bytes, (SELECT limit_bytes FROM quotas WHERE subject_type = 'default'), 0)"
+
+// ownerQuota returns the quota subject type of ownerID, a group for files in
+// team spaces and otherwise a user, and the SQL for its limit
+func ownerQuota(q queryRower, ownerID string) (string, string, error) {
+	var isGroup bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM user_groups WHERE id = ?)", ownerID).Scan(&isGroup)
+	if err != nil {
+		return "", "", err
+	}
+	if isGroup {
+		// Groups don't fall back to the default meant for users
+		return QuotaGroup, "COALESCE(limit_bytes, 0)", nil
+	}
+	return QuotaUser, userLimit, nil
+}
+
+// chargeQuota adds size to the usage of the file's owner, failing with
+// ErrQuotaExceeded if that takes the owner or any directory above the file
+// over its limit
+func chargeQuota(tx *sql.Tx, fileID string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	var ownerID, directoryID string
+	err := tx.QueryRow("SELECT owner_id, directory_id FROM files WHERE id = ?", fileID).Scan(&ownerID, &directoryID)
+	if err != nil {
+		return err
+	}
+	subjectType, limitColumn, err := ownerQuota(tx, ownerID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO quotas (subject_type, subject_id, used_bytes) VALUES (?, ?, ?) ON CONFLICT(subject_type, subject_id) DO UPDATE SET used_bytes = used_bytes + excluded.used_bytes", subjectType, ownerID, size)
+	if err != nil {
+		return err
+	}
+	var used, limit int64
+	err = tx.QueryRow("SELECT used_bytes, "+limitColumn+" FROM quotas WHERE subject_type = ? AND subject_id = ?", subjectType, ownerID).Scan(&used, &limit)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && used > limit {
+		return ErrQuotaExceeded
+	}
+	return checkDirectoryQuotas(tx, directoryID, 0)
+}
+
+// releaseQuota takes size off the usage of the file's owner
+func releaseQuota(tx *sql.Tx, fileID string, size int64) error {
+	_, err := tx.Exec("UPDATE quotas SET used_bytes = MAX(used_bytes - ?, 0) WHERE subject_type IN (?, ?) AND subject_id = (SELECT owner_id FROM files WHERE id = ?)", size, QuotaUser, QuotaGroup, fileID)
+	return err
+}
+
+// checkDirectoryQuotas returns ErrQuotaExceeded if adding extra bytes would
+// take directoryID or any directory above it over its limit
+func checkDirectoryQuotas(q queryRower, directoryID string, extra int64) error {
+	if directoryID == "" {
+		return nil
+	}
+	rows, err := q.Query(`WITH RECURSIVE ancestors(id) AS (
+			SELECT ?
+			UNION SELECT directories.parent_directory_id FROM directories JOIN ancestors ON directories.id = ancestors.id WHERE directories.parent_directory_id != ''
+		)
+		SELECT subject_id, limit_bytes FROM quotas JOIN ancestors ON quotas.subject_id = ancestors.id WHERE subject_type = ? AND limit_bytes > 0`, directoryID, QuotaDirectory)
+	if err != nil {
+		return err
+	}
+	limits := map[string]int64{}
+	for rows.Next() {
+		var id string
+		var limit int64
+		if err := rows.Scan(&id, &limit); err != nil {
+			rows.Close()
+			return err
+		}
+		limits[id] = limit
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, limit := range limits {
+		used, err := directoryUsage(q, id)
+		if err != nil {
+			return err
+		}
+		if used+extra > limit {
+			return ErrQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// directoryUsage sums every version of the live files below a directory
+func directoryUsage(q queryRower, directoryID string) (int64, error) {
+	var used int64
+	err := q.QueryRow(`WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION SELECT directories.id FROM directories JOIN subtree ON directories.parent_directory_id = subtree.id WHERE directories.trash_id = ''
+		)
+		SELECT COALESCE(SUM(file_versions.size), 0) FROM file_versions JOIN files ON files.id = file_versions.file_id
+		WHERE files.trash_id = '' AND files.directory_id IN (SELECT id FROM subtree)`, directoryID).Scan(&used)
+	return used, err
+}
+
+// GetQuota returns the limit and usage of a user, a group, a directory or,
+// with an empty subjectID, the default. Subjects without a row have no usage
+// and users without a limit of their own inherit the default.
+func (d *database) GetQuota(subjectType, subjectID string) (Quota, error) {
+	q := Quota{SubjectType: subjectType, SubjectID: subjectID}
+	var limit sql.NullInt64
+	err := d.db.QueryRow("SELECT limit_bytes, used_bytes FROM quotas WHERE subject_type = ? AND subject_id = ?", subjectType, subjectID).Scan(&limit, &q.UsedBytes)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Quota{}, err
+	}
+	q.LimitBytes = limit.Int64
+	switch subjectType {
+	case QuotaUser:
+		if !limit.Valid {
+			def, err := d.GetQuota(QuotaDefault, "")
+			if err != nil {
+				return Quota{}, err
+			}
+			q.LimitBytes = def.LimitBytes
+			q.Inherited = true
+		}
+	case QuotaDirectory:
+		q.UsedBytes, err = directoryUsage(d.db, subjectID)
+		if err != nil {
+			return Quota{}, err
+		}
+	}
+	return q, nil
+}
+
+// SetQuotaLimit in database
+func (d *database) SetQuotaLimit(subjectType, subjectID string, limitBytes int64) error {
+	_, err := d.db.Exec("INSERT INTO quotas (subject_type, subject_id, limit_bytes) VALUES (?, ?, ?) ON CONFLICT(subject_type, subject_id) DO UPDATE SET limit_bytes = excluded.limit_bytes", subjectType, subjectID, limitBytes)
+	return err
+}
+
+// ClearQuotaLimit removes a limit while keeping the usage, so a user goes
+// back to the default
+func (d *database) ClearQuotaLimit(subjectType, subjectID string) error {
+	_, err := d.db.Exec("UPDATE quotas SET limit_bytes = NULL WHERE subject_type = ? AND subject_id = ?", subjectType, subjectID)
+	return err
+}
+
+// CheckQuota returns ErrQuotaExceeded if storing size more bytes for ownerID
+// in directoryID would go over a limit. It lets uploads fail before their
+// bytes are written; the limits are enforced again when the version is added.
+func (d *database) CheckQuota(ownerID, directoryID string, size int64) error {
+	subjectType, _, err := ownerQuota(d.db, ownerID)
+	if err != nil {
+		return err
+	}
+	q, err := d.GetQuota(subjectType, ownerID)
+	if err != nil {
+		return err
+	}
+	if q.LimitBytes > 0 && q.UsedBytes+size > q.LimitBytes {
+		return ErrQuotaExceeded
+	}
+	return checkDirectoryQuotas(d.db, directoryID, size)
+}
+
+// InsertShareLink in database
+func (d *database) InsertShareLink(l ShareLink) error {
+	_, err := d.db.Exec("INSERT INTO share_links ("+shareLinkColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		l.ID, l.Token, l.OwnerID, l.FileID, l.DirectoryID, l.PasswordHash, l.Mode, l.MaxDownloads, l.DownloadCount, l.ExpiresAt, l.CreatedAt)
+	return err
+}
+
+// GetShareLink in database
+func (d *database) GetShareLink(id string) (ShareLink, error) {
+	var l ShareLink
+	err := d.db.QueryRow("SELECT "+shareLinkColumns+" FROM share_links WHERE id = ?", id).Scan(shareLinkFields(&l)...)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	return l, nil
+}
+
+// GetShareLinkByToken in database
+func (d *database) GetShareLinkByToken(token string) (ShareLink, error) {
+	var l ShareLink
+	err := d.db.QueryRow("SELECT "+shareLinkColumns+" FROM share_links WHERE token = ?", token).Scan(shareLinkFields(&l)...)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	return l, nil
+}
+
+// ListShareLinks returns the links a user created, newest first
+func (d *database) ListShareLinks(ownerID string) ([]ShareLink, error) {
+	rows, err := d.db.Query("SELECT "+shareLinkColumns+" FROM share_links WHERE owner_id = ? ORDER BY created_at DESC, id", ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []ShareLink
+	for rows.Next() {
+		var l ShareLink
+		if err := rows.Scan(shareLinkFields(&l)...); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// CountShareLinkUse adds one to the link's download count, or returns
+// sql.ErrNoRows without counting if it has reached its limit
+func (d *database) CountShareLinkUse(id string) error {
+	res, err := d.db.Exec("UPDATE share_links SET download_count = download_count + 1 WHERE id = ? AND (max_downloads = 0 OR download_count < max_downloads)", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteShareLink in database
+func (d *database) DeleteShareLink(id string) error {
+	_, err := d.db.Exec("DELETE FROM share_links WHERE id = ?", id)
+	return err
+}
+
+const shareLinkColumns = "id, token, owner_id, file_id, directory_id, password_hash, mode, max_downloads, download_count, expires_at, created_at"
+
+func shareLinkFields(l *ShareLink) []interface{} {
+	return []interface{}{&l.ID, &l.Token, &l.OwnerID, &l.FileID, &l.DirectoryID, &l.PasswordHash, &l.Mode, &l.MaxDownloads, &l.DownloadCount, timeColumn{&l.ExpiresAt}, timeColumn{&l.CreatedAt}}
+}
+
+// InsertApiKey in database
+func (d *database) InsertApiKey(k ApiKey) error {
+	_, err := d.db.Exec("INSERT INTO api_keys (id, user_id, name, prefix, key_hash, can_read, can_write, can_delete, can_create_directories, can_add_users, directory_id, expires_at, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		k.ID, k.UserID, k.Name, k.Prefix, k.KeyHash, k.Scope.Read, k.Scope.Write, k.Scope.Delete, k.Scope.CreateDirectories, k.Scope.AddUsers, k.DirectoryID, k.ExpiresAt.UTC(), k.CreatedAt.UTC(), k.LastUsedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetApiKeyByPrefix in database
+func (d *database) GetApiKeyByPrefix(prefix string) (ApiKey, error) {
+	row := d.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = ?", prefix)
+	var k ApiKey
+	err := row.Scan(apiKeyFields(&k)...)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	return k, nil
+}
+
+// ListApiKeys in database, newest first
+func (d *database) ListApiKeys(userID string) ([]ApiKey, error) {
+	rows, err := d.db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ? ORDER BY created_at DESC, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []ApiKey
+	for rows.Next() {
+		var k ApiKey
+		if err := rows.Scan(apiKeyFields(&k)...); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// TouchApiKey in database
+func (d *database) TouchApiKey(id string, usedAt time.Time) error {
+	_, err := d.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", usedAt.UTC(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteApiKey in database, returning sql.ErrNoRows if the user has no key
+// with id
+func (d *database) DeleteApiKey(userID, id string) error {
+	res, err := d.db.Exec("DELETE FROM api_keys WHERE user_id = ? AND id = ?", userID, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const apiKeyColumns = "id, user_id, name, prefix, key_hash, can_read, can_write, can_delete, can_create_directories, can_add_users, directory_id, expires_at, created_at, last_used_at"
+
+func apiKeyFields(k *ApiKey) []interface{} {
+	return []interface{}{&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &k.Scope.Read, &k.Scope.Write, &k.Scope.Delete, &k.Scope.CreateDirectories, &k.Scope.AddUsers, &k.DirectoryID, timeColumn{&k.ExpiresAt}, timeColumn{&k.CreatedAt}, timeColumn{&k.LastUsedAt}}
+}
+
+// SaveTotpSecret in database, replacing an unconfirmed secret. Returns
+// sql.ErrNoRows if the user already has a confirmed one.
+func (d *database) SaveTotpSecret(s TotpSecret) error {
+	res, err := d.db.Exec("INSERT INTO user_totp (user_id, secret, confirmed, last_step, created_at) VALUES (?, ?, 0, 0, ?) ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_step = 0, created_at = excluded.created_at WHERE confirmed = 0",
+		s.UserID, s.Secret, s.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetTotpSecret in database
+func (d *database) GetTotpSecret(userID string) (TotpSecret, error) {
+	row := d.db.QueryRow("SELECT user_id, secret, confirmed, last_step, created_at FROM user_totp WHERE user_id = ?", userID)
+	var s TotpSecret
+	err := row.Scan(&s.UserID, &s.Secret, &s.Confirmed, &s.LastStep, timeColumn{&s.CreatedAt})
+	if err != nil {
+		return TotpSecret{}, err
+	}
+	return s, nil
+}
+
+// EnableTotp confirms the user's secret, recording step as used, and gives
+// them a fresh set of recovery codes. Returns sql.ErrNoRows if there is no
+// unconfirmed secret.
+func (d *database) EnableTotp(userID string, step int64, recoveryCodeHashes []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE user_totp SET confirmed = 1, last_step = ? WHERE user_id = ? AND confirmed = 0", step, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTotpStep records a code for step as used, returning sql.ErrNoRows if a
+// code for it or a later step already was
+func (d *database) UseTotpStep(userID string, step int64) error {
+	res, err := d.db.Exec("UPDATE user_totp SET last_step = ? WHERE user_id = ? AND confirmed = 1 AND last_step < ?", step, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTotp in database, along with the user's recovery codes
+func (d *database) DeleteTotp(userID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes in database
+func (d *database) ReplaceRecoveryCodes(userID string, codeHashes []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string, codeHashes []string) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode deletes the code, returning sql.ErrNoRows if the user has
+// no such code
+func (d *database) UseRecoveryCode(userID, codeHash string) error {
+	res, err := d.db.Exec("DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?", userID, codeHash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CountRecoveryCodes in database
+func (d *database) CountRecoveryCodes(userID string) (int, error) {
+	var n int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?", userID).Scan(&n)
+	return n, err
+}
+
+// GetTwoFactorRoles returns the roles that have to use two-factor
+// authentication
+func (d *database) GetTwoFactorRoles() ([]Role, error) {
+	rows, err := d.db.Query("SELECT role FROM two_factor_roles ORDER BY role")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// SetTwoFactorRoles in database
+func (d *database) SetTwoFactorRoles(roles []Role) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM two_factor_roles")
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		_, err = tx.Exec("INSERT OR IGNORE INTO two_factor_roles (role) VALUES (?)", role)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// InsertLoginChallenge in database
+func (d *database) InsertLoginChallenge(c LoginChallenge) error {
+	_, err := d.db.Exec("INSERT INTO login_challenges (token, user_id, attempts, expires_at) VALUES (?, ?, ?, ?)",
+		c.Token, c.UserID, c.Attempts, c.ExpiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetLoginChallenge in database
+func (d *database) GetLoginChallenge(token string) (LoginChallenge, error) {
+	row := d.db.QueryRow("SELECT token, user_id, attempts, expires_at FROM login_challenges WHERE token = ?", token)
+	var c LoginChallenge
+	err := row.Scan(&c.Token, &c.UserID, &c.Attempts, timeColumn{&c.ExpiresAt})
+	if err != nil {
+		return LoginChallenge{}, err
+	}
+	return c, nil
+}
+
+// UseLoginChallengeAttempt counts an attempt at answering the challenge,
+// returning sql.ErrNoRows if it has expired by now or already had maxAttempts
+func (d *database) UseLoginChallengeAttempt(token string, maxAttempts int, now time.Time) error {
+	res, err := d.db.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE token = ? AND attempts < ? AND expires_at > ?", token, maxAttempts, now.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteLoginChallenge in database, returning sql.ErrNoRows if it was
+// already gone
+func (d *database) DeleteLoginChallenge(token string) error {
+	res, err := d.db.Exec("DELETE FROM login_challenges WHERE token = ?", token)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteExpiredLoginChallenges in database
+func (d *database) DeleteExpiredLoginChallenges(before time.Time) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM login_challenges WHERE expires_at <= ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// InsertOidcLogin in database
+func (d *database) InsertOidcLogin(l OidcLogin) error {
+	_, err := d.db.Exec("INSERT INTO oidc_logins (state, nonce, code_verifier, expires_at) VALUES (?, ?, ?, ?)",
+		l.State, l.Nonce, l.CodeVerifier, l.ExpiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TakeOidcLogin deletes the login and returns it, so it can only be
+// completed once
+func (d *database) TakeOidcLogin(state string) (OidcLogin, error) {
+	row := d.db.QueryRow("DELETE FROM oidc_logins WHERE state = ? RETURNING state, nonce, code_verifier, expires_at", state)
+	var l OidcLogin
+	err := row.Scan(&l.State, &l.Nonce, &l.CodeVerifier, timeColumn{&l.ExpiresAt})
+	if err != nil {
+		return OidcLogin{}, err
+	}
+	return l, nil
+}
+
+// DeleteExpiredOidcLogins in database
+func (d *database) DeleteExpiredOidcLogins(before time.Time) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM oidc_logins WHERE expires_at <= ?", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetOidcUser returns the user an identity provider account is linked to
+func (d *database) GetOidcUser(issuer, subject string) (User, error) {
+	row := d.db.QueryRow("SELECT "+userColumns+" FROM users JOIN oidc_identities ON oidc_identities.user_id = users.id WHERE oidc_identities.issuer = ? AND oidc_identities.subject = ?", issuer, subject)
+	var user User
+	err := row.Scan(userFields(&user)...)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// InsertOidcUser creates a user linked to an identity provider account,
+// returning ErrUsernameTaken rather than linking to an existing user
+func (d *database) InsertOidcUser(u User, issuer, subject string) error {
+	return d.insertLinkedUser(u, "INSERT INTO oidc_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)", issuer, subject, u.ID, u.CreatedAt.UTC())
+}
+
+// GetLdapUser returns the user a directory entry is linked to
+func (d *database) GetLdapUser(subject string) (User, error) {
+	row := d.db.QueryRow("SELECT "+userColumns+" FROM users JOIN ldap_identities ON ldap_identities.user_id = users.id WHERE ldap_identities.subject = ?", subject)
+	var user User
+	err := row.Scan(userFields(&user)...)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// InsertLdapUser creates a user linked to a directory entry, returning
+// ErrUsernameTaken rather than linking to an existing user
+func (d *database) InsertLdapUser(u User, subject string) error {
+	return d.insertLinkedUser(u, "INSERT INTO ldap_identities (subject, user_id, created_at) VALUES (?, ?, ?)", subject, u.ID, u.CreatedAt.UTC())
+}
+
+// insertLinkedUser inserts u and runs link to tie it to its external
+// identity, in one transaction
+func (d *database) insertLinkedUser(u User, link string, args ...interface{}) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var taken int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", u.Username).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrUsernameTaken
+	}
+	_, err = tx.Exec("INSERT INTO users (id, username, password, email, role, created_at) VALUES (?, ?, ?, ?, ?, ?)", u.ID, u.Username, u.Password, u.Email, u.Role, u.CreatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(link, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TakeRateLimitToken takes a token from key's bucket. Buckets are kept as the
+// time they will be full again, each token taken pushing it interval later,
+// and a bucket is empty when that is more than window (interval times its
+// size) away. It returns the full time and whether a token was taken.
+func (d *database) TakeRateLimitToken(key string, now time.Time, interval, window time.Duration) (time.Time, bool, error) {
+	// Unix nanoseconds rather than text, so SQLite can do the arithmetic and
+	// take the token in one statement
+	var fullAt int64
+	err := d.db.QueryRow("INSERT INTO rate_limits (key, full_at) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET full_at = MAX(full_at, ?) + ? WHERE MAX(full_at, ?) + ? <= ? RETURNING full_at",
+		key, now.Add(interval).UnixNano(), now.UnixNano(), int64(interval), now.UnixNano(), int64(interval), now.Add(window).UnixNano()).Scan(&fullAt)
+	if err == nil {
+		return time.Unix(0, fullAt), true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, err
+	}
+	err = d.db.QueryRow("SELECT full_at FROM rate_limits WHERE key = ?", key).Scan(&fullAt)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, fullAt), false, nil
+}
+
+// DeleteFullRateLimits drops buckets that have refilled, which are the same
+// as no bucket at all
+func (d *database) DeleteFullRateLimits(now time.Time) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM rate_limits WHERE full_at <= ?", now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// AddLoginFailure counts a failed login for username and returns how many
+// there have been, starting over if the last was before forgetBefore
+func (d *database) AddLoginFailure(username string, now, forgetBefore time.Time) (int, error) {
+	var failures int
+	err := d.db.QueryRow("INSERT INTO login_failures (username, failures, last_failure_at) VALUES (?, 1, ?) ON CONFLICT (username) DO UPDATE SET failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END, last_failure_at = excluded.last_failure_at RETURNING failures",
+		username, now.UTC(), forgetBefore.UTC()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+	return failures, nil
+}
+
+// LockLogin locks username out until until, unless it already is for longer
+func (d *database) LockLogin(username string, until time.Time) error {
+	_, err := d.db.Exec("UPDATE login_failures SET locked_until = ? WHERE username = ? AND (locked_until IS NULL OR locked_until < ?)", until.UTC(), username, until.UTC())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetLockout in database
+func (d *database) GetLockout(username string) (Lockout, error) {
+	row := d.db.QueryRow("SELECT username, failures, last_failure_at, locked_until FROM login_failures WHERE username = ?", username)
+	var l Lockout
+	err := row.Scan(&l.Username, &l.Failures, timeColumn{&l.LastFailureAt}, timeColumn{&l.LockedUntil})
+	if err != nil {
+		return Lockout{}, err
+	}
+	return l, nil
+}
+
+// ListLockouts returns usernames locked out at now, longest lockout first
+func (d *database) ListLockouts(now time.Time) ([]Lockout, error) {
+	rows, err := d.db.Query("SELECT username, failures, last_failure_at, locked_until FROM login_failures WHERE locked_until > ? ORDER BY locked_until DESC, username", now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lockouts []Lockout
+	for rows.Next() {
+		var l Lockout
+		if err := rows.Scan(&l.Username, &l.Failures, timeColumn{&l.LastFailureAt}, timeColumn{&l.LockedUntil}); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// DeleteLockout forgets username's failed logins, returning sql.ErrNoRows if
+// there were none
+func (d *database) DeleteLockout(username string) error {
+	res, err := d.db.Exec("DELETE FROM login_failures WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteStaleLockouts forgets failures from before forgetBefore that aren't
+// keeping a username locked at now
+func (d *database) DeleteStaleLockouts(forgetBefore, now time.Time) (int64, error) {
+	res, err := d.db.Exec("DELETE FROM login_failures WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until <= ?)", forgetBefore.UTC(), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const roleColumns = "id, name, can_read, can_write, can_delete, can_create_directories, can_add_users, built_in"
+
+func roleFields(r *RoleDefinition) []interface{} {
+	return []interface{}{&r.ID, &r.Name, &r.Privileges.Read, &r.Privileges.Write, &r.Privileges.Delete, &r.Privileges.CreateDirectories, &r.Privileges.AddUsers, &r.BuiltIn}
+}
+
+// ListRoles in database, built-in roles first
+func (d *database) ListRoles() ([]RoleDefinition, error) {
+	rows, err := d.db.Query("SELECT " + roleColumns + " FROM roles ORDER BY built_in DESC, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []RoleDefinition
+	for rows.Next() {
+		var r RoleDefinition
+		if err := rows.Scan(roleFields(&r)...); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+// GetRole in database
+func (d *database) GetRole(id Role) (RoleDefinition, error) {
+	var r RoleDefinition
+	err := d.db.QueryRow("SELECT "+roleColumns+" FROM roles WHERE id = ?", id).Scan(roleFields(&r)...)
+	return r, err
+}
+
+// GetRoleByName in database, ignoring case
+func (d *database) GetRoleByName(name string) (RoleDefinition, error) {
+	var r RoleDefinition
+	err := d.db.QueryRow("SELECT "+roleColumns+" FROM roles WHERE name = ?", name).Scan(roleFields(&r)...)
+	return r, err
+}
+
+// InsertRole adds a custom role, returning the ID it was given
+func (d *database) InsertRole(r RoleDefinition) (Role, error) {
+	var id Role
+	err := d.db.QueryRow("INSERT INTO roles (name, can_read, can_write, can_delete, can_create_directories, can_add_users, built_in) VALUES (?, ?, ?, ?, ?, ?, 0) RETURNING id",
+		r.Name, r.Privileges.Read, r.Privileges.Write, r.Privileges.Delete, r.Privileges.CreateDirectories, r.Privileges.AddUsers).Scan(&id)
+	return id, err
+}
+
+// UpdateRole in database
+func (d *database) UpdateRole(r RoleDefinition) error {
+	res, err := d.db.Exec("UPDATE roles SET name = ?, can_read = ?, can_write = ?, can_delete = ?, can_create_directories = ?, can_add_users = ? WHERE id = ?",
+		r.Name, r.Privileges.Read, r.Privileges.Write, r.Privileges.Delete, r.Privileges.CreateDirectories, r.Privileges.AddUsers, r.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteRole deletes a custom role and stops requiring two-factor
+// authentication for it, returning sql.ErrNoRows if there is no such custom
+// role
+func (d *database) DeleteRole(id Role) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM roles WHERE id = ? AND built_in = 0", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM two_factor_roles WHERE role = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CountUsersWithRole in database, disabled users included
+func (d *database) CountUsersWithRole(role Role) (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", role).Scan(&count)
+	return count, err
+}
+
+const groupColumns = "user_groups.id, user_groups.name, user_groups.created_at"
+
+func groupFields(g *Group) []interface{} {
+	return []interface{}{&g.ID, &g.Name, timeColumn{&g.CreatedAt}}
+}
+
+// InsertGroup in database
+func (d *database) InsertGroup(g Group) error {
+	_, err := d.db.Exec("INSERT INTO user_groups (id, name, created_at) VALUES (?, ?, ?)", g.ID, g.Name, g.CreatedAt)
+	return err
+}
+
+// GetGroup in database
+func (d *database) GetGroup(id string) (Group, error) {
+	var g Group
+	err := d.db.QueryRow("SELECT "+groupColumns+" FROM user_groups WHERE id = ?", id).Scan(groupFields(&g)...)
+	return g, err
+}
+
+// GetGroupByName in database, ignoring case
+func (d *database) GetGroupByName(name string) (Group, error) {
+	var g Group
+	err := d.db.QueryRow("SELECT "+groupColumns+" FROM user_groups WHERE name = ?", name).Scan(groupFields(&g)...)
+	return g, err
+}
+
+// ListGroups in database, by name
+func (d *database) ListGroups() ([]Group, error) {
+	return d.queryGroups("SELECT " + groupColumns + " FROM user_groups ORDER BY name, id")
+}
+
+// ListGroupsForUser returns the groups userID is a member of, by name
+func (d *database) ListGroupsForUser(userID string) ([]Group, error) {
+	return d.queryGroups("SELECT "+groupColumns+" FROM user_groups JOIN group_members ON group_members.group_id = user_groups.id WHERE group_members.user_id = ? ORDER BY user_groups.name, user_groups.id", userID)
+}
+
+func (d *database) queryGroups(query string, args ...interface{}) ([]Group, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []Group
+	for rows.Next() {
+		var g Group
+		if err := rows.Scan(groupFields(&g)...); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// UpdateGroup in database
+func (d *database) UpdateGroup(g Group) error {
+	res, err := d.db.Exec("UPDATE user_groups SET name = ? WHERE id = ?", g.Name, g.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteGroup deletes a group with its memberships, access grants and quota,
+// returning sql.ErrNoRows if there is no such group. The caller makes sure
+// it owns nothing first.
+func (d *database) DeleteGroup(id string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM user_groups WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	for _, t := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM group_members WHERE group_id = ?", []interface{}{id}},
+		{"DELETE FROM access_control_lists WHERE group_id = ?", []interface{}{id}},
+		{"DELETE FROM quotas WHERE subject_type = ? AND subject_id = ?", []interface{}{QuotaGroup, id}},
+	} {
+		if _, err := tx.Exec(t.query, t.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddGroupMember in database; adding an existing member does nothing
+func (d *database) AddGroupMember(groupID, userID string, now time.Time) error {
+	_, err := d.db.Exec("INSERT OR IGNORE INTO group_members (group_id, user_id, added_at) VALUES (?, ?, ?)", groupID, userID, now)
+	return err
+}
+
+// RemoveGroupMember in database, returning sql.ErrNoRows if userID wasn't a
+// member
+func (d *database) RemoveGroupMember(groupID, userID string) error {
+	res, err := d.db.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListGroupMembers in database, by username
+func (d *database) ListGroupMembers(groupID string) ([]User, error) {
+	rows, err := d.db.Query("SELECT "+userColumns+" FROM users JOIN group_members ON group_members.user_id = users.id WHERE group_members.group_id = ? ORDER BY users.username, users.id", groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(userFields(&u)...); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetGroupOwner returns the group owning directoryID, which is in one of its
+// team spaces, or an empty string for directories owned by a user
+func (d *database) GetGroupOwner(directoryID string) (string, error) {
+	var groupID string
+	err := d.db.QueryRow("SELECT user_groups.id FROM directories JOIN user_groups ON user_groups.id = directories.owner_id WHERE directories.id = ?", directoryID).Scan(&groupID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return groupID, err
 }
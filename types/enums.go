@@ -1,5 +1,7 @@
 package types
 
+import "strings"
+
 // enum for roles of users
 type Role int
 
@@ -9,3 +11,16 @@ const (
 	Regular
 	Developer
 )
+
+var roleNames = map[string]Role{
+	"admin":     Admin,
+	"owner":     Owner,
+	"regular":   Regular,
+	"developer": Developer,
+}
+
+// ParseRole looks a role up by name, ignoring case
+func ParseRole(name string) (Role, bool) {
+	role, ok := roleNames[strings.ToLower(name)]
+	return role, ok
+}
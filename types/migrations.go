@@ -0,0 +1,582 @@
+package types
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Migration is one versioned change to the schema. Up and Down run inside the
+// transaction that also records the version in schema_migrations.
+type Migration struct {
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+	Name    string
+	Version int
+}
+
+type MigrationStatus struct {
+	AppliedAt time.Time
+	Name      string
+	Version   int
+	Applied   bool
+}
+
+// migrations must stay ordered by Version and are never edited once released;
+// schema changes go in a new migration at the end
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: execAll(
+			"CREATE TABLE IF NOT EXISTS users (id TEXT PRIMARY KEY, username TEXT, password TEXT, email TEXT, role TEXT, created_at TEXT)",
+			"CREATE TABLE IF NOT EXISTS files (id TEXT PRIMARY KEY, name TEXT, size TEXT, content_type TEXT, location TEXT, upload_date TEXT, owner_id TEXT)",
+			"CREATE TABLE IF NOT EXISTS directories (id TEXT PRIMARY KEY, name TEXT, owner_id TEXT, parent_directory_id TEXT)",
+			"CREATE TABLE IF NOT EXISTS access_control_lists (id TEXT PRIMARY KEY, user_id TEXT, file_id TEXT, directory_id TEXT)",
+			"CREATE TABLE IF NOT EXISTS active_sessions (id TEXT PRIMARY KEY, user_id INTEGER, token TEXT, expires_at TEXT)",
+		),
+		Down: execAll(
+			"DROP TABLE active_sessions",
+			"DROP TABLE access_control_lists",
+			"DROP TABLE directories",
+			"DROP TABLE files",
+			"DROP TABLE users",
+		),
+	},
+	{
+		Version: 2,
+		Name:    "content addressed blobs",
+		Up: func(tx *sql.Tx) error {
+			// Databases created before migrations existed may already have the column
+			if err := addColumnIfMissing(tx, "files", "hash", "TEXT"); err != nil {
+				return err
+			}
+			return execAll(
+				"CREATE TABLE IF NOT EXISTS blobs (hash TEXT PRIMARY KEY, size INTEGER, ref_count INTEGER NOT NULL DEFAULT 0, created_at TEXT)",
+			)(tx)
+		},
+		Down: execAll(
+			"DROP TABLE blobs",
+			"ALTER TABLE files DROP COLUMN hash",
+		),
+	},
+	{
+		Version: 3,
+		Name:    "resumable uploads",
+		Up: execAll(
+			"CREATE TABLE IF NOT EXISTS uploads (id TEXT PRIMARY KEY, owner_id TEXT, length INTEGER, offset INTEGER, metadata TEXT, created_at TEXT)",
+		),
+		Down: execAll(
+			"DROP TABLE uploads",
+		),
+	},
+	{
+		Version: 4,
+		Name:    "fix files.size and active_sessions.user_id column types",
+		Up: execAll(
+			"CREATE TABLE files_new (id TEXT PRIMARY KEY, name TEXT, size INTEGER, content_type TEXT, location TEXT, upload_date TEXT, owner_id TEXT, hash TEXT)",
+			"INSERT INTO files_new SELECT id, name, CAST(size AS INTEGER), content_type, location, upload_date, owner_id, hash FROM files",
+			"DROP TABLE files",
+			"ALTER TABLE files_new RENAME TO files",
+			"CREATE INDEX files_hash ON files (hash)",
+			"CREATE TABLE active_sessions_new (id TEXT PRIMARY KEY, user_id TEXT, token TEXT, expires_at TEXT)",
+			"INSERT INTO active_sessions_new SELECT id, CAST(user_id AS TEXT), token, expires_at FROM active_sessions",
+			"DROP TABLE active_sessions",
+			"ALTER TABLE active_sessions_new RENAME TO active_sessions",
+			"CREATE UNIQUE INDEX active_sessions_token ON active_sessions (token)",
+		),
+		Down: execAll(
+			"CREATE TABLE files_old (id TEXT PRIMARY KEY, name TEXT, size TEXT, content_type TEXT, location TEXT, upload_date TEXT, owner_id TEXT, hash TEXT)",
+			"INSERT INTO files_old SELECT id, name, size, content_type, location, upload_date, owner_id, hash FROM files",
+			"DROP TABLE files",
+			"ALTER TABLE files_old RENAME TO files",
+			"CREATE TABLE active_sessions_old (id TEXT PRIMARY KEY, user_id INTEGER, token TEXT, expires_at TEXT)",
+			"INSERT INTO active_sessions_old SELECT id, user_id, token, expires_at FROM active_sessions",
+			"DROP TABLE active_sessions",
+			"ALTER TABLE active_sessions_old RENAME TO active_sessions",
+		),
+	},
+	{
+		Version: 5,
+		Name:    "directory tree",
+		Up: execAll(
+			"ALTER TABLE files ADD COLUMN directory_id TEXT NOT NULL DEFAULT ''",
+			"UPDATE directories SET parent_directory_id = '' WHERE parent_directory_id IS NULL",
+			"CREATE INDEX files_directory ON files (owner_id, directory_id)",
+			"CREATE INDEX directories_parent ON directories (owner_id, parent_directory_id)",
+		),
+		Down: execAll(
+			"DROP INDEX directories_parent",
+			"DROP INDEX files_directory",
+			"ALTER TABLE files DROP COLUMN directory_id",
+		),
+	},
+	{
+		Version: 6,
+		Name:    "acl privileges",
+		Up: execAll(
+			// Rows written before privileges existed only ever meant read access
+			"ALTER TABLE access_control_lists ADD COLUMN can_read INTEGER NOT NULL DEFAULT 1",
+			"ALTER TABLE access_control_lists ADD COLUMN can_write INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE access_control_lists ADD COLUMN can_delete INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE access_control_lists ADD COLUMN can_create_directories INTEGER NOT NULL DEFAULT 0",
+			"UPDATE access_control_lists SET file_id = COALESCE(file_id, ''), directory_id = COALESCE(directory_id, '')",
+			"CREATE INDEX acl_file ON access_control_lists (file_id, user_id)",
+			"CREATE INDEX acl_directory ON access_control_lists (directory_id, user_id)",
+		),
+		Down: execAll(
+			"DROP INDEX acl_directory",
+			"DROP INDEX acl_file",
+			"ALTER TABLE access_control_lists DROP COLUMN can_create_directories",
+			"ALTER TABLE access_control_lists DROP COLUMN can_delete",
+			"ALTER TABLE access_control_lists DROP COLUMN can_write",
+			"ALTER TABLE access_control_lists DROP COLUMN can_read",
+		),
+	},
+	{
+		Version: 7,
+		Name:    "blob encryption keys",
+		Up: execAll(
+			"ALTER TABLE files ADD COLUMN wrapped_key TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE files ADD COLUMN key_id TEXT NOT NULL DEFAULT ''",
+			"CREATE INDEX files_key_id ON files (key_id)",
+		),
+		Down: execAll(
+			"DROP INDEX files_key_id",
+			"ALTER TABLE files DROP COLUMN key_id",
+			"ALTER TABLE files DROP COLUMN wrapped_key",
+		),
+	},
+	{
+		Version: 8,
+		Name:    "file versions",
+		Up: execAll(
+			"CREATE TABLE file_versions (file_id TEXT NOT NULL, version INTEGER NOT NULL, size INTEGER, content_type TEXT, location TEXT, hash TEXT, wrapped_key TEXT NOT NULL DEFAULT '', key_id TEXT NOT NULL DEFAULT '', uploader_id TEXT, created_at TEXT, PRIMARY KEY (file_id, version))",
+			// Every existing file becomes its first version, which takes over
+			// the file's blob reference
+			"INSERT INTO file_versions (file_id, version, size, content_type, location, hash, wrapped_key, key_id, uploader_id, created_at) SELECT id, 1, size, content_type, location, hash, wrapped_key, key_id, owner_id, upload_date FROM files",
+			"CREATE INDEX file_versions_hash ON file_versions (hash)",
+			"CREATE INDEX file_versions_key_id ON file_versions (key_id)",
+			"ALTER TABLE files ADD COLUMN version INTEGER NOT NULL DEFAULT 1",
+			"CREATE INDEX files_path ON files (directory_id, name)",
+			"ALTER TABLE directories ADD COLUMN max_versions INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE directories ADD COLUMN version_retention_days INTEGER NOT NULL DEFAULT 0",
+		),
+		Down: execAll(
+			"ALTER TABLE directories DROP COLUMN version_retention_days",
+			"ALTER TABLE directories DROP COLUMN max_versions",
+			"DROP INDEX files_path",
+			"ALTER TABLE files DROP COLUMN version",
+			"DROP TABLE file_versions",
+			// Only current versions survive, so they hold the references again.
+			// Blobs left at zero are no longer tracked by any row.
+			"UPDATE blobs SET ref_count = (SELECT COUNT(*) FROM files WHERE files.hash = blobs.hash)",
+		),
+	},
+	{
+		Version: 9,
+		Name:    "trash",
+		Up: execAll(
+			"CREATE TABLE trash (id TEXT PRIMARY KEY, owner_id TEXT NOT NULL, deleted_by TEXT NOT NULL, item_type TEXT NOT NULL, item_id TEXT NOT NULL, name TEXT NOT NULL, parent_id TEXT NOT NULL, deleted_at TEXT NOT NULL)",
+			"CREATE INDEX trash_owner ON trash (owner_id)",
+			"CREATE INDEX trash_deleted_by ON trash (deleted_by)",
+			"CREATE INDEX trash_deleted_at ON trash (deleted_at)",
+			// Every row deleted along with a trash entry carries its ID
+			"ALTER TABLE files ADD COLUMN trash_id TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE directories ADD COLUMN trash_id TEXT NOT NULL DEFAULT ''",
+			"CREATE INDEX files_trash ON files (trash_id)",
+			"CREATE INDEX directories_trash ON directories (trash_id)",
+		),
+		Down: execAll(
+			"DROP INDEX directories_trash",
+			"DROP INDEX files_trash",
+			// Anything still in the trash is restored in place
+			"ALTER TABLE directories DROP COLUMN trash_id",
+			"ALTER TABLE files DROP COLUMN trash_id",
+			"DROP TABLE trash",
+		),
+	},
+	{
+		Version: 10,
+		Name:    "quotas",
+		Up: execAll(
+			// A NULL user limit falls back to the default row; used_bytes is
+			// only kept for users, directories are summed when checked
+			"CREATE TABLE quotas (subject_type TEXT NOT NULL, subject_id TEXT NOT NULL, limit_bytes INTEGER, used_bytes INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (subject_type, subject_id))",
+			"INSERT INTO quotas (subject_type, subject_id, used_bytes) SELECT 'user', files.owner_id, SUM(file_versions.size) FROM file_versions JOIN files ON files.id = file_versions.file_id GROUP BY files.owner_id",
+			"CREATE INDEX files_owner ON files (owner_id)",
+		),
+		Down: execAll(
+			"DROP INDEX files_owner",
+			"DROP TABLE quotas",
+		),
+	},
+	{
+		Version: 11,
+		Name:    "share links",
+		Up: execAll(
+			"CREATE TABLE share_links (id TEXT PRIMARY KEY, token TEXT NOT NULL UNIQUE, owner_id TEXT NOT NULL, file_id TEXT NOT NULL DEFAULT '', directory_id TEXT NOT NULL DEFAULT '', password_hash TEXT NOT NULL DEFAULT '', mode TEXT NOT NULL, max_downloads INTEGER NOT NULL DEFAULT 0, download_count INTEGER NOT NULL DEFAULT 0, expires_at TEXT, created_at TEXT)",
+			"CREATE INDEX share_links_owner ON share_links (owner_id)",
+		),
+		Down: execAll(
+			"DROP TABLE share_links",
+		),
+	},
+	{
+		Version: 12,
+		Name:    "session activity",
+		Up: execAll(
+			"ALTER TABLE active_sessions ADD COLUMN created_at TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE active_sessions ADD COLUMN last_seen_at TEXT NOT NULL DEFAULT ''",
+			// Expiry is compared in SQL from now on, so it has to be in UTC.
+			// Anything unparseable sorts first and is purged as expired.
+			"UPDATE active_sessions SET expires_at = strftime('%Y-%m-%d %H:%M:%f+00:00', expires_at) WHERE strftime('%Y-%m-%d %H:%M:%f+00:00', expires_at) IS NOT NULL",
+			"CREATE INDEX active_sessions_user ON active_sessions (user_id)",
+			"CREATE INDEX active_sessions_expires ON active_sessions (expires_at)",
+		),
+		Down: execAll(
+			"DROP INDEX active_sessions_expires",
+			"DROP INDEX active_sessions_user",
+			"ALTER TABLE active_sessions DROP COLUMN last_seen_at",
+			"ALTER TABLE active_sessions DROP COLUMN created_at",
+		),
+	},
+	{
+		Version: 13,
+		Name:    "api keys",
+		Up: execAll(
+			"CREATE TABLE api_keys (id TEXT PRIMARY KEY, user_id TEXT NOT NULL, name TEXT NOT NULL, prefix TEXT NOT NULL UNIQUE, key_hash TEXT NOT NULL, can_read INTEGER NOT NULL DEFAULT 0, can_write INTEGER NOT NULL DEFAULT 0, can_delete INTEGER NOT NULL DEFAULT 0, can_create_directories INTEGER NOT NULL DEFAULT 0, can_add_users INTEGER NOT NULL DEFAULT 0, directory_id TEXT NOT NULL DEFAULT '', expires_at TEXT, created_at TEXT, last_used_at TEXT)",
+			"CREATE INDEX api_keys_user ON api_keys (user_id)",
+		),
+		Down: execAll(
+			"DROP TABLE api_keys",
+		),
+	},
+	{
+		Version: 14,
+		Name:    "two factor",
+		Up: execAll(
+			"CREATE TABLE user_totp (user_id TEXT PRIMARY KEY, secret TEXT NOT NULL, confirmed INTEGER NOT NULL DEFAULT 0, last_step INTEGER NOT NULL DEFAULT 0, created_at TEXT)",
+			// Only hashes are kept; a code is deleted when it is used
+			"CREATE TABLE recovery_codes (user_id TEXT NOT NULL, code_hash TEXT NOT NULL, PRIMARY KEY (user_id, code_hash))",
+			"CREATE TABLE two_factor_roles (role INTEGER PRIMARY KEY)",
+			"CREATE TABLE login_challenges (token TEXT PRIMARY KEY, user_id TEXT NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, expires_at TEXT NOT NULL)",
+		),
+		Down: execAll(
+			"DROP TABLE login_challenges",
+			"DROP TABLE two_factor_roles",
+			"DROP TABLE recovery_codes",
+			"DROP TABLE user_totp",
+		),
+	},
+	{
+		Version: 15,
+		Name:    "oidc",
+		Up: execAll(
+			"CREATE TABLE oidc_logins (state TEXT PRIMARY KEY, nonce TEXT NOT NULL, code_verifier TEXT NOT NULL, expires_at TEXT NOT NULL)",
+			// Links an account at an identity provider to the user it logs in as
+			"CREATE TABLE oidc_identities (issuer TEXT NOT NULL, subject TEXT NOT NULL, user_id TEXT NOT NULL, created_at TEXT, PRIMARY KEY (issuer, subject))",
+			"CREATE INDEX oidc_identities_user ON oidc_identities (user_id)",
+		),
+		Down: execAll(
+			"DROP TABLE oidc_identities",
+			"DROP TABLE oidc_logins",
+		),
+	},
+	{
+		Version: 16,
+		Name:    "ldap",
+		Up: execAll(
+			// Links a directory entry, by its unique ID attribute or DN, to the
+			// user it logs in as
+			"CREATE TABLE ldap_identities (subject TEXT PRIMARY KEY, user_id TEXT NOT NULL, created_at TEXT)",
+			"CREATE INDEX ldap_identities_user ON ldap_identities (user_id)",
+		),
+		Down: execAll(
+			"DROP TABLE ldap_identities",
+		),
+	},
+	{
+		Version: 17,
+		Name:    "rate limits",
+		Up: execAll(
+			// full_at is in Unix nanoseconds, see TakeRateLimitToken
+			"CREATE TABLE rate_limits (key TEXT PRIMARY KEY, full_at INTEGER NOT NULL)",
+			"CREATE TABLE login_failures (username TEXT PRIMARY KEY, failures INTEGER NOT NULL, last_failure_at TEXT NOT NULL, locked_until TEXT)",
+		),
+		Down: execAll(
+			"DROP TABLE login_failures",
+			"DROP TABLE rate_limits",
+		),
+	},
+	{
+		Version: 18,
+		Name:    "disabled users",
+		Up: execAll(
+			"ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0",
+			"CREATE INDEX users_username ON users (username)",
+		),
+		Down: execAll(
+			"DROP INDEX users_username",
+			"ALTER TABLE users DROP COLUMN disabled",
+		),
+	},
+	{
+		Version: 19,
+		Name:    "roles",
+		Up: execAll(
+			// IDs are users.role; the built-in roles keep the values of the
+			// Role constants. The seed is spelled out so this migration does
+			// the same thing however the code's roles change later.
+			"CREATE TABLE roles (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE COLLATE NOCASE, can_read INTEGER NOT NULL, can_write INTEGER NOT NULL, can_delete INTEGER NOT NULL, can_create_directories INTEGER NOT NULL, can_add_users INTEGER NOT NULL, built_in INTEGER NOT NULL DEFAULT 0)",
+			"INSERT INTO roles (id, name, can_read, can_write, can_delete, can_create_directories, can_add_users, built_in) VALUES (0, 'admin', 1, 1, 1, 1, 1, 1)",
+			"INSERT INTO roles (id, name, can_read, can_write, can_delete, can_create_directories, can_add_users, built_in) VALUES (1, 'owner', 1, 1, 1, 1, 0, 1)",
+			"INSERT INTO roles (id, name, can_read, can_write, can_delete, can_create_directories, can_add_users, built_in) VALUES (2, 'regular', 1, 0, 0, 0, 0, 1)",
+			"INSERT INTO roles (id, name, can_read, can_write, can_delete, can_create_directories, can_add_users, built_in) VALUES (3, 'developer', 1, 1, 0, 1, 0, 1)",
+		),
+		Down: execAll(
+			"DROP TABLE roles",
+		),
+	},
+	{
+		Version: 20,
+		Name:    "groups",
+		Up: execAll(
+			// Team spaces are directories whose owner_id is a group's ID
+			"CREATE TABLE user_groups (id TEXT PRIMARY KEY, name TEXT NOT NULL UNIQUE COLLATE NOCASE, created_at TEXT)",
+			"CREATE TABLE group_members (group_id TEXT NOT NULL, user_id TEXT NOT NULL, added_at TEXT, PRIMARY KEY (group_id, user_id))",
+			"CREATE INDEX group_members_user ON group_members (user_id)",
+			"ALTER TABLE access_control_lists ADD COLUMN group_id TEXT NOT NULL DEFAULT ''",
+		),
+		Down: execAll(
+			"ALTER TABLE access_control_lists DROP COLUMN group_id",
+			"DROP TABLE group_members",
+			"DROP TABLE user_groups",
+		),
+	},
+	{
+		Version: 21,
+		Name:    "upload expiry",
+		Up: execAll(
+			"ALTER TABLE uploads ADD COLUMN updated_at TEXT NOT NULL DEFAULT ''",
+			"UPDATE uploads SET updated_at = created_at",
+			"CREATE INDEX uploads_updated_at ON uploads (updated_at)",
+		),
+		Down: execAll(
+			"DROP INDEX uploads_updated_at",
+			"ALTER TABLE uploads DROP COLUMN updated_at",
+		),
+	},
+	{
+		Version: 22,
+		Name:    "hash session tokens",
+		Up: func(tx *sql.Tx) error {
+			// Sessions are looked up by the hex SHA-256 of their token from
+			// now on, so the live ones keep working
+			rows, err := tx.Query("SELECT id, token FROM active_sessions")
+			if err != nil {
+				return err
+			}
+			hashes := map[string]string{}
+			for rows.Next() {
+				var id, token string
+				if err := rows.Scan(&id, &token); err != nil {
+					rows.Close()
+					return err
+				}
+				sum := sha256.Sum256([]byte(token))
+				hashes[id] = hex.EncodeToString(sum[:])
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for id, hash := range hashes {
+				if _, err := tx.Exec("UPDATE active_sessions SET token = ? WHERE id = ?", hash, id); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		// The tokens can't be recovered, so going back logs everyone out
+		Down: execAll(
+			"DELETE FROM active_sessions",
+		),
+	},
+	{
+		Version: 23,
+		Name:    "hash plaintext passwords",
+		Up: func(tx *sql.Tx) error {
+			// Rows written before passwords were hashed hold the plaintext
+			rows, err := tx.Query("SELECT id, password FROM users WHERE password != ''")
+			if err != nil {
+				return err
+			}
+			plaintext := map[string]string{}
+			for rows.Next() {
+				var id, password string
+				if err := rows.Scan(&id, &password); err != nil {
+					rows.Close()
+					return err
+				}
+				if !IsPasswordHash(password) {
+					plaintext[id] = password
+				}
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for id, password := range plaintext {
+				hash, err := HashPassword(password)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.Exec("UPDATE users SET password = ? WHERE id = ?", hash, id); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		// Hashes can't be turned back into passwords, and still verify
+		Down: execAll(),
+	},
+}
+
+// Migrate applies every pending migration in a single transaction, so a
+// failure leaves the schema exactly as it was
+func (d *database) Migrate() error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := m.Up(tx); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Rollback reverts the most recently applied steps migrations
+func (d *database) Rollback(steps int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if err := m.Down(tx); err != nil {
+			return fmt.Errorf("rolling back migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+		if err != nil {
+			return err
+		}
+		steps--
+	}
+	return tx.Commit()
+}
+
+// MigrationStatus lists every known migration and whether it has been applied
+func (d *database) MigrationStatus() ([]MigrationStatus, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	applied, err := appliedMigrations(tx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, tx.Commit()
+}
+
+func appliedMigrations(tx *sql.Tx) (map[int]time.Time, error) {
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TEXT)")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, timeColumn{&appliedAt}); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumnIfMissing adds a column unless the table already has it
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
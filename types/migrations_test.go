@@ -0,0 +1,256 @@
+package types
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T) *database {
+	t.Helper()
+	d := NewDatabaseWithPath(filepath.Join(t.TempDir(), "Smd.db")).(*database)
+	if err := d.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Disconnect() })
+	return d
+}
+
+func TestMigrate(t *testing.T) {
+	d := newTestDatabase(t)
+
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// Running again is a no-op
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := d.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != len(migrations) {
+		t.Fatalf("MigrationStatus() returned %d migrations, want %d", len(statuses), len(migrations))
+	}
+	for _, s := range statuses {
+		if !s.Applied || s.AppliedAt.IsZero() {
+			t.Errorf("migration %d not applied: %+v", s.Version, s)
+		}
+	}
+
+	if err := d.InsertFile(File{ID: "f1", Name: "a.txt", Size: 42, UploadDate: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	var sizeType string
+	if err := d.db.QueryRow("SELECT typeof(size) FROM files WHERE id = 'f1'").Scan(&sizeType); err != nil {
+		t.Fatal(err)
+	}
+	if sizeType != "integer" {
+		t.Errorf("files.size stored as %s, want integer", sizeType)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	d := newTestDatabase(t)
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Rollback(2); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := d.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		wantApplied := s.Version <= len(migrations)-2
+		if s.Applied != wantApplied {
+			t.Errorf("migration %d applied = %v, want %v", s.Version, s.Applied, wantApplied)
+		}
+	}
+
+	if err := d.Rollback(len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_migrations'").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("%d tables left after rolling everything back", tables)
+	}
+
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	d := newTestDatabase(t)
+	// Schema and data as written by CreateDb before migrations existed
+	legacy := []string{
+		"CREATE TABLE users (id TEXT PRIMARY KEY, username TEXT, password TEXT, email TEXT, role TEXT, created_at TEXT)",
+		"CREATE TABLE files (id TEXT PRIMARY KEY, name TEXT, size TEXT, content_type TEXT, location TEXT, upload_date TEXT, owner_id TEXT)",
+		"CREATE TABLE directories (id TEXT PRIMARY KEY, name TEXT, owner_id TEXT, parent_directory_id TEXT)",
+		"CREATE TABLE access_control_lists (id TEXT PRIMARY KEY, user_id TEXT, file_id TEXT, directory_id TEXT)",
+		"CREATE TABLE active_sessions (id TEXT PRIMARY KEY, user_id INTEGER, token TEXT, expires_at TEXT)",
+		"INSERT INTO files (id, name, size, content_type, location, upload_date, owner_id) VALUES ('f1', 'old.txt', '1234', 'text/plain', '/tmp/old.txt', '', '1')",
+		"INSERT INTO active_sessions (id, user_id, token, expires_at) VALUES ('s1', 7, 'tok', '')",
+		"INSERT INTO users (id, username, password, email, role, created_at) VALUES ('test', 'test', 'test', 'test', 'test', 'test')",
+	}
+	for _, statement := range legacy {
+		if _, err := d.db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := d.GetFileByID("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "old.txt" || f.Size != 1234 || f.Hash != "" {
+		t.Errorf("GetFileByID() after migration = %+v", f)
+	}
+	// Tokens are only stored hashed from migration 22 on
+	if _, err := d.GetSessionByToken("tok"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetSessionByToken() of the plaintext token error = %v, want sql.ErrNoRows", err)
+	}
+	var password string
+	if err := d.db.QueryRow("SELECT password FROM users WHERE id = 'test'").Scan(&password); err != nil {
+		t.Fatal(err)
+	}
+	if match, _, err := VerifyPassword("test", password); !IsPasswordHash(password) || !match || err != nil {
+		t.Errorf("legacy password after migration = %q, %v, %v, want a hash of it", password, match, err)
+	}
+	session, err := d.GetSessionByToken(tokenHash("tok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.UserID != "7" {
+		t.Errorf("session user_id = %q, want \"7\"", session.UserID)
+	}
+}
+
+func TestFileVersionsMigration(t *testing.T) {
+	d := newTestDatabase(t)
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rollback(len(migrations) - 7); err != nil {
+		t.Fatal(err)
+	}
+	// Two rows with one name, as uploads created before versioning did
+	for _, id := range []string{"f1", "f2"} {
+		if _, err := d.db.Exec("INSERT INTO files (id, name, size, owner_id, hash, upload_date, directory_id) VALUES (?, 'a.txt', 3, 'u1', 'h', ?, '')", id, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.db.Exec("INSERT INTO blobs (hash, size, ref_count) VALUES ('h', 3, 2)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"f1", "f2"} {
+		versions, err := d.ListFileVersions(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 1 || versions[0].Version != 1 || versions[0].Hash != "h" || versions[0].UploaderID != "u1" {
+			t.Errorf("versions of %s = %+v, want the existing contents as version 1", id, versions)
+		}
+	}
+	unreferenced, err := d.ReleaseFile("f1")
+	if err != nil || len(unreferenced) != 0 {
+		t.Errorf("ReleaseFile(f1) = %v, %v, want the blob still referenced", unreferenced, err)
+	}
+	unreferenced, err = d.ReleaseFile("f2")
+	if err != nil || len(unreferenced) != 1 || unreferenced[0] != "h" {
+		t.Errorf("ReleaseFile(f2) = %v, %v, want [h]", unreferenced, err)
+	}
+}
+
+func TestQuotasMigration(t *testing.T) {
+	d := newTestDatabase(t)
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rollback(len(migrations) - 9); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []File{
+		{ID: "f1", Name: "a.txt", Size: 3, OwnerID: "u1", UploadDate: time.Now()},
+		{ID: "f2", Name: "b.txt", Size: 4, OwnerID: "u1", UploadDate: time.Now()},
+	} {
+		if _, err := d.db.Exec("INSERT INTO files (id, name, size, owner_id, upload_date, directory_id) VALUES (?, ?, ?, ?, ?, '')", f.ID, f.Name, f.Size, f.OwnerID, f.UploadDate); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.db.Exec("INSERT INTO file_versions (file_id, version, size, uploader_id, created_at) VALUES (?, 1, ?, ?, ?)", f.ID, f.Size, f.OwnerID, f.UploadDate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := d.GetQuota(QuotaUser, "u1")
+	if err != nil || q.UsedBytes != 7 {
+		t.Errorf("GetQuota(u1) = %+v, %v, want 7 bytes used by existing files", q, err)
+	}
+	if _, err := d.ReleaseFile("f1"); err != nil {
+		t.Fatal(err)
+	}
+	if q, err := d.GetQuota(QuotaUser, "u1"); err != nil || q.UsedBytes != 4 {
+		t.Errorf("GetQuota(u1) after ReleaseFile = %+v, %v, want 4", q, err)
+	}
+}
+
+func TestSessionActivityMigration(t *testing.T) {
+	d := newTestDatabase(t)
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rollback(len(migrations) - 11); err != nil {
+		t.Fatal(err)
+	}
+	// Written in the server's local zone before expiry was kept in UTC
+	for _, statement := range []string{
+		"INSERT INTO active_sessions (id, user_id, token, expires_at) VALUES ('s1', 'u1', 'later', '2999-01-01 05:00:00.5+05:00')",
+		"INSERT INTO active_sessions (id, user_id, token, expires_at) VALUES ('s2', 'u1', 'earlier', '2000-01-01 05:00:00+05:00')",
+	} {
+		if _, err := d.db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := d.GetSessionByToken(tokenHash("later"))
+	want := time.Date(2999, 1, 1, 0, 0, 0, 500000000, time.UTC)
+	if err != nil || !s.Token.ExpiresAt.Equal(want) {
+		t.Errorf("GetSessionByToken() = %+v, %v, want expiry %v", s, err, want)
+	}
+	if n, err := d.DeleteExpiredSessions(time.Now()); err != nil || n != 1 {
+		t.Errorf("DeleteExpiredSessions() = %d, %v, want 1", n, err)
+	}
+	if sessions, err := d.ListSessionsByUser("u1"); err != nil || len(sessions) != 1 || sessions[0].ID != "s1" {
+		t.Errorf("ListSessionsByUser() = %+v, %v, want s1 only", sessions, err)
+	}
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,75 @@
+package types
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Errorf("HashPassword() = %q, want argon2id PHC string", hash)
+	}
+	other, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == other {
+		t.Errorf("HashPassword() returned the same hash twice, salt is not random")
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	current, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultPasswordParams
+	DefaultPasswordParams.Memory = 8 * 1024
+	DefaultPasswordParams.Iterations = 1
+	weak, err := HashPassword("hunter2")
+	DefaultPasswordParams = defaults
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		password        string
+		encoded         string
+		wantMatch       bool
+		wantNeedsRehash bool
+		wantErr         bool
+	}{
+		{name: "Argon2id", password: "hunter2", encoded: current, wantMatch: true},
+		{name: "Argon2idWrongPassword", password: "hunter3", encoded: current},
+		{name: "WeakArgon2id", password: "hunter2", encoded: weak, wantMatch: true, wantNeedsRehash: true},
+		{name: "Bcrypt", password: "hunter2", encoded: string(bcryptHash), wantMatch: true, wantNeedsRehash: true},
+		{name: "BcryptWrongPassword", password: "hunter3", encoded: string(bcryptHash)},
+		{name: "LegacyPlaintext", password: "hunter2", encoded: "hunter2", wantMatch: true, wantNeedsRehash: true},
+		{name: "LegacyPlaintextWrongPassword", password: "hunter3", encoded: "hunter2"},
+		{name: "EmptyHash", password: "", encoded: ""},
+		{name: "MalformedArgon2id", password: "hunter2", encoded: "$argon2id$v=19$garbage", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, needsRehash, err := VerifyPassword(tt.password, tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyPassword() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if match != tt.wantMatch || needsRehash != tt.wantNeedsRehash {
+				t.Errorf("VerifyPassword() = (%v, %v), want (%v, %v)", match, needsRehash, tt.wantMatch, tt.wantNeedsRehash)
+			}
+		})
+	}
+}
@@ -17,6 +17,10 @@ type Directory struct {
 	ParentDirectoryID string
 	FileIDs           []string
 	SubdirectoryIDs   []string
+	// Retention for the versions of files directly in the directory. Zero
+	// means no limit; the current version is always kept.
+	MaxVersions          int
+	VersionRetentionDays int
 }
 
 type File struct {
@@ -26,27 +30,262 @@ type File struct {
 	ContentType string
 	Location    string
 	OwnerID     string
+	UploaderID  string // Who stored the contents when that isn't the owner, as in team spaces
+	Hash        string // SHA-256 of the contents, keys the blob in the store
+	DirectoryID string // Empty for files at the owner's root
+	WrappedKey  string // Blob data key sealed by the master key; empty for plaintext blobs
+	KeyID       string // Master key that sealed WrappedKey
 	Size        int64
+	Version     int // Number of the current version, whose contents the fields above describe
+}
+
+// FileVersion is one stored revision of a file. Versions are numbered from 1
+// per file and each holds a reference on its blob.
+type FileVersion struct {
+	CreatedAt   time.Time
+	FileID      string
+	ContentType string
+	Location    string
+	Hash        string
+	WrappedKey  string
+	KeyID       string
+	UploaderID  string
+	Size        int64
+	Version     int
+}
+
+// Trash item types
+const (
+	TrashFile      = "file"
+	TrashDirectory = "directory"
+)
+
+// TrashItem is a file, or a directory with everything below it, that was
+// deleted and can be restored until it is purged
+type TrashItem struct {
+	DeletedAt time.Time
+	ID        string
+	OwnerID   string
+	DeletedBy string
+	ItemType  string // TrashFile or TrashDirectory
+	ItemID    string
+	Name      string
+	ParentID  string // Directory the item was deleted from; empty for the owner's root
+}
+
+// Quota subject types
+const (
+	QuotaUser      = "user"
+	QuotaDirectory = "directory"
+	QuotaDefault   = "default" // Applies to users without a limit of their own
+	QuotaGroup     = "group"   // Everything in the group's team spaces
+)
+
+// Quota is a storage limit in bytes, where zero means unlimited. Every
+// version of every file counts, including files in the trash for users.
+type Quota struct {
+	SubjectType string
+	SubjectID   string
+	LimitBytes  int64
+	UsedBytes   int64
+	Inherited   bool // LimitBytes comes from the default quota
+}
+
+// Share link modes
+const (
+	ShareRead   = "read"
+	ShareUpload = "upload" // Directories only; visitors can add files but not see any
+)
+
+// ShareLink gives anyone holding its token access to one file or directory
+// without an account. For upload links MaxDownloads caps the uploads instead.
+type ShareLink struct {
+	CreatedAt     time.Time
+	ExpiresAt     time.Time // Zero for links that don't expire
+	ID            string
+	Token         string
+	OwnerID       string
+	FileID        string
+	DirectoryID   string
+	PasswordHash  string `json:"-"` // Empty for links without a password
+	Mode          string // ShareRead or ShareUpload
+	MaxDownloads  int    // Zero for no limit
+	DownloadCount int
+}
+
+// ApiKeyPrefix starts every API key, telling them apart from session tokens
+const ApiKeyPrefix = "smd_"
+
+// ApiKey lets scripts authenticate as UserID with a bearer token instead of a
+// session. Only a hash of the key is kept; Prefix is the part that is shown.
+type ApiKey struct {
+	CreatedAt   time.Time
+	ExpiresAt   time.Time // Zero for keys that don't expire
+	LastUsedAt  time.Time
+	ID          string
+	UserID      string
+	Name        string
+	Prefix      string
+	KeyHash     string `json:"-"`
+	DirectoryID string // Empty for keys not confined to a directory
+	Scope       Privileges
+}
+
+// TotpSecret is a user's RFC 6238 authenticator secret. It only protects
+// their logins once Confirmed by a code generated from it.
+type TotpSecret struct {
+	CreatedAt time.Time
+	UserID    string
+	Secret    string // Base32, the way authenticator apps take it
+	Confirmed bool
+	LastStep  int64 // Time step of the last code accepted, which can't be used again
+}
+
+// TotpEnrollment is what an authenticator app needs to start generating codes
+type TotpEnrollment struct {
+	Secret string
+	URI    string // otpauth:// URI, usually shown as a QR code
+}
+
+// TwoFactorStatus describes a user's two-factor authentication
+type TwoFactorStatus struct {
+	Enabled           bool
+	Required          bool // The user's role has to use two-factor authentication
+	RecoveryCodesLeft int
+}
+
+// LoginChallenge stands in for a session after a correct password when the
+// user has, or must set up, two-factor authentication. Answering it with a
+// code finishes the login.
+type LoginChallenge struct {
+	ExpiresAt          time.Time
+	Token              string
+	UserID             string `json:"-"`
+	Attempts           int    `json:"-"`
+	EnrollmentRequired bool   // Set at login, not stored: the user has to enroll to answer
+}
+
+// OidcLogin is a login sent to the identity provider, kept until it comes
+// back so the response can be matched to it
+type OidcLogin struct {
+	ExpiresAt    time.Time
+	State        string
+	Nonce        string
+	CodeVerifier string // PKCE verifier the authorization code is bound to
+}
+
+// RateLimit lets Requests through per Period, evenly refilled, in bursts of
+// up to all of them. A zero RateLimit lets everything through.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Lockout counts a username's recent failed logins, and how long they're
+// locked out for after too many
+type Lockout struct {
+	Username      string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time // Zero when not locked
+}
+
+// SignedRequest is what a presigned URL lets its holder do as UserID until
+// ExpiresAt: GET the file FileID, or POST a file called Name into DirectoryID
+type SignedRequest struct {
+	ExpiresAt     time.Time
+	Method        string
+	UserID        string
+	FileID        string
+	DirectoryID   string // Empty for the user's root
+	Name          string
+	Hash          string // SHA-256 an upload must have, empty for any
+	ContentLength int64  // Size an upload must have, zero for any
+}
+
+// DirectoryListing is one page of a directory's children, subdirectories first
+type DirectoryListing struct {
+	Directories []Directory
+	Files       []File
+	Total       int
+	Limit       int
+	Offset      int
+}
+
+// UserListing is one page of users
+type UserListing struct {
+	Users  []User
+	Total  int
+	Limit  int
+	Offset int
+}
+
+// Group is a set of users that can be granted access together and can own
+// team spaces: root directories whose contents belong to the group rather
+// than to whoever uploaded them
+type Group struct {
+	CreatedAt time.Time
+	ID        string
+	Name      string
+}
+
+// RoleDefinition is a role as stored in the roles table. Built-in roles can't
+// be renamed or deleted.
+type RoleDefinition struct {
+	Name       string
+	Privileges Privileges
+	ID         Role
+	BuiltIn    bool
+}
+
+// Upload is a resumable upload that is still receiving chunks
+type Upload struct {
+	CreatedAt time.Time
+	UpdatedAt time.Time // When the last chunk arrived, for expiring abandoned uploads
+	ID        string
+	OwnerID   string
+	Metadata  string // Raw tus Upload-Metadata header
+	Length    int64
+	Offset    int64
 }
 
 type User struct {
 	CreatedAt time.Time
 	ID        string
 	Username  string
-	Password  string
+	Password  string `json:"-"`
 	Email     string
 	Role      Role
+	Disabled  bool // Disabled users can't log in or use their API keys
+	// Scope narrows the role's privileges for requests authenticated with
+	// an API key; nil for sessions. Not stored with the user.
+	Scope            *Privileges `json:"-"`
+	ScopeDirectoryID string      `json:"-"` // Confines such requests to a directory and everything below it
+	ApiKeyID         string      `json:"-"` // The key such requests were made with
 }
 
 type AccessControlList []User
 
-type Session struct {
-	Token  AuthToken
-	ID     string
-	UserID string
+// AclEntry grants a user, or every member of a group, privileges on one file,
+// or on a directory and everything below it. Exactly one of UserID and
+// GroupID and one of FileID and DirectoryID is set, and Privileges.AddUsers
+// is not used.
+type AclEntry struct {
+	ID          string
+	UserID      string
+	GroupID     string
+	FileID      string
+	DirectoryID string
+	Privileges  Privileges
 }
 
-type ActiveSessions []Session
+type Session struct {
+	CreatedAt  time.Time
+	LastSeenAt time.Time // When the session last authenticated a request
+	Token      AuthToken
+	ID         string
+	UserID     string
+}
 
 type AuthToken struct {
 	ExpiresAt time.Time
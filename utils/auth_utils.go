@@ -1,10 +1,149 @@
 package utils
 
-import "net/http"
+import (
+	"Smd/types"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
 
-type AuthUtil struct{}
+// SessionCookieName is the cookie the login handler stores the auth token in
+const SessionCookieName = "smd_session"
 
-func (a *AuthUtil) getUserIDFromRequest(r *http.Request) (string, error) {
-	// Implementation depends on )your authentication mechanism
-	return "1", nil
+// Authenticator resolves an auth token into the user it was issued to
+type Authenticator interface {
+	Authenticate(token string) (types.User, error)
+}
+
+// SignatureVerifier resolves a presigned request into what it allows and the
+// user who signed it
+type SignatureVerifier interface {
+	Verify(r *http.Request) (types.SignedRequest, types.User, error)
+}
+
+// SignatureParam is the query parameter carrying a presigned URL's signature
+const SignatureParam = "signature"
+
+type AuthUtil struct {
+	Authenticator Authenticator
+	// ApiKeys resolves bearer tokens that start with types.ApiKeyPrefix
+	ApiKeys    Authenticator
+	Signatures SignatureVerifier
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	signedRequestContextKey
+)
+
+// RequireAuth rejects requests without a valid bearer token or session cookie
+// and puts the authenticated user on the request context for next
+func (a *AuthUtil) RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.getUserFromRequest(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeApiError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		next(w, r.WithContext(WithUser(r.Context(), user)))
+	}
+}
+
+// RequireAuthOrSignature is RequireAuth that also accepts presigned URLs,
+// running next as the user who signed them with the SignedRequest on the
+// context so next can hold the request to it
+func (a *AuthUtil) RequireAuthOrSignature(next http.HandlerFunc) http.HandlerFunc {
+	requireAuth := a.RequireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Signatures == nil || !r.URL.Query().Has(SignatureParam) {
+			requireAuth(w, r)
+			return
+		}
+		signed, user, err := a.Signatures.Verify(r)
+		if err != nil {
+			writeApiError(w, http.StatusForbidden, "invalid_signature", "Invalid or expired signature")
+			return
+		}
+		ctx := WithSignedRequest(WithUser(r.Context(), user), signed)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// writeApiError sends an ApiError whose Code mirrors the HTTP status
+func writeApiError(w http.ResponseWriter, status int, key, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(types.ApiError{
+		Key:     key,
+		Message: message,
+		Code:    status,
+	})
+}
+
+func (a *AuthUtil) getUserFromRequest(r *http.Request) (types.User, error) {
+	token, err := TokenFromRequest(r)
+	if err != nil {
+		return types.User{}, err
+	}
+	// API keys are only taken from the header, never from a cookie
+	if a.ApiKeys != nil && strings.HasPrefix(token, types.ApiKeyPrefix) && r.Header.Get("Authorization") != "" {
+		return a.ApiKeys.Authenticate(token)
+	}
+	return a.Authenticator.Authenticate(token)
+}
+
+// TokenFromRequest returns the auth token from the Authorization header,
+// falling back to the session cookie
+func TokenFromRequest(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", errors.New("malformed authorization header")
+		}
+		return strings.TrimSpace(token), nil
+	}
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", errors.New("no auth token in request")
+	}
+	return cookie.Value, nil
+}
+
+// WithUser returns a copy of ctx carrying the authenticated user
+func WithUser(ctx context.Context, user types.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the user put on the context by RequireAuth
+func UserFromContext(ctx context.Context) (types.User, bool) {
+	user, ok := ctx.Value(userContextKey).(types.User)
+	return user, ok
+}
+
+// SignedRequestFromContext returns the presigned request RequireAuthOrSignature
+// let through, if the request was not authenticated with a session
+func SignedRequestFromContext(ctx context.Context) (types.SignedRequest, bool) {
+	signed, ok := ctx.Value(signedRequestContextKey).(types.SignedRequest)
+	return signed, ok
+}
+
+// WithSignedRequest returns a copy of ctx carrying a verified presigned request
+func WithSignedRequest(ctx context.Context, signed types.SignedRequest) context.Context {
+	return context.WithValue(ctx, signedRequestContextKey, signed)
+}
+
+// GenerateToken returns n random bytes hex encoded
+func GenerateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"Smd/types"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limiter takes a token from key's bucket, returning how long until one is
+// available instead when it's empty
+type Limiter interface {
+	Allow(key string, limit types.RateLimit) (time.Duration, error)
+}
+
+type RateLimitUtil struct {
+	Limiter Limiter
+	// TrustForwardedFor takes the client's address from the last
+	// X-Forwarded-For entry, for servers behind a proxy that appends it.
+	// Anyone can set the header otherwise, so it's ignored.
+	TrustForwardedFor bool
+}
+
+// Limit runs next while the caller has tokens left in their bucket for name,
+// and answers 429 once they run out. Callers are told apart by API key, then
+// user, then IP address, so inside RequireAuth requests count against the
+// user and outside it against the address they came from.
+func (rl *RateLimitUtil) Limit(name string, limit types.RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	return rl.LimitMethod("", name, limit, next)
+}
+
+// LimitMethod is Limit for requests with method only, letting others through
+// uncounted. An empty method counts every request.
+func (rl *RateLimitUtil) LimitMethod(method, name string, limit types.RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if method != "" && r.Method != method {
+			next(w, r)
+			return
+		}
+		wait, err := rl.Limiter.Allow(name+":"+rl.callerKey(r), limit)
+		if err != nil {
+			// A broken store shouldn't take the server down with it
+			fmt.Printf("error checking rate limit: %v\n", err)
+		} else if wait > 0 {
+			WriteTooManyRequests(w, wait, "rate_limited", "Too many requests, try again later")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (rl *RateLimitUtil) callerKey(r *http.Request) string {
+	if user, ok := UserFromContext(r.Context()); ok {
+		if user.ApiKeyID != "" {
+			return "key:" + user.ApiKeyID
+		}
+		return "user:" + user.ID
+	}
+	return "ip:" + rl.ClientIP(r)
+}
+
+// ClientIP returns the address r came from
+func (rl *RateLimitUtil) ClientIP(r *http.Request) string {
+	if rl.TrustForwardedFor {
+		if header := r.Header.Values("X-Forwarded-For"); len(header) > 0 {
+			entries := strings.Split(header[len(header)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// WriteTooManyRequests answers 429 with an ApiError, telling the client how
+// long to wait in whole seconds
+func WriteTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, key, message string) {
+	seconds := max(int(math.Ceil(retryAfter.Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(types.ApiError{
+		Key:     key,
+		Message: message,
+		Code:    http.StatusTooManyRequests,
+	})
+}